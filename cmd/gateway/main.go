@@ -4,7 +4,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -12,10 +14,13 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/airblackbox/gateway/pkg/auth"
 	"github.com/airblackbox/gateway/pkg/guardrails"
 	"github.com/airblackbox/gateway/pkg/proxy"
 	"github.com/airblackbox/gateway/pkg/recorder"
+	"github.com/airblackbox/gateway/pkg/tlsconf"
 	"github.com/airblackbox/gateway/pkg/trust"
+	"github.com/airblackbox/gateway/pkg/upstream"
 	"github.com/airblackbox/gateway/pkg/vault"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
@@ -27,6 +32,13 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		os.Exit(validateConfig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hash-key" {
+		os.Exit(hashKey(os.Args[2:]))
+	}
+
 	addr := flag.String("addr", envOr("LISTEN_ADDR", ":8080"), "listen address")
 	providerURL := flag.String("provider", envOr("PROVIDER_URL", "https://api.openai.com"), "upstream LLM provider")
 	runsDir := flag.String("runs", envOr("RUNS_DIR", "./runs"), "AIR record output directory")
@@ -72,34 +84,160 @@ func main() {
 	}
 
 	// --- Gateway authentication ---
+	// GATEWAY_KEYS_FILE holds per-caller keys with identities; GATEWAY_KEY
+	// is a single shared key with every scope. Either may be used alone.
 	gatewayKey := envOr("GATEWAY_KEY", "")
-	if gatewayKey != "" {
+	keys, err := auth.LoadRegistry(envOr("GATEWAY_KEYS_FILE", ""))
+	if err != nil {
+		log.Fatalf("gateway keys: %v", err)
+	}
+	switch {
+	case keys != nil:
+		log.Printf("Gateway authentication: enabled (%d keys, shared key: %v)", keys.Len(), gatewayKey != "")
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-hup:
+					if err := keys.Reload(); err != nil {
+						log.Printf("[auth] keys reload failed, keeping current keys: %v", err)
+					} else {
+						log.Printf("[auth] keys reloaded (%d keys)", keys.Len())
+					}
+				}
+			}
+		}()
+	case gatewayKey != "":
 		log.Println("Gateway authentication: enabled (X-Gateway-Key header required)")
+	default:
+		log.Println("Gateway authentication: disabled (set GATEWAY_KEY, GATEWAY_KEYS_FILE, JWT_JWKS or TLS_CLIENT_CA_FILE to require auth)")
+	}
+
+	// --- JWT bearer authentication (opt-in) ---
+	// Service JWTs are verified against a JWKS file or URL, re-read every
+	// JWT_JWKS_REFRESH.
+	jwtRefresh, err := time.ParseDuration(envOr("JWT_JWKS_REFRESH", "15m"))
+	if err != nil {
+		log.Fatalf("JWT_JWKS_REFRESH: %v", err)
+	}
+	jwtVerifier, err := auth.NewJWTVerifier(ctx, auth.JWTConfig{
+		JWKS:         envOr("JWT_JWKS", ""),
+		Issuer:       envOr("JWT_ISSUER", ""),
+		Audience:     envOr("JWT_AUDIENCE", ""),
+		TenantClaim:  envOr("JWT_TENANT_CLAIM", ""),
+		SessionClaim: envOr("JWT_SESSION_CLAIM", ""),
+		ScopesClaim:  envOr("JWT_SCOPES_CLAIM", "scope"),
+		Refresh:      jwtRefresh,
+	})
+	if err != nil {
+		log.Fatalf("JWT authentication: %v", err)
+	}
+	if jwtVerifier != nil {
+		log.Printf("JWT authentication: enabled (issuer %s, audience %s)", envOr("JWT_ISSUER", ""), envOr("JWT_AUDIENCE", ""))
+		go jwtVerifier.Run(ctx)
+	}
+
+	// --- TLS (opt-in) ---
+	// The listener terminates TLS when a certificate is set; the files are
+	// re-read when they change. With a client CA, callers authenticate with
+	// certificates (mTLS) and the certificate names the caller.
+	serverTLS, err := tlsconf.ServerConfig(tlsconf.ServerOptions{
+		CertFile:     envOr("TLS_CERT_FILE", ""),
+		KeyFile:      envOr("TLS_KEY_FILE", ""),
+		ClientCAFile: envOr("TLS_CLIENT_CA_FILE", ""),
+		ClientAuth:   envOr("TLS_CLIENT_AUTH", tlsconf.ClientAuthRequire),
+	})
+	if err != nil {
+		log.Fatalf("TLS: %v", err)
+	}
+	switch {
+	case serverTLS != nil && serverTLS.ClientCAs != nil:
+		log.Printf("TLS: enabled, client certificates %s", envOr("TLS_CLIENT_AUTH", tlsconf.ClientAuthRequire))
+	case serverTLS != nil:
+		log.Println("TLS: enabled")
+	}
+
+	// TLS to the single upstream, or to every provider without its own tls
+	// block: a private CA bundle and an optional client certificate.
+	upstreamTLS, err := tlsconf.ClientConfig(tlsconf.ClientOptions{
+		CAFile:   envOr("UPSTREAM_TLS_CA_FILE", ""),
+		CertFile: envOr("UPSTREAM_TLS_CERT_FILE", ""),
+		KeyFile:  envOr("UPSTREAM_TLS_KEY_FILE", ""),
+	})
+	if err != nil {
+		log.Fatalf("upstream TLS: %v", err)
+	}
+	var upstreamTransport http.RoundTripper
+	if upstreamTLS != nil {
+		upstreamTransport = tlsconf.Transport(upstreamTLS)
+	}
+
+	// --- Multi-provider routing (opt-in) ---
+	var providers *upstream.Config
+	providersPath := envOr("PROVIDERS_CONFIG", "")
+	if providersPath != "" {
+		providers, err = upstream.LoadConfig(providersPath)
+		if err != nil {
+			log.Fatalf("providers config: %v", err)
+		}
+		for _, p := range providers.Providers {
+			log.Printf("Provider: %s → %s (auth: %s, models: %v)", p.Name, p.BaseURL, p.Auth.Scheme, p.Models)
+		}
 	} else {
-		log.Println("Gateway authentication: disabled (set GATEWAY_KEY to require auth)")
+		log.Printf("Providers: single upstream %s (set PROVIDERS_CONFIG for multi-provider routing)", *providerURL)
+	}
+
+	// --- Virtual keys (opt-in) ---
+	// Issued via /v1/admin/virtual-keys and kept, hashed, in this file.
+	// Agents present them instead of provider keys; the gateway sends the
+	// providers' own server-side keys upstream.
+	var virtualKeys *auth.VirtualKeys
+	if path := envOr("VIRTUAL_KEYS_FILE", ""); path != "" {
+		virtualKeys, err = auth.OpenVirtualKeys(path)
+		if err != nil {
+			log.Fatalf("virtual keys: %v", err)
+		}
+		// Spend is written every few seconds; the rest on shutdown.
+		defer func() {
+			if err := virtualKeys.Close(); err != nil {
+				log.Printf("virtual keys: %v", err)
+			}
+		}()
+		log.Printf("Virtual keys: %d issued (%s)", len(virtualKeys.List()), path)
+		if providers == nil {
+			log.Println("WARN: virtual keys need PROVIDERS_CONFIG providers with server-side credentials; requests will fail until one is configured")
+		}
 	}
 
 	// --- Guardrails setup (opt-in) ---
+	// The config is reloaded on SIGHUP, when the file changes and via
+	// POST /v1/admin/reload; sessions survive reloads.
 	var grCfg *guardrails.Config
+	var grHolder *guardrails.Holder
 	var grMgr *guardrails.Manager
 	guardrailsPath := envOr("GUARDRAILS_CONFIG", "")
 	if guardrailsPath != "" {
-		grCfg, err = guardrails.LoadConfig(guardrailsPath)
+		grHolder, err = guardrails.NewHolder(guardrailsPath, applyGuardrailsEnv)
 		if err != nil {
 			log.Fatalf("guardrails config: %v", err)
 		}
-		grMgr = guardrails.NewManager(5 * time.Minute)
-		log.Printf("Guardrails: enabled (%s)", guardrailsPath)
+		grCfg = grHolder.Config()
+		const sessionTTL = 5 * time.Minute
+		store, err := guardrails.OpenSessionStore(envOr("SESSION_STORE", ""), sessionTTL)
+		if err != nil {
+			log.Fatalf("session store: %v", err)
+		}
+		defer store.Close()
+		grMgr = guardrails.NewManagerWithStore(sessionTTL, store)
+		log.Printf("Guardrail sessions: %T", store)
+		log.Printf("Guardrails: enabled (%s, sha256=%s)", guardrailsPath, grHolder.Hash())
 	} else {
 		log.Println("Guardrails: disabled (set GUARDRAILS_CONFIG to enable)")
 	}
 
-	// Override webhook URL from env if set.
-	webhookURL := envOr("WEBHOOK_URL", "")
-	if webhookURL != "" && grCfg != nil {
-		grCfg.Alerts.WebhookURL = webhookURL
-	}
-
 	// --- Optimization analytics (opt-in, enabled when guardrails are loaded) ---
 	var analytics *guardrails.PerformanceTracker
 	if grCfg != nil && grCfg.Optimization.Analytics.Enabled {
@@ -112,28 +250,64 @@ func main() {
 	// --- Trust layer setup (opt-in) ---
 	var auditChain *trust.AuditChain
 	if grCfg != nil && grCfg.Trust.Enabled {
-		signingKey := envOr("TRUST_SIGNING_KEY", grCfg.Trust.SigningKey)
-		if signingKey == "" {
+		if grCfg.Trust.SigningKey == insecureSigningKey {
 			log.Println("WARN: Trust layer enabled but no signing key set (set TRUST_SIGNING_KEY)")
-			signingKey = "insecure-default-key"
 		}
-		grCfg.Trust.SigningKey = signingKey // store resolved key for export endpoint
-		auditChain = trust.NewAuditChain(signingKey)
+		auditChain = trust.NewAuditChain(grCfg.Trust.SigningKey)
 		log.Printf("Trust layer: enabled (frameworks: %v)", grCfg.Trust.Compliance.Frameworks)
 	} else {
 		log.Println("Trust layer: disabled (enable in guardrails.yaml trust section)")
 	}
 
+	// --- Guardrails reloads ---
+	// Each reload is appended to the audit chain; the entry's record_hash is
+	// the SHA-256 of the new config file.
+	if grHolder != nil {
+		grHolder.OnReload = func(ev guardrails.ReloadEvent) {
+			if auditChain != nil {
+				auditChain.Append(fmt.Sprintf("config-reload:%s:%s", ev.Source, ev.SHA256[:12]), ev.Data)
+			}
+		}
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-hup:
+					grHolder.Reload("sighup")
+				}
+			}
+		}()
+
+		interval, err := time.ParseDuration(envOr("GUARDRAILS_WATCH_INTERVAL", "5s"))
+		if err != nil {
+			log.Fatalf("GUARDRAILS_WATCH_INTERVAL: %v", err)
+		}
+		if interval > 0 {
+			go grHolder.Watch(ctx, interval)
+		}
+	}
+
 	// --- Proxy handler ---
 	handler := proxy.Handler(proxy.Config{
 		ProviderURL: *providerURL,
 		Vault:       vc,
 		Recorder:    rec,
 		GatewayKey:  gatewayKey,
+		Keys:        keys,
+		VirtualKeys: virtualKeys,
+		JWT:         jwtVerifier,
 		Guardrails:  grCfg,
+		Live:        grHolder,
 		Sessions:    grMgr,
 		Analytics:   analytics,
 		AuditChain:  auditChain,
+		Providers:   providers,
+
+		UpstreamTransport: upstreamTransport,
 	})
 
 	srv := &http.Server{
@@ -142,11 +316,16 @@ func main() {
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 180 * time.Second, // Allow time for slow LLM streaming responses.
 		IdleTimeout:  60 * time.Second,
+		TLSConfig:    serverTLS,
 	}
 
 	go func() {
 		log.Printf("AIR Blackbox Gateway listening on %s → %s", *addr, *providerURL)
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		serve := srv.ListenAndServe
+		if serverTLS != nil {
+			serve = func() error { return srv.ListenAndServeTLS("", "") }
+		}
+		if err := serve(); err != http.ErrServerClosed {
 			log.Fatalf("server: %v", err)
 		}
 	}()
@@ -159,6 +338,24 @@ func main() {
 	srv.Shutdown(shutCtx)
 }
 
+// insecureSigningKey signs the audit chain when no key is configured.
+const insecureSigningKey = "insecure-default-key"
+
+// applyGuardrailsEnv applies environment overrides to every guardrails
+// config loaded, including reloads.
+func applyGuardrailsEnv(cfg *guardrails.Config) {
+	if webhookURL := envOr("WEBHOOK_URL", ""); webhookURL != "" {
+		cfg.Alerts.WebhookURL = webhookURL
+	}
+	if cfg.Trust.Enabled {
+		// Store the resolved key for the export endpoint.
+		cfg.Trust.SigningKey = envOr("TRUST_SIGNING_KEY", cfg.Trust.SigningKey)
+		if cfg.Trust.SigningKey == "" {
+			cfg.Trust.SigningKey = insecureSigningKey
+		}
+	}
+}
+
 func initTracer(ctx context.Context) (*sdktrace.TracerProvider, error) {
 	endpoint := envOr("OTEL_EXPORTER_OTLP_ENDPOINT", "")
 	if endpoint == "" {
@@ -197,3 +394,44 @@ func envOr(key, fallback string) string {
 	}
 	return fallback
 }
+
+// validateConfig implements "gateway validate-config <file>": it prints every
+// problem in a guardrails file, one per line, and returns the exit status.
+func validateConfig(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: gateway validate-config <guardrails.yaml>\n")
+		return 2
+	}
+	path := args[0]
+	if _, err := guardrails.LoadConfig(path); err != nil {
+		var errs guardrails.ConfigErrors
+		if !errors.As(err, &errs) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 1
+		}
+		for _, e := range errs {
+			line := e.Line
+			e.Line = 0
+			if line > 0 {
+				fmt.Fprintf(os.Stderr, "%s:%d: %v\n", path, line, e)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", path, e)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%d error(s)\n", len(errs))
+		return 1
+	}
+	fmt.Printf("%s: OK\n", path)
+	return 0
+}
+
+// hashKey implements "gateway hash-key <key>": it prints the key_sha256 to
+// put in GATEWAY_KEYS_FILE for a key.
+func hashKey(args []string) int {
+	if len(args) != 1 || args[0] == "" {
+		fmt.Fprintf(os.Stderr, "Usage: gateway hash-key <key>\n")
+		return 2
+	}
+	fmt.Println(auth.HashKey(args[0]))
+	return 0
+}
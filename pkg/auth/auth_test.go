@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeKeys(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRegistryLookup(t *testing.T) {
+	path := writeKeys(t, `keys:
+  - id: ci
+    key_sha256: `+HashKey("sk-ci")+`
+    tenant: acme
+    team: platform
+    models: ["gpt-4o-mini", "claude-*"]
+    endpoints: [/v1/chat/completions]
+    budgets: {max_session_tokens: 2000}
+    guardrail_profile: strict
+  - id: ops
+    key_sha256: `+strings.ToUpper(HashKey("sk-ops"))+`
+    scopes: [proxy, admin]
+`)
+	reg, err := LoadRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Len() != 2 {
+		t.Fatalf("Len = %d", reg.Len())
+	}
+
+	ci := reg.Lookup("sk-ci")
+	if ci == nil || ci.KeyID != "ci" || ci.Tenant != "acme" || ci.Profile != "strict" || ci.Budgets.MaxSessionTokens != 2000 {
+		t.Fatalf("ci = %+v", ci)
+	}
+	if !ci.HasScope(ScopeProxy) || ci.HasScope(ScopeAdmin) {
+		t.Errorf("ci scopes = %v, want the default [proxy]", ci.Scopes)
+	}
+	if !ci.AllowsModel("Claude-3-5-Sonnet") || ci.AllowsModel("gpt-4o") {
+		t.Error("model patterns not applied")
+	}
+	if !ci.AllowsEndpoint("/v1/chat/completions") || ci.AllowsEndpoint("/v1/messages") {
+		t.Error("endpoints not applied")
+	}
+	if ops := reg.Lookup("sk-ops"); ops == nil || !ops.HasScope(ScopeAdmin) || !ops.AllowsModel("anything") {
+		t.Errorf("ops = %+v", ops)
+	}
+	for _, key := range []string{"", "sk-c", "sk-ci ", HashKey("sk-ci")} {
+		if id := reg.Lookup(key); id != nil {
+			t.Errorf("Lookup(%q) = %+v", key, id)
+		}
+	}
+
+	// A bad file on reload keeps the loaded keys.
+	os.WriteFile(path, []byte("keys:\n  - id: x\n    key_sha256: nothex\n"), 0600)
+	if err := reg.Reload(); err == nil {
+		t.Error("expected reload error")
+	}
+	if reg.Lookup("sk-ci") == nil {
+		t.Error("failed reload dropped the keys")
+	}
+
+	ctx := WithIdentity(context.Background(), ci)
+	if FromContext(ctx) != ci || FromContext(context.Background()) != nil {
+		t.Error("identity not carried by the context")
+	}
+}
+
+func TestRegistryCertSubjects(t *testing.T) {
+	reg, err := LoadRegistry(writeKeys(t, `keys:
+  - id: search-agent
+    cert_subject: spiffe://acme.internal/agents/search
+    tenant: acme
+  - id: ops
+    key_sha256: `+HashKey("sk-ops")+`
+    cert_subject: ops.acme.internal
+    scopes: [proxy, admin]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Len() != 2 {
+		t.Errorf("Len = %d", reg.Len())
+	}
+	if id := reg.LookupCert([]string{"spiffe://acme.internal/agents/search", "search"}); id == nil || id.KeyID != "search-agent" || id.Tenant != "acme" {
+		t.Errorf("by URI SAN = %+v", id)
+	}
+	// The first name with an entry wins; a key entry also matches by hash.
+	if id := reg.LookupCert([]string{"unknown", "ops.acme.internal"}); id == nil || id.KeyID != "ops" || reg.Lookup("sk-ops") != id {
+		t.Errorf("by DNS SAN = %+v", id)
+	}
+	if id := reg.LookupCert([]string{"search"}); id != nil {
+		t.Errorf("unknown names = %+v", id)
+	}
+	if id := (*Registry)(nil).LookupCert([]string{"ops.acme.internal"}); id != nil {
+		t.Errorf("nil registry = %+v", id)
+	}
+}
+
+func TestRegistryRejectsInvalidFiles(t *testing.T) {
+	h := HashKey("k")
+	tests := map[string]string{
+		"missing id":      "keys:\n  - key_sha256: " + h + "\n",
+		"duplicate id":    "keys:\n  - id: a\n    key_sha256: " + h + "\n  - id: a\n    key_sha256: " + HashKey("j") + "\n",
+		"duplicate key":   "keys:\n  - id: a\n    key_sha256: " + h + "\n  - id: b\n    key_sha256: " + h + "\n",
+		"short hash":      "keys:\n  - id: a\n    key_sha256: abcd\n",
+		"unknown scope":   "keys:\n  - id: a\n    key_sha256: " + h + "\n    scopes: [root]\n",
+		"unknown field":   "keys:\n  - id: a\n    key: plaintext\n",
+		"bad pattern":     "keys:\n  - id: a\n    key_sha256: " + h + "\n    models: [\"gpt-[\"]\n",
+		"relative path":   "keys:\n  - id: a\n    key_sha256: " + h + "\n    endpoints: [v1/chat/completions]\n",
+		"negative budget": "keys:\n  - id: a\n    key_sha256: " + h + "\n    budgets: {max_session_cost_usd: -1}\n",
+		"duplicate cert":  "keys:\n  - id: a\n    cert_subject: svc\n  - id: b\n    cert_subject: svc\n",
+	}
+	for name, data := range tests {
+		if _, err := LoadRegistry(writeKeys(t, data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if reg, err := LoadRegistry(""); reg != nil || err != nil {
+		t.Errorf("LoadRegistry(\"\") = %v, %v", reg, err)
+	}
+}
+
+func TestVirtualKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "virtual-keys.json")
+	s, err := OpenVirtualKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	expires := now.Add(time.Hour)
+	key, vk, err := s.Issue(VirtualKey{Name: "agent", Tenant: "acme", Models: []string{"gpt-4o*"}, MaxSpendUSD: 1, ExpiresAt: &expires}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, VirtualKeyPrefix) || vk.KeySHA256 != HashKey(key) {
+		t.Fatalf("issued %q %+v", key, vk)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), key) {
+		t.Error("the key itself was persisted")
+	}
+
+	got, err := s.Resolve(key, now)
+	if err != nil || got.ID != vk.ID {
+		t.Fatalf("Resolve = %+v, %v", got, err)
+	}
+	if id := got.Identity(); !id.Virtual || id.KeyID != vk.ID || id.HasScope(ScopeAdmin) || id.AllowsModel("claude-3-opus") {
+		t.Errorf("identity = %+v", id)
+	}
+	if _, err := s.Resolve(key, expires); !errors.Is(err, ErrVirtualKeyExpired) {
+		t.Errorf("after expiry: %v", err)
+	}
+	if _, err := s.Resolve("vk-unknown", now); !errors.Is(err, ErrUnknownVirtualKey) {
+		t.Errorf("unknown key: %v", err)
+	}
+
+	s.AddSpend(vk.ID, 0.6)
+	s.AddSpend(vk.ID, 0.6)
+	if _, err := s.Resolve(key, now); !errors.Is(err, ErrVirtualKeySpent) {
+		t.Errorf("over cap: %v", err)
+	}
+
+	key2, vk2, _ := s.Issue(VirtualKey{Name: "other"}, now.Add(time.Second))
+	if _, ok, err := s.Revoke(vk2.ID, now); !ok || err != nil {
+		t.Fatalf("Revoke = %v, %v", ok, err)
+	}
+	if _, err := s.Resolve(key2, now); !errors.Is(err, ErrVirtualKeyRevoked) {
+		t.Errorf("revoked key: %v", err)
+	}
+	if _, ok, _ := s.Revoke("vk_missing", now); ok {
+		t.Error("revoked a missing key")
+	}
+
+	// Keys, spend and revocations survive a restart.
+	reopened, err := OpenVirtualKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reopened.List(); len(list) != 2 || list[0].SpentUSD != 1.2 || list[1].RevokedAt == nil {
+		t.Errorf("reopened = %+v", list)
+	}
+	if _, err := reopened.Resolve(key2, now); !errors.Is(err, ErrVirtualKeyRevoked) {
+		t.Errorf("reopened revoked key: %v", err)
+	}
+
+	for _, spec := range []VirtualKey{{MaxSpendUSD: -1}, {Models: []string{"["}}, {ExpiresAt: &now}} {
+		if _, _, err := s.Issue(spec, now); !errors.Is(err, ErrInvalidVirtualKey) {
+			t.Errorf("Issue(%+v) = %v, want ErrInvalidVirtualKey", spec, err)
+		}
+	}
+}
+
+func TestVirtualKeySpendReservations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "virtual-keys.json")
+	s, _ := OpenVirtualKeys(path)
+	defer s.Close()
+	now := time.Now()
+	key, vk, _ := s.Issue(VirtualKey{MaxSpendUSD: 1}, now)
+
+	// Requests in flight hold their estimates against the cap.
+	first, err := s.Reserve(vk.ID, 0.6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reserve(vk.ID, 0.6); !errors.Is(err, ErrVirtualKeySpent) {
+		t.Errorf("second reservation = %v, want ErrVirtualKeySpent", err)
+	}
+	first.Settle(0.1)
+	first.Settle(5) // only the first settle counts
+	second, err := s.Reserve(vk.ID, 0.6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Settle(0.95)
+	if _, err := s.Resolve(key, now); !errors.Is(err, ErrVirtualKeySpent) {
+		t.Errorf("after settling $1.05: %v", err)
+	}
+
+	// Spend reaches the file on Flush, not on every charge.
+	if reopened, _ := OpenVirtualKeys(path); reopened.List()[0].SpentUSD != 0 {
+		t.Errorf("spend written before Flush: %+v", reopened.List())
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, _ := OpenVirtualKeys(path)
+	defer reopened.Close()
+	if got := reopened.List()[0].SpentUSD; got < 1.049 || got > 1.051 {
+		t.Errorf("spent after Flush = %v, want 1.05", got)
+	}
+}
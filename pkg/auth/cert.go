@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+)
+
+// CertNames returns the names a client certificate vouches for, most
+// specific first: URI SANs (e.g. SPIFFE IDs), DNS SANs, email SANs, then
+// the subject common name.
+func CertNames(cert *x509.Certificate) []string {
+	var names []string
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// CertFingerprint returns the hex SHA-256 of a certificate's DER encoding.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// CertIdentity is the caller a verified client certificate stands for when
+// no registry key names it: "cert:<name>" with the proxy scope. Returns nil
+// for a certificate without any name.
+func CertIdentity(cert *x509.Certificate) *Identity {
+	names := CertNames(cert)
+	if len(names) == 0 {
+		return nil
+	}
+	return &Identity{KeyID: "cert:" + names[0], Subject: names[0], Scopes: []string{ScopeProxy}}
+}
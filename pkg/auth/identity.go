@@ -0,0 +1,91 @@
+// Package auth resolves the credentials callers present to the gateway into
+// identities: who is calling, for which tenant and team, and what they may do.
+package auth
+
+import (
+	"context"
+	"path"
+	"strings"
+)
+
+// Scopes a gateway key can hold.
+const (
+	ScopeProxy = "proxy" // LLM endpoints, analytics and the shadow summary
+	ScopeAdmin = "admin" // /v1/admin/*, /v1/audit and /v1/audit/export
+)
+
+// Identity is a resolved caller.
+type Identity struct {
+	KeyID     string // key ID; "jwt:<sub>" for a JWT, "gateway" for GATEWAY_KEY
+	Subject   string // JWT "sub"
+	Tenant    string // sessions are scoped to the tenant
+	Team      string
+	Session   string   // guardrails session from a JWT claim; X-Session-ID takes precedence
+	Scopes    []string // ScopeProxy, ScopeAdmin
+	Models    []string // glob patterns, e.g. "gpt-4o*"; empty allows every model
+	Endpoints []string // paths, e.g. /v1/chat/completions; empty allows every endpoint
+	Budgets   Budgets  // overrides the guardrails session budgets
+	Profile   string   // guardrails profile; "" uses the top-level rules
+	Virtual   bool     // a virtual key, whose spend is tracked
+
+	// ServerCredentials is set when the caller's credential took the place
+	// of the provider key, so providers must get the gateway's own.
+	ServerCredentials bool
+}
+
+// Budgets overrides the guardrails session budgets for one key. Zero keeps
+// the configured budget.
+type Budgets struct {
+	MaxSessionTokens  int     `yaml:"max_session_tokens"`
+	MaxSessionCostUSD float64 `yaml:"max_session_cost_usd"`
+}
+
+// HasScope reports whether the identity holds scope.
+func (id *Identity) HasScope(scope string) bool {
+	for _, s := range id.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsModel reports whether the identity may call model.
+func (id *Identity) AllowsModel(model string) bool {
+	if len(id.Models) == 0 {
+		return true
+	}
+	model = strings.ToLower(model)
+	for _, pattern := range id.Models {
+		if ok, _ := path.Match(strings.ToLower(pattern), model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsEndpoint reports whether the identity may call the endpoint path.
+func (id *Identity) AllowsEndpoint(endpoint string) bool {
+	if len(id.Endpoints) == 0 {
+		return true
+	}
+	for _, e := range id.Endpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey struct{}
+
+// WithIdentity returns a copy of ctx carrying id.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity in ctx, or nil for an anonymous caller.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
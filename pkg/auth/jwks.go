@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+)
+
+// JWT signing algorithms the gateway accepts.
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// jwk is one key of a JSON Web Key Set (RFC 7517), with the fields of RSA,
+// EC P-256 and Ed25519 signing keys.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// signingKey is a JWKS key the gateway can verify tokens with.
+type signingKey struct {
+	kid string
+	alg string
+	pub crypto.PublicKey
+}
+
+// parseJWKS decodes a JWKS document. Keys for encryption, of unsupported
+// types or that fail to decode are skipped, the last with a log line; a set
+// without any usable key is an error.
+func parseJWKS(data []byte) ([]signingKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("auth: jwks: %w", err)
+	}
+	var keys []signingKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.signingKey()
+		if err != nil {
+			log.Printf("[auth] JWKS key %q skipped: %v", k.Kid, err)
+			continue
+		}
+		if key == nil || k.Alg != "" && k.Alg != key.alg {
+			continue
+		}
+		keys = append(keys, *key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("auth: jwks: no RS256, ES256 or EdDSA signing keys")
+	}
+	return keys, nil
+}
+
+// signingKey decodes the public key, or returns nil for a key type the
+// gateway does not verify with.
+func (k jwk) signingKey() (*signingKey, error) {
+	switch {
+	case k.Kty == "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if n.BitLen() < 2048 || !e.IsInt64() {
+			return nil, errors.New("RSA key must be at least 2048 bits")
+		}
+		return &signingKey{kid: k.Kid, alg: AlgRS256, pub: &rsa.PublicKey{N: n, E: int(e.Int64())}}, nil
+
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point is not on P-256")
+		}
+		return &signingKey{kid: k.Kid, alg: AlgES256, pub: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}, nil
+
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return &signingKey{kid: k.Kid, alg: AlgEdDSA, pub: ed25519.PublicKey(x)}, nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid base64url integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// verify checks sig over signed with the key.
+func (k signingKey) verify(signed, sig []byte) bool {
+	switch pub := k.pub.(type) {
+	case *rsa.PublicKey:
+		sum := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	case *ecdsa.PublicKey:
+		// JWS ES256 signatures are r and s as two 32-byte big-endian integers.
+		if len(sig) != 64 {
+			return false
+		}
+		sum := sha256.Sum256(signed)
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, sum[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, signed, sig)
+	}
+	return false
+}
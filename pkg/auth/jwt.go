@@ -0,0 +1,303 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTConfig configures bearer JWT authentication against a JWKS.
+type JWTConfig struct {
+	JWKS     string // JWKS file path or http(s) URL
+	Issuer   string // required "iss"
+	Audience string // required in "aud"
+
+	TenantClaim  string // claim holding the tenant; "" = no tenant
+	SessionClaim string // claim holding the guardrails session ID; "" = none
+	ScopesClaim  string // claim holding gateway scopes; default "scope"
+
+	Refresh time.Duration // how often the JWKS is re-read; default 15m
+	Leeway  time.Duration // clock skew allowed on exp and nbf; default 1m
+}
+
+// minKeyRefetch is how soon a token signed by an unknown key may trigger
+// another JWKS fetch, so tokens with made-up key IDs cannot flood the
+// JWKS endpoint.
+const minKeyRefetch = time.Minute
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+// JWTVerifier validates RS256, ES256 and EdDSA bearer tokens against a
+// JWKS, which it re-reads periodically and whenever a token names a key it
+// does not know. Safe for concurrent use.
+type JWTVerifier struct {
+	cfg JWTConfig
+
+	mu        sync.RWMutex
+	keys      []signingKey
+	refreshed time.Time // last fetch attempt
+}
+
+// NewJWTVerifier loads the JWKS in cfg. Returns nil if cfg.JWKS is empty.
+func NewJWTVerifier(ctx context.Context, cfg JWTConfig) (*JWTVerifier, error) {
+	if cfg.JWKS == "" {
+		return nil, nil
+	}
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return nil, errors.New("auth: jwt: issuer and audience are required")
+	}
+	if cfg.ScopesClaim == "" {
+		cfg.ScopesClaim = "scope"
+	}
+	if cfg.Refresh <= 0 {
+		cfg.Refresh = 15 * time.Minute
+	}
+	if cfg.Leeway <= 0 {
+		cfg.Leeway = time.Minute
+	}
+	v := &JWTVerifier{cfg: cfg}
+	if err := v.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Reload re-reads the JWKS. On error the loaded keys stay in use.
+func (v *JWTVerifier) Reload(ctx context.Context) error {
+	v.mu.Lock()
+	v.refreshed = time.Now()
+	v.mu.Unlock()
+
+	data, err := v.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *JWTVerifier) fetch(ctx context.Context) ([]byte, error) {
+	src := v.cfg.JWKS
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return nil, fmt.Errorf("auth: jwks: %w", err)
+		}
+		return data, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, fmt.Errorf("auth: jwks: %w", err)
+	}
+	resp, err := jwksClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("auth: jwks: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth: jwks: %s returned %d", src, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// Run re-reads the JWKS every cfg.Refresh until ctx is done.
+func (v *JWTVerifier) Run(ctx context.Context) {
+	t := time.NewTicker(v.cfg.Refresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := v.Reload(ctx); err != nil {
+				log.Printf("[auth] JWKS refresh failed, keeping current keys: %v", err)
+			}
+		}
+	}
+}
+
+// jwtHeader is the JOSE header of a token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify checks a token's signature, issuer, audience, expiry and
+// not-before time, and returns the caller it identifies: the subject, the
+// tenant and session from the configured claims, and the gateway scopes in
+// the scopes claim (proxy if there is none).
+func (v *JWTVerifier) Verify(token string, now time.Time) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	if header.Alg != AlgRS256 && header.Alg != AlgES256 && header.Alg != AlgEdDSA {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	if !v.verifySignature(header, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]interface{}
+	dec := json.NewDecoder(base64.NewDecoder(base64.RawURLEncoding, strings.NewReader(parts[1])))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	if iss, _ := claims["iss"].(string); iss != v.cfg.Issuer {
+		return nil, fmt.Errorf("issuer %q not accepted", iss)
+	}
+	if !hasAudience(claims["aud"], v.cfg.Audience) {
+		return nil, errors.New("audience not accepted")
+	}
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return nil, errors.New("token has no exp")
+	}
+	if !now.Before(exp.Add(v.cfg.Leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(v.cfg.Leeway).Before(nbf) {
+		return nil, errors.New("token not valid yet")
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errors.New("token has no sub")
+	}
+
+	id := &Identity{KeyID: "jwt:" + sub, Subject: sub, Scopes: []string{ScopeProxy}}
+	if v.cfg.TenantClaim != "" {
+		id.Tenant, _ = claims[v.cfg.TenantClaim].(string)
+	}
+	if v.cfg.SessionClaim != "" {
+		id.Session, _ = claims[v.cfg.SessionClaim].(string)
+	}
+	if raw, ok := claims[v.cfg.ScopesClaim]; ok {
+		id.Scopes = gatewayScopes(raw)
+	}
+	return id, nil
+}
+
+// verifySignature tries the key the header names, or every key of the
+// header's algorithm if it names none. A key ID not in the JWKS triggers a
+// refetch, at most once per minKeyRefetch, in case the issuer rotated keys.
+func (v *JWTVerifier) verifySignature(header jwtHeader, signed, sig []byte) bool {
+	for attempt := 0; attempt < 2; attempt++ {
+		v.mu.RLock()
+		keys, refreshed := v.keys, v.refreshed
+		v.mu.RUnlock()
+
+		known := false
+		for _, k := range keys {
+			if k.alg != header.Alg || header.Kid != "" && k.kid != header.Kid {
+				continue
+			}
+			known = true
+			if k.verify(signed, sig) {
+				return true
+			}
+		}
+		if known || header.Kid == "" || attempt > 0 || time.Since(refreshed) < minKeyRefetch {
+			return false
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := v.Reload(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("[auth] JWKS refetch for key %q failed: %v", header.Kid, err)
+			return false
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// hasAudience reports whether aud, a string or an array of strings,
+// contains want.
+func hasAudience(aud interface{}, want string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == want
+	case []interface{}:
+		for _, s := range a {
+			if s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// numericDate decodes a JWT NumericDate, seconds since the epoch.
+func numericDate(v interface{}) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(f*float64(time.Second))), true
+}
+
+// gatewayScopes picks the gateway scopes out of a scopes claim, either a
+// space-separated string (OAuth "scope") or an array of strings. Other
+// scopes in the claim are ignored.
+func gatewayScopes(raw interface{}) []string {
+	var all []string
+	switch s := raw.(type) {
+	case string:
+		all = strings.Fields(s)
+	case []interface{}:
+		for _, v := range s {
+			if str, ok := v.(string); ok {
+				all = append(all, str)
+			}
+		}
+	}
+	var scopes []string
+	for _, s := range all {
+		if s == ScopeProxy || s == ScopeAdmin {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// LooksLikeJWT reports whether a credential has the shape of a compact JWS,
+// so it can be told apart from gateway and provider keys.
+func LooksLikeJWT(s string) bool {
+	return strings.HasPrefix(s, "eyJ") && strings.Count(s, ".") == 2
+}
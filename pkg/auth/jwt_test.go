@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSigner signs tokens with one key and publishes it as a JWK.
+type testSigner struct {
+	kid  string
+	alg  string
+	priv crypto.Signer
+}
+
+func newTestSigners(t *testing.T) []testSigner {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	return []testSigner{
+		{kid: "rsa-1", alg: AlgRS256, priv: rsaKey},
+		{kid: "ec-1", alg: AlgES256, priv: ecKey},
+		{kid: "ed-1", alg: AlgEdDSA, priv: edKey},
+	}
+}
+
+func (s testSigner) jwk() map[string]string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := s.priv.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": s.kid, "use": "sig", "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": s.kid, "crv": "P-256", "x": b64(pub.X.FillBytes(make([]byte, 32))), "y": b64(pub.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": s.kid, "crv": "Ed25519", "x": b64(pub)}
+	}
+	return nil
+}
+
+func (s testSigner) sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	var err error
+	sum := sha256.Sum256([]byte(signed))
+	switch priv := s.priv.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		var r, ss *big.Int
+		r, ss, err = ecdsa.Sign(rand.Reader, priv, sum[:])
+		sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(priv, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeJWKS(t *testing.T, path string, signers ...testSigner) {
+	t.Helper()
+	var keys []map[string]string
+	for _, s := range signers {
+		keys = append(keys, s.jwk())
+	}
+	data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWTVerify(t *testing.T) {
+	signers := newTestSigners(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, signers...)
+
+	v, err := NewJWTVerifier(context.Background(), JWTConfig{
+		JWKS:         path,
+		Issuer:       "https://idp.example.com",
+		Audience:     "air-gateway",
+		TenantClaim:  "org",
+		SessionClaim: "sid",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": "https://idp.example.com",
+			"aud": []string{"other", "air-gateway"},
+			"sub": "svc-search",
+			"exp": now.Add(time.Hour).Unix(),
+			"org": "acme",
+			"sid": "run-42",
+		}
+		for k, val := range overrides {
+			if val == nil {
+				delete(c, k)
+			} else {
+				c[k] = val
+			}
+		}
+		return c
+	}
+
+	for _, s := range signers {
+		id, err := v.Verify(s.sign(t, claims(nil)), now)
+		if err != nil {
+			t.Fatalf("%s: %v", s.alg, err)
+		}
+		if id.KeyID != "jwt:svc-search" || id.Subject != "svc-search" || id.Tenant != "acme" || id.Session != "run-42" {
+			t.Errorf("%s: identity = %+v", s.alg, id)
+		}
+		if !id.HasScope(ScopeProxy) || id.HasScope(ScopeAdmin) {
+			t.Errorf("%s: scopes = %v, want the default [proxy]", s.alg, id.Scopes)
+		}
+	}
+
+	rs := signers[0]
+	if id, err := v.Verify(rs.sign(t, claims(map[string]interface{}{"scope": "openid admin proxy"})), now); err != nil || !id.HasScope(ScopeAdmin) {
+		t.Errorf("scope claim: %+v, %v", id, err)
+	}
+	if id, err := v.Verify(rs.sign(t, claims(map[string]interface{}{"scope": "openid"})), now); err != nil || id.HasScope(ScopeProxy) {
+		t.Errorf("scope claim without gateway scopes: %+v, %v", id, err)
+	}
+
+	bad := map[string]string{
+		"expired":      rs.sign(t, claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()})),
+		"no exp":       rs.sign(t, claims(map[string]interface{}{"exp": nil})),
+		"not yet":      rs.sign(t, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})),
+		"issuer":       rs.sign(t, claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+		"audience":     rs.sign(t, claims(map[string]interface{}{"aud": "someone-else"})),
+		"no sub":       rs.sign(t, claims(map[string]interface{}{"sub": nil})),
+		"malformed":    "eyJhbGciOiJSUzI1NiJ9.e30",
+		"tampered":     rs.sign(t, claims(nil))[:40] + "x" + rs.sign(t, claims(nil))[41:],
+		"unknown kid":  testSigner{kid: "rsa-2", alg: AlgRS256, priv: rs.priv}.sign(t, claims(nil)),
+		"wrong kid":    testSigner{kid: "rsa-1", alg: AlgRS256, priv: newTestSigners(t)[0].priv}.sign(t, claims(nil)),
+		"alg mismatch": testSigner{kid: "rsa-1", alg: AlgES256, priv: signers[1].priv}.sign(t, claims(nil)),
+	}
+	none, _ := json.Marshal(map[string]string{"alg": "none"})
+	payload, _ := json.Marshal(claims(nil))
+	bad["alg none"] = base64.RawURLEncoding.EncodeToString(none) + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+	for name, token := range bad {
+		if id, err := v.Verify(token, now); err == nil {
+			t.Errorf("%s: accepted as %+v", name, id)
+		}
+	}
+	// Expiry allows a minute of clock skew.
+	if _, err := v.Verify(rs.sign(t, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})), now); err != nil {
+		t.Errorf("within leeway: %v", err)
+	}
+}
+
+func TestParseJWKSSkipsBadKeys(t *testing.T) {
+	signers := newTestSigners(t)
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := []map[string]string{
+		testSigner{kid: "rsa-weak", alg: AlgRS256, priv: weak}.jwk(),
+		{"kty": "RSA", "kid": "rsa-garbled", "n": "not base64!", "e": "AQAB"},
+		{"kty": "EC", "kid": "ec-garbled", "crv": "P-256", "x": "AQ", "y": "AQ"},
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{"keys": append(bad, signers[1].jwk())})
+	keys, err := parseJWKS(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].kid != "ec-1" {
+		t.Errorf("keys = %+v, want only ec-1", keys)
+	}
+
+	data, _ = json.Marshal(map[string]interface{}{"keys": bad})
+	if _, err := parseJWKS(data); err == nil {
+		t.Error("expected an error for a set of only bad keys")
+	}
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	signers := newTestSigners(t)
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{signers[0].jwk()}})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	defer srv.Close()
+
+	v, err := NewJWTVerifier(context.Background(), JWTConfig{JWKS: srv.URL, Issuer: "iss", Audience: "aud"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{"iss": "iss", "aud": "aud", "sub": "svc", "exp": time.Now().Add(time.Hour).Unix()}
+	if _, err := v.Verify(signers[0].sign(t, claims), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The issuer rotates to a new key; a token naming it triggers a refetch
+	// once the last fetch is old enough.
+	jwks, _ = json.Marshal(map[string]interface{}{"keys": []map[string]string{signers[2].jwk()}})
+	if _, err := v.Verify(signers[2].sign(t, claims), time.Now()); err == nil {
+		t.Error("new key accepted before the refetch interval")
+	}
+	v.mu.Lock()
+	v.refreshed = time.Now().Add(-2 * minKeyRefetch)
+	v.mu.Unlock()
+	if _, err := v.Verify(signers[2].sign(t, claims), time.Now()); err != nil {
+		t.Errorf("rotated key: %v", err)
+	}
+	if _, err := v.Verify(signers[0].sign(t, claims), time.Now()); err == nil {
+		t.Error("retired key still accepted")
+	}
+
+	// A broken JWKS keeps the current keys.
+	jwks = []byte(`{"keys":[]}`)
+	if err := v.Reload(context.Background()); err == nil {
+		t.Error("expected reload error")
+	}
+	if _, err := v.Verify(signers[2].sign(t, claims), time.Now()); err != nil {
+		t.Errorf("after failed reload: %v", err)
+	}
+
+	if _, err := NewJWTVerifier(context.Background(), JWTConfig{JWKS: srv.URL}); err == nil || !strings.Contains(err.Error(), "issuer and audience") {
+		t.Errorf("missing issuer: %v", err)
+	}
+}
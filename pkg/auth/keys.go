@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// keyFile is the YAML format of a key registry. Keys are stored as the
+// hex SHA-256 of the key, never the key itself; see HashKey. An entry with
+// cert_subject instead (or as well) applies to callers presenting a
+// verified client certificate with that name; see CertNames.
+//
+//	keys:
+//	  - id: ci-pipeline
+//	    key_sha256: 5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8
+//	    tenant: acme
+//	    team: platform
+//	    scopes: [proxy]
+//	    models: ["gpt-4o-mini", "claude-*"]
+//	    endpoints: [/v1/chat/completions]
+//	    budgets: {max_session_tokens: 20000}
+//	    guardrail_profile: strict
+//	  - id: search-agent
+//	    cert_subject: spiffe://acme.internal/agents/search
+//	    tenant: acme
+type keyFile struct {
+	Keys []keyEntry `yaml:"keys"`
+}
+
+type keyEntry struct {
+	ID               string   `yaml:"id"`
+	KeySHA256        string   `yaml:"key_sha256"`
+	CertSubject      string   `yaml:"cert_subject"`
+	Tenant           string   `yaml:"tenant"`
+	Team             string   `yaml:"team"`
+	Scopes           []string `yaml:"scopes"` // default [proxy]
+	Models           []string `yaml:"models"`
+	Endpoints        []string `yaml:"endpoints"`
+	Budgets          Budgets  `yaml:"budgets"`
+	GuardrailProfile string   `yaml:"guardrail_profile"`
+}
+
+// Registry holds the gateway keys loaded from a file. Safe for concurrent
+// use; Reload swaps in a new file atomically.
+type Registry struct {
+	path string
+
+	mu    sync.RWMutex
+	keys  map[[sha256.Size]byte]*Identity
+	certs map[string]*Identity // by certificate name
+	n     int
+}
+
+// HashKey returns the hex SHA-256 of a key, as stored in a key registry.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadRegistry reads a key registry file. Returns nil if path is empty.
+func LoadRegistry(path string) (*Registry, error) {
+	if path == "" {
+		return nil, nil
+	}
+	r := &Registry{path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the registry file. On error the loaded keys stay in use.
+func (r *Registry) Reload() error {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	keys, certs, n, err := parseKeys(data)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.keys, r.certs, r.n = keys, certs, n
+	r.mu.Unlock()
+	return nil
+}
+
+// Len returns the number of entries.
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.n
+}
+
+// Lookup returns the identity of a presented key, or nil if it is not in
+// the registry. Keys are compared by hash, so the time taken does not
+// depend on how much of a stored key the presented one matches.
+func (r *Registry) Lookup(key string) *Identity {
+	if r == nil || key == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(key))
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys[sum]
+}
+
+// LookupCert returns the identity of the first certificate name that an
+// entry's cert_subject matches, or nil.
+func (r *Registry) LookupCert(names []string) *Identity {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, name := range names {
+		if id, ok := r.certs[name]; ok {
+			return id
+		}
+	}
+	return nil
+}
+
+// parseKeys strictly decodes and validates a registry file. It returns the
+// identities by key hash and by certificate name, and the number of entries.
+func parseKeys(data []byte) (map[[sha256.Size]byte]*Identity, map[string]*Identity, int, error) {
+	var f keyFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && err != io.EOF {
+		return nil, nil, 0, fmt.Errorf("auth: %w", err)
+	}
+
+	keys := make(map[[sha256.Size]byte]*Identity, len(f.Keys))
+	certs := make(map[string]*Identity)
+	ids := make(map[string]bool, len(f.Keys))
+	for i, k := range f.Keys {
+		if k.ID == "" {
+			return nil, nil, 0, fmt.Errorf("auth: key %d: id is required", i)
+		}
+		if ids[k.ID] {
+			return nil, nil, 0, fmt.Errorf("auth: key %q defined twice", k.ID)
+		}
+		ids[k.ID] = true
+
+		var sum [sha256.Size]byte
+		hasKey := k.KeySHA256 != "" || k.CertSubject == ""
+		if hasKey {
+			b, err := hex.DecodeString(strings.ToLower(k.KeySHA256))
+			if err != nil || len(b) != sha256.Size {
+				return nil, nil, 0, fmt.Errorf("auth: key %q: key_sha256 must be 64 hex characters (see gateway hash-key)", k.ID)
+			}
+			copy(sum[:], b)
+			if _, dup := keys[sum]; dup {
+				return nil, nil, 0, fmt.Errorf("auth: key %q: key_sha256 is shared with another key", k.ID)
+			}
+		}
+		if _, dup := certs[k.CertSubject]; k.CertSubject != "" && dup {
+			return nil, nil, 0, fmt.Errorf("auth: key %q: cert_subject %q is shared with another key", k.ID, k.CertSubject)
+		}
+
+		if len(k.Scopes) == 0 {
+			k.Scopes = []string{ScopeProxy}
+		}
+		for _, s := range k.Scopes {
+			if s != ScopeProxy && s != ScopeAdmin {
+				return nil, nil, 0, fmt.Errorf("auth: key %q: unknown scope %q (want proxy or admin)", k.ID, s)
+			}
+		}
+		for _, m := range k.Models {
+			if _, err := path.Match(m, ""); err != nil {
+				return nil, nil, 0, fmt.Errorf("auth: key %q: model pattern %q: %v", k.ID, m, err)
+			}
+		}
+		for _, e := range k.Endpoints {
+			if !strings.HasPrefix(e, "/") {
+				return nil, nil, 0, fmt.Errorf("auth: key %q: endpoint %q must be a path", k.ID, e)
+			}
+		}
+		if k.Budgets.MaxSessionTokens < 0 || k.Budgets.MaxSessionCostUSD < 0 {
+			return nil, nil, 0, fmt.Errorf("auth: key %q: budgets must not be negative", k.ID)
+		}
+
+		id := &Identity{
+			KeyID:     k.ID,
+			Tenant:    k.Tenant,
+			Team:      k.Team,
+			Scopes:    k.Scopes,
+			Models:    k.Models,
+			Endpoints: k.Endpoints,
+			Budgets:   k.Budgets,
+			Profile:   k.GuardrailProfile,
+		}
+		if hasKey {
+			keys[sum] = id
+		}
+		if k.CertSubject != "" {
+			certs[k.CertSubject] = id
+		}
+	}
+	return keys, certs, len(f.Keys), nil
+}
@@ -0,0 +1,383 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/airblackbox/gateway/pkg/guardrails"
+)
+
+// VirtualKeyPrefix starts every virtual key, so the gateway can tell one
+// from a provider key in Authorization or X-Api-Key.
+const VirtualKeyPrefix = "vk-"
+
+// Errors from VirtualKeys.Resolve.
+var (
+	ErrUnknownVirtualKey = errors.New("auth: unknown virtual key")
+	ErrVirtualKeyRevoked = errors.New("auth: virtual key revoked")
+	ErrVirtualKeyExpired = errors.New("auth: virtual key expired")
+	ErrVirtualKeySpent   = errors.New("auth: virtual key spend cap reached")
+)
+
+// ErrInvalidVirtualKey wraps the reasons Issue refuses a key spec.
+var ErrInvalidVirtualKey = errors.New("auth: invalid virtual key")
+
+// VirtualKey is a key the gateway issued to an agent in place of a provider
+// key. The gateway attaches its own provider credentials to the agent's
+// requests, so the agent never holds them. The key itself is returned once
+// at issue; only its hash is kept.
+type VirtualKey struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name,omitempty"`
+	KeySHA256   string     `json:"key_sha256"`
+	Tenant      string     `json:"tenant,omitempty"`
+	Team        string     `json:"team,omitempty"`
+	Models      []string   `json:"models,omitempty"`        // glob patterns; empty allows every model
+	MaxSpendUSD float64    `json:"max_spend_usd,omitempty"` // 0 = no cap
+	SpentUSD    float64    `json:"spent_usd"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+
+	reserved float64 // estimated cost of requests in flight, see Reserve
+}
+
+// Identity returns the caller a virtual key stands for: the proxy scope only,
+// limited to the key's models.
+func (k VirtualKey) Identity() *Identity {
+	return &Identity{
+		KeyID:   k.ID,
+		Tenant:  k.Tenant,
+		Team:    k.Team,
+		Scopes:  []string{ScopeProxy},
+		Models:  k.Models,
+		Virtual: true,
+
+		ServerCredentials: true,
+	}
+}
+
+// check returns why the key cannot be used at now, or nil.
+func (k *VirtualKey) check(now time.Time) error {
+	switch {
+	case k.RevokedAt != nil:
+		return ErrVirtualKeyRevoked
+	case k.ExpiresAt != nil && !now.Before(*k.ExpiresAt):
+		return ErrVirtualKeyExpired
+	case k.MaxSpendUSD > 0 && k.SpentUSD+k.reserved >= k.MaxSpendUSD:
+		return ErrVirtualKeySpent
+	}
+	return nil
+}
+
+// virtualKeyFile is the JSON format VirtualKeys persists.
+type virtualKeyFile struct {
+	VirtualKeys []*VirtualKey `json:"virtual_keys"`
+}
+
+// spendFlushInterval is how often spend is written to the file.
+const spendFlushInterval = 5 * time.Second
+
+// VirtualKeys issues, resolves and revokes virtual keys. With a path, issued
+// keys and revocations are written to the file before they take effect, and
+// spend is written every few seconds and on Close, so all of them survive a
+// restart. Safe for concurrent use.
+type VirtualKeys struct {
+	path string // "" keeps keys in memory only
+
+	mu     sync.Mutex
+	keys   map[string]*VirtualKey // by ID
+	hashes map[[sha256.Size]byte]string
+	dirty  bool // spend changed since the last save
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// OpenVirtualKeys loads the virtual keys in path, starting empty if the file
+// does not exist yet. An empty path keeps keys in memory only.
+func OpenVirtualKeys(path string) (*VirtualKeys, error) {
+	s := &VirtualKeys{
+		path:   path,
+		keys:   make(map[string]*VirtualKey),
+		hashes: make(map[[sha256.Size]byte]string),
+		done:   make(chan struct{}),
+	}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		go s.flushLoop()
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("auth: virtual keys: %w", err)
+	}
+	var f virtualKeyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("auth: virtual keys: %s: %w", path, err)
+	}
+	for _, k := range f.VirtualKeys {
+		b, err := hex.DecodeString(k.KeySHA256)
+		if err != nil || len(b) != sha256.Size || k.ID == "" {
+			return nil, fmt.Errorf("auth: virtual keys: %s: invalid key %q", path, k.ID)
+		}
+		var sum [sha256.Size]byte
+		copy(sum[:], b)
+		s.keys[k.ID] = k
+		s.hashes[sum] = k.ID
+	}
+	go s.flushLoop()
+	return s, nil
+}
+
+// flushLoop writes changed spend to the file until Close.
+func (s *VirtualKeys) flushLoop() {
+	ticker := time.NewTicker(spendFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				log.Printf("[auth] virtual keys: spend not persisted: %v", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Flush writes spend recorded since the last write to the file.
+func (s *VirtualKeys) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+// Close stops the periodic writes and flushes the remaining spend.
+func (s *VirtualKeys) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return s.Flush()
+}
+
+// Issue creates a virtual key from spec's name, tenant, team, models, spend
+// cap and expiry. It returns the key, which is not stored and cannot be
+// recovered, and the stored record.
+func (s *VirtualKeys) Issue(spec VirtualKey, now time.Time) (string, VirtualKey, error) {
+	for _, m := range spec.Models {
+		if _, err := path.Match(m, ""); err != nil {
+			return "", VirtualKey{}, fmt.Errorf("%w: model pattern %q: %v", ErrInvalidVirtualKey, m, err)
+		}
+	}
+	if spec.MaxSpendUSD < 0 {
+		return "", VirtualKey{}, fmt.Errorf("%w: max_spend_usd must not be negative", ErrInvalidVirtualKey)
+	}
+	if spec.ExpiresAt != nil && !spec.ExpiresAt.After(now) {
+		return "", VirtualKey{}, fmt.Errorf("%w: expiry must be in the future", ErrInvalidVirtualKey)
+	}
+
+	secret := make([]byte, 24)
+	id := make([]byte, 6)
+	if _, err := rand.Read(secret); err != nil {
+		return "", VirtualKey{}, err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return "", VirtualKey{}, err
+	}
+	key := VirtualKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	sum := sha256.Sum256([]byte(key))
+
+	k := &VirtualKey{
+		ID:          "vk_" + hex.EncodeToString(id),
+		Name:        spec.Name,
+		KeySHA256:   hex.EncodeToString(sum[:]),
+		Tenant:      spec.Tenant,
+		Team:        spec.Team,
+		Models:      spec.Models,
+		MaxSpendUSD: spec.MaxSpendUSD,
+		CreatedAt:   now.UTC(),
+		ExpiresAt:   spec.ExpiresAt,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.ID] = k
+	s.hashes[sum] = k.ID
+	if err := s.save(); err != nil {
+		delete(s.keys, k.ID)
+		delete(s.hashes, sum)
+		return "", VirtualKey{}, err
+	}
+	return key, *k, nil
+}
+
+// Resolve returns the record of a presented virtual key, or an error if it
+// is unknown, revoked, expired or over its spend cap. Keys are compared by
+// hash, as in Registry.Lookup.
+func (s *VirtualKeys) Resolve(key string, now time.Time) (VirtualKey, error) {
+	if s == nil || key == "" {
+		return VirtualKey{}, ErrUnknownVirtualKey
+	}
+	sum := sha256.Sum256([]byte(key))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[s.hashes[sum]]
+	if !ok {
+		return VirtualKey{}, ErrUnknownVirtualKey
+	}
+	if err := k.check(now); err != nil {
+		return *k, err
+	}
+	return *k, nil
+}
+
+// Get returns the record with the given ID.
+func (s *VirtualKeys) Get(id string) (VirtualKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return VirtualKey{}, false
+	}
+	return *k, true
+}
+
+// List returns every record, oldest first.
+func (s *VirtualKeys) List() []VirtualKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]VirtualKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		out = append(out, *k)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Revoke revokes a key; requests presenting it are refused from then on.
+// Revoking a revoked key keeps the first revocation time. Returns false if
+// there is no such key. The revocation holds in memory even if it cannot
+// be written to the file.
+func (s *VirtualKeys) Revoke(id string, now time.Time) (VirtualKey, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return VirtualKey{}, false, nil
+	}
+	if k.RevokedAt == nil {
+		at := now.UTC()
+		k.RevokedAt = &at
+		if err := s.save(); err != nil {
+			return *k, true, err
+		}
+	}
+	return *k, true, nil
+}
+
+// AddSpend charges usd to a key. The charge takes effect at once and is
+// written to the file by the next Flush.
+func (s *VirtualKeys) AddSpend(id string, usd float64) {
+	if usd <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if k, ok := s.keys[id]; ok {
+		k.SpentUSD += usd
+		s.dirty = true
+	}
+}
+
+// SpendReservation holds the estimated cost of one request against its
+// key's spend cap until the actual cost is known.
+type SpendReservation struct {
+	keys *VirtualKeys
+	id   string
+	usd  float64
+}
+
+// Reserve holds usd against a key's spend cap, so requests in flight
+// together cannot pass it. It fails with ErrVirtualKeySpent if the key's
+// spend, its other reservations and usd would pass the cap. The reservation
+// must be settled with the actual cost.
+func (s *VirtualKeys) Reserve(id string, usd float64) (*SpendReservation, error) {
+	if usd < 0 {
+		usd = 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return nil, ErrUnknownVirtualKey
+	}
+	if k.MaxSpendUSD > 0 && (k.SpentUSD+k.reserved >= k.MaxSpendUSD || k.SpentUSD+k.reserved+usd > k.MaxSpendUSD) {
+		return nil, ErrVirtualKeySpent
+	}
+	k.reserved += usd
+	return &SpendReservation{keys: s, id: id, usd: usd}, nil
+}
+
+// Settle releases the reservation and charges actual in its place. Only the
+// first call has an effect, so a deferred Settle(0) releases requests that
+// never got a response.
+func (r *SpendReservation) Settle(actual float64) {
+	if r == nil || r.keys == nil {
+		return
+	}
+	s := r.keys
+	r.keys = nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[r.id]
+	if !ok {
+		return
+	}
+	k.reserved = max(k.reserved-r.usd, 0)
+	if actual > 0 {
+		k.SpentUSD += actual
+		s.dirty = true
+	}
+}
+
+// save writes every key to the file, replacing it atomically. Callers hold mu.
+func (s *VirtualKeys) save() error {
+	if s.path == "" {
+		return nil
+	}
+	f := virtualKeyFile{VirtualKeys: make([]*VirtualKey, 0, len(s.keys))}
+	for _, k := range s.keys {
+		f.VirtualKeys = append(f.VirtualKeys, k)
+	}
+	sort.Slice(f.VirtualKeys, func(i, j int) bool { return f.VirtualKeys[i].ID < f.VirtualKeys[j].ID })
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := guardrails.WriteFileAtomic(s.path, data); err != nil {
+		return fmt.Errorf("auth: virtual keys: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
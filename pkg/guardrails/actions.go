@@ -0,0 +1,185 @@
+package guardrails
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Actions that can run when a detection rule triggers.
+const (
+	ActionWarn             = "warn"              // log, set X-Guardrail-Warning and continue
+	ActionThrottle         = "throttle"          // delay the request by throttle_ms and continue
+	ActionStripTools       = "strip_tools"       // remove the offending tools from the request and continue
+	ActionBlock            = "block"             // reject the request with 429
+	ActionTerminateSession = "terminate_session" // block, drop the session and reject its ID for the cool-down
+	ActionAlertWebhook     = "alert_webhook"     // send the violation to the alert webhook
+	ActionSaveReplay       = "save_replay"       // write a replay bundle of the whole session
+
+	// ActionBlockToolExecution is the original name of ActionBlock.
+	ActionBlockToolExecution = "block_tool_execution"
+)
+
+// defaultActions preserve the gateway's behaviour before actions were
+// configurable: block, alert and forget the session.
+var defaultActions = []string{ActionBlock, ActionAlertWebhook, ActionTerminateSession}
+
+// Defaults for configs built without LoadConfig.
+const (
+	defaultThrottleMS = 2000
+	DefaultReplayDir  = "./replays"
+)
+
+var knownActions = map[string]bool{
+	ActionWarn: true, ActionThrottle: true, ActionStripTools: true, ActionBlock: true,
+	ActionTerminateSession: true, ActionAlertWebhook: true, ActionSaveReplay: true,
+	ActionBlockToolExecution: true,
+}
+
+// validate reports unknown action and rule names.
+func (c *ActionsConfig) validate(v *validator) {
+	check := func(path []string, actions []string) {
+		for i, a := range actions {
+			if !knownActions[a] {
+				v.errorf(at(path, i), "unknown action %q", a)
+			}
+		}
+	}
+	check(at("actions", "on_trigger"), c.OnTrigger)
+	for _, rule := range sortedKeys(c.Rules) {
+		if !knownRules[rule] {
+			v.errorf(at("actions", "rules", rule), "unknown rule %q", rule)
+		}
+		check(at("actions", "rules", rule), c.Rules[rule])
+	}
+	v.nonNegative(at("actions", "throttle_ms"), float64(c.ThrottleMS))
+	v.nonNegative(at("actions", "cooldown_minutes"), float64(c.CooldownMinutes))
+}
+
+// ActionPlan is what the gateway must do about one violation.
+type ActionPlan struct {
+	Actions []string // the actions that apply, in configured order
+
+	Block      bool
+	Warn       bool
+	Throttle   time.Duration
+	StripTools []string // tools to remove from the request
+	Terminate  bool
+	Cooldown   time.Duration // how long a terminated session ID is rejected
+	Alert      bool
+	SaveReplay bool
+}
+
+// PlanActions resolves the actions for a violation: the rule's own list if
+// actions.rules has one, else actions.on_trigger, else block, alert and
+// terminate. A plan without block or terminate_session lets the request
+// continue.
+func PlanActions(cfg *Config, v *Violation) *ActionPlan {
+	actions := defaultActions
+	if cfg != nil {
+		if list, ok := cfg.Actions.Rules[v.Rule]; ok {
+			actions = list
+		} else if len(cfg.Actions.OnTrigger) > 0 {
+			actions = cfg.Actions.OnTrigger
+		}
+	}
+
+	plan := &ActionPlan{}
+	for _, a := range actions {
+		switch a {
+		case ActionWarn:
+			plan.Warn = true
+		case ActionThrottle:
+			ms := defaultThrottleMS
+			if cfg != nil && cfg.Actions.ThrottleMS > 0 {
+				ms = cfg.Actions.ThrottleMS
+			}
+			plan.Throttle = time.Duration(ms) * time.Millisecond
+		case ActionStripTools:
+			if tool, ok := v.Details["tool_name"].(string); ok && tool != "" {
+				plan.StripTools = append(plan.StripTools, tool)
+			}
+		case ActionBlock, ActionBlockToolExecution:
+			plan.Block = true
+			a = ActionBlock
+		case ActionTerminateSession:
+			plan.Block = true
+			plan.Terminate = true
+			if cfg != nil {
+				plan.Cooldown = time.Duration(cfg.Actions.CooldownMinutes) * time.Minute
+			}
+		case ActionAlertWebhook:
+			plan.Alert = true
+		case ActionSaveReplay:
+			plan.SaveReplay = true
+		default:
+			continue
+		}
+		plan.Actions = append(plan.Actions, a)
+	}
+	return plan
+}
+
+// StripTools removes the named tools from a request's tool definitions. A
+// tool_choice that forces one of them is dropped so the provider does not
+// reject the request. Returns the body unchanged if nothing was removed.
+func StripTools(body []byte, tools []string) []byte {
+	if len(tools) == 0 {
+		return body
+	}
+	strip := make(map[string]bool, len(tools))
+	for _, t := range tools {
+		strip[t] = true
+	}
+
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return body
+	}
+	var defs []json.RawMessage
+	if err := json.Unmarshal(req["tools"], &defs); err != nil {
+		return body
+	}
+
+	var kept []json.RawMessage
+	for _, raw := range defs {
+		if !strip[toolName(raw)] {
+			kept = append(kept, raw)
+		}
+	}
+	if len(kept) == len(defs) {
+		return body
+	}
+	if len(kept) == 0 {
+		delete(req, "tools")
+		delete(req, "tool_choice")
+	} else {
+		req["tools"], _ = json.Marshal(kept)
+		if choice, ok := req["tool_choice"]; ok && strip[toolName(choice)] {
+			delete(req, "tool_choice")
+		}
+	}
+
+	modified, err := marshalNoEscape(req)
+	if err != nil {
+		return body
+	}
+	return modified
+}
+
+// toolName returns the name in a tool definition or tool_choice object:
+// function.name for OpenAI, name for Anthropic and the Responses API.
+func toolName(raw json.RawMessage) string {
+	var tool struct {
+		Name     string `json:"name"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(raw, &tool); err != nil {
+		return ""
+	}
+	if tool.Function.Name != "" {
+		return tool.Function.Name
+	}
+	return tool.Name
+}
@@ -0,0 +1,103 @@
+package guardrails
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanActionsDefaultsAndOverrides(t *testing.T) {
+	storm := &Violation{Rule: "tool_retry_storm", Details: map[string]interface{}{"tool_name": "search"}}
+
+	plan := PlanActions(&Config{}, storm)
+	if !plan.Block || !plan.Terminate || !plan.Alert {
+		t.Errorf("default plan = %+v, want block, terminate and alert", plan)
+	}
+
+	cfg := &Config{Actions: ActionsConfig{
+		OnTrigger:       []string{ActionBlockToolExecution, ActionSaveReplay},
+		Rules:           map[string][]string{"tool_retry_storm": {ActionWarn, ActionStripTools, ActionThrottle}},
+		ThrottleMS:      250,
+		CooldownMinutes: 10,
+	}}
+	plan = PlanActions(cfg, storm)
+	if plan.Block || !plan.Warn || plan.Throttle != 250*time.Millisecond {
+		t.Errorf("per-rule plan = %+v", plan)
+	}
+	if !reflect.DeepEqual(plan.StripTools, []string{"search"}) {
+		t.Errorf("StripTools = %v", plan.StripTools)
+	}
+
+	plan = PlanActions(cfg, &Violation{Rule: "prompt_loop"})
+	if !plan.Block || !plan.SaveReplay || plan.Terminate {
+		t.Errorf("on_trigger plan = %+v", plan)
+	}
+	if !reflect.DeepEqual(plan.Actions, []string{ActionBlock, ActionSaveReplay}) {
+		t.Errorf("Actions = %v, want the alias recorded as block", plan.Actions)
+	}
+
+	cfg.Actions.Rules["prompt_loop"] = []string{ActionTerminateSession}
+	if plan = PlanActions(cfg, &Violation{Rule: "prompt_loop"}); !plan.Block || plan.Cooldown != 10*time.Minute {
+		t.Errorf("terminate plan = %+v", plan)
+	}
+}
+
+func TestStripTools(t *testing.T) {
+	body := []byte(`{"model":"gpt-4o","tools":[{"type":"function","function":{"name":"search"}},{"type":"function","function":{"name":"lookup"}}],"tool_choice":{"type":"function","function":{"name":"search"}}}`)
+
+	got := string(StripTools(body, []string{"search"}))
+	if strings.Contains(got, `"search"`) || !strings.Contains(got, `"lookup"`) || strings.Contains(got, "tool_choice") {
+		t.Errorf("stripped = %s", got)
+	}
+
+	got = string(StripTools(body, []string{"search", "lookup"}))
+	if got != `{"model":"gpt-4o"}` {
+		t.Errorf("all stripped = %s", got)
+	}
+
+	if got := StripTools(body, []string{"missing"}); string(got) != string(body) {
+		t.Errorf("unknown tool changed the body: %s", got)
+	}
+}
+
+func TestTerminateCooldown(t *testing.T) {
+	mgr := NewManager(time.Minute)
+	mgr.GetOrCreate("s1")
+	mgr.RecordRun("s1", "run-1")
+	if runs := mgr.SessionRuns("s1"); !reflect.DeepEqual(runs, []string{"run-1"}) {
+		t.Errorf("SessionRuns = %v", runs)
+	}
+
+	mgr.Terminate("s1", time.Minute)
+	if mgr.GetSessionTokens("s1") != 0 || mgr.SessionRuns("s1") != nil {
+		t.Error("terminated session still has state")
+	}
+	if remaining, ok := mgr.Cooldown("s1"); !ok || remaining <= 0 {
+		t.Errorf("Cooldown = %v, %v", remaining, ok)
+	}
+
+	mgr.Terminate("s2", 0)
+	if _, ok := mgr.Cooldown("s2"); ok {
+		t.Error("zero cool-down should not reject the session")
+	}
+}
+
+func TestLoadConfigValidatesActions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "guardrails.yaml")
+	os.WriteFile(path, []byte("actions:\n  rules:\n    prompt_loop: [warn, explode]\n"), 0644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("expected an error for an unknown action")
+	}
+
+	os.WriteFile(path, []byte("actions:\n  on_trigger: [block, alert_webhook]\n"), 0644)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Actions.ThrottleMS != defaultThrottleMS || cfg.Actions.ReplayDir != DefaultReplayDir {
+		t.Errorf("defaults = %+v", cfg.Actions)
+	}
+}
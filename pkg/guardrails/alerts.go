@@ -78,12 +78,18 @@ func ruleDisplayName(rule string) string {
 	switch rule {
 	case "token_budget":
 		return "Token Budget Exceeded"
+	case "cost_budget":
+		return "Session Cost Budget Exceeded"
 	case "prompt_loop":
 		return "Prompt Loop Detection"
 	case "tool_retry_storm":
 		return "Tool Retry Storm"
 	case "error_spiral":
 		return "Error Retry Spiral"
+	case "output_policy":
+		return "Output Policy Violation"
+	case "tool_argument":
+		return "Tool Argument Policy Violation"
 	default:
 		return rule
 	}
@@ -72,15 +72,72 @@ func percentileIndex(n, pct int) int {
 // PerformanceTracker aggregates per-model performance metrics in memory.
 // Thread-safe via RWMutex. Stats reset on gateway restart.
 type PerformanceTracker struct {
-	mu     sync.RWMutex
-	models map[string]*ModelStats
+	mu        sync.RWMutex
+	models    map[string]*ModelStats
+	detectors map[[2]string]*DetectorStats // keyed by stage and detector
+}
+
+// DetectorStats counts how often one PII or secret detector matched, so
+// operators can tune noisy patterns.
+type DetectorStats struct {
+	Detector string    `json:"detector"`
+	Stage    string    `json:"stage"`    // "request" or "response"
+	Matches  int64     `json:"matches"`  // total matches
+	Requests int64     `json:"requests"` // requests with at least one match
+	LastSeen time.Time `json:"last_seen"`
 }
 
 // NewPerformanceTracker creates a new empty tracker.
 func NewPerformanceTracker() *PerformanceTracker {
 	return &PerformanceTracker{
-		models: make(map[string]*ModelStats),
+		models:    make(map[string]*ModelStats),
+		detectors: make(map[[2]string]*DetectorStats),
+	}
+}
+
+// RecordDetections records one request's detector matches at a stage.
+// counts maps detector name to number of matches.
+func (pt *PerformanceTracker) RecordDetections(stage string, counts map[string]int) {
+	if len(counts) == 0 {
+		return
 	}
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	now := time.Now()
+	for name, n := range counts {
+		if n <= 0 {
+			continue
+		}
+		key := [2]string{stage, name}
+		ds, ok := pt.detectors[key]
+		if !ok {
+			ds = &DetectorStats{Detector: name, Stage: stage}
+			pt.detectors[key] = ds
+		}
+		ds.Matches += int64(n)
+		ds.Requests++
+		ds.LastSeen = now
+	}
+}
+
+// GetDetectorStats returns copies of all detector stats, ordered by stage
+// and detector name.
+func (pt *PerformanceTracker) GetDetectorStats() []DetectorStats {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+
+	result := make([]DetectorStats, 0, len(pt.detectors))
+	for _, ds := range pt.detectors {
+		result = append(result, *ds)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Stage != result[j].Stage {
+			return result[i].Stage < result[j].Stage
+		}
+		return result[i].Detector < result[j].Detector
+	})
+	return result
 }
 
 // RecordCall records metrics for a completed LLM call.
@@ -26,15 +26,39 @@ type ApprovalResponse struct {
 	Reason   string `json:"reason,omitempty"`
 }
 
+// Approval decision sources.
+const (
+	ApprovalDisabled    = "disabled"     // approval is off; everything is allowed
+	ApprovalNotRequired = "not_required" // the rule is not in cfg.Rules; the default block applies
+	ApprovalWebhook     = "webhook"      // the approver decided
+	ApprovalFallback    = "fallback"     // the webhook failed; cfg.FallbackAllow applied
+)
+
+// ApprovalDecision is the outcome of an approval request and how it was
+// reached.
+type ApprovalDecision struct {
+	Approved bool
+	Reason   string // the approver's reason, or why the fallback applied
+	Source   string // ApprovalDisabled, ApprovalNotRequired, ApprovalWebhook or ApprovalFallback
+}
+
 // RequestApproval sends a violation to the approval webhook and waits for a decision.
 // Returns (approved, error).
 //
 // If approval is disabled, returns (true, nil) — everything is allowed.
-// If the webhook is unreachable or times out, returns (cfg.FallbackAllow, nil).
+// If the webhook is unreachable, times out or has no URL, returns
+// (cfg.FallbackAllow, nil).
 // Only rules listed in cfg.Rules trigger the approval flow.
 func RequestApproval(ctx context.Context, cfg ApprovalConfig, v *Violation) (bool, error) {
-	if !cfg.Enabled || cfg.WebhookURL == "" {
-		return true, nil // approval disabled, fall through
+	d, err := DecideApproval(ctx, cfg, v)
+	return d.Approved, err
+}
+
+// DecideApproval is RequestApproval with the approver's reason and the
+// source of the decision, for the audit record.
+func DecideApproval(ctx context.Context, cfg ApprovalConfig, v *Violation) (ApprovalDecision, error) {
+	if !cfg.Enabled {
+		return ApprovalDecision{Approved: true, Source: ApprovalDisabled}, nil // approval disabled, fall through
 	}
 
 	// Check if this rule requires approval.
@@ -47,9 +71,16 @@ func RequestApproval(ctx context.Context, cfg ApprovalConfig, v *Violation) (boo
 			}
 		}
 		if !needsApproval {
-			return false, nil // rule not in approval list, use default block
+			return ApprovalDecision{Source: ApprovalNotRequired}, nil // rule not in approval list, use default block
 		}
 	}
+	fallback := func(reason string) ApprovalDecision {
+		return ApprovalDecision{Approved: cfg.FallbackAllow, Reason: reason, Source: ApprovalFallback}
+	}
+	if cfg.WebhookURL == "" {
+		log.Printf("[approval] no webhook_url configured (fallback: %v)", cfg.FallbackAllow)
+		return fallback("no webhook_url configured"), nil
+	}
 
 	req := ApprovalRequest{
 		SessionID:   v.SessionID,
@@ -63,7 +94,7 @@ func RequestApproval(ctx context.Context, cfg ApprovalConfig, v *Violation) (boo
 	body, err := json.Marshal(req)
 	if err != nil {
 		log.Printf("[approval] marshal error: %v", err)
-		return cfg.FallbackAllow, err
+		return fallback("marshal error: " + err.Error()), err
 	}
 
 	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
@@ -77,7 +108,7 @@ func RequestApproval(ctx context.Context, cfg ApprovalConfig, v *Violation) (boo
 	httpReq, err := http.NewRequestWithContext(timeoutCtx, "POST", cfg.WebhookURL, bytes.NewReader(body))
 	if err != nil {
 		log.Printf("[approval] request creation error: %v", err)
-		return cfg.FallbackAllow, nil
+		return fallback("request creation error: " + err.Error()), nil
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
 
@@ -85,14 +116,14 @@ func RequestApproval(ctx context.Context, cfg ApprovalConfig, v *Violation) (boo
 	resp, err := client.Do(httpReq)
 	if err != nil {
 		log.Printf("[approval] webhook error: %v (fallback: %v)", err, cfg.FallbackAllow)
-		return cfg.FallbackAllow, nil
+		return fallback("webhook error: " + err.Error()), nil
 	}
 	defer resp.Body.Close()
 
 	var approval ApprovalResponse
 	if err := json.NewDecoder(resp.Body).Decode(&approval); err != nil {
 		log.Printf("[approval] decode error: %v (fallback: %v)", err, cfg.FallbackAllow)
-		return cfg.FallbackAllow, nil
+		return fallback("decode error: " + err.Error()), nil
 	}
 
 	if approval.Approved {
@@ -101,5 +132,5 @@ func RequestApproval(ctx context.Context, cfg ApprovalConfig, v *Violation) (boo
 		log.Printf("[approval] DENIED: session=%s rule=%s reason=%s", v.SessionID, v.Rule, approval.Reason)
 	}
 
-	return approval.Approved, nil
+	return ApprovalDecision{Approved: approval.Approved, Reason: approval.Reason, Source: ApprovalWebhook}, nil
 }
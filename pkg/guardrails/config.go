@@ -1,6 +1,9 @@
 package guardrails
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"os"
 
 	"gopkg.in/yaml.v3"
@@ -9,12 +12,21 @@ import (
 // Config holds all guardrail thresholds and alert settings.
 // If nil, guardrails are disabled and the gateway operates normally.
 type Config struct {
-	Budgets         BudgetConfig     `yaml:"budgets"`
-	LoopDetection   LoopConfig       `yaml:"loop_detection"`
-	ToolProtection  ToolConfig       `yaml:"tool_protection"`
-	RetryProtection RetryConfig      `yaml:"retry_protection"`
-	Alerts          AlertConfig      `yaml:"alerts"`
-	Actions         ActionsConfig    `yaml:"actions"`
+	// Mode "shadow" evaluates every rule without enforcing any, see shadow.go.
+	// Each rule section also accepts its own mode.
+	Mode string `yaml:"mode"`
+
+	Budgets         BudgetConfig       `yaml:"budgets"`
+	Pricing         PricingConfig      `yaml:"pricing"`
+	LoopDetection   LoopConfig         `yaml:"loop_detection"`
+	ToolProtection  ToolConfig         `yaml:"tool_protection"`
+	RetryProtection RetryConfig        `yaml:"retry_protection"`
+	Alerts          AlertConfig        `yaml:"alerts"`
+	Actions         ActionsConfig      `yaml:"actions"`
+	Root            DetectionRules     `yaml:"root"`        // limits for a whole session tree, see tree.go
+	TraceRoots      bool               `yaml:"trace_roots"` // group sessions without X-Parent-Session-ID by W3C trace
+	RateLimits      RateLimitConfig    `yaml:"rate_limits"` // RPM and TPM limits, see ratelimit.go
+	Profiles        map[string]Profile `yaml:"profiles"`    // per-key overrides, see profile.go
 	Prevention      PreventionConfig   `yaml:"prevention"`
 	Optimization    OptimizationConfig `yaml:"optimization"`
 	Trust           TrustConfig        `yaml:"trust"`
@@ -52,17 +64,23 @@ type RouterConfig struct {
 // PreventionConfig holds policy enforcement settings.
 // Prevention runs before detection and can modify or block requests.
 type PreventionConfig struct {
-	Tools       ToolFilterConfig `yaml:"tools"`
-	PII         PIIConfig        `yaml:"pii"`
-	ModelLimits ModelLimitConfig `yaml:"model_limits"`
-	Approval    ApprovalConfig   `yaml:"approval"`
+	Tools       ToolFilterConfig   `yaml:"tools"`
+	PII         PIIConfig          `yaml:"pii"`
+	ModelLimits ModelLimitConfig   `yaml:"model_limits"`
+	Approval    ApprovalConfig     `yaml:"approval"`
+	Output      OutputPolicyConfig `yaml:"output"`    // scans responses, see output.go
+	Injection   InjectionConfig    `yaml:"injection"` // prompt-injection scoring, see injection.go
 }
 
 // ToolFilterConfig controls which tools agents can use.
 type ToolFilterConfig struct {
 	Enabled   bool     `yaml:"enabled"`
+	Mode      string   `yaml:"mode"`      // "enforce" (default) or "shadow"
 	Allowlist []string `yaml:"allowlist"` // if set, only these tools allowed
 	Blocklist []string `yaml:"blocklist"` // if allowlist empty, block these
+
+	// Rules constrain the arguments of tool calls, see toolargs.go.
+	Rules []ToolArgRule `yaml:"rules"`
 }
 
 // PIIConfig controls PII detection and handling in prompts.
@@ -72,12 +90,22 @@ type PIIConfig struct {
 	BlockCC    bool   `yaml:"block_cc"`
 	BlockEmail bool   `yaml:"block_email"`
 	BlockPhone bool   `yaml:"block_phone"`
-	RedactMode string `yaml:"redact_mode"` // "block" or "redact"
+	RedactMode string `yaml:"redact_mode"` // "block", "redact" or "tokenize"
+	Mode       string `yaml:"mode"`        // "enforce" (default) or "shadow"
+
+	// TokenTTLSeconds is how long an idle session's tokenize mappings are kept.
+	TokenTTLSeconds int `yaml:"token_ttl_seconds"`
+
+	// Detectors adds built-in or custom detectors, see detectors.go.
+	Detectors []DetectorConfig `yaml:"detectors"`
+
+	compiled []detector // compiled Detectors, set by LoadConfig
 }
 
 // ModelLimitConfig controls cost-based model downgrading.
 type ModelLimitConfig struct {
 	Enabled          bool               `yaml:"enabled"`
+	Mode             string             `yaml:"mode"` // "enforce" (default) or "shadow"
 	CostPerMToken    map[string]float64 `yaml:"cost_per_mtoken"`
 	CostThresholdUSD float64            `yaml:"cost_threshold_usd"`
 	DowngradeMap     map[string]string  `yaml:"downgrade_map"`
@@ -88,7 +116,7 @@ type ApprovalConfig struct {
 	Enabled        bool     `yaml:"enabled"`
 	WebhookURL     string   `yaml:"webhook_url"`
 	TimeoutSeconds int      `yaml:"timeout_seconds"`
-	Rules          []string `yaml:"rules"`         // which rules require approval
+	Rules          []string `yaml:"rules"`          // which rules require approval
 	FallbackAllow  bool     `yaml:"fallback_allow"` // true = allow on timeout
 }
 
@@ -96,6 +124,7 @@ type ApprovalConfig struct {
 type BudgetConfig struct {
 	MaxSessionTokens  int     `yaml:"max_session_tokens"`
 	MaxSessionCostUSD float64 `yaml:"max_session_cost_usd"`
+	Mode              string  `yaml:"mode"` // "enforce" (default) or "shadow"
 }
 
 // LoopConfig controls prompt loop detection.
@@ -103,17 +132,20 @@ type LoopConfig struct {
 	SimilarPromptThreshold float64 `yaml:"similar_prompt_threshold"`
 	MaxSimilarPrompts      int     `yaml:"max_similar_prompts"`
 	WindowSeconds          int     `yaml:"window_seconds"`
+	Mode                   string  `yaml:"mode"` // "enforce" (default) or "shadow"
 }
 
 // ToolConfig controls tool retry storm detection.
 type ToolConfig struct {
-	MaxRepeatCalls      int `yaml:"max_repeat_calls"`
-	RepeatWindowSeconds int `yaml:"repeat_window_seconds"`
+	MaxRepeatCalls      int    `yaml:"max_repeat_calls"`
+	RepeatWindowSeconds int    `yaml:"repeat_window_seconds"`
+	Mode                string `yaml:"mode"` // "enforce" (default) or "shadow"
 }
 
 // RetryConfig controls error retry spiral detection.
 type RetryConfig struct {
-	MaxConsecutiveErrors int `yaml:"max_consecutive_errors"`
+	MaxConsecutiveErrors int    `yaml:"max_consecutive_errors"`
+	Mode                 string `yaml:"mode"` // "enforce" (default) or "shadow"
 }
 
 // AlertConfig controls where alerts are sent.
@@ -121,9 +153,15 @@ type AlertConfig struct {
 	WebhookURL string `yaml:"webhook_url"`
 }
 
-// ActionsConfig controls what happens when a guardrail triggers.
+// ActionsConfig controls what happens when a detection rule triggers.
+// See actions.go for the available actions.
 type ActionsConfig struct {
-	OnTrigger []string `yaml:"on_trigger"`
+	OnTrigger []string            `yaml:"on_trigger"` // default for every rule
+	Rules     map[string][]string `yaml:"rules"`      // per-rule overrides, e.g. prompt_loop: [warn]
+
+	ThrottleMS      int    `yaml:"throttle_ms"`      // delay applied by throttle
+	CooldownMinutes int    `yaml:"cooldown_minutes"` // terminate_session rejects the ID this long; 0 = no cool-down
+	ReplayDir       string `yaml:"replay_dir"`       // where save_replay writes session bundles
 }
 
 // LoadConfig reads a guardrails YAML file. Returns nil if path is empty
@@ -137,18 +175,50 @@ func LoadConfig(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	return ParseConfig(data)
+}
 
-	cfg := &Config{}
-	if err := yaml.Unmarshal(data, cfg); err != nil {
+// ParseConfig strictly decodes and validates guardrails YAML. Unknown
+// fields and invalid values are all reported together as ConfigErrors,
+// each with its line number.
+func ParseConfig(data []byte) (*Config, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
 		return nil, err
 	}
 
+	cfg := &Config{}
+	v := &validator{root: &root}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, err
+		}
+		v.typeErrors(typeErr)
+	}
+
 	// Apply defaults for any unset values
 	applyDefaults(cfg)
 
+	v.check(cfg)
+	if len(v.errs) > 0 {
+		return nil, v.sorted()
+	}
 	return cfg, nil
 }
 
+// Validate checks a config built in code and compiles its patterns.
+func (c *Config) Validate() error {
+	v := &validator{}
+	v.check(c)
+	if len(v.errs) > 0 {
+		return v.sorted()
+	}
+	return nil
+}
+
 func applyDefaults(cfg *Config) {
 	if cfg.Budgets.MaxSessionTokens == 0 {
 		cfg.Budgets.MaxSessionTokens = 80000
@@ -172,11 +242,43 @@ func applyDefaults(cfg *Config) {
 		cfg.RetryProtection.MaxConsecutiveErrors = 3
 	}
 
+	// Root-level rules are off unless configured; fill in the thresholds
+	// that only qualify a limit.
+	if root := &cfg.Root; root.LoopDetection.MaxSimilarPrompts > 0 {
+		if root.LoopDetection.SimilarPromptThreshold == 0 {
+			root.LoopDetection.SimilarPromptThreshold = cfg.LoopDetection.SimilarPromptThreshold
+		}
+		if root.LoopDetection.WindowSeconds == 0 {
+			root.LoopDetection.WindowSeconds = cfg.LoopDetection.WindowSeconds
+		}
+	}
+	if root := &cfg.Root; root.ToolProtection.MaxRepeatCalls > 0 && root.ToolProtection.RepeatWindowSeconds == 0 {
+		root.ToolProtection.RepeatWindowSeconds = cfg.ToolProtection.RepeatWindowSeconds
+	}
+
+	if cfg.Actions.ThrottleMS == 0 {
+		cfg.Actions.ThrottleMS = defaultThrottleMS
+	}
+	if cfg.Actions.ReplayDir == "" {
+		cfg.Actions.ReplayDir = DefaultReplayDir
+	}
+
+	applyPricingDefaults(&cfg.Pricing)
+
 	// Prevention defaults
 	if cfg.Prevention.PII.RedactMode == "" {
 		cfg.Prevention.PII.RedactMode = "redact"
 	}
+	if cfg.Prevention.PII.TokenTTLSeconds == 0 {
+		cfg.Prevention.PII.TokenTTLSeconds = 1800
+	}
 	if cfg.Prevention.Approval.TimeoutSeconds == 0 {
 		cfg.Prevention.Approval.TimeoutSeconds = 30
 	}
+	if cfg.Prevention.Output.Action == "" {
+		cfg.Prevention.Output.Action = OutputRedact
+	}
+	if cfg.Prevention.Output.StreamMode == "" {
+		cfg.Prevention.Output.StreamMode = StreamIncremental
+	}
 }
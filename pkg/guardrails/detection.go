@@ -23,60 +23,89 @@ type Violation struct {
 // Evaluate runs all detection rules against the current session state.
 // Returns a Violation if any rule triggers, or nil if everything is normal.
 // The session must already exist in the manager (call GetOrCreate first).
+// Rules in shadow mode never trigger here, see EvaluateWithShadow.
 func Evaluate(cfg *Config, mgr *Manager, sessionID string, req *EvalRequest) *Violation {
+	v, _ := EvaluateWithShadow(cfg, mgr, sessionID, req)
+	return v
+}
+
+// EvaluateWithShadow is Evaluate that also returns the violations of rules in
+// shadow mode, which do not stop later rules from being evaluated.
+func EvaluateWithShadow(cfg *Config, mgr *Manager, sessionID string, req *EvalRequest) (*Violation, []*Violation) {
 	if cfg == nil {
-		return nil
+		return nil, nil
 	}
 
-	mgr.mu.Lock()
-	s, ok := mgr.sessions[sessionID]
-	if !ok {
-		mgr.mu.Unlock()
-		return nil
+	s := mgr.session(sessionID)
+	if s == nil {
+		return nil, nil
 	}
 
-	// Copy the values we need while holding the lock, then release
-	totalTokens := s.TotalTokens
-	consecutiveErrors := s.ConsecutiveErrors
-	promptHistory := make([]promptEntry, len(s.PromptHistory))
-	copy(promptHistory, s.PromptHistory)
-	toolCalls := make(map[string][]time.Time)
-	for k, v := range s.ToolCalls {
-		cp := make([]time.Time, len(v))
-		copy(cp, v)
-		toolCalls[k] = cp
+	// The store hands out a copy, so the rules can read it without locking.
+	now := time.Now()
+	state := detectionState{
+		tokens:      s.TotalTokens,
+		cost:        s.TotalCostUSD,
+		extraTokens: s.Boost.tokens(now),
+		extraCost:   s.Boost.cost(now),
+		errors:      s.ConsecutiveErrors,
+		prompts:     s.PromptHistory,
+		toolCalls:   s.ToolCalls,
 	}
-	mgr.mu.Unlock()
 
-	// Rule 1: Token budget
-	if v := checkTokenBudget(cfg, sessionID, totalTokens); v != nil {
-		return v
+	var shadowed []*Violation
+	for _, rule := range state.rules(cfg.leafRules(), sessionID, req) {
+		v := rule()
+		if v == nil {
+			continue
+		}
+		if cfg.Shadowed(v.Rule) {
+			shadowed = append(shadowed, v)
+			continue
+		}
+		return v, shadowed
 	}
 
-	// Rule 2: Prompt loop
-	if v := checkPromptLoop(cfg, sessionID, promptHistory, req.PromptText); v != nil {
-		return v
-	}
+	// Root-level rules, see tree.go.
+	v, treeShadowed := evaluateTree(cfg, mgr, sessionID, req)
+	return v, append(shadowed, treeShadowed...)
+}
 
-	// Rule 3: Tool retry storm
-	if v := checkToolRetryStorm(cfg, sessionID, toolCalls, req.ToolNames); v != nil {
-		return v
-	}
+// detectionState is what the detection rules read of a session or tree.
+type detectionState struct {
+	tokens, extraTokens int
+	cost, extraCost     float64
+	errors              int
+	prompts             []promptEntry
+	toolCalls           map[string][]time.Time
+}
 
-	// Rule 4: Error retry spiral
-	if v := checkErrorSpiral(cfg, sessionID, consecutiveErrors); v != nil {
-		return v
+// rules returns the detection rules in evaluation order.
+func (st detectionState) rules(r DetectionRules, sessionID string, req *EvalRequest) []func() *Violation {
+	return []func() *Violation{
+		// Rule 1: Token budget
+		func() *Violation { return checkTokenBudget(r.Budgets, sessionID, st.tokens, st.extraTokens) },
+		// Rule 1b: Cost budget
+		func() *Violation { return checkCostBudget(r.Budgets, sessionID, st.cost, st.extraCost) },
+		// Rule 2: Prompt loop
+		func() *Violation { return checkPromptLoop(r.LoopDetection, sessionID, st.prompts, req.PromptText) },
+		// Rule 3: Tool retry storm
+		func() *Violation {
+			return checkToolRetryStorm(r.ToolProtection, sessionID, st.toolCalls, req.ToolNames)
+		},
+		// Rule 4: Error retry spiral
+		func() *Violation { return checkErrorSpiral(r.RetryProtection, sessionID, st.errors) },
 	}
-
-	return nil
 }
 
-// checkTokenBudget triggers if a session exceeds its token limit.
-func checkTokenBudget(cfg *Config, sessionID string, totalTokens int) *Violation {
-	max := cfg.Budgets.MaxSessionTokens
+// checkTokenBudget triggers if a session exceeds its token limit, raised by
+// extra while an admin budget raise is active.
+func checkTokenBudget(b BudgetConfig, sessionID string, totalTokens, extra int) *Violation {
+	max := b.MaxSessionTokens
 	if max <= 0 {
 		return nil
 	}
+	max += extra
 
 	if totalTokens >= max {
 		return &Violation{
@@ -92,11 +121,34 @@ func checkTokenBudget(cfg *Config, sessionID string, totalTokens int) *Violation
 	return nil
 }
 
+// checkCostBudget triggers if a session's priced spend reaches its USD limit,
+// raised by extra while an admin budget raise is active.
+func checkCostBudget(b BudgetConfig, sessionID string, totalCost, extra float64) *Violation {
+	max := b.MaxSessionCostUSD
+	if max <= 0 {
+		return nil
+	}
+	max += extra
+
+	if totalCost >= max {
+		return &Violation{
+			Rule:      "cost_budget",
+			Message:   fmt.Sprintf("Session halted: cost budget exceeded ($%.4f / $%.2f).", totalCost, max),
+			SessionID: sessionID,
+			Details: map[string]interface{}{
+				"total_cost_usd": totalCost,
+				"max_cost_usd":   max,
+			},
+		}
+	}
+	return nil
+}
+
 // checkPromptLoop triggers if the last N prompts are too similar.
-func checkPromptLoop(cfg *Config, sessionID string, history []promptEntry, currentPrompt string) *Violation {
-	threshold := cfg.LoopDetection.SimilarPromptThreshold
-	maxSimilar := cfg.LoopDetection.MaxSimilarPrompts
-	windowSec := cfg.LoopDetection.WindowSeconds
+func checkPromptLoop(lc LoopConfig, sessionID string, history []promptEntry, currentPrompt string) *Violation {
+	threshold := lc.SimilarPromptThreshold
+	maxSimilar := lc.MaxSimilarPrompts
+	windowSec := lc.WindowSeconds
 
 	if threshold <= 0 || maxSimilar <= 0 || currentPrompt == "" {
 		return nil
@@ -136,9 +188,9 @@ func checkPromptLoop(cfg *Config, sessionID string, history []promptEntry, curre
 
 // checkToolRetryStorm triggers if the same tool is called too many times
 // within a short window.
-func checkToolRetryStorm(cfg *Config, sessionID string, toolCalls map[string][]time.Time, currentTools []string) *Violation {
-	maxCalls := cfg.ToolProtection.MaxRepeatCalls
-	windowSec := cfg.ToolProtection.RepeatWindowSeconds
+func checkToolRetryStorm(tc ToolConfig, sessionID string, toolCalls map[string][]time.Time, currentTools []string) *Violation {
+	maxCalls := tc.MaxRepeatCalls
+	windowSec := tc.RepeatWindowSeconds
 
 	if maxCalls <= 0 || windowSec <= 0 {
 		return nil
@@ -165,8 +217,8 @@ func checkToolRetryStorm(cfg *Config, sessionID string, toolCalls map[string][]t
 				Message:   fmt.Sprintf("Session halted: tool '%s' called %d times in %d seconds.", tool, recentCount, windowSec),
 				SessionID: sessionID,
 				Details: map[string]interface{}{
-					"tool_name":     tool,
-					"call_count":    recentCount,
+					"tool_name":      tool,
+					"call_count":     recentCount,
 					"window_seconds": windowSec,
 				},
 			}
@@ -176,8 +228,8 @@ func checkToolRetryStorm(cfg *Config, sessionID string, toolCalls map[string][]t
 }
 
 // checkErrorSpiral triggers after too many consecutive upstream errors.
-func checkErrorSpiral(cfg *Config, sessionID string, consecutiveErrors int) *Violation {
-	maxErrors := cfg.RetryProtection.MaxConsecutiveErrors
+func checkErrorSpiral(rc RetryConfig, sessionID string, consecutiveErrors int) *Violation {
+	maxErrors := rc.MaxConsecutiveErrors
 	if maxErrors <= 0 {
 		return nil
 	}
@@ -0,0 +1,266 @@
+package guardrails
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Detector actions. An empty action follows the PII redact_mode.
+const (
+	DetectorRedact = "redact"
+	DetectorBlock  = "block"
+	DetectorFlag   = "flag" // report the match but leave it in place
+)
+
+// DetectorConfig configures one PII or secret detector from YAML. Exactly one
+// of Builtin or Pattern is set.
+type DetectorConfig struct {
+	Name        string `yaml:"name"`        // reported in AIR records, analytics and placeholders
+	Builtin     string `yaml:"builtin"`     // built-in type, see builtinDetectors
+	Pattern     string `yaml:"pattern"`     // custom regular expression
+	Replacement string `yaml:"replacement"` // defaults to the built-in's, or "[NAME]"
+	Action      string `yaml:"action"`      // "redact", "block" or "flag"
+}
+
+// detector is a compiled detector. validate, if set, rejects regex matches
+// that are not the real thing (e.g. digit runs failing the Luhn check).
+type detector struct {
+	name        string
+	kind        string // "pii", "secret" or "pattern"
+	re          *regexp.Regexp
+	validate    func(string) bool
+	replacement string
+	action      string
+}
+
+// builtinDetectors are the detectors available by name.
+var builtinDetectors = map[string]detector{
+	"ssn":         {kind: "pii", re: ssnRegex, replacement: "[SSN]"},
+	"credit_card": {kind: "pii", re: ccRegex, validate: luhnValid, replacement: "[CC]"},
+	"email":       {kind: "pii", re: emailRegex, replacement: "[EMAIL]"},
+	"phone":       {kind: "pii", re: phoneRegex, replacement: "[PHONE]"},
+	"iban": {kind: "pii", replacement: "[IBAN]", validate: ibanValid,
+		re: regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,3})?\b`)},
+	"uk_nino": {kind: "pii", replacement: "[NINO]", validate: ninoValid,
+		re: regexp.MustCompile(`\b[A-CEGHJ-PR-TW-Z][A-CEGHJ-NPR-TW-Z] ?\d{2} ?\d{2} ?\d{2} ?[A-D]\b`)},
+	"ip_address": {kind: "pii", replacement: "[IP]", validate: ipValid,
+		re: regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b|(?:[0-9A-Fa-f]{0,4}:){2,7}[0-9A-Fa-f]{0,4}`)},
+
+	"private_key": {kind: "secret", replacement: "[PRIVATE_KEY]",
+		re: regexp.MustCompile(`-----BEGIN (?:[A-Z]+ )*PRIVATE KEY-----(?:[\s\S]*?-----END (?:[A-Z]+ )*PRIVATE KEY-----)?`)},
+	"anthropic_key":  {kind: "secret", replacement: "[SECRET]", re: regexp.MustCompile(`\bsk-ant-[A-Za-z0-9_\-]{20,}`)},
+	"openai_key":     {kind: "secret", replacement: "[SECRET]", re: regexp.MustCompile(`\bsk-(?:proj-)?[A-Za-z0-9_\-]{20,}`)},
+	"aws_access_key": {kind: "secret", replacement: "[SECRET]", re: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	"gcp_api_key":    {kind: "secret", replacement: "[SECRET]", re: regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}\b`)},
+	"github_token":   {kind: "secret", replacement: "[SECRET]", re: regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`)},
+	"slack_token":    {kind: "secret", replacement: "[SECRET]", re: regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9\-]{10,}`)},
+	"jwt": {kind: "secret", replacement: "[JWT]",
+		re: regexp.MustCompile(`\beyJ[A-Za-z0-9_\-]+\.eyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]*`)},
+}
+
+// secretDetectorNames is the order secrets are checked in. anthropic_key runs
+// before openai_key so Anthropic keys are labelled as such.
+var secretDetectorNames = []string{
+	"private_key", "anthropic_key", "openai_key", "aws_access_key",
+	"gcp_api_key", "github_token", "slack_token", "jwt",
+}
+
+// builtin returns a named built-in detector.
+func builtin(name string) detector {
+	d := builtinDetectors[name]
+	d.name = name
+	return d
+}
+
+// secretDetectors returns the built-in secret detectors.
+func secretDetectors() []detector {
+	ds := make([]detector, 0, len(secretDetectorNames))
+	for _, name := range secretDetectorNames {
+		ds = append(ds, builtin(name))
+	}
+	return ds
+}
+
+// compileDetectors compiles detectors built in code, reporting the first
+// invalid one. Configs loaded from YAML go through validateDetectors.
+func compileDetectors(cfgs []DetectorConfig) ([]detector, error) {
+	v := &validator{}
+	ds := validateDetectors(v, at("detectors"), cfgs)
+	if len(v.errs) > 0 {
+		return nil, fmt.Errorf("guardrails: %w", v.errs[0])
+	}
+	return ds, nil
+}
+
+// validateDetectors reports every invalid detector and compiles the rest.
+func validateDetectors(v *validator, base []string, cfgs []DetectorConfig) []detector {
+	seen := make(map[string]bool, len(cfgs))
+	ds := make([]detector, 0, len(cfgs))
+	for i, c := range cfgs {
+		path := at(base, i)
+		if c.Name == "" {
+			v.errorf(at(path, "name"), "name is required")
+			continue
+		}
+		if seen[c.Name] {
+			v.errorf(at(path, "name"), "detector %q defined twice", c.Name)
+			continue
+		}
+		seen[c.Name] = true
+
+		var d detector
+		switch {
+		case c.Builtin != "" && c.Pattern != "":
+			v.errorf(path, "detector %q: set builtin or pattern, not both", c.Name)
+			continue
+		case c.Builtin != "":
+			b, ok := builtinDetectors[c.Builtin]
+			if !ok {
+				v.errorf(at(path, "builtin"), "unknown builtin %q", c.Builtin)
+				continue
+			}
+			d = b
+		case c.Pattern != "":
+			re, err := regexp.Compile(c.Pattern)
+			if err != nil {
+				v.errorf(at(path, "pattern"), "%v", err)
+				continue
+			}
+			d = detector{kind: "pattern", re: re, replacement: "[" + strings.ToUpper(c.Name) + "]"}
+		default:
+			v.errorf(path, "detector %q: builtin or pattern is required", c.Name)
+			continue
+		}
+
+		switch c.Action {
+		case "", DetectorRedact, DetectorBlock, DetectorFlag:
+		default:
+			v.errorf(at(path, "action"), "unknown action %q (want redact, block or flag)", c.Action)
+			continue
+		}
+
+		d.name = c.Name
+		d.action = c.Action
+		if c.Replacement != "" {
+			d.replacement = c.Replacement
+		}
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+// find returns the positions of valid matches in text.
+func (d detector) find(text string) [][]int {
+	matches := d.re.FindAllStringIndex(text, -1)
+	if d.validate == nil {
+		return matches
+	}
+	valid := matches[:0]
+	for _, m := range matches {
+		if d.validate(text[m[0]:m[1]]) {
+			valid = append(valid, m)
+		}
+	}
+	return valid
+}
+
+// apply replaces valid matches in text with replace(match), or with the
+// detector's replacement if replace is nil. Returns the new text and the
+// number of matches replaced.
+func (d detector) apply(text string, replace func(match string) string) (string, int) {
+	n := 0
+	out := d.re.ReplaceAllStringFunc(text, func(match string) string {
+		if d.validate != nil && !d.validate(match) {
+			return match
+		}
+		n++
+		if replace == nil {
+			return d.replacement
+		}
+		return replace(match)
+	})
+	return out, n
+}
+
+// digitsOnly strips everything but ASCII digits.
+func digitsOnly(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// luhnValid reports whether a card-number candidate passes the Luhn checksum.
+func luhnValid(s string) bool {
+	digits := digitsOnly(s)
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// ibanValid checks an IBAN's length and ISO 7064 mod-97 checksum.
+func ibanValid(s string) bool {
+	iban := strings.ReplaceAll(s, " ", "")
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+	var numeric strings.Builder
+	for _, r := range iban[4:] + iban[:4] {
+		switch {
+		case r >= '0' && r <= '9':
+			numeric.WriteRune(r)
+		case r >= 'A' && r <= 'Z':
+			fmt.Fprintf(&numeric, "%d", r-'A'+10)
+		default:
+			return false
+		}
+	}
+	n, ok := new(big.Int).SetString(numeric.String(), 10)
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+// ninoValid rejects National Insurance prefixes HMRC never issues.
+func ninoValid(s string) bool {
+	switch strings.ToUpper(s[:2]) {
+	case "BG", "GB", "NK", "KN", "TN", "NT", "ZZ":
+		return false
+	}
+	return true
+}
+
+// ipValid accepts well-formed IPv4 and IPv6 addresses. IPv6 candidates need
+// at least two groups and a digit, so "std::string" or "::" do not count.
+func ipValid(s string) bool {
+	if strings.Contains(s, ":") {
+		groups := 0
+		for _, g := range strings.Split(s, ":") {
+			if g != "" {
+				groups++
+			}
+		}
+		if groups < 2 || !strings.ContainsAny(s, "0123456789") {
+			return false
+		}
+	}
+	return net.ParseIP(s) != nil
+}
@@ -28,7 +28,7 @@ func ClassifyFailure(statusCode int, errorBody string) string {
 		return FailureRateLimit
 	case 401, 403:
 		return FailureAuthError
-	case 500, 502, 503:
+	case 500, 502, 503, 529: // 529 = Anthropic "overloaded"
 		return FailureServerError
 	case 504:
 		return FailureTimeout
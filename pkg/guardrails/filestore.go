@@ -0,0 +1,234 @@
+package guardrails
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileStore keeps each session as a JSON file in a directory, so sessions
+// survive a restart. It serves one gateway process; replicas should share
+// a RedisStore instead. Files are replaced atomically, so a crash never
+// leaves a half-written session behind.
+type FileStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+const cooldownFile = "cooldowns.json"
+
+// NewFileStore opens a store in dir, creating the directory if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if dir == "" {
+		return nil, errors.New("guardrails: file session store: directory is required")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("guardrails: file session store: %w", err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// path returns the session's file. Files are named by the SHA-256 of the ID,
+// so a header value of any length makes a safe file name; the ID itself is
+// kept in the JSON.
+func (f *FileStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(f.dir, "session-"+hex.EncodeToString(sum[:])+".json")
+}
+
+func (f *FileStore) read(id string) (*SessionState, error) {
+	s, err := readSessionFile(f.path(id))
+	if err != nil || s == nil || s.SessionID == id {
+		return s, err
+	}
+	return nil, fmt.Errorf("%s holds session %q", f.path(id), s.SessionID)
+}
+
+// readSessionFile reads one session file; a missing file is a nil session.
+func readSessionFile(path string) (*SessionState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &SessionState{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if s.ToolCalls == nil {
+		s.ToolCalls = make(map[string][]time.Time)
+	}
+	return s, nil
+}
+
+func (f *FileStore) write(s *SessionState) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(f.path(s.SessionID), data)
+}
+
+// WriteFileAtomic writes data to a temporary file and renames it over path,
+// so readers never see a half-written file.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (f *FileStore) Get(id string) (*SessionState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.read(id)
+}
+
+func (f *FileStore) Create(id string, now time.Time) (*SessionState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, err := f.read(id)
+	if err != nil || s != nil {
+		return s, err
+	}
+	s = newSessionState(id, now)
+	return s, f.write(s)
+}
+
+func (f *FileStore) Update(id string, fn func(*SessionState)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, err := f.read(id)
+	if err != nil || s == nil {
+		return err
+	}
+	fn(s)
+	return f.write(s)
+}
+
+func (f *FileStore) Delete(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := os.Remove(f.path(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) cooldowns() (map[string]time.Time, error) {
+	cooldowns := make(map[string]time.Time)
+	data, err := os.ReadFile(filepath.Join(f.dir, cooldownFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return cooldowns, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cooldowns, json.Unmarshal(data, &cooldowns)
+}
+
+func (f *FileStore) writeCooldowns(cooldowns map[string]time.Time) error {
+	data, err := json.Marshal(cooldowns)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(f.dir, cooldownFile), data)
+}
+
+func (f *FileStore) SetCooldown(id string, until time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cooldowns, err := f.cooldowns()
+	if err != nil {
+		return err
+	}
+	cooldowns[id] = until
+	return f.writeCooldowns(cooldowns)
+}
+
+func (f *FileStore) Cooldown(id string) (time.Time, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cooldowns, err := f.cooldowns()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	until, ok := cooldowns[id]
+	if ok && !time.Now().Before(until) {
+		return time.Time{}, false, nil
+	}
+	return until, ok, nil
+}
+
+func (f *FileStore) List() ([]*SessionState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := os.Stat(f.dir); err != nil {
+		return nil, err
+	}
+	return f.list(), nil
+}
+
+// list reads every session file, skipping unreadable ones.
+func (f *FileStore) list() []*SessionState {
+	entries, _ := os.ReadDir(f.dir)
+	var list []*SessionState
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, "session-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if s, err := readSessionFile(filepath.Join(f.dir, name)); err == nil && s != nil {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func (f *FileStore) Expire(now time.Time, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.list() {
+		if now.Sub(s.LastActive) > ttl {
+			os.Remove(f.path(s.SessionID))
+		}
+	}
+
+	cooldowns, err := f.cooldowns()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for id, until := range cooldowns {
+		if now.After(until) {
+			delete(cooldowns, id)
+			changed = true
+		}
+	}
+	if changed {
+		return f.writeCooldowns(cooldowns)
+	}
+	return nil
+}
+
+func (f *FileStore) Close() error { return nil }
@@ -16,7 +16,7 @@ func TestTokenBudgetExceeded(t *testing.T) {
 	sid := "test-token-budget"
 
 	mgr.GetOrCreate(sid)
-	mgr.RecordResponse(sid, 1200, false)
+	mgr.RecordResponse(sid, Usage{PromptTokens: 1200}, false)
 
 	v := Evaluate(cfg, mgr, sid, &EvalRequest{PromptText: "hello"})
 	if v == nil {
@@ -35,7 +35,7 @@ func TestTokenBudgetNotExceeded(t *testing.T) {
 	sid := "test-token-ok"
 
 	mgr.GetOrCreate(sid)
-	mgr.RecordResponse(sid, 500, false)
+	mgr.RecordResponse(sid, Usage{PromptTokens: 500}, false)
 
 	v := Evaluate(cfg, mgr, sid, &EvalRequest{PromptText: "hello"})
 	if v != nil {
@@ -162,7 +162,7 @@ func TestErrorSpiral(t *testing.T) {
 
 	// Record 3 consecutive errors.
 	for i := 0; i < 3; i++ {
-		mgr.RecordResponse(sid, 100, true)
+		mgr.RecordResponse(sid, Usage{PromptTokens: 100}, true)
 	}
 
 	v := Evaluate(cfg, mgr, sid, &EvalRequest{PromptText: "retry"})
@@ -183,10 +183,10 @@ func TestErrorSpiralResetsOnSuccess(t *testing.T) {
 
 	mgr.GetOrCreate(sid)
 
-	mgr.RecordResponse(sid, 100, true)
-	mgr.RecordResponse(sid, 100, true)
-	mgr.RecordResponse(sid, 200, false) // success resets counter
-	mgr.RecordResponse(sid, 100, true)
+	mgr.RecordResponse(sid, Usage{PromptTokens: 100}, true)
+	mgr.RecordResponse(sid, Usage{PromptTokens: 100}, true)
+	mgr.RecordResponse(sid, Usage{PromptTokens: 200}, false) // success resets counter
+	mgr.RecordResponse(sid, Usage{PromptTokens: 100}, true)
 
 	v := Evaluate(cfg, mgr, sid, &EvalRequest{PromptText: "hello"})
 	if v != nil {
@@ -272,28 +272,17 @@ func TestJaccardSimilarity(t *testing.T) {
 
 func TestSessionCleanup(t *testing.T) {
 	// Use a very short TTL to test cleanup.
-	mgr := &Manager{
-		sessions: make(map[string]*SessionState),
-		ttl:      50 * time.Millisecond,
-	}
-
-	s := mgr.GetOrCreate("ephemeral")
-	s.LastActive = time.Now().Add(-1 * time.Second) // already expired
+	store := NewMemoryStore()
+	mgr := &Manager{store: store, ttl: 50 * time.Millisecond}
 
-	mgr.mu.Lock()
-	now := time.Now()
-	for id, sess := range mgr.sessions {
-		if now.Sub(sess.LastActive) > mgr.ttl {
-			delete(mgr.sessions, id)
-		}
-	}
-	mgr.mu.Unlock()
+	mgr.GetOrCreate("ephemeral")
+	store.Update("ephemeral", func(s *SessionState) {
+		s.LastActive = time.Now().Add(-1 * time.Second) // already expired
+	})
 
-	mgr.mu.Lock()
-	_, exists := mgr.sessions["ephemeral"]
-	mgr.mu.Unlock()
+	store.Expire(time.Now(), mgr.ttl)
 
-	if exists {
+	if mgr.session("ephemeral") != nil {
 		t.Fatal("expected expired session to be cleaned up")
 	}
 }
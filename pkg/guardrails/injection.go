@@ -0,0 +1,366 @@
+package guardrails
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Injection heuristics. Each one that fires adds its weight to a message's score.
+const (
+	SignalInstructionOverride = "instruction_override" // "ignore all previous instructions"
+	SignalRoleSpoof           = "role_spoof"           // chat-template markers such as <|im_start|>system
+	SignalHiddenUnicode       = "hidden_unicode"       // zero-width, bidi-override or tag characters
+	SignalEncodedInstructions = "encoded_instructions" // base64 that decodes to one of the above
+	SignalToolCallAttempt     = "tool_call_attempt"    // a tool result trying to call tools
+)
+
+// Injection actions, strongest first.
+const (
+	InjectionBlock    = "block"    // reject the request
+	InjectionStrip    = "strip"    // replace the message's text with InjectionStripText
+	InjectionAnnotate = "annotate" // forward unchanged, but mark the span and AIR record
+)
+
+// InjectionStripText replaces the text of a stripped message.
+const InjectionStripText = "[content removed: suspected prompt injection]"
+
+// InjectionConfig controls the prompt-injection rule, which scores each
+// message in a request against heuristics and acts on the score according to
+// the thresholds for the message's source.
+type InjectionConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Mode    string `yaml:"mode"` // "enforce" (default) or "shadow"
+
+	// Weights overrides the default weight of a heuristic; 0 disables it.
+	Weights map[string]float64 `yaml:"weights"`
+
+	// Phrases adds instruction-override phrases, matched case-insensitively.
+	Phrases []string `yaml:"phrases"`
+
+	// Sources sets thresholds by message role: "system", "user", "assistant"
+	// or "tool". "default" applies to roles without their own entry.
+	Sources map[string]InjectionThresholds `yaml:"sources"`
+}
+
+// InjectionThresholds are the scores at or above which each action applies.
+// A zero threshold never applies.
+type InjectionThresholds struct {
+	Block    float64 `yaml:"block"`
+	Strip    float64 `yaml:"strip"`
+	Annotate float64 `yaml:"annotate"`
+}
+
+// defaultInjectionWeights score a single strong signal high enough to strip
+// untrusted tool content, and two together high enough to block it.
+var defaultInjectionWeights = map[string]float64{
+	SignalInstructionOverride: 0.6,
+	SignalRoleSpoof:           0.5,
+	SignalHiddenUnicode:       0.3,
+	SignalEncodedInstructions: 0.7,
+	SignalToolCallAttempt:     0.5,
+}
+
+// defaultInjectionSources treat tool results as untrusted and only annotate
+// everything else.
+var defaultInjectionSources = map[string]InjectionThresholds{
+	"tool":    {Block: 0.9, Strip: 0.5, Annotate: 0.3},
+	"default": {Annotate: 0.5},
+}
+
+// InjectionFinding is one message that scored at or above an action threshold.
+type InjectionFinding struct {
+	Source  string   `json:"source"` // "messages" or "input"
+	Index   int      `json:"index"`
+	Role    string   `json:"role"`
+	Score   float64  `json:"score"`
+	Signals []string `json:"signals"`
+	Action  string   `json:"action"` // "block", "strip" or "annotate"
+}
+
+var (
+	instructionOverrideRegex = regexp.MustCompile(`(?i)\b(?:` +
+		`(?:ignore|disregard|forget|override|bypass)\s+(?:all\s+|any\s+)?(?:of\s+)?(?:the\s+|your\s+|my\s+)?(?:previous|prior|above|earlier|preceding|system|original)\s+(?:instructions?|prompts?|messages?|rules|guidelines|directions)` +
+		`|you\s+are\s+now\s+(?:in\s+)?(?:developer|jailbreak|dan|god)\s+mode` +
+		`|do\s+anything\s+now` +
+		`|new\s+(?:system\s+)?instructions\s*:` +
+		`|(?:reveal|print|repeat|output)\s+(?:your|the)\s+(?:system\s+prompt|hidden\s+instructions))`)
+
+	roleSpoofRegex = regexp.MustCompile(`(?im)<\|(?:im_start|im_end|system|assistant|user|endoftext)\|>` +
+		`|\[/?INST\]|<</?SYS>>` +
+		`|</?(?:system|assistant)>` +
+		`|^\s*#{0,3}\s*(?:system|assistant)\s*:` +
+		`|\n\n(?:Human|Assistant):`)
+
+	toolCallAttemptRegex = regexp.MustCompile(`(?i)"tool_calls"\s*:|"function_call"\s*:` +
+		`|<(?:tool_call|function_calls?|invoke)\b` +
+		`|\b(?:call|invoke|use|run)\s+the\s+[\w.-]+\s+(?:tool|function)\b`)
+
+	base64RunRegex = regexp.MustCompile(`[A-Za-z0-9+/]{24,}={0,2}`)
+)
+
+// hiddenRune reports zero-width, bidirectional-override and Unicode tag
+// characters, which hide instructions from a human reviewing the text.
+func hiddenRune(r rune) bool {
+	switch {
+	case r >= 0x200B && r <= 0x200F, r >= 0x202A && r <= 0x202E,
+		r >= 0x2060 && r <= 0x2064, r >= 0x2066 && r <= 0x2069,
+		r == 0xFEFF, r >= 0xE0000 && r <= 0xE007F:
+		return true
+	}
+	return false
+}
+
+// validate reports unknown heuristics and thresholds outside 0–1.
+func (c *InjectionConfig) validate(v *validator) {
+	base := at("prevention", "injection")
+	for _, signal := range sortedKeys(c.Weights) {
+		if _, ok := defaultInjectionWeights[signal]; !ok {
+			v.errorf(at(base, "weights", signal), "unknown heuristic %q", signal)
+		} else if w := c.Weights[signal]; w < 0 {
+			v.errorf(at(base, "weights", signal), "must not be negative, got %g", w)
+		}
+	}
+	for _, source := range sortedKeys(c.Sources) {
+		for _, t := range []float64{c.Sources[source].Block, c.Sources[source].Strip, c.Sources[source].Annotate} {
+			if t < 0 || t > 1 {
+				v.errorf(at(base, "sources", source), "thresholds must be between 0 and 1, got %g", t)
+				break
+			}
+		}
+	}
+}
+
+// weight returns the configured or default weight of a heuristic.
+func (c *InjectionConfig) weight(signal string) float64 {
+	if w, ok := c.Weights[signal]; ok {
+		return w
+	}
+	return defaultInjectionWeights[signal]
+}
+
+// thresholds returns the thresholds for a message role.
+func (c *InjectionConfig) thresholds(role string) InjectionThresholds {
+	sources := c.Sources
+	if sources == nil {
+		sources = defaultInjectionSources
+	}
+	if t, ok := sources[role]; ok {
+		return t
+	}
+	return sources["default"]
+}
+
+// decide returns the strongest action whose threshold the score reaches.
+func (t InjectionThresholds) decide(score float64) string {
+	switch {
+	case t.Block > 0 && score >= t.Block:
+		return InjectionBlock
+	case t.Strip > 0 && score >= t.Strip:
+		return InjectionStrip
+	case t.Annotate > 0 && score >= t.Annotate:
+		return InjectionAnnotate
+	}
+	return ""
+}
+
+// scoreInjection runs the heuristics over a message's text and returns its
+// score (capped at 1) and the signals that fired, in a stable order.
+func (c *InjectionConfig) scoreInjection(role, text string) (float64, []string) {
+	fired := make(map[string]bool)
+	if c.overrides(text) {
+		fired[SignalInstructionOverride] = true
+	}
+	if roleSpoofRegex.MatchString(text) {
+		fired[SignalRoleSpoof] = true
+	}
+	if strings.IndexFunc(text, hiddenRune) >= 0 {
+		fired[SignalHiddenUnicode] = true
+	}
+	if role == "tool" && toolCallAttemptRegex.MatchString(text) {
+		fired[SignalToolCallAttempt] = true
+	}
+	for _, run := range base64RunRegex.FindAllString(text, -1) {
+		decoded, ok := decodeBase64Text(run)
+		if ok && (c.overrides(decoded) || roleSpoofRegex.MatchString(decoded)) {
+			fired[SignalEncodedInstructions] = true
+			break
+		}
+	}
+
+	var signals []string
+	for signal := range fired {
+		if c.weight(signal) > 0 {
+			signals = append(signals, signal)
+		}
+	}
+	sort.Strings(signals)
+	score := 0.0
+	for _, signal := range signals {
+		score += c.weight(signal)
+	}
+	if score > 1 {
+		score = 1
+	}
+	return score, signals
+}
+
+// overrides reports whether text contains an instruction-override phrase.
+func (c *InjectionConfig) overrides(text string) bool {
+	if instructionOverrideRegex.MatchString(text) {
+		return true
+	}
+	lower := strings.ToLower(text)
+	for _, p := range c.Phrases {
+		if p != "" && strings.Contains(lower, strings.ToLower(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeBase64Text decodes a base64 run, accepting it only if the result is
+// readable text.
+func decodeBase64Text(s string) (string, bool) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		if data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "=")); err != nil {
+			return "", false
+		}
+	}
+	if !utf8.Valid(data) {
+		return "", false
+	}
+	for _, b := range data {
+		if b < 0x20 && b != '\n' && b != '\r' && b != '\t' {
+			return "", false
+		}
+	}
+	return string(data), true
+}
+
+// injectionRole returns the trust source of a message or input item. Tool
+// results count as "tool" whichever shape carries them: OpenAI tool messages,
+// Anthropic tool_result blocks and Responses API function_call_output items.
+func injectionRole(item map[string]interface{}) string {
+	if typ, _ := item["type"].(string); typ == "function_call_output" {
+		return "tool"
+	}
+	if blocks, ok := item["content"].([]interface{}); ok {
+		for _, b := range blocks {
+			if block, ok := b.(map[string]interface{}); ok && block["type"] == "tool_result" {
+				return "tool"
+			}
+		}
+	}
+	role, _ := item["role"].(string)
+	return role
+}
+
+// collectText gathers the strings beneath v that can carry instructions.
+func collectText(v interface{}, out *[]string) {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for k, child := range node {
+			if !piiSkipKeys[k] {
+				collectText(child, out)
+			}
+		}
+	case []interface{}:
+		for _, child := range node {
+			collectText(child, out)
+		}
+	case string:
+		*out = append(*out, node)
+	}
+}
+
+// stripText replaces every string beneath v that collectText would gather.
+func stripText(v interface{}) interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for k, child := range node {
+			if !piiSkipKeys[k] {
+				node[k] = stripText(child)
+			}
+		}
+		return node
+	case []interface{}:
+		for i, child := range node {
+			node[i] = stripText(child)
+		}
+		return node
+	case string:
+		return InjectionStripText
+	default:
+		return v
+	}
+}
+
+// evaluateInjection scores every message and input item in a request.
+// Returns the rewritten body if any message was stripped (nil otherwise) and
+// every message that reached an action threshold.
+func evaluateInjection(cfg InjectionConfig, body []byte) ([]byte, []InjectionFinding) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, nil
+	}
+
+	var findings []InjectionFinding
+	modified := false
+	for _, source := range []string{"messages", "input"} {
+		raw, ok := req[source]
+		if !ok {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		var items []interface{}
+		if err := dec.Decode(&items); err != nil {
+			continue // e.g. a plain-string Responses API input
+		}
+
+		stripped := false
+		for i, it := range items {
+			item, ok := it.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			role := injectionRole(item)
+			var texts []string
+			collectText(item, &texts)
+			score, signals := cfg.scoreInjection(role, strings.Join(texts, "\n"))
+			action := cfg.thresholds(role).decide(score)
+			if action == "" {
+				continue
+			}
+			findings = append(findings, InjectionFinding{
+				Source: source, Index: i, Role: role, Score: score, Signals: signals, Action: action,
+			})
+			if action == InjectionStrip {
+				items[i] = stripText(item)
+				stripped = true
+			}
+		}
+
+		if stripped {
+			if rewritten, err := marshalNoEscape(items); err == nil {
+				req[source] = rewritten
+				modified = true
+			}
+		}
+	}
+
+	if !modified {
+		return nil, findings
+	}
+	rewritten, err := marshalNoEscape(req)
+	if err != nil {
+		return nil, findings
+	}
+	return rewritten, findings
+}
@@ -395,3 +395,22 @@ func TestRouteNilTracker(t *testing.T) {
 		t.Fatalf("nil tracker should not route, got %s", decision.RoutedModel)
 	}
 }
+
+func TestRecordDetections(t *testing.T) {
+	pt := NewPerformanceTracker()
+	pt.RecordDetections("request", map[string]int{"email": 2, "ssn": 1})
+	pt.RecordDetections("request", map[string]int{"email": 1})
+	pt.RecordDetections("response", map[string]int{"openai_key": 1})
+	pt.RecordDetections("request", nil)
+
+	stats := pt.GetDetectorStats()
+	if len(stats) != 3 {
+		t.Fatalf("expected 3 detector stats, got %d", len(stats))
+	}
+	if stats[0].Stage != "request" || stats[0].Detector != "email" || stats[0].Matches != 3 || stats[0].Requests != 2 {
+		t.Fatalf("unexpected email stats: %+v", stats[0])
+	}
+	if stats[2].Stage != "response" || stats[2].Detector != "openai_key" {
+		t.Fatalf("unexpected order: %+v", stats)
+	}
+}
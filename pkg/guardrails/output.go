@@ -0,0 +1,395 @@
+package guardrails
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Output policy actions.
+const (
+	OutputRedact = "redact" // replace matches in the response (default)
+	OutputBlock  = "block"  // replace the whole response with a policy error
+	OutputFlag   = "flag"   // pass the response through, but alert and mark it
+)
+
+// Output stream modes.
+const (
+	StreamIncremental = "incremental" // scan each SSE event before forwarding it (default)
+	StreamBuffer      = "buffer"      // hold the whole stream until it has been scanned
+)
+
+// OutputPolicyConfig controls the response-side policy stage, which scans the
+// assistant message and tool calls before they reach the agent.
+type OutputPolicyConfig struct {
+	Enabled      bool      `yaml:"enabled"`
+	Mode         string    `yaml:"mode"`          // "enforce" (default) or "shadow"
+	Action       string    `yaml:"action"`        // "redact", "block" or "flag"
+	PII          PIIConfig `yaml:"pii"`           // redact_mode is ignored; action applies
+	Secrets      bool      `yaml:"secrets"`       // API keys, tokens and private keys
+	BlockedTools []string  `yaml:"blocked_tools"` // tools the model may not call
+	DenyPatterns []string  `yaml:"deny_patterns"` // custom regular expressions
+	StreamMode   string    `yaml:"stream_mode"`   // "incremental" or "buffer"
+
+	denyRegexps []*regexp.Regexp // compiled DenyPatterns, set by LoadConfig
+}
+
+// OutputFinding is one kind of policy match in a response.
+type OutputFinding struct {
+	Kind  string `json:"kind"`  // "pii", "secret", "tool" or "pattern"
+	Label string `json:"label"` // e.g. "email", "aws_access_key", the tool name or the pattern
+	Count int    `json:"count"`
+}
+
+// OutputResult describes what the output policy did to a response.
+type OutputResult struct {
+	Findings []OutputFinding
+
+	// Action is the action taken: "redacted", "blocked", "flagged", or empty
+	// when nothing matched.
+	Action string
+	Reason string
+
+	// ModifiedBody is the redacted response body. nil means unchanged.
+	ModifiedBody []byte
+
+	// Shadow is true when the policy runs in shadow mode: Action is what it
+	// would have done, and the response passes through unchanged.
+	Shadow bool
+}
+
+// Blocked reports whether the response must be replaced with a policy error.
+func (r *OutputResult) Blocked() bool {
+	return r != nil && r.Action == "blocked" && !r.Shadow
+}
+
+// detectors lists the text detectors enabled by the policy. Their own actions
+// are ignored here: the policy action applies to every finding.
+func (c *OutputPolicyConfig) detectors() []detector {
+	var ds []detector
+	if c.PII.Enabled {
+		ds = append(ds, piiDetectors(c.PII)...)
+	}
+	if c.Secrets {
+		ds = append(ds, secretDetectors()...)
+	}
+
+	// Configs loaded from YAML are compiled up front; configs built in code
+	// are compiled here, skipping patterns that do not compile.
+	deny := c.denyRegexps
+	if len(deny) != len(c.DenyPatterns) {
+		deny = nil
+		for _, p := range c.DenyPatterns {
+			if re, err := regexp.Compile(p); err == nil {
+				deny = append(deny, re)
+			}
+		}
+	}
+	for _, re := range deny {
+		ds = append(ds, detector{name: re.String(), kind: "pattern", re: re, replacement: "[REDACTED]"})
+	}
+	return ds
+}
+
+// action returns the configured action, defaulting to redact.
+func (c *OutputPolicyConfig) action() string {
+	switch c.Action {
+	case OutputBlock, OutputFlag:
+		return c.Action
+	default:
+		return OutputRedact
+	}
+}
+
+// EvaluateOutput runs the output policy against a non-streaming response body
+// (OpenAI chat completions, the Responses API or Anthropic Messages).
+// Text in the assistant message and tool-call arguments is scanned for PII,
+// secrets and deny patterns; tool calls are checked against BlockedTools.
+//
+// A blocked tool call cannot be redacted, so under the redact action it
+// blocks the response instead. Returns an empty result if the policy is off.
+func EvaluateOutput(cfg *Config, respBody []byte) *OutputResult {
+	result := &OutputResult{}
+	if cfg == nil || !cfg.Prevention.Output.Enabled {
+		return result
+	}
+	policy := &cfg.Prevention.Output
+
+	doc, ok := decodeOutput(respBody)
+	if !ok {
+		return result
+	}
+
+	tally := newOutputTally()
+	detectors := policy.detectors()
+	result.Shadow = cfg.Shadowed("output_policy")
+	redact := policy.action() == OutputRedact && !result.Shadow
+	changed := false
+
+	doc = walkOutput(doc, "", false,
+		func(_, text string) string {
+			for _, d := range detectors {
+				if !redact {
+					if n := len(d.find(text)); n > 0 {
+						tally.add(d.kind, d.name, n)
+					}
+					continue
+				}
+				if redacted, n := d.apply(text, nil); n > 0 {
+					tally.add(d.kind, d.name, n)
+					text = redacted
+					changed = true
+				}
+			}
+			return text
+		},
+		func(tool string) {
+			if isBlockedTool(policy, tool) {
+				tally.add("tool", tool, 1)
+			}
+		},
+	)
+
+	result.Findings = tally.findings()
+	if len(result.Findings) == 0 {
+		return result
+	}
+	decide(policy, result)
+	if result.Action == "redacted" && changed {
+		if modified, err := json.Marshal(doc); err == nil {
+			result.ModifiedBody = modified
+		}
+	}
+	return result
+}
+
+// decide sets the action and reason for a result that has findings.
+func decide(policy *OutputPolicyConfig, result *OutputResult) {
+	result.Reason = describeFindings(result.Findings)
+	switch policy.action() {
+	case OutputFlag:
+		result.Action = "flagged"
+	case OutputBlock:
+		result.Action = "blocked"
+	default:
+		result.Action = "redacted"
+		for _, f := range result.Findings {
+			if f.Kind == "tool" {
+				result.Action = "blocked"
+			}
+		}
+	}
+}
+
+// describeFindings summarises findings for errors and alerts,
+// e.g. "response contains pii:email, tool:delete_all_data".
+func describeFindings(findings []OutputFinding) string {
+	parts := make([]string, 0, len(findings))
+	for _, f := range findings {
+		parts = append(parts, f.Kind+":"+f.Label)
+	}
+	return "response contains " + strings.Join(parts, ", ")
+}
+
+func isBlockedTool(policy *OutputPolicyConfig, tool string) bool {
+	for _, t := range policy.BlockedTools {
+		if t == tool {
+			return true
+		}
+	}
+	return false
+}
+
+// outputTextKeys hold model-generated text. Strings anywhere beneath them are
+// scanned, except for the structural keys in outputSkipKeys.
+var outputTextKeys = map[string]bool{
+	"content": true, "text": true, "arguments": true, "input": true,
+	"output_text": true, "refusal": true, "reasoning_content": true,
+	"thinking": true, "partial_json": true, "delta": true,
+}
+
+var outputSkipKeys = map[string]bool{
+	"type": true, "id": true, "role": true, "name": true, "model": true,
+	"stop_reason": true, "finish_reason": true, "call_id": true, "signature": true,
+}
+
+// walkOutput visits a decoded response. scanText is applied to (and may
+// replace) model-generated strings, along with their JSON path such as
+// "choices[0].delta.content"; onTool is called with the name of every tool
+// call: OpenAI's function.name, and the name of Anthropic tool_use blocks and
+// Responses API function_call items.
+func walkOutput(v interface{}, path string, scanning bool, scanText func(path, text string) string, onTool func(string)) interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		if fn, ok := node["function"].(map[string]interface{}); ok {
+			if name, ok := fn["name"].(string); ok && name != "" {
+				onTool(name)
+			}
+		}
+		if typ, _ := node["type"].(string); typ == "tool_use" || typ == "function_call" {
+			if name, ok := node["name"].(string); ok && name != "" {
+				onTool(name)
+			}
+		}
+		for k, child := range node {
+			if scanning && outputSkipKeys[k] {
+				continue
+			}
+			childPath := k
+			if path != "" {
+				childPath = path + "." + k
+			}
+			node[k] = walkOutput(child, childPath, scanning || outputTextKeys[k], scanText, onTool)
+		}
+		return node
+	case []interface{}:
+		for i, child := range node {
+			node[i] = walkOutput(child, fmt.Sprintf("%s[%d]", path, i), scanning, scanText, onTool)
+		}
+		return node
+	case string:
+		if scanning {
+			return scanText(path, node)
+		}
+		return node
+	default:
+		return v
+	}
+}
+
+// outputTally counts findings by kind and label.
+type outputTally struct {
+	counts map[[2]string]int
+}
+
+func newOutputTally() *outputTally {
+	return &outputTally{counts: make(map[[2]string]int)}
+}
+
+func (t *outputTally) add(kind, label string, n int) {
+	t.counts[[2]string{kind, label}] += n
+}
+
+// findings returns the tally in a stable order.
+func (t *outputTally) findings() []OutputFinding {
+	out := make([]OutputFinding, 0, len(t.counts))
+	for k, n := range t.counts {
+		out = append(out, OutputFinding{Kind: k[0], Label: k[1], Count: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Kind != out[j].Kind {
+			return out[i].Kind < out[j].Kind
+		}
+		return out[i].Label < out[j].Label
+	})
+	return out
+}
+
+// streamScanOverlap is how much already-scanned text is rescanned with each
+// new delta, so matches split across deltas are still found.
+const streamScanOverlap = 256
+
+// OutputScanner applies the output policy to a streamed response one SSE
+// event at a time. Deltas are accumulated so a match split across events is
+// still caught when its last piece arrives.
+//
+// Text that has already been sent cannot be rewritten, so in streams the
+// redact action cuts the stream like block does; flag never cuts it.
+type OutputScanner struct {
+	policy    *OutputPolicyConfig
+	detectors []detector
+	text      strings.Builder
+	scanned   int // bytes of text already scanned
+	tally     *outputTally
+	seenTools map[string]bool
+	shadow    bool // never cut the stream, see OutputResult.Shadow
+}
+
+// NewOutputScanner returns a scanner for one stream, or nil if the output
+// policy is disabled.
+func NewOutputScanner(cfg *Config) *OutputScanner {
+	if cfg == nil || !cfg.Prevention.Output.Enabled {
+		return nil
+	}
+	policy := &cfg.Prevention.Output
+	return &OutputScanner{
+		policy:    policy,
+		detectors: policy.detectors(),
+		tally:     newOutputTally(),
+		seenTools: make(map[string]bool),
+		shadow:    cfg.Shadowed("output_policy"),
+	}
+}
+
+// Buffered reports whether the whole stream must be held until scanned.
+func (s *OutputScanner) Buffered() bool {
+	return s.policy.StreamMode == StreamBuffer && !s.shadow
+}
+
+// Scan feeds one SSE data payload to the scanner and reports whether the
+// stream must be cut. Non-JSON payloads such as [DONE] are ignored.
+func (s *OutputScanner) Scan(payload []byte) (cut bool) {
+	var event map[string]interface{}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return false
+	}
+	// The Responses API repeats the full output in its closing events.
+	if typ, _ := event["type"].(string); typ == "response.completed" || strings.HasSuffix(typ, ".done") {
+		return false
+	}
+
+	found := false
+	walkOutput(event, "", false,
+		func(_, text string) string {
+			s.text.WriteString(text)
+			return text
+		},
+		func(tool string) {
+			if !s.seenTools[tool] && isBlockedTool(s.policy, tool) {
+				s.seenTools[tool] = true
+				s.tally.add("tool", tool, 1)
+				found = true
+			}
+		},
+	)
+
+	// Rescan a window overlapping the previous scan, counting only matches
+	// that end in the new text.
+	full := s.text.String()
+	from := s.scanned - streamScanOverlap
+	if from < 0 {
+		from = 0
+	}
+	window := full[from:]
+	for _, d := range s.detectors {
+		n := 0
+		for _, m := range d.find(window) {
+			if from+m[1] > s.scanned {
+				n++
+			}
+		}
+		if n > 0 {
+			s.tally.add(d.kind, d.name, n)
+			found = true
+		}
+	}
+	s.scanned = len(full)
+
+	return found && s.policy.action() != OutputFlag && !s.shadow
+}
+
+// Result summarises the scan so far. A stream cut by the policy reports
+// "blocked" whatever the configured action.
+func (s *OutputScanner) Result() *OutputResult {
+	result := &OutputResult{Findings: s.tally.findings(), Shadow: s.shadow}
+	if len(result.Findings) == 0 {
+		return result
+	}
+	decide(s.policy, result)
+	if result.Action == "redacted" {
+		result.Action = "blocked"
+	}
+	return result
+}
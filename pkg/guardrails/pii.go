@@ -8,7 +8,8 @@ var (
 	// SSN: XXX-XX-XXXX
 	ssnRegex = regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)
 
-	// Credit card: 13-19 digits with optional spaces/dashes (Visa, MC, Amex, Discover)
+	// Credit card: 13-19 digits with optional spaces/dashes (Visa, MC, Amex, Discover).
+	// Candidates must also pass the Luhn check (see luhnValid).
 	ccRegex = regexp.MustCompile(`\b(?:\d[ -]*?){13,19}\b`)
 
 	// Email: standard pattern
@@ -18,41 +19,95 @@ var (
 	phoneRegex = regexp.MustCompile(`\b(?:\(\d{3}\)\s?|\d{3}[-.])\d{3}[-.]?\d{4}\b`)
 )
 
+// piiHit is how often one detector matched a piece of text.
+type piiHit struct {
+	name   string
+	action string
+	count  int
+}
+
+// piiDetectors lists the detectors enabled in cfg, in redaction order: the
+// legacy block_* switches first, then configured detectors. Each detector's
+// action is resolved against the redact mode.
+func piiDetectors(cfg PIIConfig) []detector {
+	var ds []detector
+	if cfg.BlockSSN {
+		ds = append(ds, builtin("ssn"))
+	}
+	if cfg.BlockCC {
+		ds = append(ds, builtin("credit_card"))
+	}
+	if cfg.BlockEmail {
+		ds = append(ds, builtin("email"))
+	}
+	if cfg.BlockPhone {
+		ds = append(ds, builtin("phone"))
+	}
+
+	// Configs loaded from YAML are compiled up front; configs built in code
+	// are compiled here, and dropped entirely if any detector is invalid.
+	custom := cfg.compiled
+	if len(custom) != len(cfg.Detectors) {
+		custom, _ = compileDetectors(cfg.Detectors)
+	}
+	ds = append(ds, custom...)
+
+	defaultAction := DetectorRedact
+	if cfg.RedactMode == "block" {
+		defaultAction = DetectorBlock
+	}
+	for i := range ds {
+		if ds[i].action == "" {
+			ds[i].action = defaultAction
+		}
+	}
+	return ds
+}
+
+// redactPII replaces detected PII in text and reports what each detector
+// found, or nil if text is clean. Matches become the detector's replacement,
+// or replace(name, match) if replace is set. Flag detectors only count.
+func redactPII(detectors []detector, text string, replace func(name, match string) string) (string, []piiHit) {
+	var hits []piiHit
+	for _, d := range detectors {
+		if d.action == DetectorFlag {
+			if n := len(d.find(text)); n > 0 {
+				hits = append(hits, piiHit{d.name, d.action, n})
+			}
+			continue
+		}
+		var fn func(string) string
+		if replace != nil {
+			name := d.name
+			fn = func(match string) string { return replace(name, match) }
+		}
+		redacted, n := d.apply(text, fn)
+		if n > 0 {
+			hits = append(hits, piiHit{d.name, d.action, n})
+			text = redacted
+		}
+	}
+	return text, hits
+}
+
 // checkPII scans text for personally identifiable information.
 // Returns (blocked, redactedText).
 //   - If cfg.RedactMode == "block" and PII is found, blocked=true (reject the request).
 //   - If cfg.RedactMode == "redact" and PII is found, the text is returned with PII replaced.
 //   - If no PII is found, returns (false, original text).
+//
+// Detectors with their own action override the redact mode.
 func checkPII(cfg PIIConfig, text string) (bool, string) {
 	if !cfg.Enabled || text == "" {
 		return false, text
 	}
 
-	found := false
-	redacted := text
-
-	if cfg.BlockSSN && ssnRegex.MatchString(redacted) {
-		found = true
-		redacted = ssnRegex.ReplaceAllString(redacted, "[SSN]")
-	}
-
-	if cfg.BlockCC && ccRegex.MatchString(redacted) {
-		found = true
-		redacted = ccRegex.ReplaceAllString(redacted, "[CC]")
-	}
-
-	if cfg.BlockEmail && emailRegex.MatchString(redacted) {
-		found = true
-		redacted = emailRegex.ReplaceAllString(redacted, "[EMAIL]")
-	}
-
-	if cfg.BlockPhone && phoneRegex.MatchString(redacted) {
-		found = true
-		redacted = phoneRegex.ReplaceAllString(redacted, "[PHONE]")
-	}
+	redacted, hits := redactPII(piiDetectors(cfg), text, nil)
 
-	if found && cfg.RedactMode == "block" {
-		return true, text // blocked — return original for error context
+	for _, h := range hits {
+		if h.action == DetectorBlock {
+			return true, text // blocked — return original for error context
+		}
 	}
 
 	return false, redacted
@@ -0,0 +1,196 @@
+package guardrails
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// PIIChange records one request field where a detector matched.
+type PIIChange struct {
+	Source string         `json:"source"` // "messages", "input", "system" or "instructions"
+	Index  int            `json:"index"`  // position in the messages/input array (0 for a plain string)
+	Field  string         `json:"field"`  // path within the item, e.g. "content[1].text"; empty if the item is a string
+	Types  []string       `json:"types"`  // detectors that matched, e.g. ["email", "ssn"]
+	Counts map[string]int `json:"counts"` // matches per detector
+	Action string         `json:"action"` // strongest action taken: "blocked", "redacted" or "flagged"
+}
+
+// PIIBlocked reports whether any change came from a block detector.
+func PIIBlocked(changes []PIIChange) bool {
+	for _, c := range changes {
+		if c.Action == "blocked" {
+			return true
+		}
+	}
+	return false
+}
+
+// PIICounts totals matches per detector across changes.
+func PIICounts(changes []PIIChange) map[string]int {
+	counts := make(map[string]int)
+	for _, c := range changes {
+		for name, n := range c.Counts {
+			counts[name] += n
+		}
+	}
+	return counts
+}
+
+// MaskRequestPII returns body with the matches of cfg's redact and block
+// detectors masked in every message, e.g. so a request blocked for PII is
+// stored without it. Flag detectors leave their matches in place.
+func MaskRequestPII(cfg PIIConfig, body []byte) []byte {
+	masked, _ := redactRequestPII(cfg, body)
+	return masked
+}
+
+// newPIIChange summarises the detector hits for one field.
+func newPIIChange(source string, index int, field string, hits []piiHit) PIIChange {
+	c := PIIChange{Source: source, Index: index, Field: field, Counts: make(map[string]int), Action: "flagged"}
+	for _, h := range hits {
+		c.Types = append(c.Types, h.name)
+		c.Counts[h.name] += h.count
+		switch {
+		case h.action == DetectorBlock:
+			c.Action = "blocked"
+		case h.action == DetectorRedact && c.Action != "blocked":
+			c.Action = "redacted"
+		}
+	}
+	return c
+}
+
+// piiRequestSources are the top-level request fields that carry conversation
+// text: chat and Anthropic messages, the Responses API input and instructions,
+// and Anthropic's top-level system prompt.
+var piiRequestSources = []string{"system", "instructions", "messages", "input"}
+
+// piiSkipKeys are structural fields that never hold user text.
+var piiSkipKeys = map[string]bool{
+	"type": true, "role": true, "id": true, "name": true, "model": true,
+	"tool_call_id": true, "tool_use_id": true, "call_id": true, "status": true,
+	"cache_control": true, "image_url": true, "source": true, "file_id": true,
+	"signature": true,
+}
+
+// redactRequestPII walks every message in a request — system prompts, earlier
+// turns, tool results and tool-call arguments — and redacts PII in place in
+// each string field. Returns the rewritten body and every field where a
+// detector matched. The body is returned unchanged if nothing was redacted.
+func redactRequestPII(cfg PIIConfig, body []byte) ([]byte, []PIIChange) {
+	return rewriteRequestPII(cfg, body, nil)
+}
+
+// rewriteRequestPII is redactRequestPII with a custom replacement; see redactPII.
+func rewriteRequestPII(cfg PIIConfig, body []byte, replace func(label, match string) string) ([]byte, []PIIChange) {
+	detectors := piiDetectors(cfg)
+	if !cfg.Enabled || len(detectors) == 0 {
+		return body, nil
+	}
+
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return body, nil
+	}
+
+	var changes []PIIChange
+	modified := false
+	for _, source := range piiRequestSources {
+		raw, ok := req[source]
+		if !ok {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			continue
+		}
+
+		sourceModified := false
+		if items, ok := v.([]interface{}); ok {
+			for i := range items {
+				index := i
+				items[i] = redactPIIValue(detectors, replace, items[i], "", func(field string, hits []piiHit) {
+					changes = append(changes, newPIIChange(source, index, field, hits))
+				}, &sourceModified)
+			}
+		} else {
+			v = redactPIIValue(detectors, replace, v, "", func(field string, hits []piiHit) {
+				changes = append(changes, newPIIChange(source, 0, field, hits))
+			}, &sourceModified)
+		}
+
+		if sourceModified {
+			if rewritten, err := marshalNoEscape(v); err == nil {
+				req[source] = rewritten
+				modified = true
+			}
+		}
+	}
+
+	if !modified {
+		return body, changes
+	}
+	rewritten, err := marshalNoEscape(req)
+	if err != nil {
+		return body, changes
+	}
+	return rewritten, changes
+}
+
+// redactPIIValue redacts PII in every string beneath v, reporting each
+// matching field by its path relative to the message. modified is set if any
+// string was rewritten.
+func redactPIIValue(detectors []detector, replace func(string, string) string,
+	v interface{}, path string, report func(string, []piiHit), modified *bool) interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(node))
+		for k := range node {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys) // stable report order
+		for _, k := range keys {
+			if piiSkipKeys[k] {
+				continue
+			}
+			child := k
+			if path != "" {
+				child = path + "." + k
+			}
+			node[k] = redactPIIValue(detectors, replace, node[k], child, report, modified)
+		}
+		return node
+	case []interface{}:
+		for i := range node {
+			node[i] = redactPIIValue(detectors, replace, node[i], fmt.Sprintf("%s[%d]", path, i), report, modified)
+		}
+		return node
+	case string:
+		redacted, hits := redactPII(detectors, node, replace)
+		if len(hits) > 0 {
+			report(path, hits)
+		}
+		if redacted != node {
+			*modified = true
+		}
+		return redacted
+	default:
+		return v
+	}
+}
+
+// marshalNoEscape encodes v without escaping <, > and &, so redaction
+// placeholders reach the provider as written.
+func marshalNoEscape(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
@@ -0,0 +1,121 @@
+package guardrails
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+var piiRedactAll = PIIConfig{
+	Enabled:    true,
+	BlockSSN:   true,
+	BlockCC:    true,
+	BlockEmail: true,
+	BlockPhone: true,
+	RedactMode: "redact",
+}
+
+func TestRedactRequestPIIWalksAllMessages(t *testing.T) {
+	body := `{"model":"gpt-4o","temperature":0.2,"messages":[
+		{"role":"system","content":"Escalate to ops@example.com"},
+		{"role":"user","content":"My SSN is 123-45-6789"},
+		{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{\"email\":\"carol@example.com\"}"}}]},
+		{"role":"tool","tool_call_id":"call_1","content":"Phone: 555-123-4567"},
+		{"role":"user","content":[{"type":"text","text":"hello"},{"type":"text","text":"card 4111 1111 1111 1111"}]}
+	]}`
+
+	modified, changes := redactRequestPII(piiRedactAll, []byte(body))
+	got := string(modified)
+	for _, leaked := range []string{"ops@example.com", "123-45-6789", "carol@example.com", "555-123-4567", "4111 1111"} {
+		if strings.Contains(got, leaked) {
+			t.Errorf("%q not redacted: %s", leaked, got)
+		}
+	}
+	if !strings.Contains(got, `"temperature":0.2`) || !strings.Contains(got, `"tool_call_id":"call_1"`) {
+		t.Errorf("unrelated fields changed: %s", got)
+	}
+
+	want := []PIIChange{
+		{Source: "messages", Index: 0, Field: "content", Types: []string{"email"}},
+		{Source: "messages", Index: 1, Field: "content", Types: []string{"ssn"}},
+		{Source: "messages", Index: 2, Field: "tool_calls[0].function.arguments", Types: []string{"email"}},
+		{Source: "messages", Index: 3, Field: "content", Types: []string{"phone"}},
+		{Source: "messages", Index: 4, Field: "content[1].text", Types: []string{"credit_card"}},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("changes = %+v", changes)
+	}
+	for i := range want {
+		if changes[i].Source != want[i].Source || changes[i].Index != want[i].Index ||
+			changes[i].Field != want[i].Field || strings.Join(changes[i].Types, ",") != strings.Join(want[i].Types, ",") {
+			t.Errorf("change %d = %+v, want %+v", i, changes[i], want[i])
+		}
+	}
+}
+
+func TestRedactRequestPIIResponsesAndAnthropicShapes(t *testing.T) {
+	responses := `{"model":"gpt-4o","instructions":"Reply to bob@example.com","input":[
+		{"role":"user","content":[{"type":"input_text","text":"SSN 123-45-6789"}]},
+		{"type":"function_call_output","call_id":"c1","output":"dave@example.com"}
+	]}`
+	_, changes := redactRequestPII(piiRedactAll, []byte(responses))
+	if len(changes) != 3 || changes[0].Source != "instructions" ||
+		changes[1].Field != "content[0].text" || changes[2].Index != 1 || changes[2].Field != "output" {
+		t.Errorf("responses changes = %+v", changes)
+	}
+
+	anthropic := `{"model":"claude-3-5-sonnet-latest","system":[{"type":"text","text":"Owner: erin@example.com"}],"messages":[
+		{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"SSN 123-45-6789"}]}
+	]}`
+	modified, changes := redactRequestPII(piiRedactAll, []byte(anthropic))
+	if len(changes) != 2 || changes[0].Source != "system" || changes[0].Field != "text" || changes[1].Field != "content[0].content" {
+		t.Errorf("anthropic changes = %+v", changes)
+	}
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(modified, &parsed); err != nil {
+		t.Fatalf("modified body is not JSON: %v", err)
+	}
+}
+
+func TestRedactRequestPIICleanBodyUnchanged(t *testing.T) {
+	body := []byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"hello"}]}`)
+	modified, changes := redactRequestPII(piiRedactAll, body)
+	if changes != nil || string(modified) != string(body) {
+		t.Errorf("clean body rewritten: %s %+v", modified, changes)
+	}
+}
+
+func TestPreventionBlocksPIIInEarlierTurn(t *testing.T) {
+	cfg := &Config{Prevention: PreventionConfig{PII: PIIConfig{Enabled: true, BlockSSN: true, RedactMode: "block"}}}
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"SSN 123-45-6789"},{"role":"assistant","content":"ok"},{"role":"user","content":"thanks"}]}`
+
+	result := EvaluatePrevention(cfg, []byte(body), "thanks", nil, "gpt-4", 0)
+	if !result.Blocked {
+		t.Fatal("PII in an earlier turn should block")
+	}
+	if len(result.PIIChanges) != 1 || result.PIIChanges[0].Index != 0 {
+		t.Errorf("PIIChanges = %+v", result.PIIChanges)
+	}
+	// The blocked request can still be stored with the SSN masked.
+	if masked := MaskRequestPII(cfg.Prevention.PII, []byte(body)); strings.Contains(string(masked), "123-45-6789") || !strings.Contains(string(masked), "thanks") {
+		t.Errorf("masked = %s", masked)
+	}
+}
+
+func TestPreventionRedactsPIIAndFiltersTools(t *testing.T) {
+	cfg := &Config{Prevention: PreventionConfig{
+		PII:   PIIConfig{Enabled: true, BlockEmail: true, RedactMode: "redact"},
+		Tools: ToolFilterConfig{Enabled: true, Blocklist: []string{"shell"}},
+	}}
+	body := `{"model":"gpt-4","messages":[{"role":"system","content":"cc admin@example.com"},{"role":"user","content":"hi"}],
+		"tools":[{"type":"function","function":{"name":"shell"}},{"type":"function","function":{"name":"search"}}]}`
+
+	result := EvaluatePrevention(cfg, []byte(body), "hi", []string{"shell", "search"}, "gpt-4", 0)
+	got := string(result.ModifiedBody)
+	if !result.PIIRedacted || strings.Contains(got, "admin@example.com") {
+		t.Errorf("system prompt not redacted: %s", got)
+	}
+	if !result.ToolsFiltered || strings.Contains(got, `"shell"`) || !strings.Contains(got, `"search"`) {
+		t.Errorf("tools not filtered: %s", got)
+	}
+}
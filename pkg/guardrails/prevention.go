@@ -2,7 +2,10 @@ package guardrails
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
 )
 
 // PreventionResult describes what happened when prevention policies evaluated a request.
@@ -10,20 +13,35 @@ type PreventionResult struct {
 	// Blocked is true if the request should be rejected entirely.
 	Blocked     bool
 	BlockReason string
+	BlockRule   string // pii, prompt_injection or tool_filter
 
 	// ModifiedBody is the modified JSON request body to send upstream.
 	// nil means use the original body unchanged.
 	ModifiedBody []byte
 
 	// Tracking fields for logging / alerting.
-	ModelDowngraded string // original model if downgraded, empty if not
-	PIIRedacted     bool
-	ToolsFiltered   bool
+	ModelDowngraded  string // original model if downgraded, empty if not
+	PIIRedacted      bool
+	ToolsFiltered    bool
+	ToolsConstrained bool     // tool schemas annotated with argument rules
+	ToolsRemoved     []string // tools the filter removed, or all of them if it blocked
+
+	// PIIChanges lists every request field where PII was found.
+	PIIChanges []PIIChange
+
+	// Injections lists messages the prompt-injection rule acted on.
+	Injections        []InjectionFinding
+	InjectionStripped bool
+
+	// Shadow lists what rules in shadow mode would have done. Their
+	// decisions never block or modify the request.
+	Shadow []ShadowDecision
 }
 
 // EvaluatePrevention runs all prevention policies against the request.
-// Policies run in order: PII → Tools → Model Downgrade.
+// Policies run in order: PII → Prompt Injection → Tools → Model Downgrade.
 // If any policy blocks, we return immediately. Otherwise, modifications accumulate.
+// Rules in shadow mode are evaluated on the same body but only add to Shadow.
 //
 // Returns a result with Blocked=false and ModifiedBody=nil if no prevention config exists.
 func EvaluatePrevention(cfg *Config, reqBody []byte, promptText string, toolNames []string, model string, sessionTokens int) *PreventionResult {
@@ -36,46 +54,113 @@ func EvaluatePrevention(cfg *Config, reqBody []byte, promptText string, toolName
 
 	// Track whether we need to rewrite the request body.
 	needsRewrite := false
-	newPrompt := promptText
+	body := reqBody
 	newTools := toolNames
 	newModel := model
 
 	// --- Rule 1: PII blocking/redaction ---
-	if prev.PII.Enabled {
-		blocked, redacted := checkPII(prev.PII, promptText)
-		if blocked {
+	// Every message is scanned: system prompts, earlier turns, tool results
+	// and tool-call arguments, not just the latest user prompt. Tokenize mode
+	// needs the session's pseudonym store and is applied by PseudonymizeRequest,
+	// except in shadow mode, which never rewrites the request.
+	piiShadowed := cfg.Shadowed("pii")
+	if prev.PII.Enabled && (prev.PII.RedactMode != PIITokenize || piiShadowed) {
+		redactedBody, changes := redactRequestPII(prev.PII, reqBody)
+		promptBlocked, _ := checkPII(prev.PII, promptText)
+		if piiShadowed {
+			if d, ok := shadowPII(prev.PII, changes, promptBlocked); ok {
+				result.Shadow = append(result.Shadow, d)
+			}
+			redactedBody = reqBody
+		} else if result.PIIChanges = changes; PIIBlocked(changes) || promptBlocked {
 			result.Blocked = true
 			result.BlockReason = "PII detected in request (policy: block)"
+			result.BlockRule = "pii"
 			return result
 		}
-		if redacted != promptText {
-			newPrompt = redacted
+		if string(redactedBody) != string(reqBody) {
+			body = redactedBody
 			result.PIIRedacted = true
-			needsRewrite = true
-			log.Printf("[prevention] PII redacted from prompt")
+			log.Printf("[prevention] PII redacted from %d request field(s)", len(changes))
 		}
 	}
 
-	// --- Rule 2: Tool filtering ---
+	// --- Rule 2: Prompt injection ---
+	// Scores each message on heuristics; thresholds per source (tool results,
+	// user turns, ...) decide whether to block, strip the text or annotate.
+	if prev.Injection.Enabled && cfg.Shadowed("prompt_injection") {
+		_, findings := evaluateInjection(prev.Injection, body)
+		for _, f := range findings {
+			result.Shadow = append(result.Shadow, ShadowDecision{
+				Rule:   "prompt_injection",
+				Action: f.Action,
+				Reason: fmt.Sprintf("%s[%d] (%s, score %.2f)", f.Source, f.Index, strings.Join(f.Signals, ", "), f.Score),
+			})
+		}
+	} else if prev.Injection.Enabled {
+		stripped, findings := evaluateInjection(prev.Injection, body)
+		result.Injections = findings
+		for _, f := range findings {
+			if f.Action == InjectionBlock {
+				result.Blocked = true
+				result.BlockReason = fmt.Sprintf("prompt injection suspected in %s[%d] (%s, score %.2f)",
+					f.Source, f.Index, strings.Join(f.Signals, ", "), f.Score)
+				result.BlockRule = "prompt_injection"
+				return result
+			}
+		}
+		if stripped != nil {
+			body = stripped
+			result.InjectionStripped = true
+			log.Printf("[prevention] prompt injection: stripped %d message(s)", countInjections(findings, InjectionStrip))
+		}
+	}
+
+	// --- Rule 3: Tool filtering ---
+	// Argument rules are enforced on the calls the model makes (see
+	// CheckToolCalls); here they are only written into the tool schemas.
+	toolsShadowed := cfg.Shadowed("tool_filter")
+	if prev.Tools.Enabled && !toolsShadowed {
+		if constrained := constrainToolSchemas(prev.Tools.Rules, body); constrained != nil {
+			body = constrained
+			result.ToolsConstrained = true
+		}
+	}
 	if prev.Tools.Enabled && len(toolNames) > 0 {
 		filtered := filterTools(prev.Tools, toolNames)
-		if len(filtered) == 0 && len(toolNames) > 0 {
+		switch {
+		case toolsShadowed && len(filtered) == 0:
+			result.Shadow = append(result.Shadow, ShadowDecision{
+				Rule: "tool_filter", Action: "block", Reason: "all requested tools are blocked by policy",
+			})
+		case toolsShadowed && len(filtered) != len(toolNames):
+			result.Shadow = append(result.Shadow, ShadowDecision{
+				Rule: "tool_filter", Action: "filter_tools",
+				Reason: "would remove " + strings.Join(removedTools(toolNames, filtered), ", "),
+			})
+		case len(filtered) == 0:
 			result.Blocked = true
 			result.BlockReason = "all requested tools are blocked by policy"
+			result.BlockRule = "tool_filter"
+			result.ToolsRemoved = toolNames
 			return result
-		}
-		if len(filtered) != len(toolNames) {
+		case len(filtered) != len(toolNames):
 			newTools = filtered
 			result.ToolsFiltered = true
+			result.ToolsRemoved = removedTools(toolNames, filtered)
 			needsRewrite = true
 			log.Printf("[prevention] tools filtered: %d → %d", len(toolNames), len(filtered))
 		}
 	}
 
-	// --- Rule 3: Model downgrade ---
+	// --- Rule 4: Model downgrade ---
 	if prev.ModelLimits.Enabled {
 		downgraded := checkModelDowngrade(prev.ModelLimits, model, sessionTokens)
-		if downgraded != model {
+		if downgraded != model && cfg.Shadowed("model_downgrade") {
+			result.Shadow = append(result.Shadow, ShadowDecision{
+				Rule: "model_downgrade", Action: "downgrade", Reason: model + " → " + downgraded,
+			})
+		} else if downgraded != model {
 			result.ModelDowngraded = model
 			newModel = downgraded
 			needsRewrite = true
@@ -85,21 +170,79 @@ func EvaluatePrevention(cfg *Config, reqBody []byte, promptText string, toolName
 
 	// If any modifications were made, rewrite the request body.
 	if needsRewrite {
-		modified, err := modifyRequestBody(reqBody, newPrompt, newTools, newModel, promptText)
+		modified, err := modifyRequestBody(body, newTools, newModel)
 		if err != nil {
 			log.Printf("[prevention] failed to modify request body: %v", err)
 			// Fall through with original body rather than blocking.
 			return result
 		}
-		result.ModifiedBody = modified
+		body = modified
+	}
+	if result.PIIRedacted || result.InjectionStripped || result.ToolsConstrained || needsRewrite {
+		result.ModifiedBody = body
 	}
 
 	return result
 }
 
+// shadowPII describes what the PII rule would have done with its changes.
+func shadowPII(cfg PIIConfig, changes []PIIChange, promptBlocked bool) (ShadowDecision, bool) {
+	d := ShadowDecision{Rule: "pii"}
+	switch {
+	case PIIBlocked(changes) || promptBlocked:
+		d.Action = "block"
+	case len(changes) > 0:
+		d.Action = "flag"
+		for _, c := range changes {
+			if c.Action == "redacted" {
+				d.Action = "redact"
+				if cfg.RedactMode == PIITokenize {
+					d.Action = "tokenize"
+				}
+			}
+		}
+	default:
+		return d, false
+	}
+	var types []string
+	for t := range PIICounts(changes) {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	d.Reason = fmt.Sprintf("PII in %d request field(s): %s", len(changes), strings.Join(types, ", "))
+	return d, true
+}
+
+// removedTools lists the tools in requested that filtered dropped.
+func removedTools(requested, filtered []string) []string {
+	kept := make(map[string]bool, len(filtered))
+	for _, t := range filtered {
+		kept[t] = true
+	}
+	var removed []string
+	for _, t := range requested {
+		if !kept[t] {
+			removed = append(removed, t)
+		}
+	}
+	return removed
+}
+
+// countInjections counts findings that took the given action.
+func countInjections(findings []InjectionFinding, action string) int {
+	n := 0
+	for _, f := range findings {
+		if f.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
 // modifyRequestBody applies prevention modifications to the raw JSON request.
-// It updates messages (for PII redaction), tools (for filtering), and model (for downgrade).
-func modifyRequestBody(body []byte, newPrompt string, newTools []string, newModel string, originalPrompt string) ([]byte, error) {
+// It updates tools (for filtering) and model (for downgrade).
+// PII redaction rewrites the body separately, before this runs.
+func modifyRequestBody(body []byte, newTools []string, newModel string) ([]byte, error) {
 	// Parse the body into a generic map to preserve all fields.
 	var req map[string]json.RawMessage
 	if err := json.Unmarshal(body, &req); err != nil {
@@ -112,14 +255,6 @@ func modifyRequestBody(body []byte, newPrompt string, newTools []string, newMode
 		req["model"] = modelJSON
 	}
 
-	// Update messages if prompt was redacted (PII).
-	if newPrompt != originalPrompt {
-		if messagesRaw, ok := req["messages"]; ok {
-			modified := redactMessagesJSON(messagesRaw, originalPrompt, newPrompt)
-			req["messages"] = modified
-		}
-	}
-
 	// Update tools if filtered.
 	if newTools != nil {
 		if toolsRaw, ok := req["tools"]; ok {
@@ -128,71 +263,7 @@ func modifyRequestBody(body []byte, newPrompt string, newTools []string, newMode
 		}
 	}
 
-	return json.Marshal(req)
-}
-
-// redactMessagesJSON replaces occurrences of originalText with redactedText
-// in the messages array.
-func redactMessagesJSON(messagesRaw json.RawMessage, original, redacted string) json.RawMessage {
-	var messages []map[string]json.RawMessage
-	if err := json.Unmarshal(messagesRaw, &messages); err != nil {
-		return messagesRaw // can't parse, return original
-	}
-
-	for i, msg := range messages {
-		roleRaw, ok := msg["role"]
-		if !ok {
-			continue
-		}
-		var role string
-		if err := json.Unmarshal(roleRaw, &role); err != nil || role != "user" {
-			continue
-		}
-
-		contentRaw, ok := msg["content"]
-		if !ok {
-			continue
-		}
-
-		// Try string content.
-		var text string
-		if err := json.Unmarshal(contentRaw, &text); err == nil {
-			if text == original {
-				newContent, _ := json.Marshal(redacted)
-				messages[i]["content"] = newContent
-			}
-			continue
-		}
-
-		// Try array-of-parts content.
-		var parts []map[string]json.RawMessage
-		if err := json.Unmarshal(contentRaw, &parts); err == nil {
-			for j, part := range parts {
-				typeRaw, ok := part["type"]
-				if !ok {
-					continue
-				}
-				var partType string
-				if err := json.Unmarshal(typeRaw, &partType); err != nil || partType != "text" {
-					continue
-				}
-				textRaw, ok := part["text"]
-				if !ok {
-					continue
-				}
-				var partText string
-				if err := json.Unmarshal(textRaw, &partText); err == nil && partText == original {
-					newText, _ := json.Marshal(redacted)
-					parts[j]["text"] = newText
-				}
-			}
-			newParts, _ := json.Marshal(parts)
-			messages[i]["content"] = newParts
-		}
-	}
-
-	result, _ := json.Marshal(messages)
-	return result
+	return marshalNoEscape(req)
 }
 
 // filterToolsJSON keeps only tools whose function.name is in the allowed list.
@@ -209,7 +280,9 @@ func filterToolsJSON(toolsRaw json.RawMessage, allowed []string) json.RawMessage
 
 	var filtered []json.RawMessage
 	for _, toolRaw := range tools {
+		// OpenAI nests the name under function; Anthropic puts it at the top level.
 		var tool struct {
+			Name     string `json:"name"`
 			Function struct {
 				Name string `json:"name"`
 			} `json:"function"`
@@ -217,7 +290,11 @@ func filterToolsJSON(toolsRaw json.RawMessage, allowed []string) json.RawMessage
 		if err := json.Unmarshal(toolRaw, &tool); err != nil {
 			continue
 		}
-		if allowSet[tool.Function.Name] {
+		name := tool.Function.Name
+		if name == "" {
+			name = tool.Name
+		}
+		if allowSet[name] {
 			filtered = append(filtered, toolRaw)
 		}
 	}
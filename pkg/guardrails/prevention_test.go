@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -28,6 +29,9 @@ func TestPIIBlockSSN(t *testing.T) {
 	if !result.Blocked {
 		t.Fatal("expected request to be blocked for SSN")
 	}
+	if result.BlockRule != "pii" {
+		t.Errorf("block rule = %q, want pii", result.BlockRule)
+	}
 }
 
 func TestPIIRedactEmail(t *testing.T) {
@@ -149,6 +153,9 @@ func TestToolAllToolsBlocked(t *testing.T) {
 	if !result.Blocked {
 		t.Fatal("expected request to be blocked when all tools are filtered")
 	}
+	if result.BlockRule != "tool_filter" || len(result.ToolsRemoved) != 2 {
+		t.Errorf("block rule %q, removed %v", result.BlockRule, result.ToolsRemoved)
+	}
 }
 
 func TestToolFilterDisabled(t *testing.T) {
@@ -365,6 +372,28 @@ func TestApprovalTimeout(t *testing.T) {
 	}
 }
 
+func TestDecideApprovalReportsReasonAndSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ApprovalResponse{Approved: false, Reason: "too risky"})
+	}))
+	defer srv.Close()
+
+	v := &Violation{Rule: "token_budget", SessionID: "test", Message: "budget exceeded"}
+	cfg := ApprovalConfig{Enabled: true, WebhookURL: srv.URL, TimeoutSeconds: 5, Rules: []string{"token_budget"}}
+	if d, _ := DecideApproval(context.Background(), cfg, v); d != (ApprovalDecision{Reason: "too risky", Source: ApprovalWebhook}) {
+		t.Errorf("webhook decision = %+v", d)
+	}
+
+	srv.Close()
+	cfg.FallbackAllow = true
+	if d, _ := DecideApproval(context.Background(), cfg, v); !d.Approved || d.Source != ApprovalFallback || !strings.Contains(d.Reason, "webhook error") {
+		t.Errorf("fallback decision = %+v", d)
+	}
+	if d, _ := DecideApproval(context.Background(), cfg, &Violation{Rule: "error_spiral"}); d != (ApprovalDecision{Source: ApprovalNotRequired}) {
+		t.Errorf("rule not in list = %+v", d)
+	}
+}
+
 func TestApprovalDisabled(t *testing.T) {
 	cfg := ApprovalConfig{Enabled: false}
 	v := &Violation{Rule: "token_budget", SessionID: "test", Message: "test"}
@@ -374,6 +403,17 @@ func TestApprovalDisabled(t *testing.T) {
 	}
 }
 
+func TestDecideApprovalWithoutWebhookFollowsFallback(t *testing.T) {
+	v := &Violation{Rule: "token_budget", SessionID: "test", Message: "test"}
+	for _, allow := range []bool{false, true} {
+		cfg := ApprovalConfig{Enabled: true, FallbackAllow: allow}
+		d, err := DecideApproval(context.Background(), cfg, v)
+		if err != nil || d.Approved != allow || d.Source != ApprovalFallback || d.Reason != "no webhook_url configured" {
+			t.Errorf("fallback_allow=%v: decision = %+v, err = %v", allow, d, err)
+		}
+	}
+}
+
 func TestApprovalRuleNotInList(t *testing.T) {
 	cfg := ApprovalConfig{
 		Enabled:    true,
@@ -0,0 +1,115 @@
+package guardrails
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ModelPrice is the USD price per million tokens for one model.
+// CachedInput applies to prompt tokens served from the provider's prompt cache;
+// if zero, cached tokens are billed at the Input rate.
+type ModelPrice struct {
+	Input       float64 `yaml:"input"`
+	Output      float64 `yaml:"output"`
+	CachedInput float64 `yaml:"cached_input"`
+}
+
+// PricingConfig maps model names to prices. Keys match either the exact model
+// name or the name followed by a version or date suffix, so "gpt-4o" also
+// prices "gpt-4o-2024-08-06" but not "gpt-4o-mini".
+type PricingConfig struct {
+	Models map[string]ModelPrice `yaml:"models"`
+}
+
+// defaultModelPrices are list prices (USD per 1M tokens) for common models.
+// Entries in guardrails.yaml override these per model.
+var defaultModelPrices = map[string]ModelPrice{
+	"gpt-4o":            {Input: 2.50, Output: 10.00, CachedInput: 1.25},
+	"gpt-4o-mini":       {Input: 0.15, Output: 0.60, CachedInput: 0.075},
+	"gpt-4-turbo":       {Input: 10.00, Output: 30.00},
+	"gpt-4":             {Input: 30.00, Output: 60.00},
+	"gpt-3.5-turbo":     {Input: 0.50, Output: 1.50},
+	"o1":                {Input: 15.00, Output: 60.00, CachedInput: 7.50},
+	"o1-mini":           {Input: 1.10, Output: 4.40, CachedInput: 0.55},
+	"o3-mini":           {Input: 1.10, Output: 4.40, CachedInput: 0.55},
+	"claude-3-5-sonnet": {Input: 3.00, Output: 15.00, CachedInput: 0.30},
+	"claude-3-5-haiku":  {Input: 0.80, Output: 4.00, CachedInput: 0.08},
+	"claude-3-opus":     {Input: 15.00, Output: 75.00, CachedInput: 1.50},
+	"claude-3-haiku":    {Input: 0.25, Output: 1.25, CachedInput: 0.03},
+}
+
+// versionSuffix matches what may follow a priced name in a model ID: a date
+// ("-2024-08-06", "-20241022"), a short version ("-0613") or "-latest".
+var versionSuffix = regexp.MustCompile(`^-(\d{4}-\d{2}-\d{2}|\d{8}|\d{4}|latest)$`)
+
+// Lookup returns the price for a model, matched case-insensitively by exact
+// name or by a name plus a version suffix. Other models, e.g. "gpt-4.1" for
+// "gpt-4", are unknown and return false rather than a guessed price.
+func (p PricingConfig) Lookup(model string) (ModelPrice, bool) {
+	if price, ok := p.Models[model]; ok {
+		return price, true
+	}
+
+	lower := strings.ToLower(model)
+	best := ""
+	for name := range p.Models {
+		rest, ok := strings.CutPrefix(lower, strings.ToLower(name))
+		if ok && (rest == "" || versionSuffix.MatchString(rest)) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return ModelPrice{}, false
+	}
+	return p.Models[best], true
+}
+
+// unpricedModels holds the models already logged as having no price.
+var unpricedModels sync.Map
+
+// Cost returns the USD cost of one response. Unknown models cost 0 so that a
+// missing price never blocks traffic; each is logged once.
+func (p PricingConfig) Cost(model string, usage Usage) float64 {
+	price, ok := p.Lookup(model)
+	if !ok {
+		if _, logged := unpricedModels.LoadOrStore(model, true); !logged {
+			log.Printf("[guardrails] no price for model %q; its calls count as $0 toward cost budgets", model)
+		}
+		return 0
+	}
+
+	cached := usage.CachedTokens
+	if cached > usage.PromptTokens {
+		cached = usage.PromptTokens
+	}
+	cachedRate := price.CachedInput
+	if cachedRate == 0 {
+		cachedRate = price.Input
+	}
+
+	uncached := float64(usage.PromptTokens - cached)
+	cost := uncached*price.Input + float64(cached)*cachedRate + float64(usage.CompletionTokens)*price.Output
+	return cost / 1_000_000.0
+}
+
+// applyPricingDefaults fills in built-in prices for models the config does not list.
+func applyPricingDefaults(p *PricingConfig) {
+	if p.Models == nil {
+		p.Models = make(map[string]ModelPrice, len(defaultModelPrices))
+	}
+	for name, price := range defaultModelPrices {
+		if _, ok := p.Models[name]; !ok {
+			p.Models[name] = price
+		}
+	}
+}
+
+// DefaultPricing returns the built-in prices, for pricing calls made without
+// a guardrails config.
+func DefaultPricing() PricingConfig {
+	var p PricingConfig
+	applyPricingDefaults(&p)
+	return p
+}
@@ -0,0 +1,101 @@
+package guardrails
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPricingLookupPrefix(t *testing.T) {
+	p := PricingConfig{Models: map[string]ModelPrice{
+		"gpt-4o":      {Input: 2.50, Output: 10.00},
+		"gpt-4o-mini": {Input: 0.15, Output: 0.60},
+	}}
+
+	price, ok := p.Lookup("gpt-4o-mini-2024-07-18")
+	if !ok || price.Input != 0.15 {
+		t.Fatalf("expected longest prefix gpt-4o-mini, got %+v ok=%v", price, ok)
+	}
+	price, ok = p.Lookup("gpt-4o-2024-08-06")
+	if !ok || price.Input != 2.50 {
+		t.Fatalf("expected gpt-4o pricing, got %+v ok=%v", price, ok)
+	}
+	if _, ok := p.Lookup("unknown-model"); ok {
+		t.Fatal("expected unknown model to have no price")
+	}
+}
+
+func TestPricingLookupOnlyAcceptsVersionSuffixes(t *testing.T) {
+	p := DefaultPricing()
+	for model, want := range map[string]float64{
+		"gpt-4-0613":                 30.00,
+		"GPT-4o-2024-08-06":          2.50,
+		"claude-3-5-sonnet-20241022": 3.00,
+		"claude-3-5-haiku-latest":    0.80,
+		"o1-2024-12-17":              15.00,
+	} {
+		if price, ok := p.Lookup(model); !ok || price.Input != want {
+			t.Errorf("%s: price %+v ok=%v, want input %v", model, price, ok, want)
+		}
+	}
+	for _, model := range []string{"gpt-4.1", "gpt-4.1-mini", "o1-pro", "gpt-4o-mini-audio", "claude-3-5-sonnetx"} {
+		if price, ok := p.Lookup(model); ok {
+			t.Errorf("%s priced as %+v, want unpriced", model, price)
+		}
+	}
+}
+
+func TestPricingCostSplitsInputOutputAndCached(t *testing.T) {
+	p := PricingConfig{Models: map[string]ModelPrice{
+		"gpt-4o": {Input: 2.00, Output: 10.00, CachedInput: 1.00},
+	}}
+
+	// 1M prompt tokens (400k cached) + 100k completion tokens.
+	cost := p.Cost("gpt-4o", Usage{PromptTokens: 1_000_000, CachedTokens: 400_000, CompletionTokens: 100_000})
+	want := 0.6*2.00 + 0.4*1.00 + 0.1*10.00
+	if math.Abs(cost-want) > 1e-9 {
+		t.Fatalf("cost = %f, want %f", cost, want)
+	}
+
+	if cost := p.Cost("mystery", Usage{PromptTokens: 1000}); cost != 0 {
+		t.Fatalf("unknown model cost = %f, want 0", cost)
+	}
+}
+
+func TestApplyPricingDefaultsKeepsOverrides(t *testing.T) {
+	cfg := &Config{Pricing: PricingConfig{Models: map[string]ModelPrice{
+		"gpt-4o": {Input: 1, Output: 2},
+	}}}
+	applyDefaults(cfg)
+
+	if cfg.Pricing.Models["gpt-4o"].Input != 1 {
+		t.Fatal("configured price should override the built-in default")
+	}
+	if _, ok := cfg.Pricing.Models["gpt-4o-mini"]; !ok {
+		t.Fatal("expected built-in default for gpt-4o-mini")
+	}
+}
+
+func TestCostBudgetExceeded(t *testing.T) {
+	cfg := &Config{
+		Budgets: BudgetConfig{MaxSessionCostUSD: 1.00},
+	}
+	mgr := NewManager(5 * time.Minute)
+	sid := "test-cost-budget"
+
+	mgr.GetOrCreate(sid)
+	mgr.RecordResponse(sid, Usage{PromptTokens: 100, CostUSD: 0.60}, false)
+
+	if v := Evaluate(cfg, mgr, sid, &EvalRequest{PromptText: "hello"}); v != nil {
+		t.Fatalf("expected no violation under budget, got %+v", v)
+	}
+
+	mgr.RecordResponse(sid, Usage{PromptTokens: 100, CostUSD: 0.50}, false)
+	v := Evaluate(cfg, mgr, sid, &EvalRequest{PromptText: "hello"})
+	if v == nil {
+		t.Fatal("expected violation, got nil")
+	}
+	if v.Rule != "cost_budget" {
+		t.Fatalf("expected rule cost_budget, got %s", v.Rule)
+	}
+}
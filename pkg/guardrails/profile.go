@@ -0,0 +1,93 @@
+package guardrails
+
+// Profiles let gateway keys opt into different detection rules and rate
+// limits: a key names a profile, and the profile's settings replace the
+// top-level ones for that key's requests. Fields a profile leaves out keep
+// the top-level values.
+
+// Profile overrides the per-session detection rules and the rate limits.
+type Profile struct {
+	DetectionRules `yaml:",inline"`
+	RateLimits     RateLimitConfig `yaml:"rate_limits"`
+}
+
+// WithProfile returns the config with the named profile applied, or false
+// if there is no such profile. An empty name returns c itself.
+func (c *Config) WithProfile(name string) (*Config, bool) {
+	if name == "" {
+		return c, true
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return nil, false
+	}
+	cp := *c
+
+	b := &cp.Budgets
+	overrideInt(&b.MaxSessionTokens, p.Budgets.MaxSessionTokens)
+	overrideFloat(&b.MaxSessionCostUSD, p.Budgets.MaxSessionCostUSD)
+	overrideString(&b.Mode, p.Budgets.Mode)
+
+	lc := &cp.LoopDetection
+	overrideFloat(&lc.SimilarPromptThreshold, p.LoopDetection.SimilarPromptThreshold)
+	overrideInt(&lc.MaxSimilarPrompts, p.LoopDetection.MaxSimilarPrompts)
+	overrideInt(&lc.WindowSeconds, p.LoopDetection.WindowSeconds)
+	overrideString(&lc.Mode, p.LoopDetection.Mode)
+
+	tc := &cp.ToolProtection
+	overrideInt(&tc.MaxRepeatCalls, p.ToolProtection.MaxRepeatCalls)
+	overrideInt(&tc.RepeatWindowSeconds, p.ToolProtection.RepeatWindowSeconds)
+	overrideString(&tc.Mode, p.ToolProtection.Mode)
+
+	overrideInt(&cp.RetryProtection.MaxConsecutiveErrors, p.RetryProtection.MaxConsecutiveErrors)
+	overrideString(&cp.RetryProtection.Mode, p.RetryProtection.Mode)
+
+	rl := &cp.RateLimits
+	overrideString(&rl.Mode, p.RateLimits.Mode)
+	overrideRate(&rl.PerKey, p.RateLimits.PerKey)
+	overrideRate(&rl.PerSession, p.RateLimits.PerSession)
+	overrideRate(&rl.PerModel, p.RateLimits.PerModel)
+	overrideRate(&rl.PerProvider, p.RateLimits.PerProvider)
+	if p.RateLimits.Models != nil {
+		rl.Models = p.RateLimits.Models
+	}
+	if p.RateLimits.Providers != nil {
+		rl.Providers = p.RateLimits.Providers
+	}
+	return &cp, true
+}
+
+// WithBudgets returns the config with the session budgets replaced by the
+// non-zero limits given, e.g. a gateway key's own budgets.
+func (c *Config) WithBudgets(maxTokens int, maxCostUSD float64) *Config {
+	if maxTokens == 0 && maxCostUSD == 0 {
+		return c
+	}
+	cp := *c
+	overrideInt(&cp.Budgets.MaxSessionTokens, maxTokens)
+	overrideFloat(&cp.Budgets.MaxSessionCostUSD, maxCostUSD)
+	return &cp
+}
+
+func overrideInt(dst *int, v int) {
+	if v != 0 {
+		*dst = v
+	}
+}
+
+func overrideFloat(dst *float64, v float64) {
+	if v != 0 {
+		*dst = v
+	}
+}
+
+func overrideString(dst *string, v string) {
+	if v != "" {
+		*dst = v
+	}
+}
+
+func overrideRate(dst *RateLimit, v RateLimit) {
+	overrideInt(&dst.RPM, v.RPM)
+	overrideInt(&dst.TPM, v.TPM)
+}
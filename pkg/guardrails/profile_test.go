@@ -0,0 +1,63 @@
+package guardrails
+
+import "testing"
+
+func TestConfigWithProfile(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`budgets:
+  max_session_tokens: 50000
+  max_session_cost_usd: 10
+rate_limits:
+  per_key: {rpm: 100, tpm: 10000}
+profiles:
+  strict:
+    budgets:
+      max_session_tokens: 5000
+    loop_detection:
+      max_similar_prompts: 2
+    rate_limits:
+      per_key: {rpm: 10}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if same, ok := cfg.WithProfile(""); !ok || same != cfg {
+		t.Error("empty profile should return the config itself")
+	}
+	if _, ok := cfg.WithProfile("lenient"); ok {
+		t.Error("unknown profile accepted")
+	}
+
+	strict, ok := cfg.WithProfile("strict")
+	if !ok {
+		t.Fatal("strict profile not found")
+	}
+	if strict.Budgets.MaxSessionTokens != 5000 || strict.Budgets.MaxSessionCostUSD != 10 {
+		t.Errorf("budgets = %+v", strict.Budgets)
+	}
+	if lc := strict.LoopDetection; lc.MaxSimilarPrompts != 2 || lc.WindowSeconds != 60 || lc.SimilarPromptThreshold != 0.80 {
+		t.Errorf("loop detection = %+v", lc)
+	}
+	if rl := strict.RateLimits.PerKey; rl.RPM != 10 || rl.TPM != 10000 {
+		t.Errorf("rate limits = %+v", rl)
+	}
+	if cfg.Budgets.MaxSessionTokens != 50000 || cfg.RateLimits.PerKey.RPM != 100 {
+		t.Error("applying a profile changed the base config")
+	}
+
+	keyed := strict.WithBudgets(0, 2.5)
+	if keyed.Budgets.MaxSessionTokens != 5000 || keyed.Budgets.MaxSessionCostUSD != 2.5 {
+		t.Errorf("key budgets = %+v", keyed.Budgets)
+	}
+}
+
+func TestParseConfigProfileErrors(t *testing.T) {
+	_, err := ParseConfig([]byte("profiles:\n  strict:\n    budgets:\n      max_session_tokens: -1\n    rate_limits:\n      mode: sometimes\n"))
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	errs := err.(ConfigErrors)
+	if len(errs) != 2 || errs[0].Field != "profiles.strict.budgets.max_session_tokens" || errs[1].Field != "profiles.strict.rate_limits.mode" {
+		t.Errorf("errors = %v", err)
+	}
+}
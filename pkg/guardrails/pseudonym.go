@@ -0,0 +1,306 @@
+package guardrails
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PIITokenize is the PII redact mode that swaps each value for a stable
+// per-session placeholder such as <EMAIL_1> and restores it in the response.
+const PIITokenize = "tokenize"
+
+// placeholderRegex matches the placeholders minted by PseudonymStore.
+var placeholderRegex = regexp.MustCompile(`<[A-Z][A-Z_]*_\d+>`)
+
+// partialPlaceholderRegex matches the start of a placeholder at the end of a
+// stream delta, which is held back until the next delta completes it.
+var partialPlaceholderRegex = regexp.MustCompile(`<[A-Z_]*\d*$`)
+
+// maxPlaceholderLen bounds how much text a stream delta can hold back.
+const maxPlaceholderLen = 32
+
+// pseudonymTable is one scope's value → placeholder mapping.
+type pseudonymTable struct {
+	byValue  map[string]string // raw value → placeholder
+	counters map[string]int    // placeholder kind → last number issued
+	lastUsed time.Time
+}
+
+// PseudonymStore holds short-lived PII placeholder tables, one per scope
+// (the caller's session), so a value keeps its placeholder for the whole
+// conversation. Restoring uses the request's own Pseudonyms, never the
+// store. Tables are dropped once idle for longer than the TTL.
+type PseudonymStore struct {
+	mu       sync.Mutex
+	sessions map[string]*pseudonymTable
+	ttl      time.Duration
+}
+
+// NewPseudonymStore creates a store whose tables expire after ttl idle.
+func NewPseudonymStore(ttl time.Duration) *PseudonymStore {
+	s := &PseudonymStore{
+		sessions: make(map[string]*pseudonymTable),
+		ttl:      ttl,
+	}
+	go s.cleanupLoop()
+	return s
+}
+
+// table returns the scope's live table, creating it if needed.
+// The caller must hold s.mu.
+func (s *PseudonymStore) table(scope string) *pseudonymTable {
+	t, ok := s.sessions[scope]
+	if !ok || time.Since(t.lastUsed) > s.ttl {
+		t = &pseudonymTable{
+			byValue:  make(map[string]string),
+			counters: make(map[string]int),
+		}
+		s.sessions[scope] = t
+	}
+	t.lastUsed = time.Now()
+	return t
+}
+
+// Tokenize returns the scope's placeholder for value, minting the next one
+// for its kind (e.g. <EMAIL_2>) if the value has not been seen before.
+func (s *PseudonymStore) Tokenize(scope, label, value string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.table(scope)
+	if token, ok := t.byValue[value]; ok {
+		return token
+	}
+	kind := strings.ToUpper(label)
+	t.counters[kind]++
+	token := fmt.Sprintf("<%s_%d>", kind, t.counters[kind])
+	t.byValue[value] = token
+	return token
+}
+
+// Forget drops a scope's mappings.
+func (s *PseudonymStore) Forget(scope string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, scope)
+}
+
+// cleanupLoop removes idle tables every minute.
+func (s *PseudonymStore) cleanupLoop() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.Lock()
+		now := time.Now()
+		for id, t := range s.sessions {
+			if now.Sub(t.lastUsed) > s.ttl {
+				delete(s.sessions, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Pseudonyms are the placeholders minted for one request and the values
+// they stand for. A response is restored from its own request's Pseudonyms
+// only, so a caller never gets back PII it did not send in that request,
+// even by echoing placeholders another caller's session was given.
+type Pseudonyms struct {
+	byToken map[string]string // placeholder → raw value
+}
+
+// Len returns the number of placeholders minted for the request.
+func (p *Pseudonyms) Len() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.byToken)
+}
+
+// Restore replaces the request's placeholders in text with their original
+// values. Other placeholders are left as they are.
+func (p *Pseudonyms) Restore(text string) string {
+	if p.Len() == 0 || !strings.Contains(text, "<") {
+		return text
+	}
+	return placeholderRegex.ReplaceAllStringFunc(text, func(token string) string {
+		if value, ok := p.byToken[token]; ok {
+			return value
+		}
+		return token
+	})
+}
+
+// PseudonymizeRequest replaces PII throughout a request (see redactRequestPII)
+// with the placeholders of the store's scope, usually the caller's session.
+// Returns the original body, nil changes and nil Pseudonyms if no PII was
+// found.
+func PseudonymizeRequest(cfg PIIConfig, store *PseudonymStore, scope string, body []byte) ([]byte, []PIIChange, *Pseudonyms) {
+	if store == nil {
+		return body, nil, nil
+	}
+	p := &Pseudonyms{byToken: make(map[string]string)}
+	body, changes := rewriteRequestPII(cfg, body, func(label, match string) string {
+		token := store.Tokenize(scope, label, match)
+		p.byToken[token] = match
+		return token
+	})
+	if p.Len() == 0 {
+		p = nil
+	}
+	return body, changes, p
+}
+
+// RestoreResponse puts the request's original values back into a
+// non-streaming response: the assistant message and tool-call arguments.
+// Returns nil if nothing was restored.
+func (p *Pseudonyms) RestoreResponse(body []byte) []byte {
+	if p.Len() == 0 {
+		return nil
+	}
+	doc, ok := decodeOutput(body)
+	if !ok {
+		return nil
+	}
+	changed := false
+	doc = walkOutput(doc, "", false,
+		func(_, text string) string {
+			restored := p.Restore(text)
+			if restored != text {
+				changed = true
+			}
+			return restored
+		},
+		func(string) {},
+	)
+	if !changed {
+		return nil
+	}
+	restored, err := marshalNoEscape(doc)
+	if err != nil {
+		return nil
+	}
+	return restored
+}
+
+// PseudonymRestorer restores placeholders in a streamed response one SSE
+// payload at a time. A placeholder split across deltas ("<EMA" + "IL_1>") is
+// completed by holding back the unfinished tail of a text field until the
+// next delta at the same JSON path arrives. Held text that the next payload
+// does not continue, or that is still held when the stream ends, is released
+// as a payload of its own, so no text is lost.
+type PseudonymRestorer struct {
+	pseudonyms *Pseudonyms
+	pending    map[string]heldText // JSON path → held-back text
+}
+
+// heldText is the tail of a text field held back from a payload.
+type heldText struct {
+	text    string
+	payload []byte // the payload it was held from
+}
+
+// NewPseudonymRestorer returns a restorer for the stream answering the
+// request p was minted for, or nil if it has no placeholders.
+func NewPseudonymRestorer(p *Pseudonyms) *PseudonymRestorer {
+	if p.Len() == 0 {
+		return nil
+	}
+	return &PseudonymRestorer{pseudonyms: p, pending: make(map[string]heldText)}
+}
+
+// RestorePayload rewrites one SSE data payload. Held text the payload does
+// not continue is returned in released, to be sent before out. Non-JSON
+// payloads such as [DONE] release everything and are returned unchanged.
+func (r *PseudonymRestorer) RestorePayload(payload []byte) (released [][]byte, out []byte) {
+	doc, ok := decodeOutput(payload)
+	if !ok {
+		return r.Flush(), payload
+	}
+	held := make(map[string]bool, len(r.pending))
+	for path := range r.pending {
+		held[path] = true
+	}
+	changed := false
+	doc = walkOutput(doc, "", false,
+		func(path, text string) string {
+			if h, ok := r.pending[path]; ok && held[path] {
+				text = h.text + text
+				delete(r.pending, path)
+				delete(held, path)
+				changed = true
+			}
+			if tail := partialPlaceholderRegex.FindString(text); tail != "" && len(tail) <= maxPlaceholderLen {
+				// The caller may reuse payload's memory.
+				r.pending[path] = heldText{text: tail, payload: append([]byte(nil), payload...)}
+				text = text[:len(text)-len(tail)]
+				changed = true
+			}
+			restored := r.pseudonyms.Restore(text)
+			if restored != text {
+				changed = true
+			}
+			return restored
+		},
+		func(string) {},
+	)
+	for _, path := range sortedKeys(held) {
+		released = append(released, r.release(path))
+	}
+	if !changed {
+		return released, payload
+	}
+	rewritten, err := marshalNoEscape(doc)
+	if err != nil {
+		return released, payload
+	}
+	return released, rewritten
+}
+
+// Flush releases all held text, e.g. when the stream ends.
+func (r *PseudonymRestorer) Flush() [][]byte {
+	var released [][]byte
+	for _, path := range sortedKeys(r.pending) {
+		released = append(released, r.release(path))
+	}
+	return released
+}
+
+// release forgets the text held at path and returns it as a copy of the
+// payload it was held from, with every other text field emptied.
+func (r *PseudonymRestorer) release(path string) []byte {
+	h := r.pending[path]
+	delete(r.pending, path)
+	doc, _ := decodeOutput(h.payload)
+	doc = walkOutput(doc, "", false,
+		func(p, _ string) string {
+			if p == path {
+				return r.pseudonyms.Restore(h.text)
+			}
+			return ""
+		},
+		func(string) {},
+	)
+	out, err := marshalNoEscape(doc)
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// decodeOutput parses a JSON response or event, keeping numbers exact.
+func decodeOutput(data []byte) (interface{}, bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, false
+	}
+	return doc, true
+}
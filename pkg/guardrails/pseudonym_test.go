@@ -0,0 +1,135 @@
+package guardrails
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPseudonymStoreStableTokens(t *testing.T) {
+	s := NewPseudonymStore(time.Minute)
+
+	a := s.Tokenize("s1", "email", "ann@example.com")
+	b := s.Tokenize("s1", "email", "bob@example.com")
+	again := s.Tokenize("s1", "email", "ann@example.com")
+	ssn := s.Tokenize("s1", "ssn", "123-45-6789")
+
+	if a != "<EMAIL_1>" || b != "<EMAIL_2>" || again != a || ssn != "<SSN_1>" {
+		t.Fatalf("tokens = %s %s %s %s", a, b, again, ssn)
+	}
+	if other := s.Tokenize("other", "email", "bob@example.com"); other != "<EMAIL_1>" {
+		t.Errorf("another scope got %s, want its own numbering", other)
+	}
+}
+
+func TestPseudonymStoreExpires(t *testing.T) {
+	s := NewPseudonymStore(20 * time.Millisecond)
+	s.Tokenize("s1", "email", "ann@example.com")
+	time.Sleep(30 * time.Millisecond)
+	if token := s.Tokenize("s1", "email", "bob@example.com"); token != "<EMAIL_1>" {
+		t.Errorf("token = %s, the expired table should start over", token)
+	}
+}
+
+func TestPseudonymizeRequestAndRestoreResponse(t *testing.T) {
+	s := NewPseudonymStore(time.Minute)
+	cfg := PIIConfig{Enabled: true, BlockEmail: true, RedactMode: PIITokenize}
+	body := `{"model":"gpt-4o","messages":[{"role":"user","content":"Email ann@example.com about the refund"}]}`
+
+	tokenized, changes, p := PseudonymizeRequest(cfg, s, "s1", []byte(body))
+	if len(changes) != 1 || p.Len() != 1 || !strings.Contains(string(tokenized), "Email <EMAIL_1> about") {
+		t.Fatalf("tokenized = %s, changes = %+v", tokenized, changes)
+	}
+
+	resp := `{"choices":[{"message":{"role":"assistant","content":"Sending to <EMAIL_1>.","tool_calls":[{"id":"c1","type":"function","function":{"name":"send_email","arguments":"{\"to\":\"<EMAIL_1>\"}"}}]}}]}`
+	restored := string(p.RestoreResponse([]byte(resp)))
+	if !strings.Contains(restored, "Sending to ann@example.com.") || !strings.Contains(restored, `{\"to\":\"ann@example.com\"}`) {
+		t.Errorf("restored = %s", restored)
+	}
+	if p.RestoreResponse([]byte(`{"choices":[{"message":{"content":"nothing here"}}]}`)) != nil {
+		t.Error("unchanged response should return nil")
+	}
+
+	// A later request in the same session that does not send the address
+	// cannot have its placeholder restored.
+	_, _, later := PseudonymizeRequest(cfg, s, "s1", []byte(`{"messages":[{"role":"user","content":"Repeat <EMAIL_1>"}]}`))
+	if later != nil || later.RestoreResponse([]byte(resp)) != nil {
+		t.Errorf("request without PII restored %v", later)
+	}
+	_, _, again := PseudonymizeRequest(cfg, s, "s1", []byte(`{"messages":[{"role":"user","content":"cc bob@example.com"}]}`))
+	if got := again.Restore("<EMAIL_1> and <EMAIL_2>"); got != "<EMAIL_1> and bob@example.com" {
+		t.Errorf("restore = %q, want only this request's placeholder", got)
+	}
+}
+
+func TestPseudonymRestorerJoinsSplitPlaceholder(t *testing.T) {
+	cfg := PIIConfig{Enabled: true, BlockEmail: true, RedactMode: PIITokenize}
+	_, _, p := PseudonymizeRequest(cfg, NewPseudonymStore(time.Minute), "s1",
+		[]byte(`{"messages":[{"role":"user","content":"ann@example.com"}]}`))
+	r := NewPseudonymRestorer(p)
+
+	got := restoreStream(r,
+		`{"choices":[{"index":0,"delta":{"content":"Write to <EMA"}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"IL_1> today"}}]}`,
+		`[DONE]`)
+	if !strings.Contains(got, `"content":"Write to "`) || !strings.Contains(got, `"content":"ann@example.com today"`) {
+		t.Errorf("stream = %s", got)
+	}
+	if !strings.Contains(got, "[DONE]") {
+		t.Error("[DONE] should pass through")
+	}
+	if NewPseudonymRestorer(nil) != nil {
+		t.Error("request without placeholders should have no restorer")
+	}
+}
+
+// restoreStream runs payloads through r and returns what would be sent, one
+// payload per line, with the text still held at the end flushed.
+func restoreStream(r *PseudonymRestorer, payloads ...string) string {
+	var out strings.Builder
+	for _, payload := range payloads {
+		released, restored := r.RestorePayload([]byte(payload))
+		for _, p := range append(released, restored) {
+			out.Write(p)
+			out.WriteString("\n")
+		}
+	}
+	for _, p := range r.Flush() {
+		out.Write(p)
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+func TestPseudonymRestorerReleasesHeldText(t *testing.T) {
+	cfg := PIIConfig{Enabled: true, BlockEmail: true, RedactMode: PIITokenize}
+	_, _, p := PseudonymizeRequest(cfg, NewPseudonymStore(time.Minute), "s1",
+		[]byte(`{"messages":[{"role":"user","content":"ann@example.com"}]}`))
+
+	// Text that is not continued is released before the next payload.
+	got := restoreStream(NewPseudonymRestorer(p),
+		`{"choices":[{"index":0,"delta":{"content":"a <B"}}]}`,
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+		`[DONE]`)
+	want := `{"choices":[{"delta":{"content":"a "},"index":0}]}` + "\n" +
+		`{"choices":[{"delta":{"content":"<B"},"index":0}]}` + "\n" +
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}` + "\n[DONE]\n"
+	if got != want {
+		t.Errorf("stream = %s, want %s", got, want)
+	}
+
+	// A stream ending in "<" without a terminator is flushed at the end.
+	got = restoreStream(NewPseudonymRestorer(p), `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"x <"}}`)
+	if !strings.HasSuffix(got, `"text":"<","type":"text_delta"},"index":0,"type":"content_block_delta"}`+"\n") {
+		t.Errorf("stream = %s, want the trailing < flushed", got)
+	}
+}
+
+func TestPreventionSkipsPIIInTokenizeMode(t *testing.T) {
+	cfg := &Config{Prevention: PreventionConfig{PII: PIIConfig{Enabled: true, BlockEmail: true, RedactMode: PIITokenize}}}
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"ann@example.com"}]}`
+	result := EvaluatePrevention(cfg, []byte(body), "ann@example.com", nil, "gpt-4", 0)
+	if result.Blocked || result.ModifiedBody != nil {
+		t.Errorf("result = %+v, tokenize is applied by PseudonymizeRequest", result)
+	}
+}
@@ -0,0 +1,287 @@
+package guardrails
+
+import (
+	"sync"
+	"time"
+)
+
+// Rate limiting: token buckets cap requests per minute and tokens per
+// minute per gateway key, session, model and provider, so one runaway agent
+// cannot use up the organisation's provider rate limit. Tokens are reserved
+// up front from an estimate and reconciled with the reported usage once the
+// response is in.
+
+// RateLimitConfig sets RPM and TPM limits. A zero limit is unlimited.
+type RateLimitConfig struct {
+	Mode        string               `yaml:"mode"`         // "enforce" (default) or "shadow"
+	PerKey      RateLimit            `yaml:"per_key"`      // each gateway key
+	PerSession  RateLimit            `yaml:"per_session"`  // each session
+	PerModel    RateLimit            `yaml:"per_model"`    // each model, across all callers
+	PerProvider RateLimit            `yaml:"per_provider"` // each provider, across all callers
+	Models      map[string]RateLimit `yaml:"models"`       // replaces per_model for these models
+	Providers   map[string]RateLimit `yaml:"providers"`    // replaces per_provider for these providers
+}
+
+// RateLimit is a pair of per-minute limits.
+type RateLimit struct {
+	RPM int `yaml:"rpm"` // requests per minute
+	TPM int `yaml:"tpm"` // tokens per minute
+}
+
+// RateScope is one limiter a request counts against.
+type RateScope struct {
+	Scope string // key, session, model or provider
+	Key   string
+	Limit RateLimit
+}
+
+// Scopes returns the limiters a request from the gateway key and session
+// for the model on the provider counts against.
+func (c *RateLimitConfig) Scopes(key, session, model, provider string) []RateScope {
+	perModel, ok := c.Models[model]
+	if !ok {
+		perModel = c.PerModel
+	}
+	perProvider, ok := c.Providers[provider]
+	if !ok {
+		perProvider = c.PerProvider
+	}
+	var scopes []RateScope
+	for _, s := range []RateScope{
+		{"key", key, c.PerKey},
+		{"session", session, c.PerSession},
+		{"model", model, perModel},
+		{"provider", provider, perProvider},
+	} {
+		if s.Limit.RPM > 0 || s.Limit.TPM > 0 {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
+
+// RateStatus is the state of the tightest request and token limits, as
+// reported in OpenAI's x-ratelimit-* headers. Zero limits were not set.
+type RateStatus struct {
+	LimitRequests     int
+	RemainingRequests int
+	ResetRequests     time.Duration // until the request bucket is full again
+	LimitTokens       int
+	RemainingTokens   int
+	ResetTokens       time.Duration
+}
+
+// RateLimited is a rejected reservation.
+type RateLimited struct {
+	Scope      string // key, session, model or provider
+	Key        string
+	Kind       string // requests or tokens
+	Limit      int
+	RetryAfter time.Duration
+	Status     RateStatus
+}
+
+// RateReservation holds the tokens reserved for a request until Settle
+// replaces the estimate with the actual usage.
+type RateReservation struct {
+	limiter  *RateLimiter
+	buckets  []*rateBucket // the token buckets charged
+	reserved int
+
+	Status RateStatus
+}
+
+// rateBucket refills continuously at limit per minute up to limit. Level
+// goes negative when a request used more tokens than it reserved.
+type rateBucket struct {
+	level float64
+	limit int
+	last  time.Time
+	holds int // unsettled reservations charged to the bucket
+}
+
+// refill brings the bucket up to now under the current limit.
+func (b *rateBucket) refill(now time.Time, limit int) {
+	if b.limit != limit {
+		b.level += float64(limit - b.limit)
+		b.limit = limit
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.level += elapsed.Minutes() * float64(limit)
+		b.last = now
+	}
+	if b.level > float64(limit) {
+		b.level = float64(limit)
+	}
+}
+
+// wait returns how long until the bucket holds n.
+func (b *rateBucket) wait(n float64) time.Duration {
+	if b.level >= n {
+		return 0
+	}
+	return time.Duration((n - b.level) / float64(b.limit) * float64(time.Minute))
+}
+
+// rateSweepInterval is how often buckets that have refilled are dropped.
+const rateSweepInterval = time.Minute
+
+// RateLimiter keeps the token buckets. Buckets live in this process; each
+// replica enforces its own limits. Safe for concurrent use.
+type RateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a limiter with full buckets.
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[string]*rateBucket), lastSweep: time.Now()}
+}
+
+// Reserve takes one request and tokens from every scope's buckets, or none
+// if any bucket is short. An estimate above a TPM limit is reserved as the
+// whole limit so that large requests still go through once the bucket is
+// full.
+func (l *RateLimiter) Reserve(scopes []RateScope, tokens int, now time.Time) (*RateReservation, *RateLimited) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	var charges []rateCharge
+	for _, s := range scopes {
+		if s.Limit.RPM > 0 {
+			charges = append(charges, rateCharge{s, "requests", s.Limit.RPM, l.bucket(s, "requests", s.Limit.RPM, now), 1})
+		}
+		if s.Limit.TPM > 0 {
+			n := tokens
+			if n > s.Limit.TPM {
+				n = s.Limit.TPM
+			}
+			charges = append(charges, rateCharge{s, "tokens", s.Limit.TPM, l.bucket(s, "tokens", s.Limit.TPM, now), float64(n)})
+		}
+	}
+
+	var denied *RateLimited
+	for _, c := range charges {
+		if wait := c.bucket.wait(c.n); wait > 0 && (denied == nil || wait > denied.RetryAfter) {
+			denied = &RateLimited{Scope: c.scope.Scope, Key: c.scope.Key, Kind: c.kind, Limit: c.limit, RetryAfter: wait}
+		}
+	}
+	if denied != nil {
+		for _, c := range charges {
+			if c.scope.Scope == denied.Scope && c.kind == denied.Kind {
+				denied.Status = rateStatus([]rateCharge{c})
+			}
+		}
+		return nil, denied
+	}
+
+	res := &RateReservation{limiter: l, reserved: tokens}
+	for _, c := range charges {
+		c.bucket.level -= c.n
+		if c.kind == "tokens" {
+			c.bucket.holds++
+			res.buckets = append(res.buckets, c.bucket)
+		}
+	}
+	res.Status = rateStatus(charges)
+	return res, nil
+}
+
+// rateCharge is what a reservation takes from one bucket.
+type rateCharge struct {
+	scope  RateScope
+	kind   string // requests or tokens
+	limit  int
+	bucket *rateBucket
+	n      float64
+}
+
+// rateStatus reports the buckets with the least left of each kind.
+func rateStatus(charges []rateCharge) RateStatus {
+	var st RateStatus
+	var requests, tokens *rateBucket
+	for _, c := range charges {
+		switch b := c.bucket; {
+		case c.kind == "requests" && (requests == nil || b.level < requests.level):
+			requests = b
+		case c.kind == "tokens" && (tokens == nil || b.level < tokens.level):
+			tokens = b
+		}
+	}
+	if requests != nil {
+		st.LimitRequests = requests.limit
+		st.RemainingRequests = remaining(requests)
+		st.ResetRequests = requests.wait(float64(requests.limit))
+	}
+	if tokens != nil {
+		st.LimitTokens = tokens.limit
+		st.RemainingTokens = remaining(tokens)
+		st.ResetTokens = tokens.wait(float64(tokens.limit))
+	}
+	return st
+}
+
+func remaining(b *rateBucket) int {
+	if b.level < 0 {
+		return 0
+	}
+	return int(b.level)
+}
+
+// bucket returns the bucket for a scope, refilled to now; the caller holds
+// l.mu.
+func (l *RateLimiter) bucket(s RateScope, kind string, limit int, now time.Time) *rateBucket {
+	id := s.Scope + "\x00" + kind + "\x00" + s.Key
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &rateBucket{level: float64(limit), limit: limit, last: now}
+		l.buckets[id] = b
+	}
+	b.refill(now, limit)
+	return b
+}
+
+// sweep drops buckets that have had time to refill, which are the same as
+// new ones. Buckets still held by a reservation, e.g. a long stream's, stay
+// so that its Settle charges the bucket later requests see. The caller holds
+// l.mu.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for id, b := range l.buckets {
+		if now.Sub(b.last) >= time.Minute && b.level >= 0 && b.holds == 0 {
+			delete(l.buckets, id)
+		}
+	}
+}
+
+// Settle replaces the reserved estimate with the tokens the request
+// actually used, returning the difference to the buckets or charging the
+// overrun. Only the first call has an effect; a nil reservation is a no-op.
+func (r *RateReservation) Settle(actual int) {
+	if r == nil || r.limiter == nil {
+		return
+	}
+	l := r.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r.limiter = nil
+	now := time.Now()
+	for _, b := range r.buckets {
+		b.holds--
+		b.refill(now, b.limit) // the usage is charged now, not when reserved
+		// The reservation was capped at the bucket's limit.
+		reserved := r.reserved
+		if reserved > b.limit {
+			reserved = b.limit
+		}
+		b.level += float64(reserved - actual)
+		if b.level > float64(b.limit) {
+			b.level = float64(b.limit)
+		}
+	}
+}
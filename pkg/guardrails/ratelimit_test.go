@@ -0,0 +1,110 @@
+package guardrails
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRequestsPerMinute(t *testing.T) {
+	l := NewRateLimiter()
+	cfg := RateLimitConfig{PerKey: RateLimit{RPM: 2}}
+	scopes := cfg.Scopes("k1", "s1", "gpt-4o", "openai")
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if _, denied := l.Reserve(scopes, 0, now); denied != nil {
+			t.Fatalf("request %d denied: %+v", i, denied)
+		}
+	}
+	_, denied := l.Reserve(scopes, 0, now)
+	if denied == nil || denied.Scope != "key" || denied.Kind != "requests" {
+		t.Fatalf("third request = %+v, want denied by key requests", denied)
+	}
+	if denied.RetryAfter != 30*time.Second || denied.Status.RemainingRequests != 0 || denied.Status.LimitRequests != 2 {
+		t.Errorf("denied = %+v", denied)
+	}
+
+	// Another key has its own bucket, and the first refills over time.
+	if _, denied := l.Reserve(cfg.Scopes("k2", "s1", "gpt-4o", "openai"), 0, now); denied != nil {
+		t.Errorf("k2 denied: %+v", denied)
+	}
+	if _, denied := l.Reserve(scopes, 0, now.Add(30*time.Second)); denied != nil {
+		t.Errorf("k1 denied after refill: %+v", denied)
+	}
+}
+
+func TestRateLimiterReconcilesTokens(t *testing.T) {
+	l := NewRateLimiter()
+	cfg := RateLimitConfig{
+		PerModel: RateLimit{TPM: 1000},
+		Models:   map[string]RateLimit{"gpt-4o-mini": {TPM: 100000}},
+	}
+	scopes := cfg.Scopes("k", "s", "gpt-4o", "openai")
+	now := time.Now()
+
+	// An overestimate is refunded, so the next request fits.
+	res, denied := l.Reserve(scopes, 900, now)
+	if denied != nil || res.Status.RemainingTokens != 100 {
+		t.Fatalf("reserve = %+v, %+v", res, denied)
+	}
+	if _, denied := l.Reserve(scopes, 500, now); denied == nil {
+		t.Fatal("second reservation should not fit before settling")
+	}
+	res.Settle(200)
+	res.Settle(0) // only the first settle counts
+	res, denied = l.Reserve(scopes, 500, now)
+	if denied != nil || res.Status.RemainingTokens != 300 {
+		t.Fatalf("after settle = %+v, %+v", res, denied)
+	}
+
+	// An underestimate is charged, leaving the bucket in debt.
+	res.Settle(1500)
+	_, denied = l.Reserve(scopes, 1, now.Add(30*time.Second))
+	if denied == nil || denied.Kind != "tokens" || denied.Scope != "model" {
+		t.Fatalf("reservation in debt = %+v", denied)
+	}
+
+	// Models with their own limit are not held to per_model.
+	if _, denied := l.Reserve(cfg.Scopes("k", "s", "gpt-4o-mini", "openai"), 5000, now); denied != nil {
+		t.Errorf("gpt-4o-mini denied: %+v", denied)
+	}
+	// An estimate above the limit still goes through on a full bucket.
+	if _, denied := l.Reserve(cfg.Scopes("k", "s", "gpt-4o", "openai"), 5000, now.Add(5*time.Minute)); denied != nil {
+		t.Errorf("large request denied on a full bucket: %+v", denied)
+	}
+}
+
+func TestRateLimiterKeepsBucketsHeldByLongRequests(t *testing.T) {
+	l := NewRateLimiter()
+	cfg := RateLimitConfig{PerKey: RateLimit{TPM: 1000}}
+	other := RateLimitConfig{PerKey: RateLimit{RPM: 1}}
+	now := time.Now()
+
+	// A stream started two minutes ago survives a sweep, so its usage is
+	// charged to the bucket later requests see.
+	stream, _ := l.Reserve(cfg.Scopes("k", "s", "m", "p"), 10, now.Add(-2*time.Minute))
+	l.lastSweep = now.Add(-2 * time.Minute)
+	l.Reserve(other.Scopes("other", "s", "m", "p"), 0, now)
+	stream.Settle(1000)
+	if _, denied := l.Reserve(cfg.Scopes("k", "s", "m", "p"), 100, now); denied == nil {
+		t.Error("the stream's usage was not charged")
+	}
+}
+
+func TestRateLimiterAllOrNothing(t *testing.T) {
+	l := NewRateLimiter()
+	cfg := RateLimitConfig{PerKey: RateLimit{RPM: 10}, PerSession: RateLimit{RPM: 1}}
+	now := time.Now()
+	l.Reserve(cfg.Scopes("k", "s1", "m", "p"), 0, now)
+	if _, denied := l.Reserve(cfg.Scopes("k", "s1", "m", "p"), 0, now); denied == nil || denied.Scope != "session" {
+		t.Fatalf("denied = %+v, want session", denied)
+	}
+	// The denied request took nothing from the key's bucket.
+	res, denied := l.Reserve(cfg.Scopes("k", "s2", "m", "p"), 0, now)
+	if denied != nil || res.Status.RemainingRequests != 0 {
+		t.Fatalf("s2 = %+v, %+v", res, denied)
+	}
+	if _, denied := l.Reserve(cfg.Scopes("k", "s3", "m", "p"), 0, now); denied != nil {
+		t.Fatalf("key bucket was charged for a denied request: %+v", denied)
+	}
+}
@@ -0,0 +1,376 @@
+package guardrails
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RedisOptions configures a RedisStore.
+type RedisOptions struct {
+	Addr     string // host:port
+	Password string
+	DB       int
+	TTL      time.Duration // idle sessions expire after this; 0 = never
+	Prefix   string        // key prefix, default "airgw:"
+}
+
+// RedisStore keeps sessions in a server speaking the Redis protocol (Redis,
+// Valkey, KeyDB, ...), so gateway replicas share budgets and loop detection.
+// Each session is one JSON value; updates run in WATCH/MULTI/EXEC
+// transactions and are retried when another replica changed the session
+// first. Keys carry the TTL, so the server expires idle sessions itself.
+type RedisStore struct {
+	opts RedisOptions
+	pool chan *redisConn
+}
+
+// maxRedisRetries bounds how often a contended update is retried.
+const maxRedisRetries = 50
+
+const redisPoolSize = 8
+
+// NewRedisStore connects to the server and checks it answers.
+func NewRedisStore(opts RedisOptions) (*RedisStore, error) {
+	if opts.Addr == "" {
+		opts.Addr = "localhost:6379"
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "airgw:"
+	}
+	r := &RedisStore{opts: opts, pool: make(chan *redisConn, redisPoolSize)}
+	if _, err := r.do("PING"); err != nil {
+		return nil, fmt.Errorf("guardrails: redis session store %s: %w", opts.Addr, err)
+	}
+	return r, nil
+}
+
+func (r *RedisStore) sessionKey(id string) string  { return r.opts.Prefix + "session:" + id }
+func (r *RedisStore) cooldownKey(id string) string { return r.opts.Prefix + "cooldown:" + id }
+
+// expiry returns the SET arguments that apply the session TTL.
+func (r *RedisStore) expiry() []string {
+	if r.opts.TTL <= 0 {
+		return nil
+	}
+	return []string{"PX", strconv.FormatInt(r.opts.TTL.Milliseconds(), 10)}
+}
+
+func (r *RedisStore) Get(id string) (*SessionState, error) {
+	reply, err := r.do("GET", r.sessionKey(id))
+	if err != nil {
+		return nil, err
+	}
+	return decodeSession(reply)
+}
+
+func (r *RedisStore) Create(id string, now time.Time) (*SessionState, error) {
+	data, err := json.Marshal(newSessionState(id, now))
+	if err != nil {
+		return nil, err
+	}
+	args := append([]string{"SET", r.sessionKey(id), string(data), "NX"}, r.expiry()...)
+	if _, err := r.do(args...); err != nil {
+		return nil, err
+	}
+	s, err := r.Get(id)
+	if err == nil && s == nil {
+		// Deleted between SET and GET, e.g. by a terminate on another replica.
+		s = newSessionState(id, now)
+	}
+	return s, err
+}
+
+func (r *RedisStore) Update(id string, fn func(*SessionState)) error {
+	key := r.sessionKey(id)
+	for attempt := 0; attempt < maxRedisRetries; attempt++ {
+		done, err := r.tryUpdate(key, fn)
+		if err != nil || done {
+			return err
+		}
+		// Back off with jitter so busy replicas do not keep colliding.
+		time.Sleep(time.Duration(rand.Int63n(int64(time.Millisecond) << min(attempt, 5))))
+	}
+	return fmt.Errorf("session %s: update abandoned after %d conflicting writes", id, maxRedisRetries)
+}
+
+// tryUpdate runs one optimistic transaction. done is false when another
+// client changed the session between WATCH and EXEC.
+func (r *RedisStore) tryUpdate(key string, fn func(*SessionState)) (done bool, err error) {
+	c, err := r.conn()
+	if err != nil {
+		return false, err
+	}
+	defer func() { r.release(c, err) }()
+
+	if _, err = c.do("WATCH", key); err != nil {
+		return false, err
+	}
+	reply, err := c.do("GET", key)
+	if err != nil {
+		return false, err
+	}
+	s, err := decodeSession(reply)
+	if err != nil || s == nil {
+		c.do("UNWATCH")
+		return true, err
+	}
+	fn(s)
+	data, err := json.Marshal(s)
+	if err != nil {
+		c.do("UNWATCH")
+		return false, err
+	}
+
+	if _, err = c.do("MULTI"); err != nil {
+		return false, err
+	}
+	if _, err = c.do(append([]string{"SET", key, string(data)}, r.expiry()...)...); err != nil {
+		c.do("DISCARD")
+		return false, err
+	}
+	reply, err = c.do("EXEC")
+	if err != nil || reply == nil {
+		return false, err
+	}
+	if items, _ := reply.([]interface{}); len(items) > 0 {
+		if rerr, ok := items[0].(redisError); ok {
+			return false, rerr
+		}
+	}
+	return true, nil
+}
+
+// List scans the session keys. Sessions that expire during the scan are
+// skipped.
+func (r *RedisStore) List() ([]*SessionState, error) {
+	var list []*SessionState
+	cursor := "0"
+	for {
+		reply, err := r.do("SCAN", cursor, "MATCH", r.sessionKey("*"), "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		page, _ := reply.([]interface{})
+		if len(page) != 2 {
+			return nil, fmt.Errorf("unexpected SCAN reply %v", reply)
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]interface{})
+		for _, k := range keys {
+			key, _ := k.([]byte)
+			value, err := r.do("GET", string(key))
+			if err != nil {
+				return nil, err
+			}
+			s, err := decodeSession(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			if s != nil {
+				list = append(list, s)
+			}
+		}
+		if cursor = string(next); cursor == "0" {
+			return list, nil
+		}
+	}
+}
+
+func (r *RedisStore) Delete(id string) error {
+	_, err := r.do("DEL", r.sessionKey(id))
+	return err
+}
+
+func (r *RedisStore) SetCooldown(id string, until time.Time) error {
+	ms := time.Until(until).Milliseconds()
+	if ms <= 0 {
+		return nil
+	}
+	_, err := r.do("SET", r.cooldownKey(id), strconv.FormatInt(until.UnixNano(), 10), "PX", strconv.FormatInt(ms, 10))
+	return err
+}
+
+func (r *RedisStore) Cooldown(id string) (time.Time, bool, error) {
+	reply, err := r.do("GET", r.cooldownKey(id))
+	if err != nil || reply == nil {
+		return time.Time{}, false, err
+	}
+	b, _ := reply.([]byte)
+	ns, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("cooldown %s: %w", id, err)
+	}
+	return time.Unix(0, ns), true, nil
+}
+
+// Expire is a no-op: session and cool-down keys carry their own TTL.
+func (r *RedisStore) Expire(time.Time, time.Duration) error { return nil }
+
+// Close closes the pooled connections.
+func (r *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-r.pool:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func decodeSession(reply interface{}) (*SessionState, error) {
+	if reply == nil {
+		return nil, nil
+	}
+	b, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %T", reply)
+	}
+	s := &SessionState{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if s.ToolCalls == nil {
+		s.ToolCalls = make(map[string][]time.Time)
+	}
+	return s, nil
+}
+
+// do runs one command on a pooled connection.
+func (r *RedisStore) do(args ...string) (reply interface{}, err error) {
+	c, err := r.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { r.release(c, err) }()
+	return c.do(args...)
+}
+
+// conn takes a connection from the pool, dialling a new one if it is empty.
+func (r *RedisStore) conn() (*redisConn, error) {
+	select {
+	case c := <-r.pool:
+		return c, nil
+	default:
+	}
+	nc, err := net.DialTimeout("tcp", r.opts.Addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if r.opts.Password != "" {
+		if _, err := c.do("AUTH", r.opts.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if r.opts.DB != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(r.opts.DB)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// release returns a connection to the pool unless it failed at the network
+// level, in which case its state is unknown and it is closed.
+func (r *RedisStore) release(c *redisConn, err error) {
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		c.Close()
+		return
+	}
+	select {
+	case r.pool <- c:
+	default:
+		c.Close()
+	}
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisConn speaks RESP, the Redis serialization protocol.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends a command and reads its reply: string, int64, []byte, nil or
+// []interface{}.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, a := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(a)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, a...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return readRESP(c.r)
+}
+
+// readRESP reads one RESP value. Error replies are returned as redisError.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			// Errors inside EXEC replies belong to single commands.
+			if items[i], err = readRESP(r); err != nil {
+				var rerr redisError
+				if !errors.As(err, &rerr) {
+					return nil, err
+				}
+				items[i] = rerr
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
@@ -0,0 +1,132 @@
+package guardrails
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReloadEvent describes a config that has just gone live.
+type ReloadEvent struct {
+	Source string // "sighup", "file_watch" or "admin"
+	Path   string
+	SHA256 string // hex SHA-256 of the file contents
+	Data   []byte // the file contents
+}
+
+// Holder holds the live guardrails config and swaps it atomically on reload,
+// so a request in flight keeps the config it started with. Sessions, analytics
+// and the audit chain live outside the config and survive reloads; sections
+// read once at startup (trust, optimization.analytics) need a restart.
+type Holder struct {
+	path    string
+	adjust  func(*Config)
+	current atomic.Pointer[Config]
+
+	mu   sync.Mutex // serialises reloads
+	hash string
+
+	// OnReload, if set, is called after each reload that changed the config.
+	OnReload func(ReloadEvent)
+}
+
+// NewHolder loads the config at path. adjust, if not nil, is applied to every
+// config loaded before it goes live, e.g. to apply environment overrides.
+func NewHolder(path string, adjust func(*Config)) (*Holder, error) {
+	h := &Holder{path: path, adjust: adjust}
+	cfg, data, err := h.load()
+	if err != nil {
+		return nil, err
+	}
+	h.current.Store(cfg)
+	h.hash = configHash(data)
+	return h, nil
+}
+
+// Config returns the live config.
+func (h *Holder) Config() *Config {
+	return h.current.Load()
+}
+
+// Hash returns the hex SHA-256 of the live config file.
+func (h *Holder) Hash() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.hash
+}
+
+// Reload re-reads and validates the config file. An invalid file leaves the
+// live config in place and returns the validation error. A file identical to
+// the live one is not swapped. Returns the hash of the live config.
+func (h *Holder) Reload(source string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cfg, data, err := h.load()
+	if err != nil {
+		log.Printf("[guardrails] reload (%s) rejected, keeping current config: %v", source, err)
+		return h.hash, err
+	}
+	hash := configHash(data)
+	if hash == h.hash {
+		return hash, nil
+	}
+
+	h.current.Store(cfg)
+	h.hash = hash
+	log.Printf("[guardrails] config reloaded (%s): %s sha256=%s", source, h.path, hash)
+	if h.OnReload != nil {
+		h.OnReload(ReloadEvent{Source: source, Path: h.path, SHA256: hash, Data: data})
+	}
+	return hash, nil
+}
+
+// Watch polls the config file every interval and reloads it when its
+// contents change, until ctx is done.
+func (h *Holder) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	seen := h.Hash() // last contents tried, so an invalid file is reported once
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		data, err := os.ReadFile(h.path)
+		if err != nil {
+			continue
+		}
+		if hash := configHash(data); hash != seen {
+			seen = hash
+			h.Reload("file_watch")
+		}
+	}
+}
+
+// load reads, parses and adjusts the config file.
+func (h *Holder) load() (*Config, []byte, error) {
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", h.path, err)
+	}
+	if h.adjust != nil {
+		h.adjust(cfg)
+	}
+	return cfg, data, nil
+}
+
+func configHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,84 @@
+package guardrails
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHolderReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "guardrails.yaml")
+	os.WriteFile(path, []byte("budgets:\n  max_session_tokens: 1000\n"), 0644)
+
+	h, err := NewHolder(path, func(c *Config) { c.Alerts.WebhookURL = "https://hooks.example/env" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := h.Config()
+	if old.Budgets.MaxSessionTokens != 1000 || old.Alerts.WebhookURL != "https://hooks.example/env" {
+		t.Fatalf("initial config = %+v", old)
+	}
+
+	var events []ReloadEvent
+	h.OnReload = func(ev ReloadEvent) { events = append(events, ev) }
+
+	// Unchanged file: nothing to swap.
+	if _, err := h.Reload("admin"); err != nil || len(events) != 0 {
+		t.Fatalf("unchanged reload: err=%v events=%d", err, len(events))
+	}
+
+	// Invalid file: the old config stays live.
+	os.WriteFile(path, []byte("prevention:\n  pii:\n    mode: sideways\n"), 0644)
+	if _, err := h.Reload("admin"); err == nil {
+		t.Fatal("expected invalid config to be rejected")
+	}
+	if h.Config() != old || len(events) != 0 {
+		t.Error("invalid config replaced the live one")
+	}
+
+	data := []byte("budgets:\n  max_session_tokens: 2000\n")
+	os.WriteFile(path, data, 0644)
+	hash, err := h.Reload("sighup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if hash != hex.EncodeToString(sum[:]) || h.Hash() != hash {
+		t.Errorf("hash = %s", hash)
+	}
+	if cfg := h.Config(); cfg.Budgets.MaxSessionTokens != 2000 || cfg.Alerts.WebhookURL != "https://hooks.example/env" {
+		t.Errorf("reloaded config = %+v", cfg)
+	}
+	if len(events) != 1 || events[0].Source != "sighup" || events[0].SHA256 != hash {
+		t.Errorf("events = %+v", events)
+	}
+	if old.Budgets.MaxSessionTokens != 1000 {
+		t.Error("reload mutated the previous config")
+	}
+}
+
+func TestHolderWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "guardrails.yaml")
+	os.WriteFile(path, []byte("budgets:\n  max_session_tokens: 1000\n"), 0644)
+	h, err := NewHolder(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Watch(ctx, 10*time.Millisecond)
+
+	os.WriteFile(path, []byte("budgets:\n  max_session_tokens: 3000\n"), 0644)
+	deadline := time.Now().Add(2 * time.Second)
+	for h.Config().Budgets.MaxSessionTokens != 3000 {
+		if time.Now().After(deadline) {
+			t.Fatal("file change not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,7 +1,8 @@
 package guardrails
 
 import (
-	"sync"
+	"fmt"
+	"log"
 	"time"
 )
 
@@ -12,8 +13,13 @@ type SessionState struct {
 	LastActive time.Time
 
 	// Token tracking
-	TotalTokens  int
-	RequestCount int
+	TotalTokens      int
+	PromptTokens     int
+	CompletionTokens int
+	RequestCount     int
+
+	// Cost tracking (USD, priced per model via PricingConfig)
+	TotalCostUSD float64
 
 	// Prompt history (last N prompts for loop detection)
 	PromptHistory []promptEntry
@@ -23,6 +29,39 @@ type SessionState struct {
 
 	// Error tracking
 	ConsecutiveErrors int
+
+	// Run IDs of the session's requests, oldest first (last maxSessionRuns),
+	// used to bundle the session for replay.
+	RunIDs []string
+
+	// Budget raise granted through the admin API, see RaiseBudget.
+	Boost BudgetBoost
+
+	// Session tree, see tree.go. Tree aggregates this session and all of
+	// its descendants.
+	ParentID string
+	Children []string
+	Tree     TreeTotals
+}
+
+// maxSessionRuns bounds how many run IDs a session keeps.
+const maxSessionRuns = 200
+
+// Usage is the token usage of one upstream response. Estimated is true when
+// the provider omitted usage and the counts were approximated by the gateway.
+// CachedTokens is the subset of PromptTokens served from the provider's prompt
+// cache. CostUSD is filled in by the caller from the PricingConfig.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	CachedTokens     int
+	Estimated        bool
+	CostUSD          float64
+}
+
+// Total returns prompt plus completion tokens.
+func (u Usage) Total() int {
+	return u.PromptTokens + u.CompletionTokens
 }
 
 type promptEntry struct {
@@ -30,108 +69,207 @@ type promptEntry struct {
 	Timestamp time.Time
 }
 
-// Manager holds all active sessions with automatic cleanup.
+// Manager tracks agent sessions in a SessionStore and removes idle ones.
 type Manager struct {
-	mu       sync.Mutex
-	sessions map[string]*SessionState
-	ttl      time.Duration
+	store SessionStore
+	ttl   time.Duration
 }
 
-// NewManager creates a session manager that cleans up sessions
-// idle for longer than ttl.
+// NewManager creates a session manager that keeps sessions in memory and
+// cleans up sessions idle for longer than ttl.
 func NewManager(ttl time.Duration) *Manager {
-	m := &Manager{
-		sessions: make(map[string]*SessionState),
-		ttl:      ttl,
-	}
+	return NewManagerWithStore(ttl, NewMemoryStore())
+}
+
+// NewManagerWithStore creates a session manager backed by store. Stores
+// shared between gateway replicas let them enforce budgets and detect loops
+// together.
+func NewManagerWithStore(ttl time.Duration, store SessionStore) *Manager {
+	m := &Manager{store: store, ttl: ttl}
 	go m.cleanupLoop()
 	return m
 }
 
-// GetOrCreate returns the session for the given ID, creating one if needed.
+// Store returns the manager's session store.
+func (m *Manager) Store() SessionStore {
+	return m.store
+}
+
+// GetOrCreate returns a copy of the session for the given ID, creating one
+// if needed.
 func (m *Manager) GetOrCreate(sessionID string) *SessionState {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	s, err := m.store.Create(sessionID, time.Now())
+	if err != nil {
+		logStoreError("create", sessionID, err)
+		return newSessionState(sessionID, time.Now())
+	}
+	return s
+}
 
-	s, ok := m.sessions[sessionID]
-	if !ok {
-		s = &SessionState{
-			SessionID: sessionID,
-			CreatedAt: time.Now(),
-			ToolCalls: make(map[string][]time.Time),
-		}
-		m.sessions[sessionID] = s
+// Open is GetOrCreateChild for a request about to be evaluated. Unlike the
+// other methods, which log store errors and carry on, it fails when the
+// store cannot hold the session: the caller should refuse the request rather
+// than run budgets and loop detection without state.
+func (m *Manager) Open(sessionID, parentID string) error {
+	if _, err := m.store.Create(sessionID, time.Now()); err != nil {
+		logStoreError("create", sessionID, err)
+		return fmt.Errorf("guardrails: session store: %w", err)
+	}
+	m.GetOrCreateChild(sessionID, parentID)
+	return nil
+}
+
+// session returns a copy of the session, or nil if it does not exist.
+func (m *Manager) session(sessionID string) *SessionState {
+	s, err := m.store.Get(sessionID)
+	if err != nil {
+		logStoreError("get", sessionID, err)
+		return nil
 	}
 	return s
 }
 
+// update applies fn to an existing session atomically.
+func (m *Manager) update(sessionID string, fn func(*SessionState)) {
+	if err := m.store.Update(sessionID, fn); err != nil {
+		logStoreError("update", sessionID, err)
+	}
+}
+
 // RecordRequest updates the session after a request is parsed (before forwarding).
 // This is called pre-upstream to track prompts and detect loops.
 func (m *Manager) RecordRequest(sessionID string, promptText string, toolNames []string) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	s, ok := m.sessions[sessionID]
-	if !ok {
-		return
-	}
-
 	now := time.Now()
-	s.LastActive = now
-	s.RequestCount++
-
-	// Track prompt
-	if promptText != "" {
-		s.PromptHistory = append(s.PromptHistory, promptEntry{
-			Text:      promptText,
-			Timestamp: now,
-		})
-		// Keep only last 20 prompts
-		if len(s.PromptHistory) > 20 {
-			s.PromptHistory = s.PromptHistory[len(s.PromptHistory)-20:]
+	m.update(sessionID, func(s *SessionState) {
+		s.LastActive = now
+		s.RequestCount++
+		s.PromptHistory = appendPrompt(s.PromptHistory, promptText, now, maxSessionPrompts)
+		addToolCalls(s.ToolCalls, toolNames, now)
+	})
+	m.updateTree(sessionID, now, func(t *TreeTotals) {
+		t.RequestCount++
+		t.PromptHistory = appendPrompt(t.PromptHistory, promptText, now, maxTreePrompts)
+		if t.ToolCalls == nil {
+			t.ToolCalls = make(map[string][]time.Time)
 		}
+		addToolCalls(t.ToolCalls, toolNames, now)
+	})
+}
+
+// maxSessionPrompts bounds the prompt history kept for loop detection.
+const maxSessionPrompts = 20
+
+// appendPrompt records a prompt, keeping only the last max.
+func appendPrompt(history []promptEntry, text string, now time.Time, max int) []promptEntry {
+	if text == "" {
+		return history
 	}
+	history = append(history, promptEntry{Text: text, Timestamp: now})
+	if len(history) > max {
+		history = history[len(history)-max:]
+	}
+	return history
+}
 
-	// Track tool calls
+func addToolCalls(calls map[string][]time.Time, toolNames []string, now time.Time) {
 	for _, tool := range toolNames {
-		s.ToolCalls[tool] = append(s.ToolCalls[tool], now)
+		calls[tool] = append(calls[tool], now)
 	}
 }
 
 // RecordResponse updates the session after receiving the upstream response.
-func (m *Manager) RecordResponse(sessionID string, tokens int, isError bool) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	s, ok := m.sessions[sessionID]
-	if !ok {
-		return
-	}
-
-	s.TotalTokens += tokens
+func (m *Manager) RecordResponse(sessionID string, usage Usage, isError bool) {
+	m.update(sessionID, func(s *SessionState) {
+		s.TotalTokens += usage.Total()
+		s.PromptTokens += usage.PromptTokens
+		s.CompletionTokens += usage.CompletionTokens
+		s.TotalCostUSD += usage.CostUSD
 
-	if isError {
-		s.ConsecutiveErrors++
-	} else {
-		s.ConsecutiveErrors = 0
-	}
+		if isError {
+			s.ConsecutiveErrors++
+		} else {
+			s.ConsecutiveErrors = 0
+		}
+	})
+	m.updateTree(sessionID, time.Now(), func(t *TreeTotals) {
+		t.TotalTokens += usage.Total()
+		t.TotalCostUSD += usage.CostUSD
+		if isError {
+			t.ConsecutiveErrors++
+		} else {
+			t.ConsecutiveErrors = 0
+		}
+	})
 }
 
 // GetSessionTokens returns the total tokens for a session, or 0 if not found.
 func (m *Manager) GetSessionTokens(sessionID string) int {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if s, ok := m.sessions[sessionID]; ok {
+	if s := m.session(sessionID); s != nil {
 		return s.TotalTokens
 	}
 	return 0
 }
 
+// GetSessionCost returns the accumulated USD cost for a session, or 0 if not found.
+func (m *Manager) GetSessionCost(sessionID string) float64 {
+	if s := m.session(sessionID); s != nil {
+		return s.TotalCostUSD
+	}
+	return 0
+}
+
 // Remove deletes a session (used when a guardrail terminates it).
 func (m *Manager) Remove(sessionID string) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	delete(m.sessions, sessionID)
+	if err := m.store.Delete(sessionID); err != nil {
+		logStoreError("delete", sessionID, err)
+	}
+}
+
+// RecordRun appends a request's run ID to the session.
+func (m *Manager) RecordRun(sessionID, runID string) {
+	m.update(sessionID, func(s *SessionState) {
+		s.RunIDs = append(s.RunIDs, runID)
+		if len(s.RunIDs) > maxSessionRuns {
+			s.RunIDs = s.RunIDs[len(s.RunIDs)-maxSessionRuns:]
+		}
+	})
+}
+
+// SessionRuns returns a copy of the session's run IDs, oldest first.
+func (m *Manager) SessionRuns(sessionID string) []string {
+	if s := m.session(sessionID); s != nil {
+		return s.RunIDs
+	}
+	return nil
+}
+
+// Terminate removes a session and, if cooldown is positive, rejects its ID
+// until the cool-down has passed (see Cooldown).
+func (m *Manager) Terminate(sessionID string, cooldown time.Duration) {
+	m.Remove(sessionID)
+	if cooldown > 0 {
+		if err := m.store.SetCooldown(sessionID, time.Now().Add(cooldown)); err != nil {
+			logStoreError("cooldown", sessionID, err)
+		}
+	}
+}
+
+// Cooldown returns how long a terminated session ID is still rejected for,
+// and false if it is not cooling down.
+func (m *Manager) Cooldown(sessionID string) (time.Duration, bool) {
+	until, ok, err := m.store.Cooldown(sessionID)
+	if err != nil {
+		logStoreError("cooldown", sessionID, err)
+		return 0, false
+	}
+	if !ok {
+		return 0, false
+	}
+	remaining := time.Until(until)
+	if remaining <= 0 {
+		return 0, false
+	}
+	return remaining, true
 }
 
 // cleanupLoop removes idle sessions every minute.
@@ -140,13 +278,12 @@ func (m *Manager) cleanupLoop() {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		m.mu.Lock()
-		now := time.Now()
-		for id, s := range m.sessions {
-			if now.Sub(s.LastActive) > m.ttl {
-				delete(m.sessions, id)
-			}
+		if err := m.store.Expire(time.Now(), m.ttl); err != nil {
+			log.Printf("[guardrails] session store expire: %v", err)
 		}
-		m.mu.Unlock()
 	}
 }
+
+func logStoreError(op, sessionID string, err error) {
+	log.Printf("[guardrails] session store %s (session=%s): %v", op, sessionID, err)
+}
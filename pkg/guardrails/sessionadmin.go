@@ -0,0 +1,179 @@
+package guardrails
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+)
+
+// BudgetBoost temporarily raises a session's token and cost budgets.
+type BudgetBoost struct {
+	ExtraTokens  int
+	ExtraCostUSD float64
+	Until        time.Time
+}
+
+// active reports whether the boost still applies at now.
+func (b BudgetBoost) active(now time.Time) bool {
+	return now.Before(b.Until)
+}
+
+// tokens and cost return the extra budget in force at now.
+func (b BudgetBoost) tokens(now time.Time) int {
+	if b.active(now) {
+		return b.ExtraTokens
+	}
+	return 0
+}
+
+func (b BudgetBoost) cost(now time.Time) float64 {
+	if b.active(now) {
+		return b.ExtraCostUSD
+	}
+	return 0
+}
+
+// SessionSummary is what the admin API shows of a session. Prompts are
+// reduced to a hash and a short preview so the listing does not replay
+// agent conversations.
+type SessionSummary struct {
+	SessionID         string          `json:"session_id"`
+	CreatedAt         time.Time       `json:"created_at"`
+	LastActive        time.Time       `json:"last_active"`
+	TotalTokens       int             `json:"total_tokens"`
+	PromptTokens      int             `json:"prompt_tokens"`
+	CompletionTokens  int             `json:"completion_tokens"`
+	TotalCostUSD      float64         `json:"total_cost_usd"`
+	RequestCount      int             `json:"request_count"`
+	ConsecutiveErrors int             `json:"consecutive_errors"`
+	RecentPrompts     []PromptSummary `json:"recent_prompts"`
+	ToolCalls         map[string]int  `json:"tool_calls"` // calls per tool
+	Runs              int             `json:"runs"`
+	BudgetBoost       *BoostSummary   `json:"budget_boost,omitempty"`
+	ParentID          string          `json:"parent_session_id,omitempty"`
+	Children          []string        `json:"children,omitempty"`
+	Tree              TreeSummary     `json:"tree"` // this session and its descendants
+}
+
+// TreeSummary is the usage of a session tree.
+type TreeSummary struct {
+	TotalTokens  int     `json:"total_tokens"`
+	TotalCostUSD float64 `json:"total_cost_usd"`
+	RequestCount int     `json:"request_count"`
+}
+
+// PromptSummary identifies a prompt without its full text.
+type PromptSummary struct {
+	SHA256    string    `json:"sha256"`
+	Preview   string    `json:"preview"` // the first promptPreviewRunes runes
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// BoostSummary is an active budget boost.
+type BoostSummary struct {
+	ExtraTokens  int       `json:"extra_tokens"`
+	ExtraCostUSD float64   `json:"extra_cost_usd"`
+	Until        time.Time `json:"until"`
+}
+
+const promptPreviewRunes = 32
+
+// Summary returns the admin view of the session.
+func (s *SessionState) Summary() SessionSummary {
+	sum := SessionSummary{
+		SessionID:         s.SessionID,
+		CreatedAt:         s.CreatedAt,
+		LastActive:        s.LastActive,
+		TotalTokens:       s.TotalTokens,
+		PromptTokens:      s.PromptTokens,
+		CompletionTokens:  s.CompletionTokens,
+		TotalCostUSD:      s.TotalCostUSD,
+		RequestCount:      s.RequestCount,
+		ConsecutiveErrors: s.ConsecutiveErrors,
+		RecentPrompts:     make([]PromptSummary, 0, len(s.PromptHistory)),
+		ToolCalls:         make(map[string]int, len(s.ToolCalls)),
+		Runs:              len(s.RunIDs),
+		ParentID:          s.ParentID,
+		Children:          s.Children,
+		Tree: TreeSummary{
+			TotalTokens:  s.Tree.TotalTokens,
+			TotalCostUSD: s.Tree.TotalCostUSD,
+			RequestCount: s.Tree.RequestCount,
+		},
+	}
+	for _, p := range s.PromptHistory {
+		h := sha256.Sum256([]byte(p.Text))
+		preview := []rune(p.Text)
+		if len(preview) > promptPreviewRunes {
+			preview = append(preview[:promptPreviewRunes], '…')
+		}
+		sum.RecentPrompts = append(sum.RecentPrompts, PromptSummary{
+			SHA256:    hex.EncodeToString(h[:]),
+			Preview:   string(preview),
+			Timestamp: p.Timestamp,
+		})
+	}
+	for tool, calls := range s.ToolCalls {
+		sum.ToolCalls[tool] = len(calls)
+	}
+	if s.Boost.active(time.Now()) {
+		sum.BudgetBoost = &BoostSummary{
+			ExtraTokens:  s.Boost.ExtraTokens,
+			ExtraCostUSD: s.Boost.ExtraCostUSD,
+			Until:        s.Boost.Until,
+		}
+	}
+	return sum
+}
+
+// Sessions returns every tracked session, most recently active first.
+func (m *Manager) Sessions() ([]*SessionState, error) {
+	list, err := m.store.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastActive.After(list[j].LastActive) })
+	return list, nil
+}
+
+// Session returns a copy of one session, or nil if it is not tracked.
+func (m *Manager) Session(sessionID string) (*SessionState, error) {
+	return m.store.Get(sessionID)
+}
+
+// Reset zeroes a session's counters and history, including its tree totals,
+// so budgets and detection rules start over. Its run IDs, tree links and any
+// budget boost are kept. It returns the reset session, or nil if it is not
+// tracked.
+func (m *Manager) Reset(sessionID string) (*SessionState, error) {
+	return m.modify(sessionID, func(s *SessionState) {
+		s.TotalTokens, s.PromptTokens, s.CompletionTokens = 0, 0, 0
+		s.TotalCostUSD = 0
+		s.RequestCount = 0
+		s.ConsecutiveErrors = 0
+		s.PromptHistory = nil
+		s.ToolCalls = make(map[string][]time.Time)
+		s.Tree = TreeTotals{}
+	})
+}
+
+// RaiseBudget adds extra tokens and USD to the session's budgets for d,
+// replacing any earlier raise. It returns the session, or nil if it is not
+// tracked.
+func (m *Manager) RaiseBudget(sessionID string, extraTokens int, extraCostUSD float64, d time.Duration) (*SessionState, error) {
+	until := time.Now().Add(d)
+	return m.modify(sessionID, func(s *SessionState) {
+		s.Boost = BudgetBoost{ExtraTokens: extraTokens, ExtraCostUSD: extraCostUSD, Until: until}
+	})
+}
+
+// modify updates a session and returns the result.
+func (m *Manager) modify(sessionID string, fn func(*SessionState)) (*SessionState, error) {
+	var updated *SessionState
+	err := m.store.Update(sessionID, func(s *SessionState) {
+		fn(s)
+		updated = s.clone()
+	})
+	return updated, err
+}
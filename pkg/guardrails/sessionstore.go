@@ -0,0 +1,204 @@
+package guardrails
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionStore keeps session state for a Manager. Each Update is applied
+// atomically, so gateway replicas sharing a store never lose an increment
+// or a prompt-history append. Stores hand out copies: changing a returned
+// SessionState does not change the stored one.
+type SessionStore interface {
+	// Get returns a copy of the session, or nil if it does not exist.
+	Get(id string) (*SessionState, error)
+
+	// Create creates the session if it does not exist and returns a copy.
+	Create(id string, now time.Time) (*SessionState, error)
+
+	// Update applies fn to the session atomically. Missing sessions are
+	// left alone and fn is not called.
+	Update(id string, fn func(*SessionState)) error
+
+	// List returns copies of every session, in no particular order.
+	List() ([]*SessionState, error)
+
+	// Delete removes the session.
+	Delete(id string) error
+
+	// SetCooldown rejects the session ID until the given time.
+	SetCooldown(id string, until time.Time) error
+
+	// Cooldown returns when the session ID stops being rejected, and false
+	// if it is not cooling down.
+	Cooldown(id string) (time.Time, bool, error)
+
+	// Expire removes sessions idle for longer than ttl, and cool-downs that
+	// have passed.
+	Expire(now time.Time, ttl time.Duration) error
+
+	Close() error
+}
+
+// OpenSessionStore opens the store named by spec:
+//
+//	"" or "memory"                          in-process (lost on restart)
+//	"file:///var/lib/gateway/sessions"      JSON files in a directory
+//	"redis://[:password@]host:6379[/db]"    a Redis-protocol server
+//
+// ttl is how long an idle session is kept; the Redis store expires keys
+// itself, the others rely on the Manager's cleanup loop.
+func OpenSessionStore(spec string, ttl time.Duration) (SessionStore, error) {
+	if spec == "" || spec == "memory" {
+		return NewMemoryStore(), nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("guardrails: session store %q: %w", spec, err)
+	}
+	switch u.Scheme {
+	case "file":
+		dir := u.Path
+		if u.Host != "" {
+			dir = u.Host + dir
+		}
+		return NewFileStore(dir)
+	case "redis":
+		password, _ := u.User.Password()
+		db := 0
+		if p := strings.Trim(u.Path, "/"); p != "" {
+			if _, err := fmt.Sscanf(p, "%d", &db); err != nil {
+				return nil, fmt.Errorf("guardrails: session store %q: bad database %q", spec, p)
+			}
+		}
+		return NewRedisStore(RedisOptions{Addr: u.Host, Password: password, DB: db, TTL: ttl})
+	}
+	return nil, fmt.Errorf("guardrails: session store %q: unknown scheme (want memory, file or redis)", spec)
+}
+
+func newSessionState(id string, now time.Time) *SessionState {
+	return &SessionState{
+		SessionID:  id,
+		CreatedAt:  now,
+		LastActive: now,
+		ToolCalls:  make(map[string][]time.Time),
+	}
+}
+
+// clone returns a deep copy of s.
+func (s *SessionState) clone() *SessionState {
+	c := *s
+	c.PromptHistory = append([]promptEntry(nil), s.PromptHistory...)
+	c.RunIDs = append([]string(nil), s.RunIDs...)
+	c.ToolCalls = make(map[string][]time.Time, len(s.ToolCalls))
+	for tool, calls := range s.ToolCalls {
+		c.ToolCalls[tool] = append([]time.Time(nil), calls...)
+	}
+	c.Children = append([]string(nil), s.Children...)
+	c.Tree.PromptHistory = append([]promptEntry(nil), s.Tree.PromptHistory...)
+	c.Tree.ToolCalls = make(map[string][]time.Time, len(s.Tree.ToolCalls))
+	for tool, calls := range s.Tree.ToolCalls {
+		c.Tree.ToolCalls[tool] = append([]time.Time(nil), calls...)
+	}
+	return &c
+}
+
+// MemoryStore keeps sessions in process memory. It is the default store.
+type MemoryStore struct {
+	mu        sync.Mutex
+	sessions  map[string]*SessionState
+	cooldowns map[string]time.Time // terminated session ID → rejected until
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions:  make(map[string]*SessionState),
+		cooldowns: make(map[string]time.Time),
+	}
+}
+
+func (m *MemoryStore) Get(id string) (*SessionState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[id]; ok {
+		return s.clone(), nil
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) Create(id string, now time.Time) (*SessionState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		s = newSessionState(id, now)
+		m.sessions[id] = s
+	}
+	return s.clone(), nil
+}
+
+func (m *MemoryStore) Update(id string, fn func(*SessionState)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[id]; ok {
+		fn(s)
+	}
+	return nil
+}
+
+func (m *MemoryStore) List() ([]*SessionState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*SessionState, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		list = append(list, s.clone())
+	}
+	return list, nil
+}
+
+func (m *MemoryStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *MemoryStore) SetCooldown(id string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cooldowns[id] = until
+	return nil
+}
+
+func (m *MemoryStore) Cooldown(id string) (time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	until, ok := m.cooldowns[id]
+	if ok && !time.Now().Before(until) {
+		delete(m.cooldowns, id)
+		return time.Time{}, false, nil
+	}
+	return until, ok, nil
+}
+
+func (m *MemoryStore) Expire(now time.Time, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, s := range m.sessions {
+		if now.Sub(s.LastActive) > ttl {
+			delete(m.sessions, id)
+		}
+	}
+	for id, until := range m.cooldowns {
+		if now.After(until) {
+			delete(m.cooldowns, id)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) Close() error { return nil }
@@ -0,0 +1,389 @@
+package guardrails
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a local stand-in for a Redis server implementing the
+// commands RedisStore uses, including WATCH/MULTI/EXEC conflict detection.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	values   map[string]string
+	expires  map[string]time.Time
+	versions map[string]int
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, values: map[string]string{}, expires: map[string]time.Time{}, versions: map[string]int{}}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+func (f *fakeRedis) addr() string { return f.ln.Addr().String() }
+
+// get returns a live value; the caller holds f.mu.
+func (f *fakeRedis) get(key string) (string, bool) {
+	if exp, ok := f.expires[key]; ok && time.Now().After(exp) {
+		delete(f.values, key)
+		delete(f.expires, key)
+		f.versions[key]++
+	}
+	v, ok := f.values[key]
+	return v, ok
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	var watched map[string]int
+	var queued [][]string
+	inMulti := false
+	for {
+		reply, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, it := range items {
+			b, _ := it.([]byte)
+			args[i] = string(b)
+		}
+		cmd := strings.ToUpper(args[0])
+
+		if inMulti && cmd != "EXEC" && cmd != "DISCARD" {
+			queued = append(queued, args)
+			c.Write([]byte("+QUEUED\r\n"))
+			continue
+		}
+		switch cmd {
+		case "WATCH":
+			f.mu.Lock()
+			if watched == nil {
+				watched = map[string]int{}
+			}
+			for _, k := range args[1:] {
+				f.get(k)
+				watched[k] = f.versions[k]
+			}
+			f.mu.Unlock()
+			c.Write([]byte("+OK\r\n"))
+		case "UNWATCH":
+			watched = nil
+			c.Write([]byte("+OK\r\n"))
+		case "MULTI":
+			inMulti = true
+			c.Write([]byte("+OK\r\n"))
+		case "DISCARD":
+			inMulti, queued, watched = false, nil, nil
+			c.Write([]byte("+OK\r\n"))
+		case "EXEC":
+			f.mu.Lock()
+			conflict := false
+			for k, v := range watched {
+				f.get(k)
+				if f.versions[k] != v {
+					conflict = true
+				}
+			}
+			var out []byte
+			if conflict {
+				out = []byte("*-1\r\n")
+			} else {
+				out = []byte("*" + strconv.Itoa(len(queued)) + "\r\n")
+				for _, q := range queued {
+					out = append(out, f.exec(q)...)
+				}
+			}
+			f.mu.Unlock()
+			inMulti, queued, watched = false, nil, nil
+			c.Write(out)
+		default:
+			f.mu.Lock()
+			out := f.exec(args)
+			f.mu.Unlock()
+			c.Write(out)
+		}
+	}
+}
+
+// exec runs a plain command; the caller holds f.mu.
+func (f *fakeRedis) exec(args []string) []byte {
+	switch strings.ToUpper(args[0]) {
+	case "PING", "AUTH", "SELECT":
+		return []byte("+OK\r\n")
+	case "GET":
+		v, ok := f.get(args[1])
+		if !ok {
+			return []byte("$-1\r\n")
+		}
+		return []byte("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n")
+	case "SET":
+		key := args[1]
+		var px time.Duration
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				px = time.Duration(ms) * time.Millisecond
+				i++
+			}
+		}
+		if _, ok := f.get(key); ok && nx {
+			return []byte("$-1\r\n")
+		}
+		f.values[key] = args[2]
+		delete(f.expires, key)
+		if px > 0 {
+			f.expires[key] = time.Now().Add(px)
+		}
+		f.versions[key]++
+		return []byte("+OK\r\n")
+	case "SCAN":
+		// One page holding every match; MATCH supports a trailing '*' only.
+		prefix := ""
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				prefix = strings.TrimSuffix(args[i+1], "*")
+			}
+		}
+		var keys []string
+		for k := range f.values {
+			if _, ok := f.get(k); ok && strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+		out := "*2\r\n$1\r\n0\r\n*" + strconv.Itoa(len(keys)) + "\r\n"
+		for _, k := range keys {
+			out += "$" + strconv.Itoa(len(k)) + "\r\n" + k + "\r\n"
+		}
+		return []byte(out)
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			if _, ok := f.get(k); ok {
+				delete(f.values, k)
+				delete(f.expires, k)
+				f.versions[k]++
+				n++
+			}
+		}
+		return []byte(":" + strconv.Itoa(n) + "\r\n")
+	}
+	return []byte("-ERR unknown command '" + args[0] + "'\r\n")
+}
+
+func testStores(t *testing.T) map[string]SessionStore {
+	fs, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := NewRedisStore(RedisOptions{Addr: newFakeRedis(t).addr(), TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rs.Close() })
+	return map[string]SessionStore{"memory": NewMemoryStore(), "file": fs, "redis": rs}
+}
+
+func TestSessionStores(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			if s, err := store.Get("s1"); err != nil || s != nil {
+				t.Fatalf("Get before Create = %v, %v", s, err)
+			}
+			if err := store.Update("s1", func(*SessionState) { t.Error("Update called fn for a missing session") }); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := store.Create("s1/with:odd chars", now)
+			if err != nil || s.SessionID != "s1/with:odd chars" {
+				t.Fatalf("Create = %+v, %v", s, err)
+			}
+			s.TotalTokens = 999 // copies must not leak back into the store
+			store.Update("s1/with:odd chars", func(s *SessionState) {
+				s.TotalTokens += 10
+				s.ToolCalls["search"] = append(s.ToolCalls["search"], now)
+				s.PromptHistory = append(s.PromptHistory, promptEntry{Text: "hi", Timestamp: now})
+			})
+			got, err := store.Get("s1/with:odd chars")
+			if err != nil || got.TotalTokens != 10 || len(got.ToolCalls["search"]) != 1 || got.PromptHistory[0].Text != "hi" {
+				t.Fatalf("Get = %+v, %v", got, err)
+			}
+			if again, _ := store.Create("s1/with:odd chars", now); again.TotalTokens != 10 {
+				t.Errorf("Create replaced an existing session: %+v", again)
+			}
+			long := strings.Repeat("a-very-long-session-id/", 20)
+			if s, err := store.Create(long, now); err != nil || s.SessionID != long {
+				t.Fatalf("Create(long ID) = %+v, %v", s, err)
+			}
+			if s, err := store.Get(long); err != nil || s == nil || s.SessionID != long {
+				t.Fatalf("Get(long ID) = %+v, %v", s, err)
+			}
+			store.Delete(long)
+			store.SetCooldown("not-a-session", now.Add(time.Minute))
+			if list, err := store.List(); err != nil || len(list) != 1 || list[0].TotalTokens != 10 {
+				t.Errorf("List = %v, %v", list, err)
+			}
+
+			store.Delete("s1/with:odd chars")
+			if s, _ := store.Get("s1/with:odd chars"); s != nil {
+				t.Errorf("session survived Delete: %+v", s)
+			}
+
+			store.SetCooldown("s2", now.Add(time.Minute))
+			if until, ok, err := store.Cooldown("s2"); err != nil || !ok || until.Sub(now) < 59*time.Second {
+				t.Errorf("Cooldown = %v, %v, %v", until, ok, err)
+			}
+			if _, ok, _ := store.Cooldown("s3"); ok {
+				t.Error("s3 was never terminated")
+			}
+		})
+	}
+}
+
+func TestSessionStoreExpire(t *testing.T) {
+	for name, store := range testStores(t) {
+		if name == "redis" {
+			continue // keys expire on the server
+		}
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			store.Create("old", now.Add(-time.Hour))
+			store.Create("new", now)
+			store.SetCooldown("gone", now.Add(-time.Second))
+			if err := store.Expire(now, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if s, _ := store.Get("old"); s != nil {
+				t.Error("idle session was not expired")
+			}
+			if s, _ := store.Get("new"); s == nil {
+				t.Error("active session was expired")
+			}
+		})
+	}
+}
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileStore(dir)
+	mgr := &Manager{store: store, ttl: time.Minute}
+	mgr.GetOrCreate("s1")
+	mgr.RecordResponse("s1", Usage{PromptTokens: 700, CostUSD: 0.25}, false)
+	mgr.Terminate("s2", time.Minute)
+
+	reopened, _ := NewFileStore(dir)
+	mgr = &Manager{store: reopened, ttl: time.Minute}
+	if got := mgr.GetSessionTokens("s1"); got != 700 {
+		t.Errorf("tokens after restart = %d, want 700", got)
+	}
+	if _, ok := mgr.Cooldown("s2"); !ok {
+		t.Error("cool-down lost on restart")
+	}
+}
+
+func TestManagerOpenReportsStoreErrors(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileStore(dir)
+	mgr := &Manager{store: store, ttl: time.Minute}
+	if err := mgr.Open("s1", "parent"); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := mgr.Session("s1"); s == nil || s.ParentID != "parent" {
+		t.Errorf("session = %+v", s)
+	}
+
+	os.RemoveAll(dir)
+	if err := mgr.Open("s2", ""); err == nil {
+		t.Error("Open succeeded without a store directory")
+	}
+}
+
+func TestRedisStoreSharedBetweenReplicas(t *testing.T) {
+	addr := newFakeRedis(t).addr()
+	var replicas []*Manager
+	for i := 0; i < 3; i++ {
+		store, err := NewRedisStore(RedisOptions{Addr: addr, TTL: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		replicas = append(replicas, &Manager{store: store, ttl: time.Minute})
+	}
+
+	replicas[0].GetOrCreate("swarm")
+	const perReplica = 20
+	var wg sync.WaitGroup
+	for _, m := range replicas {
+		wg.Add(1)
+		go func(m *Manager) {
+			defer wg.Done()
+			for i := 0; i < perReplica; i++ {
+				m.RecordRequest("swarm", "", []string{"search"})
+				m.RecordResponse("swarm", Usage{PromptTokens: 10}, false)
+			}
+		}(m)
+	}
+	wg.Wait()
+
+	s := replicas[2].session("swarm")
+	want := len(replicas) * perReplica
+	if s.TotalTokens != want*10 || s.RequestCount != want || len(s.ToolCalls["search"]) != want {
+		t.Errorf("tokens=%d requests=%d tool calls=%d, want %d/%d/%d",
+			s.TotalTokens, s.RequestCount, len(s.ToolCalls["search"]), want*10, want, want)
+	}
+
+	replicas[1].Terminate("swarm", time.Minute)
+	if _, ok := replicas[0].Cooldown("swarm"); !ok {
+		t.Error("terminate on one replica should reject the session on the others")
+	}
+}
+
+func TestOpenSessionStore(t *testing.T) {
+	if s, err := OpenSessionStore("", time.Minute); err != nil {
+		t.Fatal(err)
+	} else if _, ok := s.(*MemoryStore); !ok {
+		t.Errorf("default store = %T, want *MemoryStore", s)
+	}
+	if s, err := OpenSessionStore("file://"+t.TempDir(), time.Minute); err != nil {
+		t.Fatal(err)
+	} else if _, ok := s.(*FileStore); !ok {
+		t.Errorf("file store = %T", s)
+	}
+	if s, err := OpenSessionStore("redis://:secret@"+newFakeRedis(t).addr()+"/2", time.Minute); err != nil {
+		t.Fatal(err)
+	} else if rs := s.(*RedisStore); rs.opts.Password != "secret" || rs.opts.DB != 2 {
+		t.Errorf("redis options = %+v", rs.opts)
+	}
+	if _, err := OpenSessionStore("etcd://localhost", time.Minute); err == nil {
+		t.Error("expected an error for an unknown scheme")
+	}
+}
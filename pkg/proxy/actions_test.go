@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/airblackbox/gateway/pkg/guardrails"
+	"github.com/airblackbox/gateway/pkg/recorder"
+	"github.com/airblackbox/gateway/pkg/replay"
+	"github.com/airblackbox/gateway/pkg/upstream"
+)
+
+// stormHandler returns a handler whose second call with the same tool trips
+// tool_retry_storm, and a pointer to the tool names upstream last received.
+func stormHandler(t *testing.T, actions guardrails.ActionsConfig) (http.Handler, string, *[]string) {
+	t.Helper()
+	var tools []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Tools []struct {
+				Function struct {
+					Name string `json:"name"`
+				} `json:"function"`
+			} `json:"tools"`
+		}
+		readJSON(r, &req)
+		tools = nil
+		for _, tool := range req.Tools {
+			tools = append(tools, tool.Function.Name)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","model":"gpt-4o","choices":[{"message":{"role":"assistant","content":"ok"}}]}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	rec, _ := recorder.NewWriter(dir)
+	h := Handler(Config{
+		ProviderURL: srv.URL,
+		Recorder:    rec,
+		Guardrails: &guardrails.Config{
+			ToolProtection: guardrails.ToolConfig{MaxRepeatCalls: 2, RepeatWindowSeconds: 30},
+			Actions:        actions,
+		},
+		Sessions: guardrails.NewManager(5 * time.Minute),
+	})
+	return h, dir, &tools
+}
+
+func sendWithTools(h http.Handler, session string) *httptest.ResponseRecorder {
+	body := `{"model":"gpt-4o","messages":[{"role":"user","content":"find it"}],` +
+		`"tools":[{"type":"function","function":{"name":"search"}},{"type":"function","function":{"name":"lookup"}}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("X-Session-ID", session)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestProxyWarnsAndStripsToolsOnViolation(t *testing.T) {
+	h, dir, tools := stormHandler(t, guardrails.ActionsConfig{
+		Rules: map[string][]string{"tool_retry_storm": {"warn", "strip_tools"}},
+	})
+
+	sendWithTools(h, "warn-session")
+	w := sendWithTools(h, "warn-session")
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if !strings.HasPrefix(w.Header().Get("X-Guardrail-Warning"), "tool_retry_storm: ") {
+		t.Errorf("X-Guardrail-Warning = %q", w.Header().Get("X-Guardrail-Warning"))
+	}
+	if got := w.Header().Get("X-Tools-Stripped"); got != "search" {
+		t.Errorf("X-Tools-Stripped = %q, want search", got)
+	}
+	if !reflect.DeepEqual(*tools, []string{"lookup"}) {
+		t.Errorf("upstream tools = %v, want [lookup]", *tools)
+	}
+
+	loaded, err := recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Guardrail == nil || loaded.Guardrail.Rule != "tool_retry_storm" ||
+		!reflect.DeepEqual(loaded.Guardrail.Actions, []string{"warn", "strip_tools"}) {
+		t.Errorf("guardrail = %+v", loaded.Guardrail)
+	}
+	if !reflect.DeepEqual(loaded.FilteredTools, []recorder.FilteredTool{{Name: "search", Rule: "tool_retry_storm"}}) {
+		t.Errorf("filtered_tools = %+v", loaded.FilteredTools)
+	}
+	if len(loaded.Violations) != 1 || loaded.Violations[0].Stage != "detection" || loaded.Violations[0].Outcome != "modified" {
+		t.Errorf("violations = %+v", loaded.Violations)
+	}
+}
+
+func TestProxyTerminatesSessionWithCooldownAndSavesReplay(t *testing.T) {
+	replayDir := t.TempDir()
+	h, dir, _ := stormHandler(t, guardrails.ActionsConfig{
+		OnTrigger:       []string{"terminate_session", "save_replay"},
+		CooldownMinutes: 5,
+		ReplayDir:       replayDir,
+	})
+
+	first := sendWithTools(h, "bad-agent")
+	waitForAIRRecord(t, dir, first.Header().Get("x-run-id"))
+
+	w := sendWithTools(h, "bad-agent")
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "agent_guardrail_triggered") {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	loaded, err := recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Status != "blocked" || loaded.Guardrail == nil || loaded.Guardrail.Rule != "tool_retry_storm" {
+		t.Errorf("blocked record: status %q, guardrail %+v", loaded.Status, loaded.Guardrail)
+	}
+	if len(loaded.Violations) != 1 || loaded.Violations[0].Outcome != "blocked" || loaded.Error != loaded.Violations[0].Message {
+		t.Errorf("violations = %+v, error %q", loaded.Violations, loaded.Error)
+	}
+
+	w = sendWithTools(h, "bad-agent")
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "session_terminated") {
+		t.Fatalf("cool-down status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After on cool-down rejection")
+	}
+	loaded, _ = recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id")))
+	if loaded.Status != "blocked" || len(loaded.Violations) != 1 || loaded.Violations[0].Rule != "session_terminated" {
+		t.Errorf("cool-down record: status %q, violations %+v", loaded.Status, loaded.Violations)
+	}
+	if w = sendWithTools(h, "other-agent"); w.Code != 200 {
+		t.Errorf("other session status = %d, want 200", w.Code)
+	}
+
+	var bundles []string
+	deadline := time.Now().Add(2 * time.Second)
+	for len(bundles) == 0 && time.Now().Before(deadline) {
+		bundles, _ = filepath.Glob(filepath.Join(replayDir, "bad-agent-*.bundle.json"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(bundles) != 1 {
+		t.Fatalf("bundles = %v, want one", bundles)
+	}
+	b, err := replay.LoadBundle(bundles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Rule != "tool_retry_storm" || len(b.Records) != 1 || b.Records[0].RunID != first.Header().Get("x-run-id") {
+		t.Errorf("bundle = %+v", b)
+	}
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(b.Request, &req); err != nil || req["tools"] == nil {
+		t.Errorf("bundle request = %s", b.Request)
+	}
+}
+
+func TestSaveReplayRedactsProviderKeys(t *testing.T) {
+	replayDir := t.TempDir()
+	cfg := Config{
+		Guardrails: &guardrails.Config{Actions: guardrails.ActionsConfig{ReplayDir: replayDir}},
+		Providers: &upstream.Config{Providers: []upstream.Provider{{Name: "openai", BaseURL: "http://unused.invalid", Default: true,
+			Auth: upstream.AuthConfig{Scheme: upstream.AuthBearer, APIKey: "sk-real"}}}},
+	}
+	body := []byte(`{"model":"gpt-4o","messages":[{"role":"user","content":"my key is sk-real"}]}`)
+	saveReplay(cfg, "leaky", nil, &guardrails.Violation{Rule: "prompt_loop"}, []string{"save_replay"}, body)
+
+	bundles, _ := filepath.Glob(filepath.Join(replayDir, "leaky-*.bundle.json"))
+	if len(bundles) != 1 {
+		t.Fatalf("bundles = %v, want one", bundles)
+	}
+	b, err := replay.LoadBundle(bundles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b.Request), "sk-real") || !strings.Contains(string(b.Request), "[REDACTED_CREDENTIAL]") {
+		t.Errorf("bundle request = %s", b.Request)
+	}
+}
+
+func TestProxyRefusesWhenSessionStoreFails(t *testing.T) {
+	storeDir := t.TempDir()
+	store, err := guardrails.NewFileStore(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	rec, _ := recorder.NewWriter(dir)
+	h := Handler(Config{
+		ProviderURL: "http://127.0.0.1:1", // never reached
+		Recorder:    rec,
+		Guardrails:  &guardrails.Config{Budgets: guardrails.BudgetConfig{MaxSessionTokens: 1000}},
+		Sessions:    guardrails.NewManagerWithStore(5*time.Minute, store),
+	})
+	os.RemoveAll(storeDir)
+
+	w := sendWithTools(h, "s1")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "session_store_unavailable") {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	loaded, err := recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Status != "blocked" || len(loaded.Violations) != 1 || loaded.Violations[0].Rule != "session_store" {
+		t.Errorf("status %q, violations %+v", loaded.Status, loaded.Violations)
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/airblackbox/gateway/pkg/recorder"
+)
+
+// anthropicMessagesEndpoint is the native Anthropic Messages API path.
+const anthropicMessagesEndpoint = "/v1/messages"
+
+// anthropicForwardHeaders are client headers the Messages API requires or
+// understands, forwarded verbatim to the upstream.
+var anthropicForwardHeaders = []string{"anthropic-version", "anthropic-beta"}
+
+// copyAnthropicHeaders forwards Anthropic's auth and versioning headers.
+// Anthropic authenticates with x-api-key rather than Authorization. The
+// gateway also accepts its own key via X-Api-Key; authenticate removes it
+// then, so what is left here is the provider key.
+func copyAnthropicHeaders(dst *http.Request, src *http.Request) {
+	if key := src.Header.Get("X-Api-Key"); key != "" {
+		dst.Header.Set("X-Api-Key", key)
+	}
+	for _, h := range anthropicForwardHeaders {
+		if v := src.Header.Get(h); v != "" {
+			dst.Header.Set(h, v)
+		}
+	}
+}
+
+// anthropicUsage is the usage block from Anthropic responses and stream events.
+// input_tokens excludes prompt-cache reads and writes, which are reported separately.
+type anthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+}
+
+// isAnthropicStream reports whether an SSE body uses the Messages API event types.
+func isAnthropicStream(data []byte) bool {
+	return strings.Contains(string(data), `"type":"message_start"`) ||
+		strings.Contains(string(data), "event: message_start")
+}
+
+// extractAnthropicStreamTokens aggregates usage across a Messages API stream.
+// message_start carries the input tokens; each message_delta carries the
+// cumulative output tokens, so the last one wins.
+func extractAnthropicStreamTokens(data []byte) recorder.Tokens {
+	var prompt, completion, cached int
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var event struct {
+			Type    string `json:"type"`
+			Message *struct {
+				Usage *anthropicUsage `json:"usage"`
+			} `json:"message"`
+			Usage *anthropicUsage `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+			continue
+		}
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil && event.Message.Usage != nil {
+				u := event.Message.Usage
+				prompt = u.InputTokens + u.CacheReadInputTokens + u.CacheCreationInputTokens
+				cached = u.CacheReadInputTokens
+				completion = u.OutputTokens
+			}
+		case "message_delta":
+			if event.Usage != nil {
+				completion = event.Usage.OutputTokens
+				if event.Usage.InputTokens > 0 {
+					prompt = event.Usage.InputTokens + event.Usage.CacheReadInputTokens + event.Usage.CacheCreationInputTokens
+					cached = event.Usage.CacheReadInputTokens
+				}
+			}
+		}
+	}
+	return recorder.Tokens{
+		Prompt:     prompt,
+		Completion: completion,
+		Total:      prompt + completion,
+		Cached:     cached,
+	}
+}
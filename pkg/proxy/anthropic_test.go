@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/airblackbox/gateway/pkg/guardrails"
+	"github.com/airblackbox/gateway/pkg/recorder"
+)
+
+const anthropicRequest = `{
+	"model": "claude-3-5-sonnet-20241022",
+	"max_tokens": 256,
+	"system": "You are a support agent.",
+	"tools": [
+		{"name": "lookup_order", "input_schema": {"type": "object"}},
+		{"name": "delete_all_data", "input_schema": {"type": "object"}}
+	],
+	"messages": [
+		{"role": "user", "content": "Where is my order?"},
+		{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_1", "name": "lookup_order", "input": {"id": "42"}}]},
+		{"role": "user", "content": [
+			{"type": "tool_result", "tool_use_id": "toolu_1", "content": "shipped"},
+			{"type": "text", "text": "Email me at alice@example.com when it arrives"}
+		]}
+	]
+}`
+
+func TestAnthropicMessagesBuffered(t *testing.T) {
+	var upstreamBody []byte
+	var upstreamHeaders http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			t.Errorf("upstream path = %s, want /v1/messages", r.URL.Path)
+		}
+		upstreamBody, _ = io.ReadAll(r.Body)
+		upstreamHeaders = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("request-id", "req_anthropic_1")
+		w.Write([]byte(`{
+			"id": "msg_1", "type": "message", "role": "assistant", "model": "claude-3-5-sonnet-20241022",
+			"content": [{"type": "text", "text": "I'll let you know."}],
+			"usage": {"input_tokens": 20, "output_tokens": 6, "cache_read_input_tokens": 100}
+		}`))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	rec, _ := recorder.NewWriter(dir)
+	mgr := guardrails.NewManager(5 * time.Minute)
+	cfg := Config{
+		ProviderURL: upstream.URL,
+		Recorder:    rec,
+		Guardrails: &guardrails.Config{
+			Prevention: guardrails.PreventionConfig{
+				PII:   guardrails.PIIConfig{Enabled: true, BlockEmail: true, RedactMode: "redact"},
+				Tools: guardrails.ToolFilterConfig{Enabled: true, Blocklist: []string{"delete_all_data"}},
+			},
+		},
+		Sessions: mgr,
+	}
+	h := Handler(cfg)
+
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(anthropicRequest))
+	req.Header.Set("X-Api-Key", "sk-ant-test")
+	req.Header.Set("Anthropic-Version", "2023-06-01")
+	req.Header.Set("X-Session-ID", "anthropic-session")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if got := upstreamHeaders.Get("X-Api-Key"); got != "sk-ant-test" {
+		t.Errorf("upstream x-api-key = %q, want sk-ant-test", got)
+	}
+	if got := upstreamHeaders.Get("Anthropic-Version"); got != "2023-06-01" {
+		t.Errorf("upstream anthropic-version = %q, want 2023-06-01", got)
+	}
+	if got := w.Header().Get("request-id"); got != "req_anthropic_1" {
+		t.Errorf("request-id = %q, want req_anthropic_1", got)
+	}
+
+	// PII in the text block was redacted and the blocked tool was removed.
+	sent := string(upstreamBody)
+	if strings.Contains(sent, "alice@example.com") {
+		t.Error("email reached the upstream unredacted")
+	}
+	if strings.Contains(sent, "delete_all_data") {
+		t.Error("blocked tool reached the upstream")
+	}
+	if !strings.Contains(sent, "lookup_order") {
+		t.Error("allowed tool was dropped")
+	}
+
+	// Session accounting includes cache reads in the prompt total.
+	s := mgr.GetOrCreate("anthropic-session")
+	if s.PromptTokens != 120 || s.CompletionTokens != 6 {
+		t.Errorf("session tokens = prompt %d completion %d, want 120/6", s.PromptTokens, s.CompletionTokens)
+	}
+
+	airFile := waitForAIRRecord(t, dir, w.Header().Get("x-run-id"))
+	loaded, _ := recorder.Load(airFile)
+	if loaded.Provider != "anthropic" || loaded.Endpoint != "/v1/messages" {
+		t.Errorf("AIR provider/endpoint = %s %s", loaded.Provider, loaded.Endpoint)
+	}
+	if loaded.Tokens.Total != 126 || loaded.Tokens.Cached != 100 {
+		t.Errorf("AIR tokens = %+v, want total 126 cached 100", loaded.Tokens)
+	}
+}
+
+func TestAnthropicMessagesStreaming(t *testing.T) {
+	stream := strings.Join([]string{
+		"event: message_start",
+		`data: {"type":"message_start","message":{"id":"msg_1","model":"claude-3-5-sonnet-20241022","usage":{"input_tokens":25,"output_tokens":1}}}`,
+		"",
+		"event: content_block_delta",
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+		"",
+		"event: message_delta",
+		`data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":15}}`,
+		"",
+		"event: message_stop",
+		`data: {"type":"message_stop"}`,
+		"",
+	}, "\n")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		w.Write([]byte(stream))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	rec, _ := recorder.NewWriter(dir)
+	mgr := guardrails.NewManager(5 * time.Minute)
+	cfg := Config{ProviderURL: upstream.URL, Recorder: rec, Guardrails: &guardrails.Config{}, Sessions: mgr}
+	h := Handler(cfg)
+
+	body := `{"model":"claude-3-5-sonnet-20241022","max_tokens":64,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body))
+	req.Header.Set("X-Session-ID", "anthropic-stream")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if !strings.Contains(w.Body.String(), "content_block_delta") {
+		t.Fatal("stream was not forwarded to the client")
+	}
+	s := mgr.GetOrCreate("anthropic-stream")
+	if s.PromptTokens != 25 || s.CompletionTokens != 15 {
+		t.Errorf("session tokens = prompt %d completion %d, want 25/15", s.PromptTokens, s.CompletionTokens)
+	}
+
+	airFile := waitForAIRRecord(t, dir, w.Header().Get("x-run-id"))
+	loaded, _ := recorder.Load(airFile)
+	if loaded.Tokens.Total != 40 {
+		t.Errorf("AIR total tokens = %d, want 40", loaded.Tokens.Total)
+	}
+}
+
+func TestAnthropicGatewayKeyNotForwarded(t *testing.T) {
+	var upstreamKey string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamKey = r.Header.Get("X-Api-Key")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"id": "msg_1"})
+	}))
+	defer upstream.Close()
+
+	h := Handler(Config{ProviderURL: upstream.URL, GatewayKey: "gw-secret"})
+	req := httptest.NewRequest("POST", "/v1/messages",
+		strings.NewReader(`{"model":"claude-3-5-haiku-latest","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("X-Api-Key", "gw-secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if upstreamKey != "" {
+		t.Errorf("gateway key leaked upstream as x-api-key: %q", upstreamKey)
+	}
+}
+
+func TestExtractToolNamesAnthropic(t *testing.T) {
+	names := extractToolNames([]byte(anthropicRequest))
+	if len(names) != 2 || names[0] != "lookup_order" || names[1] != "delete_all_data" {
+		t.Errorf("tool names = %v", names)
+	}
+	if got := extractPromptText(mustMessages(t, anthropicRequest)); got != "Email me at alice@example.com when it arrives" {
+		t.Errorf("prompt text = %q", got)
+	}
+}
+
+func mustMessages(t *testing.T, body string) json.RawMessage {
+	t.Helper()
+	var req chatRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("parse request: %v", err)
+	}
+	return req.Messages
+}
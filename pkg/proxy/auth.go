@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/airblackbox/gateway/pkg/auth"
+	"github.com/airblackbox/gateway/pkg/recorder"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// gatewayIdentity is the caller presenting the shared GATEWAY_KEY: every
+// scope and no restrictions.
+var gatewayIdentity = &auth.Identity{KeyID: "gateway", Scopes: []string{auth.ScopeProxy, auth.ScopeAdmin}}
+
+// authenticateGateway resolves the gateway key in X-Gateway-Key (or
+// X-Api-Key) against the key registry and GATEWAY_KEY, and checks the
+// caller holds the proxy scope. It returns the request carrying the
+// caller's identity, or false once it has rejected the request. Without
+// any gateway key or JWT verifier configured every caller is let through
+// anonymously. A virtual key in place of the provider key authenticates on
+// its own.
+func authenticateGateway(w http.ResponseWriter, r *http.Request, cfg Config) (*http.Request, bool) {
+	return authenticate(w, r, cfg, auth.ScopeProxy)
+}
+
+// authenticateAdmin is authenticateGateway for admin endpoints, which need
+// the admin scope and are refused outright when no gateway key is
+// configured.
+func authenticateAdmin(w http.ResponseWriter, r *http.Request, cfg Config) (*http.Request, bool) {
+	if cfg.GatewayKey == "" && cfg.Keys == nil && cfg.JWT == nil {
+		http.Error(w, `{"error":"admin endpoints require GATEWAY_KEY, GATEWAY_KEYS_FILE or JWT_JWKS to be set"}`, http.StatusForbidden)
+		return r, false
+	}
+	return authenticate(w, r, cfg, auth.ScopeAdmin)
+}
+
+func authenticate(w http.ResponseWriter, r *http.Request, cfg Config, scope string) (*http.Request, bool) {
+	if header, key := presentedVirtualKey(r); cfg.VirtualKeys != nil && key != "" {
+		return authenticateVirtual(w, r, cfg, scope, header, key)
+	}
+	if header, token := presentedJWT(r); cfg.JWT != nil && token != "" {
+		return authenticateJWT(w, r, cfg, scope, header, token)
+	}
+	cert := clientCertIdentity(r, cfg)
+	if cfg.GatewayKey == "" && cfg.Keys == nil && cfg.JWT == nil && cert == nil {
+		return r, true // no gateway auth configured
+	}
+
+	header := "X-Gateway-Key"
+	provided := r.Header.Get(header)
+	if provided == "" {
+		header = "X-Api-Key"
+		provided = r.Header.Get(header)
+	}
+	id := cfg.Keys.Lookup(provided)
+	if id == nil && cfg.GatewayKey != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(cfg.GatewayKey)) == 1 {
+		id = gatewayIdentity
+	}
+	// A verified client certificate identifies callers that send no
+	// gateway key; X-Api-Key is then the provider's.
+	if id == nil && cert != nil && r.Header.Get("X-Gateway-Key") == "" {
+		id, header = cert, ""
+	}
+	if id == nil {
+		http.Error(w, `{"error":"unauthorized: invalid or missing gateway key"}`, http.StatusUnauthorized)
+		return r, false
+	}
+	if !authorize(w, r, id, scope) {
+		return r, false
+	}
+
+	// A gateway key sent as X-Api-Key is ours, not the provider's.
+	if header == "X-Api-Key" {
+		r.Header.Del(header)
+	}
+	return r.WithContext(auth.WithIdentity(r.Context(), id)), true
+}
+
+// authorize checks the identity holds scope and may call the endpoint.
+func authorize(w http.ResponseWriter, r *http.Request, id *auth.Identity, scope string) bool {
+	if !id.HasScope(scope) {
+		log.Printf("[auth] key %s denied %s: no %s scope", id.KeyID, r.URL.Path, scope)
+		http.Error(w, fmt.Sprintf(`{"error":"forbidden: key lacks the %s scope"}`, scope), http.StatusForbidden)
+		return false
+	}
+	if !id.AllowsEndpoint(r.URL.Path) {
+		log.Printf("[auth] key %s denied %s: endpoint not allowed", id.KeyID, r.URL.Path)
+		http.Error(w, `{"error":"forbidden: endpoint not allowed for this key"}`, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// presentedVirtualKey returns the header and value of a virtual key sent
+// where SDKs send the provider key: Authorization: Bearer vk-... or
+// X-Api-Key: vk-....
+func presentedVirtualKey(r *http.Request) (header, key string) {
+	if v := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); strings.HasPrefix(v, auth.VirtualKeyPrefix) {
+		return "Authorization", v
+	}
+	if v := r.Header.Get("X-Api-Key"); strings.HasPrefix(v, auth.VirtualKeyPrefix) {
+		return "X-Api-Key", v
+	}
+	return "", ""
+}
+
+// presentedJWT returns the header and value of a bearer JWT, sent either as
+// X-Gateway-Key or as Authorization: Bearer in place of the provider key.
+func presentedJWT(r *http.Request) (header, token string) {
+	if v := r.Header.Get("X-Gateway-Key"); auth.LooksLikeJWT(v) {
+		return "X-Gateway-Key", v
+	}
+	if v := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); auth.LooksLikeJWT(v) {
+		return "Authorization", v
+	}
+	return "", ""
+}
+
+// authenticateJWT verifies a bearer JWT. A token sent as Authorization is
+// removed from the request, and the providers get the gateway's own
+// credentials instead.
+func authenticateJWT(w http.ResponseWriter, r *http.Request, cfg Config, scope, header, token string) (*http.Request, bool) {
+	id, err := cfg.JWT.Verify(token, time.Now())
+	if err != nil {
+		log.Printf("[auth] JWT rejected for %s: %v", r.URL.Path, err)
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": "unauthorized: invalid token: " + err.Error()})
+		return r, false
+	}
+	if !authorize(w, r, id, scope) {
+		return r, false
+	}
+	if header == "Authorization" {
+		r.Header.Del(header)
+		id.ServerCredentials = true
+	}
+	return r.WithContext(auth.WithIdentity(r.Context(), id)), true
+}
+
+// authenticateVirtual resolves a virtual key and removes it from the
+// request, so only the gateway's provider credentials go upstream.
+func authenticateVirtual(w http.ResponseWriter, r *http.Request, cfg Config, scope, header, key string) (*http.Request, bool) {
+	vk, err := cfg.VirtualKeys.Resolve(key, time.Now())
+	switch {
+	case errors.Is(err, auth.ErrVirtualKeySpent):
+		log.Printf("[auth] virtual key %s denied: spent $%.4f of $%.4f", vk.ID, vk.SpentUSD, vk.MaxSpendUSD)
+		http.Error(w, `{"error":"forbidden: virtual key spend cap reached"}`, http.StatusForbidden)
+		return r, false
+	case err != nil:
+		if vk.ID != "" {
+			log.Printf("[auth] virtual key %s denied: %v", vk.ID, err)
+		}
+		http.Error(w, fmt.Sprintf(`{"error":"unauthorized: %s"}`, strings.TrimPrefix(err.Error(), "auth: ")), http.StatusUnauthorized)
+		return r, false
+	}
+	id := vk.Identity()
+	if !authorize(w, r, id, scope) {
+		return r, false
+	}
+	r.Header.Del(header)
+	return r.WithContext(auth.WithIdentity(r.Context(), id)), true
+}
+
+// clientCertIdentity returns the caller a verified TLS client certificate
+// stands for: the registry entry whose cert_subject names it, or else
+// "cert:<name>" with the proxy scope. Either way the subject is the
+// certificate's name. Nil without a verified certificate.
+func clientCertIdentity(r *http.Request, cfg Config) *auth.Identity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	leaf := r.TLS.PeerCertificates[0]
+	names := auth.CertNames(leaf)
+	if id := cfg.Keys.LookupCert(names); id != nil {
+		cid := *id
+		cid.Subject = names[0]
+		return &cid
+	}
+	return auth.CertIdentity(leaf)
+}
+
+// clientCertRecord describes the verified client certificate for the span
+// and the AIR record, or returns nil without one.
+func clientCertRecord(r *http.Request, span trace.Span) *recorder.ClientCert {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	leaf := r.TLS.PeerCertificates[0]
+	cc := &recorder.ClientCert{SHA256: auth.CertFingerprint(leaf)}
+	if names := auth.CertNames(leaf); len(names) > 0 {
+		cc.Subject = names[0]
+	}
+	span.SetAttributes(
+		attribute.String("tls.client.subject", leaf.Subject.String()),
+		attribute.String("tls.client.hash.sha256", cc.SHA256),
+	)
+	return cc
+}
+
+// applyIdentity applies the guardrails profile and budgets of the caller's
+// key. It returns false once it has rejected the request.
+func applyIdentity(w http.ResponseWriter, cfg *Config, id *auth.Identity, notes *airAnnotations, span trace.Span) bool {
+	if id == nil {
+		return true
+	}
+	span.SetAttributes(
+		attribute.String("gateway.key.id", id.KeyID),
+		attribute.String("gateway.tenant", id.Tenant),
+		attribute.String("gateway.team", id.Team),
+	)
+	if id.Subject != "" {
+		span.SetAttributes(attribute.String("enduser.id", id.Subject))
+	}
+	notes.Identity = &recorder.Identity{KeyID: id.KeyID, Subject: id.Subject, Tenant: id.Tenant, Team: id.Team, Profile: id.Profile}
+
+	if cfg.Guardrails == nil {
+		return true
+	}
+	gr, ok := cfg.Guardrails.WithProfile(id.Profile)
+	if !ok {
+		log.Printf("[auth] key %s names guardrail profile %q, which is not configured", id.KeyID, id.Profile)
+		http.Error(w, `{"error":"guardrail profile for this key is not configured"}`, http.StatusInternalServerError)
+		return false
+	}
+	cfg.Guardrails = gr.WithBudgets(id.Budgets.MaxSessionTokens, id.Budgets.MaxSessionCostUSD)
+	return true
+}
+
+// allowModel refuses the request with 403 if the caller's key may not use
+// model, noting the violation for its AIR record. It returns false once it
+// has rejected the request.
+func allowModel(w http.ResponseWriter, runID string, id *auth.Identity, model string, notes *airAnnotations) bool {
+	if id == nil || id.AllowsModel(model) {
+		return true
+	}
+	reason := fmt.Sprintf("model %q is not allowed for this key", model)
+	log.Printf("[auth] key %s denied model %q", id.KeyID, model)
+	noteViolation(notes, stagePrevention, "model_not_allowed", reason, outcomeBlocked)
+	w.Header().Set("x-run-id", runID)
+	writePolicyBlocked(w, "model_not_allowed", reason)
+	return false
+}
@@ -0,0 +1,421 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/airblackbox/gateway/pkg/auth"
+	"github.com/airblackbox/gateway/pkg/guardrails"
+	"github.com/airblackbox/gateway/pkg/recorder"
+	"github.com/airblackbox/gateway/pkg/trust"
+	"github.com/airblackbox/gateway/pkg/upstream"
+)
+
+func TestGatewayKeyRegistry(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","model":"gpt-4o-mini","choices":[{"message":{"role":"assistant","content":"ok"}}],` +
+			`"usage":{"prompt_tokens":600,"completion_tokens":0,"total_tokens":600}}`))
+	}))
+	defer upstream.Close()
+
+	keysPath := filepath.Join(t.TempDir(), "keys.yaml")
+	os.WriteFile(keysPath, []byte(`keys:
+  - id: ci
+    key_sha256: `+auth.HashKey("sk-ci")+`
+    tenant: acme
+    team: platform
+    models: ["gpt-4o-mini"]
+    endpoints: [/v1/chat/completions]
+    guardrail_profile: strict
+  - id: ops
+    key_sha256: `+auth.HashKey("sk-ops")+`
+    scopes: [proxy, admin]
+  - id: dev
+    key_sha256: `+auth.HashKey("sk-dev")+`
+    scopes: [proxy]
+`), 0600)
+	keys, err := auth.LoadRegistry(keysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	rec, _ := recorder.NewWriter(dir)
+	sessions := guardrails.NewManager(5 * time.Minute)
+	h := Handler(Config{
+		ProviderURL: upstream.URL,
+		Recorder:    rec,
+		Keys:        keys,
+		Guardrails: &guardrails.Config{
+			Budgets:  guardrails.BudgetConfig{MaxSessionTokens: 100000},
+			Actions:  guardrails.ActionsConfig{OnTrigger: []string{"block"}},
+			Profiles: map[string]guardrails.Profile{"strict": {DetectionRules: guardrails.DetectionRules{Budgets: guardrails.BudgetConfig{MaxSessionTokens: 1000}}}},
+		},
+		Sessions:   sessions,
+		AuditChain: trust.NewAuditChain("secret"),
+	})
+	do := func(key, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("X-Gateway-Key", key)
+		}
+		req.Header.Set("X-Session-ID", "s1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	chat := func(key, model string) *httptest.ResponseRecorder {
+		return do(key, "POST", "/v1/chat/completions", `{"model":"`+model+`","messages":[{"role":"user","content":"hi"}]}`)
+	}
+
+	if w := chat("", "gpt-4o-mini"); w.Code != http.StatusUnauthorized {
+		t.Errorf("no key = %d, want 401", w.Code)
+	}
+	if w := chat("sk-unknown", "gpt-4o-mini"); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown key = %d, want 401", w.Code)
+	}
+	if w := chat("sk-ci", "gpt-4o"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "model_not_allowed") {
+		t.Errorf("disallowed model = %d %s", w.Code, w.Body.String())
+	} else if loaded, err := recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id"))); err != nil ||
+		loaded.Status != "blocked" || loaded.Identity == nil || loaded.Identity.KeyID != "ci" ||
+		len(loaded.Violations) != 1 || loaded.Violations[0].Rule != "model_not_allowed" {
+		t.Errorf("disallowed model record = %+v, %v", loaded, err)
+	}
+	if w := do("sk-ci", "POST", "/v1/responses", `{"model":"gpt-4o-mini"}`); w.Code != http.StatusForbidden {
+		t.Errorf("disallowed endpoint = %d, want 403", w.Code)
+	}
+
+	// The strict profile's 1000-token budget applies to ci, in its tenant's
+	// session namespace.
+	w := chat("sk-ci", "gpt-4o-mini")
+	if w.Code != 200 {
+		t.Fatalf("ci = %d %s", w.Code, w.Body.String())
+	}
+	loaded, err := recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := loaded.Identity; id == nil || id.KeyID != "ci" || id.Tenant != "acme" || id.Team != "platform" || id.Profile != "strict" {
+		t.Errorf("AIR identity = %+v", loaded.Identity)
+	}
+	chat("sk-ci", "gpt-4o-mini")
+	if w := chat("sk-ci", "gpt-4o-mini"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("ci over its profile budget = %d, want 429", w.Code)
+	}
+	if s, _ := sessions.Session("acme:s1"); s == nil || s.TotalTokens != 1200 {
+		t.Errorf("tenant session = %+v", s)
+	}
+
+	// ops uses the top-level budget and the global namespace.
+	for i := 0; i < 3; i++ {
+		if w := chat("sk-ops", "gpt-4o"); w.Code != 200 {
+			t.Errorf("ops call %d = %d", i, w.Code)
+		}
+	}
+
+	// Admin endpoints need the admin scope; dev may call any endpoint but
+	// only has the proxy scope.
+	for _, path := range []string{"/v1/audit", "/v1/audit/export", "/v1/admin/sessions"} {
+		if w := do("sk-dev", "GET", path, ""); w.Code != http.StatusForbidden {
+			t.Errorf("%s with proxy scope = %d, want 403", path, w.Code)
+		}
+	}
+	if w := do("sk-ops", "GET", "/v1/audit/export", ""); w.Code != 200 {
+		t.Errorf("audit export with admin scope = %d %s", w.Code, w.Body.String())
+	}
+	if w := do("sk-ops", "GET", "/v1/admin/sessions/acme:s1", ""); w.Code != 200 {
+		t.Errorf("admin session = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestKeyModelsApplyToDowngradesAndFallbacks(t *testing.T) {
+	var served []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body chatRequest
+		readJSON(r, &body)
+		if body.Model == "gpt-4o-mini" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		served = append(served, body.Model)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(okChatResponse))
+	}))
+	defer srv.Close()
+
+	keysPath := filepath.Join(t.TempDir(), "keys.yaml")
+	os.WriteFile(keysPath, []byte("keys:\n  - id: mini\n    key_sha256: "+auth.HashKey("sk-mini")+"\n    models: [gpt-4o-mini]\n"), 0600)
+	keys, err := auth.LoadRegistry(keysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := guardrails.NewManager(5 * time.Minute)
+	sessions.GetOrCreate("big")
+	sessions.RecordResponse("big", guardrails.Usage{PromptTokens: 10}, false)
+
+	dir := t.TempDir()
+	rec, _ := recorder.NewWriter(dir)
+	h := Handler(Config{
+		Recorder: rec,
+		Keys:     keys,
+		Sessions: sessions,
+		Guardrails: &guardrails.Config{Prevention: guardrails.PreventionConfig{
+			ModelLimits: guardrails.ModelLimitConfig{Enabled: true, CostThresholdUSD: 1,
+				CostPerMToken: map[string]float64{"gpt-4o-mini": 1e6}, DowngradeMap: map[string]string{"gpt-4o-mini": "gpt-3.5-turbo"}},
+		}},
+		Providers: &upstream.Config{
+			Providers: []upstream.Provider{{Name: "openai", BaseURL: srv.URL, Default: true}},
+			Retry:     upstream.RetryConfig{MaxAttempts: 1, RetryOn: []string{"server_error"}},
+			Fallbacks: map[string][]string{"gpt-4o-mini": {"gpt-4o"}},
+		},
+	})
+	chat := func(session string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set("X-Gateway-Key", "sk-mini")
+		req.Header.Set("X-Session-ID", session)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// The fallback to gpt-4o is outside the key's models and is skipped.
+	w := chat("s1")
+	if w.Code != http.StatusInternalServerError || len(served) != 0 {
+		t.Fatalf("status = %d, served %v, want the primary's 500 and no fallback", w.Code, served)
+	}
+	loaded, _ := recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id")))
+	if len(loaded.Attempts) != 2 || loaded.Attempts[1].Model != "gpt-4o" || loaded.Attempts[1].Outcome != "model_not_allowed" {
+		t.Errorf("attempts = %+v", loaded.Attempts)
+	}
+
+	// A downgrade to a model outside the key's models is refused.
+	if w := chat("big"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "model_not_allowed") || len(served) != 0 {
+		t.Errorf("downgrade = %d %s, served %v", w.Code, w.Body.String(), served)
+	}
+}
+
+func TestSharedGatewayKeyStillWorks(t *testing.T) {
+	h := Handler(Config{ProviderURL: "http://unused", GatewayKey: "gw-secret", AuditChain: trust.NewAuditChain("secret")})
+	for key, want := range map[string]int{"gw-secret": 200, "gw-secre": 401, "gw-secret2": 401} {
+		req := httptest.NewRequest("GET", "/v1/audit", nil)
+		req.Header.Set("X-Gateway-Key", key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("key %q = %d, want %d", key, w.Code, want)
+		}
+	}
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	var gotAuth []string
+	upstreamSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = append(gotAuth, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","model":"gpt-4o-mini","usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`))
+	}))
+	defer upstreamSrv.Close()
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{"kty": "OKP", "crv": "Ed25519", "kid": "k1", "x": b64(pub)}}})
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(jwksPath, jwks, 0600)
+	verifier, err := auth.NewJWTVerifier(context.Background(), auth.JWTConfig{
+		JWKS: jwksPath, Issuer: "idp", Audience: "gateway", TenantClaim: "org", SessionClaim: "sid",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := func(claims map[string]interface{}) string {
+		claims["iss"], claims["aud"], claims["exp"] = "idp", "gateway", time.Now().Add(time.Hour).Unix()
+		header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "kid": "k1"})
+		payload, _ := json.Marshal(claims)
+		signed := b64(header) + "." + b64(payload)
+		return signed + "." + b64(ed25519.Sign(priv, []byte(signed)))
+	}
+
+	dir := t.TempDir()
+	rec, _ := recorder.NewWriter(dir)
+	sessions := guardrails.NewManager(5 * time.Minute)
+	h := Handler(Config{
+		ProviderURL: "http://unused.invalid",
+		Recorder:    rec,
+		JWT:         verifier,
+		Guardrails:  &guardrails.Config{Budgets: guardrails.BudgetConfig{MaxSessionTokens: 100000}},
+		Sessions:    sessions,
+		Providers: &upstream.Config{Providers: []upstream.Provider{{Name: "openai", BaseURL: upstreamSrv.URL, Default: true,
+			Auth: upstream.AuthConfig{Scheme: upstream.AuthBearer, APIKey: "sk-real"}}}},
+	})
+	do := func(header, value, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// The token replaces the provider key; its subject, tenant and session
+	// claim reach the session key and the AIR record.
+	w := do("Authorization", "Bearer "+token(map[string]interface{}{"sub": "svc-search", "org": "acme", "sid": "run-42"}), "/v1/chat/completions")
+	if w.Code != http.StatusOK {
+		t.Fatalf("JWT = %d %s", w.Code, w.Body.String())
+	}
+	if len(gotAuth) != 1 || gotAuth[0] != "Bearer sk-real" {
+		t.Errorf("upstream Authorization = %v, want the server key", gotAuth)
+	}
+	if s, _ := sessions.Session("acme:run-42"); s == nil || s.TotalTokens != 15 {
+		t.Errorf("session from claims = %+v", s)
+	}
+	loaded, _ := recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id")))
+	if id := loaded.Identity; id == nil || id.KeyID != "jwt:svc-search" || id.Subject != "svc-search" || id.Tenant != "acme" {
+		t.Errorf("AIR identity = %+v", loaded.Identity)
+	}
+
+	// Without a session claim the subject keys the session.
+	if w := do("X-Gateway-Key", token(map[string]interface{}{"sub": "svc-batch"}), "/v1/chat/completions"); w.Code != http.StatusOK {
+		t.Errorf("JWT in X-Gateway-Key = %d %s", w.Code, w.Body.String())
+	}
+	if s, _ := sessions.Session("jwt:svc-batch"); s == nil {
+		t.Error("no session keyed by the subject")
+	}
+
+	if w := do("", "", "/v1/chat/completions"); w.Code != http.StatusUnauthorized {
+		t.Errorf("no token = %d, want 401", w.Code)
+	}
+	expired := token(map[string]interface{}{"sub": "svc"})
+	expired = expired[:len(expired)-4] + "AAAA"
+	if w := do("Authorization", "Bearer "+expired, "/v1/chat/completions"); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "invalid signature") {
+		t.Errorf("bad signature = %d %s", w.Code, w.Body.String())
+	}
+	if w := do("Authorization", "Bearer "+token(map[string]interface{}{"sub": "svc"}), "/v1/admin/reload"); w.Code != http.StatusForbidden {
+		t.Errorf("admin without the admin scope = %d, want 403", w.Code)
+	}
+	if w := do("Authorization", "Bearer "+token(map[string]interface{}{"sub": "ops", "scope": "admin"}), "/v1/admin/sessions"); w.Code == http.StatusUnauthorized || w.Code == http.StatusForbidden {
+		t.Errorf("admin scope claim = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	var gotKey []string
+	upstreamSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKey = append(gotKey, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","model":"gpt-4o-mini","usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`))
+	}))
+	defer upstreamSrv.Close()
+
+	keysPath := filepath.Join(t.TempDir(), "keys.yaml")
+	os.WriteFile(keysPath, []byte(`keys:
+  - id: search-agent
+    cert_subject: spiffe://acme.internal/agents/search
+    tenant: acme
+  - id: ops
+    key_sha256: `+auth.HashKey("sk-ops")+`
+    scopes: [proxy, admin]
+`), 0600)
+	keys, err := auth.LoadRegistry(keysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The listener has verified the chain by the time a request arrives;
+	// the handler only reads the connection state.
+	verified := func(name, uri string) *tls.ConnectionState {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name}, NotAfter: time.Now().Add(time.Hour)}
+		if uri != "" {
+			u, _ := url.Parse(uri)
+			tmpl.URIs = []*url.URL{u}
+		}
+		der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		cert, _ := x509.ParseCertificate(der)
+		return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	dir := t.TempDir()
+	rec, _ := recorder.NewWriter(dir)
+	sessions := guardrails.NewManager(5 * time.Minute)
+	h := Handler(Config{
+		ProviderURL: upstreamSrv.URL,
+		Recorder:    rec,
+		Keys:        keys,
+		Guardrails:  &guardrails.Config{Budgets: guardrails.BudgetConfig{MaxSessionTokens: 100000}},
+		Sessions:    sessions,
+	})
+	do := func(state *tls.ConnectionState, header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o-mini","messages":[{"role":"user","content":"hi"}]}`))
+		req.TLS = state
+		req.Header.Set("Authorization", "Bearer sk-provider")
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// A registered certificate takes its entry's policy; the caller's own
+	// provider key is passed through.
+	state := verified("search", "spiffe://acme.internal/agents/search")
+	w := do(state, "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("registered certificate = %d %s", w.Code, w.Body.String())
+	}
+	if len(gotKey) != 1 || gotKey[0] != "Bearer sk-provider" {
+		t.Errorf("upstream Authorization = %v", gotKey)
+	}
+	if s, _ := sessions.Session("acme:search-agent"); s == nil || s.TotalTokens != 15 {
+		t.Errorf("session keyed by the certificate's entry = %+v", s)
+	}
+	loaded, _ := recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id")))
+	if id := loaded.Identity; id == nil || id.KeyID != "search-agent" || id.Subject != "spiffe://acme.internal/agents/search" || id.Tenant != "acme" {
+		t.Errorf("AIR identity = %+v", loaded.Identity)
+	}
+	if cc := loaded.ClientCert; cc == nil || cc.Subject != "spiffe://acme.internal/agents/search" || cc.SHA256 != auth.CertFingerprint(state.PeerCertificates[0]) {
+		t.Errorf("AIR client_cert = %+v", loaded.ClientCert)
+	}
+
+	// Any other verified certificate is a proxy caller named by it.
+	w = do(verified("batch.acme.internal", ""), "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("unregistered certificate = %d %s", w.Code, w.Body.String())
+	}
+	loaded, _ = recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id")))
+	if id := loaded.Identity; id == nil || id.KeyID != "cert:batch.acme.internal" {
+		t.Errorf("AIR identity = %+v", loaded.Identity)
+	}
+
+	// A gateway key still decides for callers that send one.
+	if w := do(state, "X-Gateway-Key", "sk-wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("certificate with a wrong gateway key = %d, want 401", w.Code)
+	}
+	if w := do(state, "X-Gateway-Key", "sk-ops"); w.Code != http.StatusOK {
+		t.Errorf("certificate with a gateway key = %d %s", w.Code, w.Body.String())
+	}
+	if w := do(nil, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("no certificate = %d, want 401", w.Code)
+	}
+	if w := do(&tls.ConnectionState{PeerCertificates: state.PeerCertificates}, "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("unverified certificate = %d, want 401", w.Code)
+	}
+}
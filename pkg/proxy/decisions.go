@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/airblackbox/gateway/pkg/guardrails"
+	"github.com/airblackbox/gateway/pkg/recorder"
+)
+
+// Stages and outcomes of the violations in an AIR record.
+const (
+	stagePrevention = "prevention"
+	stageDetection  = "detection"
+	stageOutput     = "output"
+	stageToolCall   = "tool_call"
+
+	outcomeBlocked  = "blocked"
+	outcomeModified = "modified"
+	outcomeFlagged  = "flagged"
+	outcomeApproved = "approved"
+)
+
+// noteViolation adds a policy finding and what came of it to the AIR record.
+func noteViolation(notes *airAnnotations, stage, rule, message, outcome string) {
+	notes.Violations = append(notes.Violations, recorder.Violation{
+		Stage: stage, Rule: rule, Message: message, Outcome: outcome,
+	})
+}
+
+// noteModelChange adds a step from the requested model towards the one that
+// served the request to the AIR record.
+func noteModelChange(notes *airAnnotations, stage, from, to, rule, reason string) {
+	notes.ModelChanges = append(notes.ModelChanges, recorder.ModelChange{
+		Stage: stage, From: from, To: to, Rule: rule, Reason: reason,
+	})
+}
+
+// notePrevention adds what the prevention rules blocked or changed to the
+// AIR record. PII findings are noted by notePIIChanges. model is the model
+// after any downgrade.
+func notePrevention(cfg Config, notes *airAnnotations, res *guardrails.PreventionResult, model string) {
+	// A PII block with PII changes was already noted with them.
+	if res.Blocked && !(res.BlockRule == "pii" && guardrails.PIIBlocked(res.PIIChanges)) {
+		noteViolation(notes, stagePrevention, res.BlockRule, res.BlockReason, outcomeBlocked)
+	}
+	if n := len(res.Injections); n > 0 && res.BlockRule != "prompt_injection" {
+		outcome := outcomeFlagged
+		if res.InjectionStripped {
+			outcome = outcomeModified
+		}
+		noteViolation(notes, stagePrevention, "prompt_injection",
+			fmt.Sprintf("prompt injection suspected in %d message(s)", n), outcome)
+	}
+	if res.ToolsFiltered {
+		for _, name := range res.ToolsRemoved {
+			notes.FilteredTools = append(notes.FilteredTools, recorder.FilteredTool{Name: name, Rule: "tool_filter"})
+		}
+		noteViolation(notes, stagePrevention, "tool_filter",
+			"tools not allowed by policy: "+strings.Join(res.ToolsRemoved, ", "), outcomeModified)
+	}
+	if res.ModelDowngraded != "" {
+		noteModelChange(notes, "downgrade", res.ModelDowngraded, model, "model_downgrade",
+			fmt.Sprintf("session cost reached the $%g threshold", cfg.Guardrails.Prevention.ModelLimits.CostThresholdUSD))
+	}
+}
+
+// noteDetection adds a detection violation to the AIR record, with the tools
+// of reqBody its strip_tools action removes.
+func noteDetection(notes *airAnnotations, v *guardrails.Violation, plan *guardrails.ActionPlan, reqBody []byte) {
+	outcome := outcomeFlagged
+	if plan.Block {
+		outcome = outcomeBlocked
+	} else if len(plan.StripTools) > 0 {
+		strip := make(map[string]bool, len(plan.StripTools))
+		for _, name := range plan.StripTools {
+			strip[name] = true
+		}
+		for _, name := range extractToolNames(reqBody) {
+			if strip[name] {
+				notes.FilteredTools = append(notes.FilteredTools, recorder.FilteredTool{Name: name, Rule: v.Rule})
+				outcome = outcomeModified
+			}
+		}
+	}
+	noteViolation(notes, stageDetection, v.Rule, v.Message, outcome)
+}
+
+// outputOutcomes maps output policy actions to violation outcomes.
+var outputOutcomes = map[string]string{"redacted": outcomeModified, "blocked": outcomeBlocked, "flagged": outcomeFlagged}
+
+// requestApproval asks the approval webhook about a violation and adds the
+// decision to the AIR record.
+func requestApproval(ctx context.Context, cfg Config, notes *airAnnotations, v *guardrails.Violation) bool {
+	d, _ := guardrails.DecideApproval(ctx, cfg.Guardrails.Prevention.Approval, v)
+	notes.Approvals = append(notes.Approvals, recorder.Approval{
+		Rule: v.Rule, Approved: d.Approved, Reason: d.Reason, Source: d.Source,
+	})
+	return d.Approved
+}
+
+// fallbackReason says why the upstream of model was given up on: the
+// failure class or outcome of its last attempt.
+func fallbackReason(attempts []recorder.Attempt, model string) string {
+	for i := len(attempts) - 1; i >= 0; i-- {
+		if a := attempts[i]; a.Model == model {
+			if a.FailureClass != "" {
+				return a.FailureClass
+			}
+			return a.Outcome
+		}
+	}
+	return ""
+}
@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/airblackbox/gateway/pkg/auth"
+	"github.com/airblackbox/gateway/pkg/guardrails"
+	"github.com/airblackbox/gateway/pkg/recorder"
+	"github.com/airblackbox/gateway/pkg/upstream"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errAllCircuitsOpen is returned when every upstream in the fallback chain
+// has an open circuit breaker.
+var errAllCircuitsOpen = errors.New("all upstreams unavailable (circuit open)")
+
+// errNoServerCredential is returned when a caller without a provider key,
+// e.g. one using a virtual key, can only be served by upstreams that would
+// be sent the caller's own credentials.
+var errNoServerCredential = errors.New("no upstream with a server-side credential for this caller")
+
+// clientFailures are the failure classes of requests the upstream answered
+// but refused because of the request itself, e.g. a 400.
+var clientFailures = map[string]bool{
+	guardrails.FailureInvalidReq:    true,
+	guardrails.FailureContextLength: true,
+	guardrails.FailureContentFilter: true,
+}
+
+// forwardResult describes the upstream call that ultimately served a request.
+type forwardResult struct {
+	Resp     *http.Response // final response (success or last failure); nil if Err is set
+	Err      error          // transport error from the last attempt
+	Model    string         // model whose upstream sent Resp (may be a fallback); empty if none answered
+	Provider string
+	Body     []byte // request body sent to it (model rewritten for fallbacks)
+	Attempts []recorder.Attempt
+}
+
+// forward sends the request upstream, retrying retryable failures with
+// jittered backoff and walking the configured fallback chain. Each upstream
+// has a circuit breaker that is skipped while open. Every attempt becomes a
+// child span and an entry in the AIR record.
+//
+// Without a providers config this makes exactly one attempt against
+// ProviderURL, preserving single-upstream behaviour.
+func forward(ctx context.Context, cfg Config, r *http.Request, endpoint string, reqBody []byte, model string) forwardResult {
+	var res forwardResult
+	retry := upstream.RetryConfig{MaxAttempts: 1}
+	if cfg.Providers != nil {
+		retry = cfg.Providers.Retry
+	}
+	maxAttempts := retry.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	id := auth.FromContext(r.Context())
+	noCredential := false
+	chain := cfg.Providers.Chain(model)
+	for ci, candidate := range chain {
+		target := cfg.Providers.Resolve(candidate, inferProvider(candidate, ""))
+		baseURL, providerName := cfg.ProviderURL, inferProvider(candidate, cfg.ProviderURL)
+		if target != nil {
+			baseURL, providerName = target.BaseURL, target.Name
+		}
+		lastCandidate := ci == len(chain)-1
+
+		body := reqBody
+		if candidate != model {
+			body = rewriteModel(reqBody, candidate)
+		}
+
+		// A fallback must take the same request shape: a Messages API body
+		// cannot be sent to an OpenAI-shaped upstream, nor the reverse.
+		if candidate != model && !servesEndpoint(target, providerName, endpoint) {
+			res.Attempts = append(res.Attempts, recorder.Attempt{
+				Number:   len(res.Attempts) + 1,
+				Model:    candidate,
+				Provider: providerName,
+				Outcome:  "unsupported_endpoint",
+			})
+			continue
+		}
+
+		// A fallback must be a model the caller's key may use.
+		if id != nil && !id.AllowsModel(candidate) {
+			res.Attempts = append(res.Attempts, recorder.Attempt{
+				Number:   len(res.Attempts) + 1,
+				Model:    candidate,
+				Provider: providerName,
+				Outcome:  "model_not_allowed",
+			})
+			continue
+		}
+
+		// Virtual keys and bearer JWTs stand in for provider keys, so only
+		// upstreams the gateway holds credentials for can serve them.
+		if id != nil && id.ServerCredentials && (target == nil || target.ForwardsClientCredentials()) {
+			res.Attempts = append(res.Attempts, recorder.Attempt{
+				Number:   len(res.Attempts) + 1,
+				Model:    candidate,
+				Provider: providerName,
+				Outcome:  "no_credential",
+			})
+			noCredential = true
+			continue
+		}
+
+		breaker := cfg.Providers.Breaker(providerName)
+		if breaker != nil && !breaker.Allow() {
+			res.Attempts = append(res.Attempts, recorder.Attempt{
+				Number:   len(res.Attempts) + 1,
+				Model:    candidate,
+				Provider: providerName,
+				Outcome:  "circuit_open",
+			})
+			continue
+		}
+
+		for attempt := 1; attempt <= maxAttempts; attempt++ {
+			closePrevious(&res)
+
+			started := time.Now()
+			attemptCtx, attemptSpan := tracer.Start(ctx, "llm.upstream.attempt",
+				trace.WithAttributes(
+					attribute.Int("gen_ai.attempt.number", len(res.Attempts)+1),
+					attribute.String("gen_ai.request.model", candidate),
+					attribute.String("gen_ai.system", providerName),
+					attribute.String("server.address", baseURL),
+				),
+			)
+			resp, err := sendUpstream(attemptCtx, cfg, r, target, baseURL+endpoint, endpoint, body)
+			res.Resp, res.Err = resp, err
+			if err == nil {
+				res.Model, res.Provider, res.Body = candidate, providerName, body
+			}
+
+			rec := recorder.Attempt{
+				Number:     len(res.Attempts) + 1,
+				Model:      candidate,
+				Provider:   providerName,
+				DurationMS: time.Since(started).Milliseconds(),
+			}
+			failureClass := ""
+			if err != nil {
+				failureClass = guardrails.ClassifyFailure(http.StatusBadGateway, err.Error())
+				rec.Error = err.Error()
+			} else {
+				rec.StatusCode = resp.StatusCode
+				if resp.StatusCode >= 400 {
+					failureClass = guardrails.ClassifyFailure(resp.StatusCode, "")
+				}
+			}
+			rec.FailureClass = failureClass
+			attemptSpan.SetAttributes(attribute.Int("http.response.status_code", rec.StatusCode))
+			if failureClass != "" {
+				attemptSpan.SetAttributes(attribute.String("gen_ai.failure_class", failureClass))
+			}
+
+			// Every finished attempt settles the breaker, ending a half-open
+			// trial. Client errors show the upstream is up.
+			if breaker != nil {
+				switch {
+				case err != nil && ctx.Err() != nil:
+					breaker.Release()
+				case failureClass == "" || clientFailures[failureClass]:
+					breaker.Success()
+				default:
+					breaker.Failure()
+				}
+			}
+
+			// Success, or a failure that retrying will not fix (e.g. 400).
+			if failureClass == "" || !retry.Retryable(failureClass) {
+				rec.Outcome = "success"
+				if failureClass != "" {
+					rec.Outcome = "error"
+				}
+				attemptSpan.SetAttributes(attribute.String("gen_ai.attempt.outcome", rec.Outcome))
+				attemptSpan.End()
+				res.Attempts = append(res.Attempts, rec)
+				return res
+			}
+
+			// Decide between retrying this upstream, falling back, or giving up.
+			delay, canWait := retry.Backoff(attempt, resp)
+			switch {
+			case attempt < maxAttempts && canWait && (breaker == nil || breaker.State() == upstream.BreakerClosed):
+				rec.Outcome = "retry"
+			case !lastCandidate:
+				rec.Outcome = "fallback"
+			default:
+				rec.Outcome = "error"
+			}
+			attemptSpan.SetAttributes(attribute.String("gen_ai.attempt.outcome", rec.Outcome))
+			attemptSpan.End()
+			res.Attempts = append(res.Attempts, rec)
+
+			// The final failure is recorded by the response handlers; record
+			// the ones we moved past here so routing sees them too.
+			if cfg.Analytics != nil && rec.Outcome != "error" {
+				cfg.Analytics.RecordCall(candidate, rec.DurationMS, 0, 0, 0, "error", failureClass)
+			}
+
+			if rec.Outcome != "retry" {
+				break
+			}
+			if !sleepCtx(ctx, delay) {
+				return res
+			}
+		}
+	}
+
+	if res.Resp == nil && res.Err == nil {
+		res.Err = errAllCircuitsOpen
+		if noCredential {
+			res.Err = errNoServerCredential
+		}
+	}
+	return res
+}
+
+// sendUpstream builds and sends one upstream request with the client's
+// forwarded headers and the provider's credentials.
+func sendUpstream(ctx context.Context, cfg Config, r *http.Request, target *upstream.Provider,
+	url, endpoint string, body []byte) (*http.Response, error) {
+
+	proxyReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy relevant headers.
+	proxyReq.Header.Set("Content-Type", "application/json")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		proxyReq.Header.Set("Authorization", auth)
+	}
+	if endpoint == anthropicMessagesEndpoint {
+		copyAnthropicHeaders(proxyReq, r)
+	}
+	client := upstreamClient
+	transport := cfg.UpstreamTransport
+	if target != nil {
+		target.Apply(proxyReq)
+		if t := target.Transport(); t != nil {
+			transport = t
+		}
+	}
+	if transport != nil {
+		client = &http.Client{Timeout: upstreamClient.Timeout, Transport: transport}
+	}
+
+	return client.Do(proxyReq)
+}
+
+// servesEndpoint reports whether an upstream accepts requests on endpoint.
+// Without a provider entry, its shape is judged by the inferred provider.
+func servesEndpoint(target *upstream.Provider, providerName, endpoint string) bool {
+	if target == nil {
+		target = &upstream.Provider{Name: providerName}
+	}
+	return target.Serves(endpoint)
+}
+
+// closePrevious closes a failed response before the next attempt.
+func closePrevious(res *forwardResult) {
+	if res.Resp != nil {
+		res.Resp.Body.Close()
+		res.Resp = nil
+	}
+	res.Err = nil
+}
+
+// sleepCtx waits for d or until ctx is done. Returns false if ctx ended first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// rewriteModel returns body with its "model" field replaced.
+// The original body is returned unchanged if it cannot be parsed.
+func rewriteModel(body []byte, model string) []byte {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return body
+	}
+	modelJSON, _ := json.Marshal(model)
+	raw["model"] = modelJSON
+	rewritten, err := json.Marshal(raw)
+	if err != nil {
+		return body
+	}
+	return rewritten
+}
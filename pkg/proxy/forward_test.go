@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/airblackbox/gateway/pkg/recorder"
+	"github.com/airblackbox/gateway/pkg/upstream"
+)
+
+const okChatResponse = `{"id":"chatcmpl-1","usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`
+
+func sendChat(h http.Handler, model string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"model":"`+model+`","messages":[{"role":"user","content":"hi"}]}`))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestForwardRetriesServerErrors(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(okChatResponse))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	rec, _ := recorder.NewWriter(dir)
+	h := Handler(Config{
+		Recorder: rec,
+		Providers: &upstream.Config{
+			Providers: []upstream.Provider{{Name: "openai", BaseURL: srv.URL, Default: true}},
+			Retry:     upstream.RetryConfig{MaxAttempts: 3, BaseDelayMS: 1, MaxDelayMS: 2, RetryOn: []string{"server_error"}},
+		},
+	})
+
+	w := sendChat(h, "gpt-4o")
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200 after retries", w.Code)
+	}
+
+	loaded, _ := recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id")))
+	if len(loaded.Attempts) != 3 {
+		t.Fatalf("attempts = %+v, want 3", loaded.Attempts)
+	}
+	if loaded.Attempts[0].Outcome != "retry" || loaded.Attempts[0].FailureClass != "server_error" {
+		t.Errorf("first attempt = %+v", loaded.Attempts[0])
+	}
+	if loaded.Attempts[2].Outcome != "success" || loaded.Attempts[2].StatusCode != 200 {
+		t.Errorf("last attempt = %+v", loaded.Attempts[2])
+	}
+}
+
+func TestForwardFallsBackOnLongRetryAfter(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer primary.Close()
+	var fallbackModel string
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body chatRequest
+		readJSON(r, &body)
+		fallbackModel = body.Model
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(okChatResponse))
+	}))
+	defer secondary.Close()
+
+	dir := t.TempDir()
+	rec, _ := recorder.NewWriter(dir)
+	h := Handler(Config{
+		Recorder: rec,
+		Providers: &upstream.Config{
+			Providers: []upstream.Provider{
+				{Name: "openai", BaseURL: primary.URL, Models: []string{"gpt-*"}},
+				{Name: "anthropic", BaseURL: secondary.URL, Models: []string{"claude-*"}},
+			},
+			Retry:     upstream.RetryConfig{MaxAttempts: 3, BaseDelayMS: 1, MaxDelayMS: 2, MaxRetryAfterSeconds: 5, RetryOn: []string{"rate_limit"}},
+			Fallbacks: map[string][]string{"gpt-4o": {"claude-3-5-sonnet-latest"}},
+		},
+	})
+
+	w := sendChat(h, "gpt-4o")
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200 from fallback", w.Code)
+	}
+	if fallbackModel != "claude-3-5-sonnet-latest" {
+		t.Errorf("fallback upstream got model %q", fallbackModel)
+	}
+	if got := w.Header().Get("X-Model-Fallback"); got != "claude-3-5-sonnet-latest" {
+		t.Errorf("X-Model-Fallback = %q", got)
+	}
+
+	loaded, _ := recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id")))
+	if loaded.Model != "claude-3-5-sonnet-latest" || loaded.Provider != "anthropic" {
+		t.Errorf("AIR model/provider = %s/%s, want the fallback that served it", loaded.Model, loaded.Provider)
+	}
+	if len(loaded.Attempts) != 2 || loaded.Attempts[0].Outcome != "fallback" || loaded.Attempts[0].StatusCode != 429 {
+		t.Errorf("attempts = %+v", loaded.Attempts)
+	}
+}
+
+func TestForwardSkipsFallbacksOfAnotherAPIShape(t *testing.T) {
+	var primaryCalls, openaiCalls int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primaryCalls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	openai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&openaiCalls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(okChatResponse))
+	}))
+	defer openai.Close()
+
+	dir := t.TempDir()
+	rec, _ := recorder.NewWriter(dir)
+	h := Handler(Config{
+		Recorder: rec,
+		Providers: &upstream.Config{
+			Providers: []upstream.Provider{
+				{Name: "anthropic", BaseURL: primary.URL, Models: []string{"claude-*"}},
+				{Name: "openai", BaseURL: openai.URL, Models: []string{"gpt-*"}},
+			},
+			Retry:     upstream.RetryConfig{MaxAttempts: 1, RetryOn: []string{"server_error"}},
+			Fallbacks: map[string][]string{"claude-3-5-sonnet-latest": {"gpt-4o"}},
+		},
+	})
+
+	req := httptest.NewRequest("POST", anthropicMessagesEndpoint,
+		strings.NewReader(`{"model":"claude-3-5-sonnet-latest","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the primary's 503", w.Code)
+	}
+	if n := atomic.LoadInt32(&openaiCalls); n != 0 {
+		t.Errorf("OpenAI upstream got %d Messages API requests", n)
+	}
+	loaded, _ := recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id")))
+	if len(loaded.Attempts) != 2 || loaded.Attempts[1].Model != "gpt-4o" || loaded.Attempts[1].Outcome != "unsupported_endpoint" {
+		t.Errorf("attempts = %+v", loaded.Attempts)
+	}
+
+	// Chat completions, which both serve, still fall back across them.
+	if w := sendChat(h, "claude-3-5-sonnet-latest"); w.Code != 200 || atomic.LoadInt32(&openaiCalls) != 1 {
+		t.Errorf("chat status = %d, OpenAI calls = %d, want a fallback", w.Code, openaiCalls)
+	}
+}
+
+func TestForwardSkipsOpenCircuit(t *testing.T) {
+	var primaryCalls int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primaryCalls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(okChatResponse))
+	}))
+	defer secondary.Close()
+
+	h := Handler(Config{
+		Providers: &upstream.Config{
+			Providers: []upstream.Provider{
+				{Name: "openai", BaseURL: primary.URL, Models: []string{"gpt-*"}},
+				{Name: "mistral", BaseURL: secondary.URL, Models: []string{"mistral-*"}},
+			},
+			Retry:          upstream.RetryConfig{MaxAttempts: 1, RetryOn: []string{"server_error"}},
+			CircuitBreaker: upstream.CircuitBreakerConfig{FailureThreshold: 2, CooldownSeconds: 60},
+			Fallbacks:      map[string][]string{"gpt-4o": {"mistral-large-latest"}},
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		if w := sendChat(h, "gpt-4o"); w.Code != 200 {
+			t.Fatalf("call %d status = %d, want 200 via fallback", i, w.Code)
+		}
+	}
+	if n := atomic.LoadInt32(&primaryCalls); n != 2 {
+		t.Fatalf("primary calls = %d, want 2 before the circuit opens", n)
+	}
+
+	// The circuit is now open: the primary is skipped entirely.
+	if w := sendChat(h, "gpt-4o"); w.Code != 200 {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if n := atomic.LoadInt32(&primaryCalls); n != 2 {
+		t.Errorf("primary calls = %d, want no call while the circuit is open", n)
+	}
+}
+
+func TestForwardAllCircuitsOpenReportsNoFallback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	rec, _ := recorder.NewWriter(dir)
+	h := Handler(Config{
+		Recorder: rec,
+		Providers: &upstream.Config{
+			Providers: []upstream.Provider{
+				{Name: "openai", BaseURL: srv.URL, Models: []string{"gpt-*"}},
+				{Name: "mistral", BaseURL: srv.URL, Models: []string{"mistral-*"}},
+			},
+			Retry:          upstream.RetryConfig{MaxAttempts: 1, RetryOn: []string{"server_error"}},
+			CircuitBreaker: upstream.CircuitBreakerConfig{FailureThreshold: 1, CooldownSeconds: 60},
+			Fallbacks:      map[string][]string{"gpt-4o": {"mistral-large-latest"}},
+		},
+	})
+
+	sendChat(h, "gpt-4o") // opens both circuits
+	w := sendChat(h, "gpt-4o")
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "circuit open") {
+		t.Fatalf("status = %d %s, want 502 with every circuit open", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("X-Model-Fallback"); got != "" {
+		t.Errorf("X-Model-Fallback = %q, want none", got)
+	}
+
+	loaded, _ := recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id")))
+	if loaded.Model != "gpt-4o" || len(loaded.ModelChanges) != 0 {
+		t.Errorf("model %q, model_changes %+v, want the requested model unchanged", loaded.Model, loaded.ModelChanges)
+	}
+	if len(loaded.Attempts) != 2 || loaded.Attempts[0].Outcome != "circuit_open" || loaded.Attempts[1].Outcome != "circuit_open" {
+		t.Errorf("attempts = %+v", loaded.Attempts)
+	}
+}
+
+func TestForwardClientErrorClosesHalfOpenCircuit(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		case 2:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"unknown parameter"}`))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(okChatResponse))
+		}
+	}))
+	defer srv.Close()
+
+	// No cool-down: the call after the circuit opens is the half-open trial.
+	providers := &upstream.Config{
+		Providers:      []upstream.Provider{{Name: "openai", BaseURL: srv.URL, Default: true}},
+		Retry:          upstream.RetryConfig{MaxAttempts: 1, RetryOn: []string{"server_error"}},
+		CircuitBreaker: upstream.CircuitBreakerConfig{FailureThreshold: 1},
+	}
+	h := Handler(Config{Providers: providers})
+
+	if w := sendChat(h, "gpt-4o"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("first call = %d, want 500", w.Code)
+	}
+	if w := sendChat(h, "gpt-4o"); w.Code != http.StatusBadRequest {
+		t.Fatalf("trial call = %d, want the upstream 400", w.Code)
+	}
+	if state := providers.Breaker("openai").State(); state != upstream.BreakerClosed {
+		t.Errorf("breaker = %s after a 400 trial, want closed", state)
+	}
+	if w := sendChat(h, "gpt-4o"); w.Code != 200 {
+		t.Errorf("call after the trial = %d, want 200", w.Code)
+	}
+}
+
+func TestForwardReturnsLastFailureWhenChainExhausted(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`{"error":"bad gateway"}`))
+	}))
+	defer srv.Close()
+
+	h := Handler(Config{
+		Providers: &upstream.Config{
+			Providers: []upstream.Provider{{Name: "openai", BaseURL: srv.URL, Default: true}},
+			Retry:     upstream.RetryConfig{MaxAttempts: 2, BaseDelayMS: 1, MaxDelayMS: 1, RetryOn: []string{"server_error"}},
+		},
+	})
+
+	w := sendChat(h, "gpt-4o")
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want the upstream 502 passed through", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "bad gateway") {
+		t.Errorf("body = %s, want upstream error body", w.Body.String())
+	}
+}
@@ -60,8 +60,8 @@ func TestGoldenFixtures(t *testing.T) {
 			}
 
 			// Version must be set.
-			if loaded.Version != "1.0.0" {
-				t.Errorf("version = %q, want 1.0.0", loaded.Version)
+			if loaded.Version != "1.1.0" {
+				t.Errorf("version = %q, want 1.1.0", loaded.Version)
 			}
 
 			// Run ID must match header.
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/airblackbox/gateway/pkg/guardrails"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// reviewOutput logs, traces and alerts on an output policy decision.
+// It does nothing if the response had no findings. In shadow mode the
+// decision is only noted, not alerted.
+func reviewOutput(cfg Config, span trace.Span, runID, sessionID string, result *guardrails.OutputResult, notes *airAnnotations) {
+	if result == nil || result.Action == "" {
+		return
+	}
+	if result.Shadow {
+		noteShadow(cfg, notes, span, guardrails.ShadowDecision{
+			Rule: "output_policy", Action: outputShadowActions[result.Action], Reason: result.Reason,
+		})
+		return
+	}
+	log.Printf("[%s] output policy %s: %s (session=%s)", runID, result.Action, result.Reason, sessionID)
+	noteViolation(notes, stageOutput, "output_policy", result.Reason, outputOutcomes[result.Action])
+
+	labels := make([]string, 0, len(result.Findings))
+	counts := make(map[string]int)
+	for _, f := range result.Findings {
+		labels = append(labels, f.Kind+":"+f.Label)
+		if f.Kind == "pii" || f.Kind == "secret" {
+			counts[f.Label] += f.Count
+		}
+	}
+	if cfg.Analytics != nil {
+		cfg.Analytics.RecordDetections("response", counts)
+	}
+	span.SetAttributes(
+		attribute.String("gen_ai.output_policy.action", result.Action),
+		attribute.StringSlice("gen_ai.output_policy.findings", labels),
+	)
+
+	guardrails.SendWebhookAlert(cfg.Guardrails.Alerts.WebhookURL, &guardrails.Violation{
+		Rule:      "output_policy",
+		Message:   result.Reason,
+		SessionID: sessionID,
+		Details: map[string]interface{}{
+			"action":   result.Action,
+			"findings": result.Findings,
+			"run_id":   runID,
+		},
+	})
+}
+
+// writePolicyBlocked replaces a buffered response with a policy error of the
+// given type, e.g. output_policy_blocked.
+func writePolicyBlocked(w http.ResponseWriter, errType, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"type":    errType,
+			"message": reason,
+		},
+	})
+}
+
+// policyErrorEvent is the terminal SSE event sent when a policy cuts a
+// stream, in the error shape the endpoint's SDKs understand.
+func policyErrorEvent(endpoint, errType, reason string) []byte {
+	detail := map[string]string{"type": errType, "message": reason}
+	if endpoint == anthropicMessagesEndpoint {
+		data, _ := json.Marshal(map[string]interface{}{"type": "error", "error": detail})
+		return []byte("event: error\ndata: " + string(data) + "\n\n")
+	}
+	data, _ := json.Marshal(map[string]interface{}{"error": detail})
+	return []byte("data: " + string(data) + "\n\n")
+}
+
+// blockToolCall runs a tool-argument violation through the approval flow and
+// reports whether the response must be blocked. Blocks are logged, traced and
+// sent to the alert webhook. In shadow mode the violation is only noted.
+func blockToolCall(ctx context.Context, cfg Config, span trace.Span, runID string, v *guardrails.Violation, notes *airAnnotations) bool {
+	if v == nil {
+		return false
+	}
+	if cfg.Guardrails.Shadowed(v.Rule) {
+		noteShadow(cfg, notes, span, shadowViolation(cfg, v))
+		return false
+	}
+	if cfg.Guardrails.Prevention.Approval.Enabled && requestApproval(ctx, cfg, notes, v) {
+		log.Printf("[%s] %s: approved via webhook (session=%s)", runID, v.Rule, v.SessionID)
+		noteViolation(notes, stageToolCall, v.Rule, v.Message, outcomeApproved)
+		return false
+	}
+	log.Printf("[%s] %s: %s (session=%s)", runID, v.Rule, v.Message, v.SessionID)
+	noteViolation(notes, stageToolCall, v.Rule, v.Message, outcomeBlocked)
+	span.SetAttributes(
+		attribute.String("gen_ai.tool_policy.violation", v.Message),
+		attribute.String("gen_ai.tool_policy.tool", fmt.Sprint(v.Details["tool_name"])),
+	)
+	guardrails.SendWebhookAlert(cfg.Guardrails.Alerts.WebhookURL, v)
+	return true
+}
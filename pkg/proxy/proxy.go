@@ -11,14 +11,17 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/google/uuid"
+	"github.com/airblackbox/gateway/pkg/auth"
 	"github.com/airblackbox/gateway/pkg/guardrails"
 	"github.com/airblackbox/gateway/pkg/recorder"
 	"github.com/airblackbox/gateway/pkg/trust"
+	"github.com/airblackbox/gateway/pkg/upstream"
 	"github.com/airblackbox/gateway/pkg/vault"
+	"github.com/google/uuid"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -34,53 +37,141 @@ var upstreamClient = &http.Client{
 
 // Config holds proxy configuration.
 type Config struct {
-	ProviderURL string           // e.g. https://api.openai.com
-	Vault       *vault.Client    // S3 vault for content (nil = disabled)
-	Recorder    *recorder.Writer // AIR file writer (nil = disabled)
-	GatewayKey  string           // optional API key required to use the gateway
-	Guardrails  *guardrails.Config  // guardrails configuration (nil = disabled)
-	Sessions    *guardrails.Manager // session state for guardrails (nil = disabled)
-	Analytics   *guardrails.PerformanceTracker // optimization analytics (nil = disabled)
-	AuditChain  *trust.AuditChain  // cryptographic audit chain (nil = disabled)
+	ProviderURL       string                         // e.g. https://api.openai.com
+	Vault             *vault.Client                  // S3 vault for content (nil = disabled)
+	Recorder          *recorder.Writer               // AIR file writer (nil = disabled)
+	GatewayKey        string                         // optional API key required to use the gateway
+	Keys              *auth.Registry                 // gateway keys with identities (nil = GatewayKey only)
+	VirtualKeys       *auth.VirtualKeys              // issued virtual keys standing in for provider keys (nil = disabled)
+	JWT               *auth.JWTVerifier              // bearer JWT authentication (nil = disabled)
+	Guardrails        *guardrails.Config             // guardrails configuration (nil = disabled)
+	Sessions          *guardrails.Manager            // session state for guardrails (nil = disabled)
+	Analytics         *guardrails.PerformanceTracker // optimization analytics (nil = disabled)
+	AuditChain        *trust.AuditChain              // cryptographic audit chain (nil = disabled)
+	Providers         *upstream.Config               // multi-provider routing (nil = ProviderURL only)
+	Pseudonyms        *guardrails.PseudonymStore     // PII tokenize mappings (created by Handler if needed)
+	Shadow            *guardrails.ShadowTracker      // shadow-mode decisions (created by Handler with guardrails)
+	Live              *guardrails.Holder             // reloadable guardrails config; replaces Guardrails per request
+	RateLimiter       *guardrails.RateLimiter        // RPM and TPM buckets (created by Handler with guardrails)
+	UpstreamTransport http.RoundTripper              // upstream TLS, e.g. a private CA, for providers without their own (nil = default)
 }
 
-// Handler returns an http.Handler that proxies OpenAI-compatible requests.
+// snapshot returns cfg with the live guardrails config, so a request sees
+// one config from start to finish even if it is reloaded meanwhile.
+func (c Config) snapshot() Config {
+	if c.Live != nil {
+		c.Guardrails = c.Live.Config()
+	}
+	return c
+}
+
+// Handler returns an http.Handler that proxies OpenAI-compatible requests and
+// native Anthropic Messages API requests.
 func Handler(cfg Config) http.Handler {
+	cfg = cfg.snapshot()
+	if cfg.Pseudonyms == nil && cfg.Guardrails != nil {
+		// In shadow mode EvaluatePrevention reports what tokenizing would do.
+		// A reloadable config may switch tokenizing on later, so it always
+		// gets a store.
+		if pii := cfg.Guardrails.Prevention.PII; cfg.Live != nil || pii.Enabled && pii.RedactMode == guardrails.PIITokenize && !cfg.Guardrails.Shadowed("pii") {
+			ttl := time.Duration(pii.TokenTTLSeconds) * time.Second
+			if ttl <= 0 {
+				ttl = 30 * time.Minute
+			}
+			cfg.Pseudonyms = guardrails.NewPseudonymStore(ttl)
+		}
+	}
+	if cfg.Shadow == nil && cfg.Guardrails != nil {
+		cfg.Shadow = guardrails.NewShadowTracker()
+	}
+	if cfg.RateLimiter == nil && cfg.Guardrails != nil {
+		cfg.RateLimiter = guardrails.NewRateLimiter()
+	}
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
-		if !authenticateGateway(w, r, cfg.GatewayKey) {
+		r, ok := authenticateGateway(w, r, cfg)
+		if !ok {
 			return
 		}
-		handleProxy(w, r, cfg, "/v1/chat/completions")
+		handleProxy(w, r, cfg.snapshot(), "/v1/chat/completions")
 	})
 
 	mux.HandleFunc("/v1/responses", func(w http.ResponseWriter, r *http.Request) {
-		if !authenticateGateway(w, r, cfg.GatewayKey) {
+		r, ok := authenticateGateway(w, r, cfg)
+		if !ok {
 			return
 		}
-		handleProxy(w, r, cfg, "/v1/responses")
+		handleProxy(w, r, cfg.snapshot(), "/v1/responses")
+	})
+
+	mux.HandleFunc(anthropicMessagesEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		r, ok := authenticateGateway(w, r, cfg)
+		if !ok {
+			return
+		}
+		handleProxy(w, r, cfg.snapshot(), anthropicMessagesEndpoint)
 	})
 
 	mux.HandleFunc("/v1/analytics", func(w http.ResponseWriter, r *http.Request) {
-		if !authenticateGateway(w, r, cfg.GatewayKey) {
+		r, ok := authenticateGateway(w, r, cfg)
+		if !ok {
+			return
+		}
+		handleAnalytics(w, r, cfg.snapshot())
+	})
+
+	mux.HandleFunc("/v1/policy/shadow", func(w http.ResponseWriter, r *http.Request) {
+		r, ok := authenticateGateway(w, r, cfg)
+		if !ok {
 			return
 		}
-		handleAnalytics(w, r, cfg)
+		handleShadowSummary(w, r, cfg.snapshot())
 	})
 
+	mux.HandleFunc("/v1/admin/reload", func(w http.ResponseWriter, r *http.Request) {
+		r, ok := authenticateAdmin(w, r, cfg)
+		if !ok {
+			return
+		}
+		handleReload(w, r, cfg)
+	})
+
+	adminSessions := func(w http.ResponseWriter, r *http.Request) {
+		r, ok := authenticateAdmin(w, r, cfg)
+		if !ok {
+			return
+		}
+		handleAdminSessions(w, r, cfg.snapshot())
+	}
+	mux.HandleFunc(adminSessionsPath, adminSessions)
+	mux.HandleFunc(adminSessionsPath+"/", adminSessions)
+
+	adminVirtualKeys := func(w http.ResponseWriter, r *http.Request) {
+		r, ok := authenticateAdmin(w, r, cfg)
+		if !ok {
+			return
+		}
+		handleAdminVirtualKeys(w, r, cfg)
+	}
+	mux.HandleFunc(adminVirtualKeysPath, adminVirtualKeys)
+	mux.HandleFunc(adminVirtualKeysPath+"/", adminVirtualKeys)
+
 	mux.HandleFunc("/v1/audit", func(w http.ResponseWriter, r *http.Request) {
-		if !authenticateGateway(w, r, cfg.GatewayKey) {
+		r, ok := authenticateAdmin(w, r, cfg)
+		if !ok {
 			return
 		}
-		handleAudit(w, r, cfg)
+		handleAudit(w, r, cfg.snapshot())
 	})
 
 	mux.HandleFunc("/v1/audit/export", func(w http.ResponseWriter, r *http.Request) {
-		if !authenticateGateway(w, r, cfg.GatewayKey) {
+		r, ok := authenticateAdmin(w, r, cfg)
+		if !ok {
 			return
 		}
-		handleAuditExport(w, r, cfg)
+		handleAuditExport(w, r, cfg.snapshot())
 	})
 
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -91,24 +182,9 @@ func Handler(cfg Config) http.Handler {
 	return mux
 }
 
-// authenticateGateway checks the x-gateway-key header if a key is configured.
-// Returns true if auth passes (or no key is configured), false if rejected.
-func authenticateGateway(w http.ResponseWriter, r *http.Request, gatewayKey string) bool {
-	if gatewayKey == "" {
-		return true // no gateway auth configured
-	}
-	provided := r.Header.Get("X-Gateway-Key")
-	if provided == "" {
-		provided = r.Header.Get("X-Api-Key")
-	}
-	if provided != gatewayKey {
-		http.Error(w, `{"error":"unauthorized: invalid or missing gateway key"}`, http.StatusUnauthorized)
-		return false
-	}
-	return true
-}
-
 // chatRequest is the minimal OpenAI chat completion request we need to parse.
+// Anthropic Messages requests share the model, messages and stream fields;
+// their text content blocks use the same {"type":"text","text":...} shape.
 type chatRequest struct {
 	Model    string          `json:"model"`
 	Messages json.RawMessage `json:"messages"`
@@ -117,13 +193,54 @@ type chatRequest struct {
 
 // chatResponse is the minimal response structure for token extraction.
 type chatResponse struct {
-	ID    string `json:"id"`
-	Model string `json:"model"`
-	Usage *struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-		TotalTokens      int `json:"total_tokens"`
-	} `json:"usage"`
+	ID    string       `json:"id"`
+	Model string       `json:"model"`
+	Usage *usageFields `json:"usage"`
+}
+
+// usageFields accepts the Chat Completions (prompt/completion) spelling of
+// token usage as well as the input/output spelling shared by the Responses API
+// and the Anthropic Messages API.
+type usageFields struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+	InputTokens      int `json:"input_tokens"`
+	OutputTokens     int `json:"output_tokens"`
+
+	// Anthropic reports prompt-cache reads and writes outside input_tokens.
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+
+	PromptTokensDetails *struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+	InputTokensDetails *struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+}
+
+// tokens normalises the usage block into an AIR token count.
+func (u *usageFields) tokens() recorder.Tokens {
+	t := recorder.Tokens{
+		Prompt:     u.PromptTokens,
+		Completion: u.CompletionTokens,
+		Total:      u.TotalTokens,
+	}
+	if t.Prompt == 0 && t.Completion == 0 {
+		t.Prompt = u.InputTokens + u.CacheReadInputTokens + u.CacheCreationInputTokens
+		t.Completion = u.OutputTokens
+		t.Cached = u.CacheReadInputTokens
+	}
+	if t.Total == 0 {
+		t.Total = t.Prompt + t.Completion
+	}
+	if u.PromptTokensDetails != nil && t.Cached == 0 {
+		t.Cached = u.PromptTokensDetails.CachedTokens
+	} else if u.InputTokensDetails != nil && t.Cached == 0 {
+		t.Cached = u.InputTokensDetails.CachedTokens
+	}
+	return t
 }
 
 func handleProxy(w http.ResponseWriter, r *http.Request, cfg Config, endpoint string) {
@@ -160,9 +277,30 @@ func handleProxy(w http.ResponseWriter, r *http.Request, cfg Config, endpoint st
 	provider := inferProvider(req.Model, cfg.ProviderURL)
 	span.SetAttributes(attribute.String("gen_ai.system", provider))
 
+	notes := &airAnnotations{}
+
+	// --- Caller identity ---
+	// Keys may be limited to some models and carry their own guardrails
+	// profile and budgets.
+	id := auth.FromContext(r.Context())
+	if !applyIdentity(w, &cfg, id, notes, span) {
+		return
+	}
+	notes.ClientCert = clientCertRecord(r, span)
+	notes.SessionID = extractSessionID(r)
+	notes.RequestedModel = req.Model
+	if !allowModel(w, runID, id, req.Model, notes) {
+		if cfg.Guardrails != nil {
+			reqBody = guardrails.MaskRequestPII(cfg.Guardrails.Prevention.PII, reqBody)
+		}
+		recordBlocked(cfg, runID, span, req.Model, provider, endpoint, reqBody, start, notes)
+		return
+	}
+
 	// --- Prevention layer (opt-in) ---
 	// Runs BEFORE detection. May modify the request body (PII redaction, tool filtering,
 	// model downgrade) or block entirely. Returns 403 for policy blocks.
+	var pseudonyms *guardrails.Pseudonyms
 	if cfg.Guardrails != nil {
 		sessionID := extractSessionID(r)
 		promptText := extractPromptText(req.Messages)
@@ -172,28 +310,43 @@ func handleProxy(w http.ResponseWriter, r *http.Request, cfg Config, endpoint st
 			sessionTokens = cfg.Sessions.GetSessionTokens(sessionID)
 		}
 
-		prevResult := guardrails.EvaluatePrevention(cfg.Guardrails, reqBody, promptText, toolNames, req.Model, sessionTokens)
-		if prevResult.Blocked {
-			log.Printf("[prevention] blocked: %s (session=%s)", prevResult.BlockReason, sessionID)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusForbidden)
-			json.NewEncoder(w).Encode(map[string]interface{}{
-				"error": map[string]interface{}{
-					"type":    "prevention_policy_blocked",
-					"message": prevResult.BlockReason,
-				},
-			})
-			go guardrails.SendWebhookAlert(cfg.Guardrails.Alerts.WebhookURL, &guardrails.Violation{
-				Rule:      "prevention",
-				Message:   prevResult.BlockReason,
-				SessionID: sessionID,
-			})
-			return
+		// Tokenize mode swaps PII for per-session placeholders; only those
+		// minted for this request are restored in its response.
+		// In shadow mode EvaluatePrevention reports what tokenizing would do.
+		if pii := cfg.Guardrails.Prevention.PII; pii.Enabled && pii.RedactMode == guardrails.PIITokenize && !cfg.Guardrails.Shadowed("pii") {
+			tokenized, changes, minted := guardrails.PseudonymizeRequest(pii, cfg.Pseudonyms, pseudonymScope(r, sessionID), reqBody)
+			if len(changes) > 0 {
+				notePIIChanges(cfg, notes, span, changes)
+				if guardrails.PIIBlocked(changes) {
+					writePreventionBlocked(w, cfg, runID, sessionID, "PII detected in request (policy: block)")
+					recordBlocked(cfg, runID, span, req.Model, provider, endpoint, guardrails.MaskRequestPII(pii, reqBody), start, notes)
+					return
+				}
+				reqBody, pseudonyms = tokenized, minted
+				json.Unmarshal(reqBody, &req)
+				log.Printf("[prevention] PII tokenized in %d request field(s) (session=%s)", len(changes), sessionID)
+			}
 		}
+
+		prevResult := guardrails.EvaluatePrevention(cfg.Guardrails, reqBody, promptText, toolNames, req.Model, sessionTokens)
+		notePIIChanges(cfg, notes, span, prevResult.PIIChanges)
+		noteInjections(notes, span, prevResult.Injections)
+		noteShadow(cfg, notes, span, prevResult.Shadow...)
 		if prevResult.ModifiedBody != nil {
 			reqBody = prevResult.ModifiedBody
 			// Re-parse the modified body so downstream uses the updated model/messages.
 			json.Unmarshal(reqBody, &req)
+		}
+		notePrevention(cfg, notes, prevResult, req.Model)
+		if prevResult.Blocked {
+			writePreventionBlocked(w, cfg, runID, sessionID, prevResult.BlockReason)
+			if prevResult.BlockRule == "pii" {
+				reqBody = guardrails.MaskRequestPII(cfg.Guardrails.Prevention.PII, reqBody)
+			}
+			recordBlocked(cfg, runID, span, req.Model, provider, endpoint, reqBody, start, notes)
+			return
+		}
+		if prevResult.ModifiedBody != nil {
 			log.Printf("[prevention] request modified: pii_redacted=%v tools_filtered=%v model_downgraded=%s",
 				prevResult.PIIRedacted, prevResult.ToolsFiltered, prevResult.ModelDowngraded)
 		}
@@ -206,25 +359,66 @@ func handleProxy(w http.ResponseWriter, r *http.Request, cfg Config, endpoint st
 		if decision.RoutedModel != decision.OriginalModel {
 			log.Printf("[optimization] model routed: %s → %s (%s: %s)",
 				decision.OriginalModel, decision.RoutedModel, decision.Rule, decision.Reason)
+			noteModelChange(notes, "route", decision.OriginalModel, decision.RoutedModel, decision.Rule, decision.Reason)
 			req.Model = decision.RoutedModel
 			// Rewrite the model in the request body so upstream gets the routed model.
-			var raw map[string]interface{}
-			if err := json.Unmarshal(reqBody, &raw); err == nil {
-				raw["model"] = decision.RoutedModel
-				if rewritten, err := json.Marshal(raw); err == nil {
-					reqBody = rewritten
-				}
-			}
+			reqBody = rewriteModel(reqBody, decision.RoutedModel)
 			w.Header().Set("X-Model-Routed", decision.RoutedModel)
 		}
 	}
 
+	// A downgrade or reroute must stay within the key's models too.
+	if !allowModel(w, runID, id, req.Model, notes) {
+		recordBlocked(cfg, runID, span, req.Model, provider, endpoint, reqBody, start, notes)
+		return
+	}
+
+	// --- Rate limits (opt-in) ---
+	// Reserves the request and its estimated tokens against the RPM and TPM
+	// limits of the key, session, model and provider; settle reconciles the
+	// estimate with the reported usage. Returns 429 when a limit is reached.
+	limit, ok := reserveRateLimit(w, r, cfg, runID, notes, span, req.Model, reqBody)
+	if !ok {
+		recordBlocked(cfg, runID, span, req.Model, provider, endpoint, reqBody, start, notes)
+		return
+	}
+	defer limit.Settle(0) // refunds the tokens of requests that never got a response
+
+	// --- Virtual key spend cap ---
+	// Holds the estimated cost against the key's cap while the request is in
+	// flight; chargeVirtualKey replaces it with the actual cost.
+	spend, ok := reserveVirtualKeySpend(w, r, cfg, runID, notes, req.Model, reqBody)
+	if !ok {
+		recordBlocked(cfg, runID, span, req.Model, provider, endpoint, reqBody, start, notes)
+		return
+	}
+	defer spend.Settle(0)
+
 	// --- Detection layer (opt-in) ---
 	// Catches runaway agents: token budgets, prompt loops, tool retry storms, error spirals.
 	// Returns 429 for guardrail violations. Approval webhook can override blocks.
 	if cfg.Guardrails != nil && cfg.Sessions != nil {
 		sessionID := extractSessionID(r)
-		cfg.Sessions.GetOrCreate(sessionID)
+		if remaining, ok := cfg.Sessions.Cooldown(sessionID); ok {
+			writeSessionCoolingDown(w, runID, sessionID, remaining, notes)
+			recordBlocked(cfg, runID, span, req.Model, provider, endpoint, reqBody, start, notes)
+			return
+		}
+		// Detection needs the session's state; without it the request is refused.
+		if err := cfg.Sessions.Open(sessionID, extractParentSessionID(r, cfg.Guardrails.TraceRoots)); err != nil {
+			writeSessionStoreUnavailable(w, runID, sessionID, err, notes)
+			recordBlocked(cfg, runID, span, req.Model, provider, endpoint, reqBody, start, notes)
+			return
+		}
+		// Killing a session also stops its sub-agents.
+		for _, ancestor := range cfg.Sessions.Lineage(sessionID)[1:] {
+			if remaining, ok := cfg.Sessions.Cooldown(ancestor); ok {
+				writeSessionCoolingDown(w, runID, ancestor, remaining, notes)
+				recordBlocked(cfg, runID, span, req.Model, provider, endpoint, reqBody, start, notes)
+				return
+			}
+		}
+		cfg.Sessions.RecordRun(sessionID, runID)
 
 		promptText := extractPromptText(req.Messages)
 		toolNames := extractToolNames(reqBody)
@@ -235,48 +429,52 @@ func handleProxy(w http.ResponseWriter, r *http.Request, cfg Config, endpoint st
 			ToolNames:  toolNames,
 			Model:      req.Model,
 		}
-		if v := guardrails.Evaluate(cfg.Guardrails, cfg.Sessions, sessionID, evalReq); v != nil {
-			// Check approval webhook before blocking.
-			approved, _ := guardrails.RequestApproval(r.Context(), cfg.Guardrails.Prevention.Approval, v)
+		v, shadowed := guardrails.EvaluateWithShadow(cfg.Guardrails, cfg.Sessions, sessionID, evalReq)
+		for _, sv := range shadowed {
+			noteShadow(cfg, notes, span, shadowViolation(cfg, sv))
+		}
+		if v != nil {
+			// Check approval webhook before blocking. RequestApproval allows
+			// everything when approval is disabled, so only consult it when on.
+			approved := cfg.Guardrails.Prevention.Approval.Enabled && requestApproval(r.Context(), cfg, notes, v)
 			if approved {
 				log.Printf("[guardrails] %s: approved via webhook (session=%s)", v.Rule, sessionID)
+				noteViolation(notes, stageDetection, v.Rule, v.Message, outcomeApproved)
 			} else {
-				log.Printf("[guardrails] %s: %s (session=%s)", v.Rule, v.Message, sessionID)
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusTooManyRequests)
-				json.NewEncoder(w).Encode(map[string]interface{}{
-					"error": map[string]interface{}{
-						"type":       "agent_guardrail_triggered",
-						"rule":       v.Rule,
-						"message":    v.Message,
-						"session_id": v.SessionID,
-						"details":    v.Details,
-					},
-				})
-				go guardrails.SendWebhookAlert(cfg.Guardrails.Alerts.WebhookURL, v)
-				cfg.Sessions.Remove(sessionID)
-				return
+				var blocked bool
+				if reqBody, blocked = runActions(ctx, w, cfg, span, runID, sessionID, v, reqBody, notes); blocked {
+					recordBlocked(cfg, runID, span, req.Model, provider, endpoint, reqBody, start, notes)
+					return
+				}
 			}
 		}
 	}
 
-	// Forward to upstream provider.
-	upstream := cfg.ProviderURL + endpoint
-	proxyReq, err := http.NewRequestWithContext(ctx, "POST", upstream, bytes.NewReader(reqBody))
-	if err != nil {
-		http.Error(w, `{"error":"failed to create upstream request"}`, http.StatusInternalServerError)
-		return
-	}
-
-	// Copy relevant headers.
-	proxyReq.Header.Set("Content-Type", "application/json")
-	if auth := r.Header.Get("Authorization"); auth != "" {
-		proxyReq.Header.Set("Authorization", auth)
+	// Forward to the upstream provider. Routing and downgrades run first, so a
+	// cross-provider switch (e.g. gpt-4o → claude) lands on the right provider
+	// with the right credentials. Retries and fallbacks happen inside forward.
+	fwd := forward(ctx, cfg, r, endpoint, reqBody, req.Model)
+	notes.Attempts = fwd.Attempts
+	// Only an upstream that answered can have served a fallback.
+	if fwd.Resp != nil {
+		if fwd.Model != req.Model {
+			log.Printf("[upstream] fallback: %s → %s", req.Model, fwd.Model)
+			w.Header().Set("X-Model-Fallback", fwd.Model)
+			noteModelChange(notes, "fallback", req.Model, fwd.Model, "fallbacks", fallbackReason(fwd.Attempts, req.Model))
+			req.Model = fwd.Model
+		}
+		reqBody = fwd.Body
+		provider = fwd.Provider
 	}
+	span.SetAttributes(
+		attribute.String("gen_ai.system", provider),
+		attribute.Int("gen_ai.upstream.attempts", len(fwd.Attempts)),
+	)
 
-	resp, err := upstreamClient.Do(proxyReq)
+	resp, err := fwd.Resp, fwd.Err
 	if err != nil {
 		span.SetAttributes(attribute.String("error", err.Error()))
+		w.Header().Set("x-run-id", runID)
 		http.Error(w, fmt.Sprintf(`{"error":"upstream: %s"}`, err), http.StatusBadGateway)
 
 		// --- Optimization: record upstream failure ---
@@ -288,39 +486,72 @@ func handleProxy(w http.ResponseWriter, r *http.Request, cfg Config, endpoint st
 
 		// Fire-and-forget: vault + AIR record for failed requests.
 		go backgroundRecord(cfg, runID, span, req.Model, provider, endpoint,
-			reqBody, nil, start, "error", err.Error())
+			reqBody, nil, start, "error", err.Error(), notes)
 		return
 	}
 	defer resp.Body.Close()
 
 	// Set run_id header early so the client gets it even for streaming responses.
 	w.Header().Set("x-run-id", runID)
-	for _, h := range []string{"x-request-id", "openai-organization"} {
+	for _, h := range []string{"x-request-id", "request-id", "openai-organization"} {
 		if v := resp.Header.Get(h); v != "" {
 			w.Header().Set(h, v)
 		}
 	}
+	// OpenAI sends x-request-id, Anthropic request-id.
+	if notes.UpstreamRequestID = resp.Header.Get("x-request-id"); notes.UpstreamRequestID == "" {
+		notes.UpstreamRequestID = resp.Header.Get("request-id")
+	}
+
+	// settle updates guardrails session state once the response usage is known.
+	// Buffered responses settle before the headers are written, so the cost
+	// headers include this call; streams settle after the last chunk.
+	sessionID := extractSessionID(r)
+	settle := func(usage guardrails.Usage) {
+		limit.Settle(usage.PromptTokens + usage.CompletionTokens)
+		chargeVirtualKey(spend, cfg, req.Model, usage)
+		if cfg.Guardrails == nil || cfg.Sessions == nil {
+			return
+		}
+		usage.CostUSD = cfg.Guardrails.Pricing.Cost(req.Model, usage)
+		isError := resp.StatusCode >= 400
+		cfg.Sessions.RecordResponse(sessionID, usage, isError)
+		span.SetAttributes(attribute.Float64("gen_ai.usage.cost_usd", usage.CostUSD))
+		setCostHeaders(w, cfg, sessionID)
+	}
 
 	// --- Streaming vs non-streaming response handling ---
-	if req.Stream && resp.Header.Get("Content-Type") == "text/event-stream" {
-		handleStreamingResponse(w, resp, cfg, runID, span, req, provider, endpoint, reqBody, start)
+	if req.Stream && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		if cfg.Guardrails != nil && cfg.Sessions != nil {
+			setCostHeaders(w, cfg, sessionID)
+		}
+		handleStreamingResponse(w, resp, cfg, runID, sessionID, pseudonyms, span, req, provider, endpoint, reqBody, start, settle, notes)
 	} else {
-		handleBufferedResponse(w, resp, cfg, runID, span, req, provider, endpoint, reqBody, start)
+		handleBufferedResponse(w, resp, cfg, runID, sessionID, pseudonyms, span, req, provider, endpoint, reqBody, start, settle, notes)
 	}
+}
 
-	// Update guardrails session state after response.
-	if cfg.Guardrails != nil && cfg.Sessions != nil {
-		sessionID := extractSessionID(r)
-		isError := resp.StatusCode >= 400
-		cfg.Sessions.RecordResponse(sessionID, 0, isError)
+// setCostHeaders reports the session's spend so far and, when a cost budget
+// is configured, how much of it remains.
+func setCostHeaders(w http.ResponseWriter, cfg Config, sessionID string) {
+	spent := cfg.Sessions.GetSessionCost(sessionID)
+	w.Header().Set("X-Session-Cost-USD", strconv.FormatFloat(spent, 'f', 6, 64))
+	if max := cfg.Guardrails.Budgets.MaxSessionCostUSD; max > 0 {
+		remaining := max - spent
+		if remaining < 0 {
+			remaining = 0
+		}
+		w.Header().Set("X-Session-Cost-Remaining-USD", strconv.FormatFloat(remaining, 'f', 6, 64))
 	}
 }
 
 // handleStreamingResponse forwards SSE chunks to the client in real-time while
 // capturing the full response in the background for vault storage.
+// settle receives the token usage for guardrail session accounting.
 func handleStreamingResponse(w http.ResponseWriter, resp *http.Response,
-	cfg Config, runID string, span trace.Span, req chatRequest,
-	provider, endpoint string, reqBody []byte, start time.Time) {
+	cfg Config, runID, sessionID string, pseudonyms *guardrails.Pseudonyms, span trace.Span, req chatRequest,
+	provider, endpoint string, reqBody []byte, start time.Time, settle func(guardrails.Usage),
+	notes *airAnnotations) {
 
 	// Set streaming headers.
 	w.Header().Set("Content-Type", "text/event-stream")
@@ -329,25 +560,88 @@ func handleStreamingResponse(w http.ResponseWriter, resp *http.Response,
 	w.WriteHeader(resp.StatusCode)
 
 	flusher, canFlush := w.(http.Flusher)
+	flush := func() {
+		if canFlush {
+			flusher.Flush()
+		}
+	}
 
 	// Buffer the full response for vault/recording while streaming to client.
 	var fullResponse bytes.Buffer
-	buf := make([]byte, 4096)
-
-	for {
-		n, err := resp.Body.Read(buf)
-		if n > 0 {
-			fullResponse.Write(buf[:n])
-			w.Write(buf[:n])
-			if canFlush {
-				flusher.Flush()
+
+	// --- Output policy and PII restoration (opt-in) ---
+	// Streams are relayed event by event so each delta is scanned before it
+	// is sent; a violation cuts the stream with a terminal error event.
+	// Tokenized PII placeholders are then swapped back for the real values.
+	// Tool calls are then checked against argument rules as each one completes.
+	var scanner *guardrails.OutputScanner
+	var restorer *guardrails.PseudonymRestorer
+	var toolGuard *guardrails.ToolCallGuard
+	if resp.StatusCode < 400 {
+		scanner = guardrails.NewOutputScanner(cfg.Guardrails)
+		restorer = guardrails.NewPseudonymRestorer(pseudonyms)
+		toolGuard = guardrails.NewToolCallGuard(cfg.Guardrails, sessionID)
+	}
+	var outcome *guardrails.OutputResult
+	var toolViolation *guardrails.Violation
+	if scanner != nil || restorer != nil || toolGuard != nil {
+		hold := scanner != nil && scanner.Buffered()
+		var prev []byte // the event before, for framing text the restorer releases
+		cut := relayEvents(w, flush, resp.Body, &fullResponse, runID, hold, func(event []byte) ([]byte, bool) {
+			if scanner != nil && scanEvent(scanner, event) {
+				return nil, true
 			}
+			if restorer != nil {
+				raw := append([]byte(nil), event...)
+				event, prev = restoreEvent(restorer, event, prev), raw
+			}
+			if toolGuard != nil {
+				for _, payload := range eventPayloads(event) {
+					if v := toolGuard.Scan(payload); blockToolCall(resp.Request.Context(), cfg, span, runID, v, notes) {
+						toolViolation = v
+						return nil, true
+					}
+				}
+			}
+			return event, false
+		})
+		if scanner != nil {
+			outcome = scanner.Result()
 		}
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("[%s] stream read error: %v", runID, err)
+		// A stream that ends without a terminal event still gets the text
+		// the restorer held back.
+		if restorer != nil && !cut {
+			if released := releasedEvents(restorer.Flush(), prev); len(released) > 0 {
+				w.Write(released)
+				flush()
+			}
+		}
+		switch {
+		case cut && toolViolation != nil:
+			w.Write(policyErrorEvent(endpoint, "tool_argument_blocked", toolViolation.Message))
+			flush()
+		case cut:
+			w.Write(policyErrorEvent(endpoint, "output_policy_blocked", outcome.Reason))
+			flush()
+		}
+		if scanner != nil {
+			reviewOutput(cfg, span, runID, sessionID, outcome, notes)
+		}
+	} else {
+		buf := make([]byte, 4096)
+		for {
+			n, err := resp.Body.Read(buf)
+			if n > 0 {
+				fullResponse.Write(buf[:n])
+				w.Write(buf[:n])
+				flush()
+			}
+			if err != nil {
+				if err != io.EOF {
+					log.Printf("[%s] stream read error: %v", runID, err)
+				}
+				break
 			}
-			break
 		}
 	}
 
@@ -385,19 +679,31 @@ func handleStreamingResponse(w http.ResponseWriter, resp *http.Response,
 	}
 
 	// Fire-and-forget: vault + AIR record in background.
+	errMsg := ""
+	if toolViolation != nil {
+		status, errMsg = "blocked", toolViolation.Message
+	} else if outcome.Blocked() {
+		status, errMsg = "blocked", outcome.Reason
+	}
 	go backgroundRecord(cfg, runID, span, req.Model, provider, endpoint,
-		reqBody, respBytes, start, status, "")
+		reqBody, respBytes, start, status, errMsg, notes)
+
+	settle(sessionUsage(span, tokens, reqBody, respBytes, resp.StatusCode >= 400))
 }
 
 // handleBufferedResponse handles traditional (non-streaming) responses.
+// settle receives the token usage for guardrail session accounting and is
+// called before the response headers are written.
 func handleBufferedResponse(w http.ResponseWriter, resp *http.Response,
-	cfg Config, runID string, span trace.Span, req chatRequest,
-	provider, endpoint string, reqBody []byte, start time.Time) {
+	cfg Config, runID, sessionID string, pseudonyms *guardrails.Pseudonyms, span trace.Span, req chatRequest,
+	provider, endpoint string, reqBody []byte, start time.Time, settle func(guardrails.Usage),
+	notes *airAnnotations) {
 
 	// Read response body.
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
 		http.Error(w, `{"error":"failed to read upstream response"}`, http.StatusBadGateway)
+		settle(guardrails.Usage{})
 		return
 	}
 
@@ -405,11 +711,7 @@ func handleBufferedResponse(w http.ResponseWriter, resp *http.Response,
 	var tokens recorder.Tokens
 	var respParsed chatResponse
 	if err := json.Unmarshal(respBody, &respParsed); err == nil && respParsed.Usage != nil {
-		tokens = recorder.Tokens{
-			Prompt:     respParsed.Usage.PromptTokens,
-			Completion: respParsed.Usage.CompletionTokens,
-			Total:      respParsed.Usage.TotalTokens,
-		}
+		tokens = respParsed.Usage.tokens()
 		span.SetAttributes(
 			attribute.Int("gen_ai.usage.prompt_tokens", tokens.Prompt),
 			attribute.Int("gen_ai.usage.completion_tokens", tokens.Completion),
@@ -425,10 +727,52 @@ func handleBufferedResponse(w http.ResponseWriter, resp *http.Response,
 		status = "error"
 	}
 
-	// Return response to caller.
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(resp.StatusCode)
-	w.Write(respBody)
+	settle(sessionUsage(span, tokens, reqBody, respBody, resp.StatusCode >= 400))
+
+	// --- Output policy (opt-in) ---
+	// Scans the assistant message and tool calls before they reach the agent.
+	// The vault keeps what the provider actually returned.
+	clientBody := respBody
+	var outcome *guardrails.OutputResult
+	if resp.StatusCode < 400 {
+		outcome = guardrails.EvaluateOutput(cfg.Guardrails, respBody)
+		reviewOutput(cfg, span, runID, sessionID, outcome, notes)
+		if outcome.Action != "" && !outcome.Shadow {
+			w.Header().Set("X-Output-Policy", outcome.Action)
+		}
+		if outcome.ModifiedBody != nil {
+			clientBody = outcome.ModifiedBody
+		}
+		if restored := pseudonyms.RestoreResponse(clientBody); restored != nil {
+			clientBody = restored
+		}
+	}
+
+	// --- Tool argument rules (opt-in) ---
+	// Checked on what the agent would receive, after PII restoration.
+	var toolViolation *guardrails.Violation
+	if resp.StatusCode < 400 && !outcome.Blocked() {
+		v := guardrails.CheckToolCalls(cfg.Guardrails, sessionID, guardrails.ResponseToolCalls(clientBody))
+		if blockToolCall(resp.Request.Context(), cfg, span, runID, v, notes) {
+			toolViolation = v
+		}
+	}
+
+	// Return response to caller. A blocked response is still a successful
+	// upstream call for analytics; only the AIR record marks it blocked.
+	recordStatus, errMsg := status, ""
+	switch {
+	case outcome.Blocked():
+		recordStatus, errMsg = "blocked", outcome.Reason
+		writePolicyBlocked(w, "output_policy_blocked", outcome.Reason)
+	case toolViolation != nil:
+		recordStatus, errMsg = "blocked", toolViolation.Message
+		writePolicyBlocked(w, "tool_argument_blocked", toolViolation.Message)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(clientBody)
+	}
 
 	log.Printf("[%s] %s model=%s tokens=%d duration=%dms status=%s",
 		runID, endpoint, req.Model, tokens.Total, duration.Milliseconds(), status)
@@ -446,18 +790,136 @@ func handleBufferedResponse(w http.ResponseWriter, resp *http.Response,
 
 	// Fire-and-forget: vault + AIR record in background.
 	go backgroundRecord(cfg, runID, span, req.Model, provider, endpoint,
-		reqBody, respBody, start, status, "")
+		reqBody, respBody, start, recordStatus, errMsg, notes)
+}
+
+// notePIIChanges adds the request fields where PII was found, the matches
+// per type and what the PII rule did about them to the AIR record.
+func notePIIChanges(cfg Config, notes *airAnnotations, span trace.Span, changes []guardrails.PIIChange) {
+	if len(changes) == 0 {
+		return
+	}
+	outcome := outcomeFlagged
+	for _, c := range changes {
+		notes.PIIRedactions = append(notes.PIIRedactions, recorder.Redaction{
+			Source: c.Source, Index: c.Index, Field: c.Field, Types: c.Types, Action: c.Action,
+		})
+		if c.Action == "redacted" {
+			outcome = outcomeModified
+		}
+	}
+	if guardrails.PIIBlocked(changes) {
+		outcome = outcomeBlocked
+	}
+	counts := guardrails.PIICounts(changes)
+	if notes.PIICounts == nil {
+		notes.PIICounts = make(map[string]int, len(counts))
+	}
+	for name, n := range counts {
+		notes.PIICounts[name] += n
+	}
+	noteViolation(notes, stagePrevention, "pii", fmt.Sprintf("PII found in %d request field(s)", len(changes)), outcome)
+	span.SetAttributes(attribute.Int("gen_ai.prevention.pii_fields", len(notes.PIIRedactions)))
+	if cfg.Analytics != nil {
+		cfg.Analytics.RecordDetections("request", counts)
+	}
+}
+
+// noteInjections adds messages the prompt-injection rule acted on to the span
+// and AIR record.
+func noteInjections(notes *airAnnotations, span trace.Span, findings []guardrails.InjectionFinding) {
+	if len(findings) == 0 {
+		return
+	}
+	maxScore := 0.0
+	var actions, signals []string
+	for _, f := range findings {
+		notes.PromptInjection = append(notes.PromptInjection, recorder.Injection{
+			Source: f.Source, Index: f.Index, Role: f.Role, Score: f.Score, Signals: f.Signals, Action: f.Action,
+		})
+		if f.Score > maxScore {
+			maxScore = f.Score
+		}
+		actions = append(actions, f.Action)
+		signals = append(signals, f.Signals...)
+	}
+	span.SetAttributes(
+		attribute.Float64("gen_ai.prevention.injection.score", maxScore),
+		attribute.StringSlice("gen_ai.prevention.injection.actions", actions),
+		attribute.StringSlice("gen_ai.prevention.injection.signals", signals),
+	)
+}
+
+// writePreventionBlocked rejects a request the prevention layer blocked.
+func writePreventionBlocked(w http.ResponseWriter, cfg Config, runID, sessionID, reason string) {
+	log.Printf("[prevention] blocked: %s (session=%s)", reason, sessionID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("x-run-id", runID)
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"type":    "prevention_policy_blocked",
+			"message": reason,
+		},
+	})
+	go guardrails.SendWebhookAlert(cfg.Guardrails.Alerts.WebhookURL, &guardrails.Violation{
+		Rule:      "prevention",
+		Message:   reason,
+		SessionID: sessionID,
+	})
+}
+
+// recordBlocked writes the vault entry, AIR record and audit-chain entry of
+// a request a guardrail rejected before it reached the provider, in the
+// background. The record's error is the blocking violation noted last.
+func recordBlocked(cfg Config, runID string, span trace.Span, model, provider, endpoint string,
+	reqBody []byte, start time.Time, notes *airAnnotations) {
+
+	reason := ""
+	for _, v := range notes.Violations {
+		if v.Outcome == outcomeBlocked {
+			reason = v.Message
+		}
+	}
+	go backgroundRecord(cfg, runID, span, model, provider, endpoint,
+		reqBody, nil, start, "blocked", reason, notes)
+}
+
+// airAnnotations carries decisions the gateway made while serving a request
+// into its AIR record. It must not be modified once handed to backgroundRecord.
+type airAnnotations struct {
+	Attempts        []recorder.Attempt
+	PIIRedactions   []recorder.Redaction
+	PromptInjection []recorder.Injection
+	Guardrail       *recorder.Guardrail
+	Shadow          []recorder.Shadow
+	Identity        *recorder.Identity
+	ClientCert      *recorder.ClientCert
+
+	SessionID         string
+	RequestedModel    string
+	ModelChanges      []recorder.ModelChange
+	PIICounts         map[string]int
+	FilteredTools     []recorder.FilteredTool
+	Violations        []recorder.Violation
+	Approvals         []recorder.Approval
+	UpstreamRequestID string
 }
 
 // backgroundRecord handles vault storage and AIR record writing off the hot path.
 // Failures are logged but never block the response to the caller.
 func backgroundRecord(cfg Config, runID string, span trace.Span,
 	model, provider, endpoint string,
-	reqBody, respBody []byte, start time.Time, status, errMsg string) {
+	reqBody, respBody []byte, start time.Time, status, errMsg string, notes *airAnnotations) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	// Provider keys never reach the vault, even if a prompt quotes one.
+	secrets := cfg.Providers.Secrets()
+	reqBody = redactSecrets(reqBody, secrets)
+	respBody = redactSecrets(respBody, secrets)
+
 	// Vault the request (best-effort).
 	reqRef, err := vaultStore(ctx, cfg.Vault, runID, "request.json", reqBody)
 	if err != nil {
@@ -478,11 +940,7 @@ func backgroundRecord(cfg Config, runID string, span trace.Span,
 	if respBody != nil {
 		var respParsed chatResponse
 		if err := json.Unmarshal(respBody, &respParsed); err == nil && respParsed.Usage != nil {
-			tokens = recorder.Tokens{
-				Prompt:     respParsed.Usage.PromptTokens,
-				Completion: respParsed.Usage.CompletionTokens,
-				Total:      respParsed.Usage.TotalTokens,
-			}
+			tokens = respParsed.Usage.tokens()
 		} else {
 			// Try extracting from SSE stream.
 			tokens = extractStreamTokens(respBody)
@@ -491,11 +949,11 @@ func backgroundRecord(cfg Config, runID string, span trace.Span,
 
 	// Write AIR record (best-effort).
 	writeAIRRecord(cfg.Recorder, runID, span, model, provider, endpoint,
-		reqRef, respRef, tokens, start, status, errMsg)
+		reqRef, respRef, tokens, start, status, errMsg, notes)
 
 	// Append to cryptographic audit chain (best-effort).
 	if cfg.AuditChain != nil {
-		recordJSON, _ := json.Marshal(map[string]interface{}{
+		entry := map[string]interface{}{
 			"run_id":    runID,
 			"model":     model,
 			"provider":  provider,
@@ -503,14 +961,30 @@ func backgroundRecord(cfg Config, runID string, span trace.Span,
 			"status":    status,
 			"tokens":    tokens,
 			"timestamp": start.UTC(),
-		})
+		}
+		if notes != nil && notes.Identity != nil {
+			entry["key_id"] = notes.Identity.KeyID
+			entry["tenant"] = notes.Identity.Tenant
+		}
+		if notes != nil && notes.SessionID != "" {
+			entry["session_id"] = notes.SessionID
+		}
+		if errMsg != "" {
+			entry["error"] = errMsg
+		}
+		recordJSON, _ := json.Marshal(entry)
 		cfg.AuditChain.Append(runID, recordJSON)
 	}
 }
 
 // extractStreamTokens attempts to extract token usage from the last SSE data chunk.
-// OpenAI includes usage when the request has stream_options.include_usage=true.
+// OpenAI includes usage when the request has stream_options.include_usage=true;
+// the Responses API nests it under response.usage in the response.completed event.
+// Anthropic streams spread usage over several events and are aggregated separately.
 func extractStreamTokens(data []byte) recorder.Tokens {
+	if isAnthropicStream(data) {
+		return extractAnthropicStreamTokens(data)
+	}
 	lines := strings.Split(string(data), "\n")
 	for i := len(lines) - 1; i >= 0; i-- {
 		line := strings.TrimSpace(lines[i])
@@ -522,18 +996,19 @@ func extractStreamTokens(data []byte) recorder.Tokens {
 			continue
 		}
 		var chunk struct {
-			Usage *struct {
-				PromptTokens     int `json:"prompt_tokens"`
-				CompletionTokens int `json:"completion_tokens"`
-				TotalTokens      int `json:"total_tokens"`
-			} `json:"usage"`
-		}
-		if err := json.Unmarshal([]byte(payload), &chunk); err == nil && chunk.Usage != nil {
-			return recorder.Tokens{
-				Prompt:     chunk.Usage.PromptTokens,
-				Completion: chunk.Usage.CompletionTokens,
-				Total:      chunk.Usage.TotalTokens,
-			}
+			Usage    *usageFields `json:"usage"`
+			Response *struct {
+				Usage *usageFields `json:"usage"`
+			} `json:"response"`
+		}
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			continue
+		}
+		if chunk.Usage != nil {
+			return chunk.Usage.tokens()
+		}
+		if chunk.Response != nil && chunk.Response.Usage != nil {
+			return chunk.Response.Usage.tokens()
 		}
 	}
 	return recorder.Tokens{}
@@ -548,7 +1023,7 @@ func vaultStore(ctx context.Context, vc *vault.Client, runID, name string, data
 }
 
 func writeAIRRecord(w *recorder.Writer, runID string, span trace.Span, model, provider, endpoint string,
-	reqRef, respRef vault.Ref, tokens recorder.Tokens, start time.Time, status, errMsg string) {
+	reqRef, respRef vault.Ref, tokens recorder.Tokens, start time.Time, status, errMsg string, notes *airAnnotations) {
 
 	if w == nil {
 		return
@@ -575,6 +1050,25 @@ func writeAIRRecord(w *recorder.Writer, runID string, span trace.Span, model, pr
 		Status:           status,
 		Error:            errMsg,
 	}
+	if notes != nil {
+		rec.Attempts = notes.Attempts
+		rec.PIIRedactions = notes.PIIRedactions
+		rec.PromptInjection = notes.PromptInjection
+		rec.Guardrail = notes.Guardrail
+		rec.Shadow = notes.Shadow
+		rec.Identity = notes.Identity
+		rec.ClientCert = notes.ClientCert
+		rec.SessionID = notes.SessionID
+		if notes.RequestedModel != model {
+			rec.RequestedModel = notes.RequestedModel
+		}
+		rec.ModelChanges = notes.ModelChanges
+		rec.PIICounts = notes.PIICounts
+		rec.FilteredTools = notes.FilteredTools
+		rec.Violations = notes.Violations
+		rec.Approvals = notes.Approvals
+		rec.UpstreamRequestID = notes.UpstreamRequestID
+	}
 
 	if err := w.Write(rec); err != nil {
 		log.Printf("[%s] write AIR record: %v", runID, err)
@@ -582,17 +1076,61 @@ func writeAIRRecord(w *recorder.Writer, runID string, span trace.Span, model, pr
 }
 
 // extractSessionID derives a session identifier from the request.
-// Checks X-Session-ID header first, then falls back to a hash of the Authorization header.
+// Checks X-Session-ID header first, then the caller's JWT session claim. JWT callers
+// and callers whose credential replaced the provider key then fall back to their key
+// ID ("jwt:<sub>" for a JWT), everyone else to a hash of the Authorization header.
+// Sessions of keys with a tenant are prefixed with it, so tenants never share one.
 func extractSessionID(r *http.Request) string {
-	if sid := r.Header.Get("X-Session-ID"); sid != "" {
-		return sid
+	id := auth.FromContext(r.Context())
+	sid := "anonymous"
+	if h := r.Header.Get("X-Session-ID"); h != "" {
+		sid = h
+	} else if id != nil && id.Session != "" {
+		sid = id.Session
+	} else if id != nil && (id.Subject != "" || id.ServerCredentials) {
+		sid = id.KeyID
+	} else if authz := r.Header.Get("Authorization"); authz != "" {
+		h := sha256.Sum256([]byte(authz))
+		sid = fmt.Sprintf("auth_%x", h[:8])
+	}
+	return sessionNamespace(r) + sid
+}
+
+// pseudonymScope keys the caller's PII placeholders in the pseudonym store:
+// its session, within its gateway key, so callers sharing a session ID never
+// share placeholders.
+func pseudonymScope(r *http.Request, sessionID string) string {
+	if id := auth.FromContext(r.Context()); id != nil && id.KeyID != "" {
+		return id.KeyID + "/" + sessionID
+	}
+	return sessionID
+}
+
+// sessionNamespace is the prefix of the caller's session IDs: "<tenant>:"
+// for keys with a tenant, else "".
+func sessionNamespace(r *http.Request) string {
+	if id := auth.FromContext(r.Context()); id != nil && id.Tenant != "" {
+		return id.Tenant + ":"
+	}
+	return ""
+}
+
+// extractParentSessionID returns the session a sub-agent's session belongs
+// to: X-Parent-Session-ID, or else, with byTrace, the W3C trace of the
+// request, so every agent in one distributed trace shares a root session.
+// "" means none.
+func extractParentSessionID(r *http.Request, byTrace bool) string {
+	if pid := r.Header.Get("X-Parent-Session-ID"); pid != "" {
+		return sessionNamespace(r) + pid
+	}
+	if !byTrace {
+		return ""
 	}
-	auth := r.Header.Get("Authorization")
-	if auth != "" {
-		h := sha256.Sum256([]byte(auth))
-		return fmt.Sprintf("auth_%x", h[:8])
+	// traceparent: version-traceid-parentid-flags
+	if parts := strings.Split(r.Header.Get("traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 {
+		return sessionNamespace(r) + "trace_" + parts[1]
 	}
-	return "anonymous"
+	return ""
 }
 
 // extractPromptText pulls the last user message content from raw messages JSON.
@@ -633,9 +1171,11 @@ func extractPromptText(messages json.RawMessage) string {
 }
 
 // extractToolNames pulls tool/function names from the request body.
+// OpenAI nests the name under function; Anthropic puts it at the top level.
 func extractToolNames(body []byte) []string {
 	var req struct {
 		Tools []struct {
+			Name     string `json:"name"`
 			Function struct {
 				Name string `json:"name"`
 			} `json:"function"`
@@ -649,6 +1189,8 @@ func extractToolNames(body []byte) []string {
 	for _, t := range req.Tools {
 		if t.Function.Name != "" {
 			names = append(names, t.Function.Name)
+		} else if t.Name != "" {
+			names = append(names, t.Name)
 		}
 	}
 	return names
@@ -693,7 +1235,6 @@ func inferProvider(model, providerURL string) string {
 	}
 }
 
-
 // handleAnalytics returns per-model performance stats as JSON.
 // GET /v1/analytics — returns all models.
 // GET /v1/analytics?model=gpt-4 — returns stats for a specific model.
@@ -729,8 +1270,9 @@ func handleAnalytics(w http.ResponseWriter, r *http.Request, cfg Config) {
 	// Return all models.
 	allStats := cfg.Analytics.GetAllStats()
 	result := map[string]interface{}{
-		"models": allStats,
-		"count":  len(allStats),
+		"models":    allStats,
+		"count":     len(allStats),
+		"detectors": cfg.Analytics.GetDetectorStats(),
 	}
 	json.NewEncoder(w).Encode(result)
 }
@@ -754,8 +1296,8 @@ func handleAudit(w http.ResponseWriter, r *http.Request, cfg Config) {
 	valid, brokenAt, verifyErr := cfg.AuditChain.Verify()
 
 	result := map[string]interface{}{
-		"chain_length":   cfg.AuditChain.Len(),
-		"chain_valid":    valid,
+		"chain_length":    cfg.AuditChain.Len(),
+		"chain_valid":     valid,
 		"chain_broken_at": brokenAt,
 	}
 	if verifyErr != nil {
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/airblackbox/gateway/pkg/auth"
+	"github.com/airblackbox/gateway/pkg/guardrails"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// reserveRateLimit takes the request and its estimated tokens from the
+// rate limits of the caller's key, session, model and provider. A request
+// over a limit is rejected with 429 and false, and noted as a violation; the
+// returned reservation, possibly nil, must be settled with the actual usage.
+func reserveRateLimit(w http.ResponseWriter, r *http.Request, cfg Config, runID string, notes *airAnnotations, span trace.Span,
+	model string, reqBody []byte) (*guardrails.RateReservation, bool) {
+
+	if cfg.Guardrails == nil || cfg.RateLimiter == nil {
+		return nil, true
+	}
+	scopes := cfg.Guardrails.RateLimits.Scopes(extractKeyID(r), extractSessionID(r), model, primaryProvider(cfg, model))
+	if len(scopes) == 0 {
+		return nil, true
+	}
+
+	estimate := estimateRequestTokens(reqBody) + requestedOutputTokens(reqBody)
+	res, denied := cfg.RateLimiter.Reserve(scopes, estimate, time.Now())
+	if denied == nil {
+		setRateLimitHeaders(w, res.Status)
+		return res, true
+	}
+
+	msg := fmt.Sprintf("Rate limit reached for %s %s on %s per min: limit %d", denied.Scope, denied.Key, denied.Kind, denied.Limit)
+	span.SetAttributes(
+		attribute.String("gen_ai.ratelimit.scope", denied.Scope),
+		attribute.String("gen_ai.ratelimit.kind", denied.Kind),
+	)
+	if cfg.Guardrails.Shadowed("rate_limit") {
+		noteShadow(cfg, notes, span, guardrails.ShadowDecision{Rule: "rate_limit", Action: guardrails.ActionBlock, Reason: msg})
+		return nil, true
+	}
+	log.Printf("[ratelimit] %s (estimate=%d tokens)", msg, estimate)
+	noteViolation(notes, stagePrevention, "rate_limit", msg, outcomeBlocked)
+	setRateLimitHeaders(w, denied.Status)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("x-run-id", runID)
+	w.Header().Set("Retry-After", strconv.Itoa(int(denied.RetryAfter/time.Second)+1))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"type":    denied.Kind,
+			"code":    "rate_limit_exceeded",
+			"message": msg + ". Please try again in " + formatRateReset(denied.RetryAfter) + ".",
+			"scope":   denied.Scope,
+		},
+	})
+	return nil, false
+}
+
+// setRateLimitHeaders reports the tightest limits in OpenAI's format.
+func setRateLimitHeaders(w http.ResponseWriter, st guardrails.RateStatus) {
+	h := w.Header()
+	if st.LimitRequests > 0 {
+		h.Set("x-ratelimit-limit-requests", strconv.Itoa(st.LimitRequests))
+		h.Set("x-ratelimit-remaining-requests", strconv.Itoa(st.RemainingRequests))
+		h.Set("x-ratelimit-reset-requests", formatRateReset(st.ResetRequests))
+	}
+	if st.LimitTokens > 0 {
+		h.Set("x-ratelimit-limit-tokens", strconv.Itoa(st.LimitTokens))
+		h.Set("x-ratelimit-remaining-tokens", strconv.Itoa(st.RemainingTokens))
+		h.Set("x-ratelimit-reset-tokens", formatRateReset(st.ResetTokens))
+	}
+}
+
+// formatRateReset formats a duration the way OpenAI does, e.g. 1s, 6m0s, 20ms.
+func formatRateReset(d time.Duration) string {
+	if d >= time.Second {
+		d = d.Round(time.Second)
+	}
+	return d.Round(time.Millisecond).String()
+}
+
+// requestedOutputTokens returns the completion tokens a request asks for at
+// most, or 0 if it does not say.
+func requestedOutputTokens(body []byte) int {
+	var req struct {
+		MaxTokens           int `json:"max_tokens"`
+		MaxCompletionTokens int `json:"max_completion_tokens"`
+		MaxOutputTokens     int `json:"max_output_tokens"`
+	}
+	json.Unmarshal(body, &req)
+	for _, n := range []int{req.MaxCompletionTokens, req.MaxOutputTokens, req.MaxTokens} {
+		if n > 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// primaryProvider is the provider forward tries first for model.
+func primaryProvider(cfg Config, model string) string {
+	if target := cfg.Providers.Resolve(model, inferProvider(model, "")); target != nil {
+		return target.Name
+	}
+	return inferProvider(model, cfg.ProviderURL)
+}
+
+// extractKeyID identifies the caller's key for per-key limits without
+// keeping the key itself: the registry key ID, the gateway key, or else the
+// provider credential.
+func extractKeyID(r *http.Request) string {
+	if id := auth.FromContext(r.Context()); id != nil {
+		return id.KeyID
+	}
+	key := r.Header.Get("X-Gateway-Key")
+	if key == "" {
+		key = r.Header.Get("X-Api-Key")
+	}
+	if key == "" {
+		key = r.Header.Get("Authorization")
+	}
+	if key == "" {
+		return "anonymous"
+	}
+	h := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("key_%x", h[:8])
+}
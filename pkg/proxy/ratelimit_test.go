@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/airblackbox/gateway/pkg/guardrails"
+	"github.com/airblackbox/gateway/pkg/recorder"
+)
+
+func TestProxyRateLimits(t *testing.T) {
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","model":"gpt-4o","choices":[{"message":{"role":"assistant","content":"ok"}}],` +
+			`"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`))
+	}))
+	defer upstream.Close()
+
+	gr := &guardrails.Config{
+		RateLimits: guardrails.RateLimitConfig{
+			PerKey:   guardrails.RateLimit{RPM: 2},
+			PerModel: guardrails.RateLimit{TPM: 1000},
+		},
+	}
+	dir := t.TempDir()
+	rec, _ := recorder.NewWriter(dir)
+	h := Handler(Config{ProviderURL: upstream.URL, Guardrails: gr, Recorder: rec})
+	call := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	small := `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"max_tokens":400}`
+
+	// The 400-token reservations are refunded down to the 15 tokens used.
+	for i := 0; i < 2; i++ {
+		w := call("sk-a", small)
+		if w.Code != 200 {
+			t.Fatalf("call %d status = %d: %s", i, w.Code, w.Body.String())
+		}
+		if w.Header().Get("x-ratelimit-limit-requests") != "2" || w.Header().Get("x-ratelimit-limit-tokens") != "1000" {
+			t.Errorf("call %d headers = %v", i, w.Header())
+		}
+	}
+
+	w := call("sk-a", small)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("third call status = %d, want 429", w.Code)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "30" && ra != "31" || w.Header().Get("x-ratelimit-remaining-requests") != "0" ||
+		w.Header().Get("x-ratelimit-reset-requests") != "1m0s" {
+		t.Errorf("429 headers = %v", w.Header())
+	}
+	var body struct {
+		Error struct {
+			Type, Code, Scope string
+		}
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body.Error.Code != "rate_limit_exceeded" || body.Error.Type != "requests" || body.Error.Scope != "key" {
+		t.Errorf("429 body = %s", w.Body.String())
+	}
+	if calls != 2 {
+		t.Errorf("upstream calls = %d, want 2", calls)
+	}
+	loaded, err := recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Status != "blocked" || len(loaded.Violations) != 1 || loaded.Violations[0].Rule != "rate_limit" ||
+		loaded.Error != loaded.Violations[0].Message {
+		t.Errorf("429 record: status %q, violations %+v, error %q", loaded.Status, loaded.Violations, loaded.Error)
+	}
+
+	// Another key shares the model's token limit: 970 tokens are left, and
+	// the request reserves 900 plus 2 estimated prompt tokens.
+	if w := call("sk-b", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"max_tokens":900}`); w.Code != 200 ||
+		w.Header().Get("x-ratelimit-remaining-tokens") != "68" {
+		t.Errorf("sk-b = %d remaining tokens %s", w.Code, w.Header().Get("x-ratelimit-remaining-tokens"))
+	}
+
+	// In shadow mode the limit is only reported.
+	gr.RateLimits.Mode = guardrails.ModeShadow
+	if w := call("sk-a", small); w.Code != 200 {
+		t.Errorf("shadow mode status = %d, want 200", w.Code)
+	}
+}
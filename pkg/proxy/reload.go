@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleReload re-reads the guardrails config file. An invalid file is
+// rejected with 422 and the current config stays live.
+// POST /v1/admin/reload
+func handleReload(w http.ResponseWriter, r *http.Request, cfg Config) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	if cfg.Live == nil {
+		http.Error(w, `{"error":"guardrails config is not reloadable"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	hash, err := cfg.Live.Reload("admin")
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]interface{}{
+				"type":    "config_invalid",
+				"message": err.Error(),
+				"sha256":  hash, // the config still live
+			},
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "ok",
+		"sha256": hash,
+	})
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/airblackbox/gateway/pkg/guardrails"
+)
+
+func TestAdminReloadSwapsConfig(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","model":"gpt-4o","choices":[{"message":{"role":"assistant","content":"ok"}}]}`))
+	}))
+	defer upstream.Close()
+
+	path := filepath.Join(t.TempDir(), "guardrails.yaml")
+	os.WriteFile(path, []byte("prevention:\n  tools:\n    enabled: true\n    blocklist: [shell]\n"), 0644)
+	holder, err := guardrails.NewHolder(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Handler(Config{
+		ProviderURL: upstream.URL,
+		GatewayKey:  "gw-secret",
+		Guardrails:  holder.Config(),
+		Live:        holder,
+		Sessions:    guardrails.NewManager(5 * time.Minute),
+	})
+
+	call := func() int {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(
+			`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function","function":{"name":"search"}}]}`))
+		req.Header.Set("X-Gateway-Key", "gw-secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	reload := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/admin/reload", nil)
+		if key != "" {
+			req.Header.Set("X-Gateway-Key", key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if code := call(); code != 200 {
+		t.Fatalf("before reload status = %d, want 200", code)
+	}
+
+	os.WriteFile(path, []byte("prevention:\n  tools:\n    enabled: true\n    blocklist: [search]\n"), 0644)
+	if w := reload(""); w.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated reload status = %d, want 401", w.Code)
+	}
+	if w := reload("gw-secret"); w.Code != 200 || !strings.Contains(w.Body.String(), holder.Hash()) {
+		t.Fatalf("reload = %d %s", w.Code, w.Body.String())
+	}
+	if code := call(); code != http.StatusForbidden {
+		t.Errorf("after reload status = %d, want 403", code)
+	}
+
+	os.WriteFile(path, []byte("prevention: [not, a, map]\n"), 0644)
+	if w := reload("gw-secret"); w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "config_invalid") {
+		t.Errorf("invalid reload = %d %s", w.Code, w.Body.String())
+	}
+	if code := call(); code != http.StatusForbidden {
+		t.Errorf("invalid reload replaced the config: status = %d", code)
+	}
+}
+
+func TestAdminEndpointsNeedGatewayKey(t *testing.T) {
+	h := Handler(Config{ProviderURL: "http://unused"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/admin/reload", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", w.Code)
+	}
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/airblackbox/gateway/pkg/auth"
+	"github.com/airblackbox/gateway/pkg/guardrails"
+)
+
+const adminSessionsPath = "/v1/admin/sessions"
+
+// defaultKillTTL is how long a killed session is rejected when the request
+// does not say.
+const defaultKillTTL = 15 * time.Minute
+
+// handleAdminSessions serves session inspection and control:
+//
+//	GET  /v1/admin/sessions               list active sessions
+//	GET  /v1/admin/sessions/{id}          one session
+//	POST /v1/admin/sessions/{id}/reset    zero its counters and history
+//	POST /v1/admin/sessions/{id}/kill     {"ttl_seconds":600} reject it with 429 until the TTL passes
+//	POST /v1/admin/sessions/{id}/budget   {"extra_tokens":N,"extra_cost_usd":X,"duration_seconds":S}
+//
+// Session IDs are path-escaped. Every reset, kill and budget raise is
+// appended to the audit chain.
+func handleAdminSessions(w http.ResponseWriter, r *http.Request, cfg Config) {
+	if cfg.Sessions == nil {
+		http.Error(w, `{"error":"guardrails not enabled"}`, http.StatusNotFound)
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), adminSessionsPath), "/")
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+			return
+		}
+		sessions, err := cfg.Sessions.Sessions()
+		if err != nil {
+			writeSessionStoreError(w, err)
+			return
+		}
+		summaries := make([]guardrails.SessionSummary, 0, len(sessions))
+		for _, s := range sessions {
+			summaries = append(summaries, s.Summary())
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": summaries})
+		return
+	}
+
+	escapedID, action, _ := strings.Cut(rest, "/")
+	sessionID, err := url.PathUnescape(escapedID)
+	if err != nil {
+		http.Error(w, `{"error":"invalid session ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	if action == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+			return
+		}
+		s, err := cfg.Sessions.Session(sessionID)
+		writeSession(w, sessionID, s, err)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	switch action {
+	case "reset":
+		s, err := cfg.Sessions.Reset(sessionID)
+		if err == nil && s != nil {
+			auditAdminAction(cfg, r, "reset", sessionID, nil)
+		}
+		writeSession(w, sessionID, s, err)
+
+	case "kill":
+		var body struct {
+			TTLSeconds int `json:"ttl_seconds"`
+		}
+		if !decodeAdminBody(w, r, &body) {
+			return
+		}
+		ttl := defaultKillTTL
+		if body.TTLSeconds > 0 {
+			ttl = time.Duration(body.TTLSeconds) * time.Second
+		}
+		cfg.Sessions.Terminate(sessionID, ttl)
+		auditAdminAction(cfg, r, "kill", sessionID, map[string]interface{}{"ttl_seconds": int(ttl.Seconds())})
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":     "killed",
+			"session_id": sessionID,
+			"until":      time.Now().Add(ttl).UTC(),
+		})
+
+	case "budget":
+		var body struct {
+			ExtraTokens     int     `json:"extra_tokens"`
+			ExtraCostUSD    float64 `json:"extra_cost_usd"`
+			DurationSeconds int     `json:"duration_seconds"`
+		}
+		if !decodeAdminBody(w, r, &body) {
+			return
+		}
+		if body.ExtraTokens < 0 || body.ExtraCostUSD < 0 || body.DurationSeconds <= 0 {
+			http.Error(w, `{"error":"extra_tokens and extra_cost_usd must not be negative and duration_seconds must be positive"}`, http.StatusBadRequest)
+			return
+		}
+		s, err := cfg.Sessions.RaiseBudget(sessionID, body.ExtraTokens, body.ExtraCostUSD, time.Duration(body.DurationSeconds)*time.Second)
+		if err == nil && s != nil {
+			auditAdminAction(cfg, r, "budget", sessionID, map[string]interface{}{
+				"extra_tokens":     body.ExtraTokens,
+				"extra_cost_usd":   body.ExtraCostUSD,
+				"duration_seconds": body.DurationSeconds,
+			})
+		}
+		writeSession(w, sessionID, s, err)
+
+	default:
+		http.Error(w, `{"error":"unknown session action"}`, http.StatusNotFound)
+	}
+}
+
+// decodeAdminBody reads an optional JSON body, answering 400 if it is invalid.
+func decodeAdminBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(v); err != nil {
+		http.Error(w, `{"error":"invalid JSON body"}`, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeSession(w http.ResponseWriter, sessionID string, s *guardrails.SessionState, err error) {
+	if err != nil {
+		writeSessionStoreError(w, err)
+		return
+	}
+	if s == nil {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"error": map[string]interface{}{
+				"type":       "session_not_found",
+				"message":    "session is not tracked",
+				"session_id": sessionID,
+			},
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Summary())
+}
+
+func writeSessionStoreError(w http.ResponseWriter, err error) {
+	log.Printf("[admin] session store: %v", err)
+	http.Error(w, `{"error":"session store unavailable"}`, http.StatusServiceUnavailable)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// auditAdminAction appends an admin session action to the audit chain.
+func auditAdminAction(cfg Config, r *http.Request, action, sessionID string, params map[string]interface{}) {
+	log.Printf("[admin] session %s: %s %v", sessionID, action, params)
+	appendAdminAudit(cfg, r, fmt.Sprintf("admin-session-%s:%s", action, sessionID), map[string]interface{}{
+		"action":     action,
+		"session_id": sessionID,
+		"params":     params,
+	})
+}
+
+// appendAdminAudit appends an admin action to the audit chain, adding the
+// caller's key, address and the time.
+func appendAdminAudit(cfg Config, r *http.Request, runID string, entry map[string]interface{}) {
+	if cfg.AuditChain == nil {
+		return
+	}
+	keyID := ""
+	if id := auth.FromContext(r.Context()); id != nil {
+		keyID = id.KeyID
+	}
+	entry["key_id"] = keyID
+	entry["remote_addr"] = r.RemoteAddr
+	entry["timestamp"] = time.Now().UTC()
+	data, _ := json.Marshal(entry)
+	cfg.AuditChain.Append(runID, data)
+}
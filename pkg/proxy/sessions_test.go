@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/airblackbox/gateway/pkg/guardrails"
+	"github.com/airblackbox/gateway/pkg/trust"
+)
+
+func TestAdminSessions(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","model":"gpt-4o","choices":[{"message":{"role":"assistant","content":"ok"}}],` +
+			`"usage":{"prompt_tokens":600,"completion_tokens":0,"total_tokens":600}}`))
+	}))
+	defer upstream.Close()
+
+	chain := trust.NewAuditChain("secret")
+	h := Handler(Config{
+		ProviderURL: upstream.URL,
+		GatewayKey:  "gw-secret",
+		Guardrails: &guardrails.Config{
+			Budgets: guardrails.BudgetConfig{MaxSessionTokens: 1000},
+			Actions: guardrails.ActionsConfig{OnTrigger: []string{"block"}},
+		},
+		Sessions:   guardrails.NewManager(5 * time.Minute),
+		AuditChain: chain,
+	})
+
+	call := func() int {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(
+			`{"model":"gpt-4o","messages":[{"role":"user","content":"summarise the quarterly report for the board please"}],"tools":[{"type":"function","function":{"name":"search"}}]}`))
+		req.Header.Set("X-Gateway-Key", "gw-secret")
+		req.Header.Set("X-Session-ID", "agent/1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	admin := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-Gateway-Key", "gw-secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	call()
+	call()
+	if code := call(); code != http.StatusTooManyRequests {
+		t.Fatalf("third call status = %d, want 429 (budget spent)", code)
+	}
+
+	w := admin("GET", "/v1/admin/sessions", "")
+	var list struct {
+		Sessions []guardrails.SessionSummary `json:"sessions"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if w.Code != 200 || len(list.Sessions) != 1 {
+		t.Fatalf("list = %d %s", w.Code, w.Body.String())
+	}
+	s := list.Sessions[0]
+	if s.SessionID != "agent/1" || s.TotalTokens != 1200 || s.RequestCount != 3 || s.ToolCalls["search"] != 3 {
+		t.Errorf("summary = %+v", s)
+	}
+	if p := s.RecentPrompts[0]; len(p.SHA256) != 64 || strings.Contains(p.Preview, "board please") {
+		t.Errorf("prompt not reduced to hash and preview: %+v", p)
+	}
+
+	if w := admin("GET", "/v1/admin/sessions/agent%2F1", ""); w.Code != 200 {
+		t.Errorf("get = %d %s", w.Code, w.Body.String())
+	}
+	if w := admin("GET", "/v1/admin/sessions/nobody", ""); w.Code != http.StatusNotFound {
+		t.Errorf("get unknown = %d, want 404", w.Code)
+	}
+
+	// A raised budget lets the session continue.
+	if w := admin("POST", "/v1/admin/sessions/agent%2F1/budget", `{"extra_tokens":1000,"duration_seconds":60}`); w.Code != 200 {
+		t.Fatalf("budget = %d %s", w.Code, w.Body.String())
+	}
+	if code := call(); code != 200 {
+		t.Errorf("after budget raise status = %d, want 200", code)
+	}
+
+	// A reset zeroes the counters.
+	w = admin("POST", "/v1/admin/sessions/agent%2F1/reset", "")
+	var reset guardrails.SessionSummary
+	json.Unmarshal(w.Body.Bytes(), &reset)
+	if w.Code != 200 || reset.TotalTokens != 0 || reset.RequestCount != 0 || len(reset.ToolCalls) != 0 {
+		t.Errorf("reset = %d %s", w.Code, w.Body.String())
+	}
+
+	// A killed session is rejected until the TTL passes.
+	if w := admin("POST", "/v1/admin/sessions/agent%2F1/kill", `{"ttl_seconds":120}`); w.Code != 200 {
+		t.Fatalf("kill = %d %s", w.Code, w.Body.String())
+	}
+	if code := call(); code != http.StatusTooManyRequests {
+		t.Errorf("after kill status = %d, want 429", code)
+	}
+
+	var audited []string
+	for _, e := range chain.Entries() {
+		if strings.HasPrefix(e.RunID, "admin-") {
+			audited = append(audited, e.RunID)
+		}
+	}
+	want := []string{"admin-session-budget:agent/1", "admin-session-reset:agent/1", "admin-session-kill:agent/1"}
+	if strings.Join(audited, ",") != strings.Join(want, ",") {
+		t.Errorf("audit chain = %v, want %v", audited, want)
+	}
+}
+
+func TestAdminSessionsRequireGatewayKey(t *testing.T) {
+	h := Handler(Config{
+		ProviderURL: "http://unused",
+		Guardrails:  &guardrails.Config{},
+		Sessions:    guardrails.NewManager(5 * time.Minute),
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/admin/sessions", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status without GATEWAY_KEY = %d, want 403", w.Code)
+	}
+}
+
+func TestSessionTreeThroughProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","model":"gpt-4o","choices":[{"message":{"role":"assistant","content":"ok"}}],` +
+			`"usage":{"prompt_tokens":500,"completion_tokens":0,"total_tokens":500}}`))
+	}))
+	defer upstream.Close()
+
+	sessions := guardrails.NewManager(5 * time.Minute)
+	gr := &guardrails.Config{
+		Budgets: guardrails.BudgetConfig{MaxSessionTokens: 1000},
+		Root:    guardrails.DetectionRules{Budgets: guardrails.BudgetConfig{MaxSessionTokens: 1000}},
+		Actions: guardrails.ActionsConfig{OnTrigger: []string{"block"}},
+	}
+	h := Handler(Config{
+		ProviderURL: upstream.URL,
+		GatewayKey:  "gw-secret",
+		Guardrails:  gr,
+		Sessions:    sessions,
+	})
+	call := func(sessionID string, headers map[string]string) int {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(
+			`{"model":"gpt-4o","messages":[{"role":"user","content":"hello"}]}`))
+		req.Header.Set("X-Gateway-Key", "gw-secret")
+		req.Header.Set("X-Session-ID", sessionID)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Three sub-agents each stay under their own budget, but the third
+	// request finds the tree's budget spent.
+	parent := map[string]string{"X-Parent-Session-ID": "orchestrator"}
+	for i, sub := range []string{"sub-1", "sub-2", "sub-3"} {
+		want := http.StatusOK
+		if i == 2 {
+			want = http.StatusTooManyRequests
+		}
+		if code := call(sub, parent); code != want {
+			t.Errorf("%s status = %d, want %d", sub, code, want)
+		}
+	}
+	if root, _ := sessions.Session("orchestrator"); root == nil || root.Tree.TotalTokens != 1000 || len(root.Children) != 3 || root.TotalTokens != 0 {
+		t.Errorf("orchestrator = %+v", root)
+	}
+
+	// A W3C trace alone links nothing unless trace_roots is on.
+	trace := map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	if code := call("untraced", trace); code != 200 {
+		t.Fatalf("untraced status = %d", code)
+	}
+	if got := sessions.Root("untraced"); got != "untraced" {
+		t.Errorf("Root(untraced) = %q, want its own session", got)
+	}
+
+	// With it, agents in one trace share a root, and killing it stops them.
+	gr.TraceRoots = true
+	if code := call("traced", trace); code != 200 {
+		t.Fatalf("traced status = %d", code)
+	}
+	if got := sessions.Root("traced"); got != "trace_4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Root(traced) = %q", got)
+	}
+	sessions.Terminate("trace_4bf92f3577b34da6a3ce929d0e0e4736", time.Minute)
+	if code := call("traced", trace); code != http.StatusTooManyRequests {
+		t.Errorf("after killing the root status = %d, want 429", code)
+	}
+}
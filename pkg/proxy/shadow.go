@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/airblackbox/gateway/pkg/guardrails"
+	"github.com/airblackbox/gateway/pkg/recorder"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// noteShadow reports what rules in shadow mode would have done to the span,
+// the AIR record and the /v1/policy/shadow summary.
+func noteShadow(cfg Config, notes *airAnnotations, span trace.Span, decisions ...guardrails.ShadowDecision) {
+	if len(decisions) == 0 {
+		return
+	}
+	for _, d := range decisions {
+		log.Printf("[shadow] %s would %s: %s", d.Rule, d.Action, d.Reason)
+		notes.Shadow = append(notes.Shadow, recorder.Shadow{Rule: d.Rule, Action: d.Action, Reason: d.Reason})
+	}
+	rules := make([]string, 0, len(notes.Shadow))
+	actions := make([]string, 0, len(notes.Shadow))
+	for _, s := range notes.Shadow {
+		rules = append(rules, s.Rule)
+		actions = append(actions, s.Action)
+	}
+	span.SetAttributes(
+		attribute.StringSlice("gen_ai.shadow.rules", rules),
+		attribute.StringSlice("gen_ai.shadow.actions", actions),
+	)
+	cfg.Shadow.Record(decisions...)
+}
+
+// shadowViolation turns a detection or tool-argument violation from a rule
+// in shadow mode into the decision it would have led to.
+func shadowViolation(cfg Config, v *guardrails.Violation) guardrails.ShadowDecision {
+	action := guardrails.ActionBlock
+	if v.Rule != "tool_argument" {
+		action = strings.Join(guardrails.PlanActions(cfg.Guardrails, v).Actions, ",")
+	}
+	return guardrails.ShadowDecision{Rule: v.Rule, Action: action, Reason: v.Message}
+}
+
+// outputShadowActions maps output policy results to shadow actions.
+var outputShadowActions = map[string]string{"redacted": "redact", "blocked": "block", "flagged": "flag"}
+
+// handleShadowSummary returns per-rule hit counts of rules in shadow mode.
+// GET /v1/policy/shadow
+func handleShadowSummary(w http.ResponseWriter, r *http.Request, cfg Config) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	if cfg.Shadow == nil {
+		http.Error(w, `{"error":"guardrails not enabled"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cfg.Shadow.Summary())
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/airblackbox/gateway/pkg/guardrails"
+	"github.com/airblackbox/gateway/pkg/recorder"
+)
+
+func TestProxyShadowModeForwardsUnmodified(t *testing.T) {
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"chatcmpl-1","model":"gpt-4o","choices":[{"message":{"role":"assistant","content":"ok"}}]}`))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	rec, _ := recorder.NewWriter(dir)
+	h := Handler(Config{
+		ProviderURL: upstream.URL,
+		Recorder:    rec,
+		Guardrails: &guardrails.Config{
+			Budgets: guardrails.BudgetConfig{MaxSessionTokens: 1, Mode: guardrails.ModeShadow},
+			Prevention: guardrails.PreventionConfig{
+				PII: guardrails.PIIConfig{Enabled: true, BlockEmail: true, RedactMode: "block", Mode: guardrails.ModeShadow},
+			},
+		},
+		Sessions: guardrails.NewManager(5 * time.Minute),
+	})
+
+	body := `{"model":"gpt-4o","messages":[{"role":"user","content":"mail jane@example.com"}],"stream_options":{"include_usage":true}}`
+	var runID string
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("X-Session-ID", "shadow-session")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("call %d status = %d, want 200: %s", i, w.Code, w.Body.String())
+		}
+		runID = w.Header().Get("x-run-id")
+	}
+	if received != body {
+		t.Errorf("upstream received a modified request: %s", received)
+	}
+
+	loaded, err := recorder.Load(waitForAIRRecord(t, dir, runID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := map[string]string{}
+	for _, s := range loaded.Shadow {
+		rules[s.Rule] = s.Action
+	}
+	if rules["pii"] != "block" || !strings.Contains(rules["token_budget"], "block") {
+		t.Errorf("AIR shadow = %+v", loaded.Shadow)
+	}
+	if len(loaded.PIIRedactions) != 0 {
+		t.Errorf("shadow PII recorded as redactions: %+v", loaded.PIIRedactions)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/policy/shadow", nil))
+	var summary guardrails.ShadowSummary
+	if err := json.NewDecoder(w.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	hits := map[string]int{}
+	for _, r := range summary.Rules {
+		hits[r.Rule] = r.Hits
+	}
+	if hits["pii"] != 2 || hits["token_budget"] != 1 {
+		t.Errorf("summary = %+v", summary)
+	}
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+
+	"github.com/airblackbox/gateway/pkg/guardrails"
+)
+
+// eventFilter inspects one SSE event (including its trailing blank line) and
+// returns the bytes to send in its place. cut=true ends the stream without
+// sending the event.
+type eventFilter func(event []byte) (out []byte, cut bool)
+
+// relayEvents forwards an SSE body to the client one event at a time through
+// filter. With hold set, nothing is sent until the whole stream has passed the
+// filter. Everything read from upstream is copied to full for recording.
+//
+// Returns true if the filter cut the stream; the caller sends any terminal event.
+func relayEvents(w io.Writer, flush func(), body io.Reader, full *bytes.Buffer,
+	runID string, hold bool, filter eventFilter) (cut bool) {
+
+	reader := bufio.NewReader(body)
+	var event, held bytes.Buffer
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		full.Write(line)
+		event.Write(line)
+
+		endOfEvent := len(line) > 0 && len(bytes.TrimSpace(line)) == 0
+		if (endOfEvent || err != nil) && event.Len() > 0 {
+			out, cut := filter(event.Bytes())
+			if cut {
+				return true
+			}
+			if hold {
+				held.Write(out)
+			} else {
+				w.Write(out)
+				flush()
+			}
+			event.Reset()
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[%s] stream read error: %v", runID, err)
+			}
+			break
+		}
+	}
+
+	if held.Len() > 0 {
+		w.Write(held.Bytes())
+		flush()
+	}
+	return false
+}
+
+// eventPayloads returns the data payloads of one SSE event.
+func eventPayloads(event []byte) [][]byte {
+	var payloads [][]byte
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if bytes.HasPrefix(line, []byte("data:")) {
+			payloads = append(payloads, bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:"))))
+		}
+	}
+	return payloads
+}
+
+// scanEvent feeds the data lines of one SSE event to the output scanner.
+func scanEvent(scanner *guardrails.OutputScanner, event []byte) bool {
+	for _, payload := range eventPayloads(event) {
+		if scanner.Scan(payload) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteEventData applies fn to every data payload of an SSE event,
+// leaving event:, id: and blank lines as they are.
+func rewriteEventData(event []byte, fn func(payload []byte) []byte) []byte {
+	lines := bytes.Split(event, []byte("\n"))
+	for i, line := range lines {
+		trimmed := bytes.TrimRight(line, "\r")
+		if !bytes.HasPrefix(trimmed, []byte("data:")) {
+			continue
+		}
+		payload := bytes.TrimSpace(bytes.TrimPrefix(trimmed, []byte("data:")))
+		lines[i] = append([]byte("data: "), fn(payload)...)
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// restoreEvent restores PII placeholders in one SSE event. Text the restorer
+// releases is sent first, in events framed like prev, the event before.
+func restoreEvent(restorer *guardrails.PseudonymRestorer, event, prev []byte) []byte {
+	var released [][]byte
+	event = rewriteEventData(event, func(payload []byte) []byte {
+		r, out := restorer.RestorePayload(payload)
+		released = append(released, r...)
+		return out
+	})
+	return append(releasedEvents(released, prev), event...)
+}
+
+// releasedEvents frames payloads released by a PseudonymRestorer as SSE
+// events, keeping the event: line of prev, the event they were held from.
+func releasedEvents(payloads [][]byte, prev []byte) []byte {
+	var eventLine []byte
+	for _, line := range bytes.Split(prev, []byte("\n")) {
+		if line = bytes.TrimSpace(line); bytes.HasPrefix(line, []byte("event:")) {
+			eventLine = append(append([]byte(nil), line...), '\n')
+		}
+	}
+	var out bytes.Buffer
+	for _, payload := range payloads {
+		if payload == nil {
+			continue
+		}
+		out.Write(eventLine)
+		out.WriteString("data: ")
+		out.Write(payload)
+		out.WriteString("\n\n")
+	}
+	return out.Bytes()
+}
@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"encoding/json"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -10,13 +12,13 @@ import (
 
 // waitForAIRRecord polls for an AIR record file to appear in dir.
 // Background goroutines write AIR records asynchronously, so tests
-// must wait briefly for them to land on disk.
+// must wait briefly for them to land on disk, and for the write to finish.
 func waitForAIRRecord(t *testing.T, dir, runID string) string {
 	t.Helper()
 	airFile := filepath.Join(dir, runID+".air.json")
 	deadline := time.Now().Add(2 * time.Second)
 	for time.Now().Before(deadline) {
-		if _, err := os.Stat(airFile); err == nil {
+		if data, err := os.ReadFile(airFile); err == nil && json.Valid(data) {
 			return airFile
 		}
 		time.Sleep(10 * time.Millisecond)
@@ -51,3 +53,8 @@ func waitForAIRRecords(t *testing.T, dir string, count int) int {
 	}
 	return n
 }
+
+// readJSON decodes a request body in a mock upstream handler.
+func readJSON(r *http.Request, v interface{}) {
+	json.NewDecoder(r.Body).Decode(v)
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/airblackbox/gateway/pkg/guardrails"
+	"github.com/airblackbox/gateway/pkg/recorder"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// charsPerToken is the rough characters-per-token ratio used when a provider
+// does not report usage. It matches OpenAI's published rule of thumb for English.
+const charsPerToken = 4
+
+// sessionUsage converts the provider-reported tokens into guardrail session usage.
+// When the provider omitted usage (e.g. a stream without include_usage), the counts
+// are estimated from the request and response text so budgets are still enforced.
+// Failed upstream calls without usage are not charged.
+func sessionUsage(span trace.Span, tokens recorder.Tokens, reqBody, respBody []byte, isError bool) guardrails.Usage {
+	if tokens.Prompt > 0 || tokens.Completion > 0 {
+		return guardrails.Usage{
+			PromptTokens:     tokens.Prompt,
+			CompletionTokens: tokens.Completion,
+			CachedTokens:     tokens.Cached,
+		}
+	}
+	if tokens.Total > 0 {
+		return guardrails.Usage{PromptTokens: tokens.Total}
+	}
+	if isError {
+		return guardrails.Usage{}
+	}
+
+	usage := guardrails.Usage{
+		PromptTokens:     estimateRequestTokens(reqBody),
+		CompletionTokens: estimateResponseTokens(respBody),
+		Estimated:        true,
+	}
+	span.SetAttributes(
+		attribute.Bool("gen_ai.usage.estimated", true),
+		attribute.Int("gen_ai.usage.estimated_prompt_tokens", usage.PromptTokens),
+		attribute.Int("gen_ai.usage.estimated_completion_tokens", usage.CompletionTokens),
+	)
+	return usage
+}
+
+// estimateRequestTokens approximates prompt tokens from the text the model will
+// read: message contents, the Responses API input, instructions and tool schemas.
+func estimateRequestTokens(body []byte) int {
+	var req map[string]interface{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return estimateTokens(len(body))
+	}
+	chars := 0
+	for _, key := range []string{"messages", "input", "instructions", "system", "tools"} {
+		if v, ok := req[key]; ok {
+			chars += textLength(v, nil)
+		}
+	}
+	return estimateTokens(chars)
+}
+
+// completionTextKeys are the JSON keys that carry generated text in buffered
+// responses and streamed deltas across the supported API shapes.
+var completionTextKeys = map[string]bool{
+	"content":      true,
+	"text":         true,
+	"arguments":    true,
+	"delta":        true,
+	"partial_json": true,
+	"thinking":     true,
+}
+
+// estimateResponseTokens approximates completion tokens from a buffered JSON
+// response or a raw SSE stream.
+func estimateResponseTokens(body []byte) int {
+	if len(body) == 0 {
+		return 0
+	}
+
+	var parsed interface{}
+	if err := json.Unmarshal(body, &parsed); err == nil {
+		return estimateTokens(textLength(parsed, completionTextKeys))
+	}
+
+	chars := 0
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		payload := strings.TrimPrefix(line, "data: ")
+		if payload == "[DONE]" {
+			continue
+		}
+		var chunk interface{}
+		if err := json.Unmarshal([]byte(payload), &chunk); err == nil {
+			chars += textLength(chunk, completionTextKeys)
+		}
+	}
+	return estimateTokens(chars)
+}
+
+// textLength sums the length of every string in v. If keys is non-nil, only
+// strings found under one of those object keys are counted.
+func textLength(v interface{}, keys map[string]bool) int {
+	switch val := v.(type) {
+	case string:
+		if keys == nil {
+			return len(val)
+		}
+	case []interface{}:
+		n := 0
+		for _, item := range val {
+			n += textLength(item, keys)
+		}
+		return n
+	case map[string]interface{}:
+		n := 0
+		for k, item := range val {
+			if s, ok := item.(string); ok {
+				if keys == nil || keys[k] {
+					n += len(s)
+				}
+				continue
+			}
+			n += textLength(item, keys)
+		}
+		return n
+	}
+	return 0
+}
+
+// estimateTokens converts a character count into a token estimate, rounding up.
+func estimateTokens(chars int) int {
+	if chars <= 0 {
+		return 0
+	}
+	return (chars + charsPerToken - 1) / charsPerToken
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/airblackbox/gateway/pkg/auth"
+	"github.com/airblackbox/gateway/pkg/guardrails"
+)
+
+const adminVirtualKeysPath = "/v1/admin/virtual-keys"
+
+// handleAdminVirtualKeys serves virtual key issuance and revocation:
+//
+//	GET  /v1/admin/virtual-keys              list keys
+//	POST /v1/admin/virtual-keys              issue a key (body below); the key is only in this response
+//	GET  /v1/admin/virtual-keys/{id}         one key
+//	POST /v1/admin/virtual-keys/{id}/revoke  refuse the key from now on
+//
+//	{"name":"agent-7","tenant":"acme","team":"search","models":["gpt-4o-mini"],
+//	 "max_spend_usd":25,"expires_in_seconds":86400}
+//
+// Every issue and revocation is appended to the audit chain.
+func handleAdminVirtualKeys(w http.ResponseWriter, r *http.Request, cfg Config) {
+	if cfg.VirtualKeys == nil {
+		http.Error(w, `{"error":"virtual keys not enabled"}`, http.StatusNotFound)
+		return
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, adminVirtualKeysPath), "/")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"virtual_keys": cfg.VirtualKeys.List()})
+		case http.MethodPost:
+			issueVirtualKey(w, r, cfg)
+		default:
+			http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		vk, ok := cfg.VirtualKeys.Get(id)
+		if !ok {
+			writeVirtualKeyNotFound(w, id)
+			return
+		}
+		writeJSON(w, http.StatusOK, vk)
+
+	case action == "revoke" && r.Method == http.MethodPost:
+		vk, ok, err := cfg.VirtualKeys.Revoke(id, time.Now())
+		if !ok {
+			writeVirtualKeyNotFound(w, id)
+			return
+		}
+		auditVirtualKeyAction(cfg, r, "revoke", id, nil)
+		if err != nil {
+			// The key is refused already; only the file is behind.
+			log.Printf("[admin] virtual key %s: revocation not persisted: %v", id, err)
+		}
+		writeJSON(w, http.StatusOK, vk)
+
+	case action == "" || action == "revoke":
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+
+	default:
+		http.Error(w, `{"error":"unknown virtual key action"}`, http.StatusNotFound)
+	}
+}
+
+func issueVirtualKey(w http.ResponseWriter, r *http.Request, cfg Config) {
+	var body struct {
+		Name             string   `json:"name"`
+		Tenant           string   `json:"tenant"`
+		Team             string   `json:"team"`
+		Models           []string `json:"models"`
+		MaxSpendUSD      float64  `json:"max_spend_usd"`
+		ExpiresInSeconds int      `json:"expires_in_seconds"`
+	}
+	if !decodeAdminBody(w, r, &body) {
+		return
+	}
+	if body.ExpiresInSeconds < 0 {
+		http.Error(w, `{"error":"expires_in_seconds must not be negative"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	spec := auth.VirtualKey{
+		Name:        body.Name,
+		Tenant:      body.Tenant,
+		Team:        body.Team,
+		Models:      body.Models,
+		MaxSpendUSD: body.MaxSpendUSD,
+	}
+	if body.ExpiresInSeconds > 0 {
+		expires := now.Add(time.Duration(body.ExpiresInSeconds) * time.Second).UTC()
+		spec.ExpiresAt = &expires
+	}
+	key, vk, err := cfg.VirtualKeys.Issue(spec, now)
+	if errors.Is(err, auth.ErrInvalidVirtualKey) {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": strings.TrimPrefix(err.Error(), "auth: "),
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("[admin] issue virtual key: %v", err)
+		http.Error(w, `{"error":"virtual key store unavailable"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	auditVirtualKeyAction(cfg, r, "issue", vk.ID, map[string]interface{}{
+		"name":          vk.Name,
+		"tenant":        vk.Tenant,
+		"team":          vk.Team,
+		"models":        vk.Models,
+		"max_spend_usd": vk.MaxSpendUSD,
+		"expires_at":    vk.ExpiresAt,
+	})
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"key":         key,
+		"virtual_key": vk,
+	})
+}
+
+func writeVirtualKeyNotFound(w http.ResponseWriter, id string) {
+	writeJSON(w, http.StatusNotFound, map[string]interface{}{
+		"error": map[string]interface{}{
+			"type":    "virtual_key_not_found",
+			"message": "no virtual key with this ID",
+			"id":      id,
+		},
+	})
+}
+
+// auditVirtualKeyAction appends a virtual key issue or revocation to the
+// audit chain.
+func auditVirtualKeyAction(cfg Config, r *http.Request, action, id string, params map[string]interface{}) {
+	log.Printf("[admin] virtual key %s: %s %v", id, action, params)
+	appendAdminAudit(cfg, r, "admin-virtual-key-"+action+":"+id, map[string]interface{}{
+		"action":         action,
+		"virtual_key_id": id,
+		"params":         params,
+	})
+}
+
+// reserveVirtualKeySpend holds the estimated cost of the request against
+// the spend cap of the virtual key that made it, if any. A request that
+// would pass the cap is rejected with 403 and false, and noted as a
+// violation; the returned reservation, possibly nil, must be settled with
+// chargeVirtualKey.
+func reserveVirtualKeySpend(w http.ResponseWriter, r *http.Request, cfg Config, runID string, notes *airAnnotations,
+	model string, reqBody []byte) (*auth.SpendReservation, bool) {
+
+	id := auth.FromContext(r.Context())
+	if id == nil || !id.Virtual || cfg.VirtualKeys == nil {
+		return nil, true
+	}
+	estimate := virtualKeyPricing(cfg).Cost(model, guardrails.Usage{
+		PromptTokens:     estimateRequestTokens(reqBody),
+		CompletionTokens: requestedOutputTokens(reqBody),
+	})
+	spend, err := cfg.VirtualKeys.Reserve(id.KeyID, estimate)
+	if err != nil {
+		msg := fmt.Sprintf("virtual key %s refused a request estimated at $%.4f: %v", id.KeyID, estimate, err)
+		log.Printf("[auth] %s", msg)
+		noteViolation(notes, stagePrevention, "spend_cap", msg, outcomeBlocked)
+		w.Header().Set("x-run-id", runID)
+		http.Error(w, `{"error":"forbidden: virtual key spend cap reached"}`, http.StatusForbidden)
+		return nil, false
+	}
+	return spend, true
+}
+
+// chargeVirtualKey settles a spend reservation with the cost of the
+// response. Once the key reaches its cap, its next request is refused.
+func chargeVirtualKey(spend *auth.SpendReservation, cfg Config, model string, usage guardrails.Usage) {
+	if spend != nil {
+		spend.Settle(virtualKeyPricing(cfg).Cost(model, usage))
+	}
+}
+
+// virtualKeyPricing returns the prices virtual key spend is charged at.
+func virtualKeyPricing(cfg Config) guardrails.PricingConfig {
+	if cfg.Guardrails != nil {
+		return cfg.Guardrails.Pricing
+	}
+	return guardrails.DefaultPricing()
+}
+
+// redactSecrets replaces every occurrence of a secret in data, so provider
+// keys are never vaulted.
+func redactSecrets(data []byte, secrets []string) []byte {
+	for _, s := range secrets {
+		if bytes.Contains(data, []byte(s)) {
+			data = bytes.ReplaceAll(data, []byte(s), []byte("[REDACTED_CREDENTIAL]"))
+		}
+	}
+	return data
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/airblackbox/gateway/pkg/auth"
+	"github.com/airblackbox/gateway/pkg/recorder"
+	"github.com/airblackbox/gateway/pkg/trust"
+	"github.com/airblackbox/gateway/pkg/upstream"
+)
+
+func TestVirtualKeys(t *testing.T) {
+	var gotAuth []string
+	upstreamSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = append(gotAuth, r.Header.Get("Authorization")+"|"+r.Header.Get("X-Api-Key"))
+		w.Header().Set("Content-Type", "application/json")
+		// $0.15 at gpt-4o-mini list prices.
+		w.Write([]byte(`{"id":"chatcmpl-1","model":"gpt-4o-mini","choices":[{"message":{"role":"assistant","content":"ok"}}],` +
+			`"usage":{"prompt_tokens":1000000,"completion_tokens":0,"total_tokens":1000000}}`))
+	}))
+	defer upstreamSrv.Close()
+
+	vks, _ := auth.OpenVirtualKeys("")
+	chain := trust.NewAuditChain("secret")
+	dir := t.TempDir()
+	rec, _ := recorder.NewWriter(dir)
+	h := Handler(Config{
+		ProviderURL: "http://unused.invalid",
+		Recorder:    rec,
+		GatewayKey:  "gw-admin",
+		VirtualKeys: vks,
+		AuditChain:  chain,
+		Providers: &upstream.Config{Providers: []upstream.Provider{{Name: "openai", BaseURL: upstreamSrv.URL, Default: true,
+			Auth: upstream.AuthConfig{Scheme: upstream.AuthBearer, APIKey: "sk-real"}}}},
+	})
+	admin := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-Gateway-Key", "gw-admin")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	issue := func(body string) (string, auth.VirtualKey) {
+		t.Helper()
+		w := admin("POST", "/v1/admin/virtual-keys", body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("issue = %d %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			Key        string          `json:"key"`
+			VirtualKey auth.VirtualKey `json:"virtual_key"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Key, resp.VirtualKey
+	}
+	chat := func(header, value, model string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"`+model+`","messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set(header, value)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	key, vk := issue(`{"name":"agent","tenant":"acme","models":["gpt-4o*"],"max_spend_usd":0.2,"expires_in_seconds":3600}`)
+	if !strings.HasPrefix(key, "vk-") || vk.ID == "" || vk.Tenant != "acme" || vk.ExpiresAt == nil {
+		t.Fatalf("issued %q %+v", key, vk)
+	}
+
+	// The virtual key authenticates on its own and is swapped for the real key.
+	w := chat("Authorization", "Bearer "+key, "gpt-4o-mini")
+	if w.Code != http.StatusOK {
+		t.Fatalf("virtual key = %d %s", w.Code, w.Body.String())
+	}
+	if len(gotAuth) != 1 || gotAuth[0] != "Bearer sk-real|" {
+		t.Errorf("upstream credentials = %v, want the server key only", gotAuth)
+	}
+	loaded, _ := recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id")))
+	if loaded.Identity == nil || loaded.Identity.KeyID != vk.ID || loaded.Identity.Tenant != "acme" {
+		t.Errorf("AIR identity = %+v", loaded.Identity)
+	}
+
+	if w := chat("X-Api-Key", key, "claude-3-5-sonnet"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "model_not_allowed") {
+		t.Errorf("disallowed model = %d %s", w.Code, w.Body.String())
+	}
+	if w := chat("Authorization", "Bearer vk-unknown", "gpt-4o-mini"); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown virtual key = %d", w.Code)
+	}
+	req := httptest.NewRequest("GET", "/v1/admin/virtual-keys", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("virtual key on the admin API = %d, want 403", w.Code)
+	}
+
+	// $0.15 spent of $0.20: a request whose estimate would pass the cap is
+	// refused up front.
+	req = httptest.NewRequest("POST", "/v1/chat/completions",
+		strings.NewReader(`{"model":"gpt-4o-mini","max_tokens":200000,"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Authorization", "Bearer "+key)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "spend cap") || len(gotAuth) != 1 {
+		t.Errorf("estimate over cap = %d %s, upstream calls %d", w.Code, w.Body.String(), len(gotAuth))
+	}
+	if loaded, _ := recorder.Load(waitForAIRRecord(t, dir, w.Header().Get("x-run-id"))); loaded.Status != "blocked" || len(loaded.Violations) != 1 || loaded.Violations[0].Rule != "spend_cap" {
+		t.Errorf("estimate over cap record = %+v", loaded)
+	}
+
+	// One more call, then the cap refuses the key.
+	if w := chat("Authorization", "Bearer "+key, "gpt-4o-mini"); w.Code != http.StatusOK {
+		t.Errorf("second call = %d", w.Code)
+	}
+	if w := chat("Authorization", "Bearer "+key, "gpt-4o-mini"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "spend cap") {
+		t.Errorf("over cap = %d %s", w.Code, w.Body.String())
+	}
+	if len(gotAuth) != 2 {
+		t.Errorf("upstream calls = %d, want 2", len(gotAuth))
+	}
+
+	// Revocation takes effect on the next request.
+	key2, vk2 := issue(`{"name":"other"}`)
+	if w := chat("Authorization", "Bearer "+key2, "gpt-4o-mini"); w.Code != http.StatusOK {
+		t.Errorf("second key = %d", w.Code)
+	}
+	if w := admin("POST", "/v1/admin/virtual-keys/"+vk2.ID+"/revoke", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "revoked_at") {
+		t.Errorf("revoke = %d %s", w.Code, w.Body.String())
+	}
+	if w := chat("Authorization", "Bearer "+key2, "gpt-4o-mini"); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "revoked") {
+		t.Errorf("revoked key = %d %s", w.Code, w.Body.String())
+	}
+
+	w = admin("GET", "/v1/admin/virtual-keys", "")
+	var list struct {
+		VirtualKeys []auth.VirtualKey `json:"virtual_keys"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.VirtualKeys) != 2 || list.VirtualKeys[0].SpentUSD < 0.29 || list.VirtualKeys[1].RevokedAt == nil {
+		t.Errorf("list = %s", w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), key) {
+		t.Error("list exposes a key")
+	}
+	if w := admin("GET", "/v1/admin/virtual-keys/vk_missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("missing key = %d", w.Code)
+	}
+	if w := admin("POST", "/v1/admin/virtual-keys", `{"max_spend_usd":-1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("negative cap = %d", w.Code)
+	}
+
+	var audited []string
+	for _, e := range chain.Entries() {
+		if strings.HasPrefix(e.RunID, "admin-") {
+			audited = append(audited, e.RunID)
+		}
+	}
+	want := []string{"admin-virtual-key-issue:" + vk.ID, "admin-virtual-key-issue:" + vk2.ID, "admin-virtual-key-revoke:" + vk2.ID}
+	if strings.Join(audited, ",") != strings.Join(want, ",") {
+		t.Errorf("audit chain = %v, want %v", audited, want)
+	}
+}
+
+func TestVirtualKeyNeedsServerCredential(t *testing.T) {
+	called := false
+	upstreamSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer upstreamSrv.Close()
+
+	vks, _ := auth.OpenVirtualKeys("")
+	key, _, _ := vks.Issue(auth.VirtualKey{Name: "agent"}, time.Now())
+	h := Handler(Config{
+		ProviderURL: upstreamSrv.URL,
+		VirtualKeys: vks,
+	})
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o-mini","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "server-side credential") {
+		t.Errorf("status = %d %s, want 502", w.Code, w.Body.String())
+	}
+	if called {
+		t.Error("a passthrough upstream was sent the request")
+	}
+
+	if got := string(redactSecrets([]byte(`{"content":"my key is sk-real"}`), []string{"sk-real"})); got != `{"content":"my key is [REDACTED_CREDENTIAL]"}` {
+		t.Errorf("redactSecrets = %s", got)
+	}
+}
@@ -10,30 +10,153 @@ import (
 	"time"
 )
 
+// Version is the AIR format version records are written with. 1.1.0 added
+// the session, requested model, model changes, PII counts, filtered tools,
+// violations, approvals and upstream request ID, so a record explains why a
+// request was altered or blocked.
+const Version = "1.1.0"
+
 // Record is the AIR file format — one per LLM call.
 type Record struct {
-	Version          string    `json:"version"`
-	RunID            string    `json:"run_id"`
-	TraceID          string    `json:"trace_id"`
-	Timestamp        time.Time `json:"timestamp"`
-	Model            string    `json:"model"`
-	Provider         string    `json:"provider"`
-	Endpoint         string    `json:"endpoint"`
-	RequestVaultRef  string    `json:"request_vault_ref"`
-	ResponseVaultRef string    `json:"response_vault_ref"`
-	RequestChecksum  string    `json:"request_checksum"`
-	ResponseChecksum string    `json:"response_checksum"`
-	Tokens           Tokens    `json:"tokens"`
-	DurationMS       int64     `json:"duration_ms"`
-	Status           string    `json:"status"`
-	Error            string    `json:"error,omitempty"`
+	Version          string      `json:"version"`
+	RunID            string      `json:"run_id"`
+	TraceID          string      `json:"trace_id"`
+	Timestamp        time.Time   `json:"timestamp"`
+	Model            string      `json:"model"`
+	Provider         string      `json:"provider"`
+	Endpoint         string      `json:"endpoint"`
+	RequestVaultRef  string      `json:"request_vault_ref"`
+	ResponseVaultRef string      `json:"response_vault_ref"`
+	RequestChecksum  string      `json:"request_checksum"`
+	ResponseChecksum string      `json:"response_checksum"`
+	Tokens           Tokens      `json:"tokens"`
+	DurationMS       int64       `json:"duration_ms"`
+	Status           string      `json:"status"`
+	Error            string      `json:"error,omitempty"`
+	Attempts         []Attempt   `json:"attempts,omitempty"`
+	PIIRedactions    []Redaction `json:"pii_redactions,omitempty"`
+	PromptInjection  []Injection `json:"prompt_injection,omitempty"`
+	Guardrail        *Guardrail  `json:"guardrail,omitempty"`
+	Shadow           []Shadow    `json:"shadow,omitempty"`
+	Identity         *Identity   `json:"identity,omitempty"`
+	ClientCert       *ClientCert `json:"client_cert,omitempty"`
+
+	SessionID         string         `json:"session_id,omitempty"`
+	RequestedModel    string         `json:"requested_model,omitempty"` // set when Model differs
+	ModelChanges      []ModelChange  `json:"model_changes,omitempty"`
+	PIICounts         map[string]int `json:"pii_counts,omitempty"` // request PII matches by type
+	FilteredTools     []FilteredTool `json:"filtered_tools,omitempty"`
+	Violations        []Violation    `json:"violations,omitempty"`
+	Approvals         []Approval     `json:"approvals,omitempty"`
+	UpstreamRequestID string         `json:"upstream_request_id,omitempty"` // the provider's x-request-id
+}
+
+// ModelChange is one step between the model the caller asked for and the
+// one that served the request, in the order the gateway made them.
+type ModelChange struct {
+	Stage  string `json:"stage"` // downgrade, route or fallback
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Rule   string `json:"rule,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// FilteredTool is a tool removed from the request before it was sent.
+type FilteredTool struct {
+	Name string `json:"name"`
+	Rule string `json:"rule"` // tool_filter, or the detection rule whose strip_tools action removed it
+}
+
+// Violation is a policy that found something in the request or response,
+// and what came of it.
+type Violation struct {
+	Stage   string `json:"stage"` // prevention, detection, output or tool_call
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+	Outcome string `json:"outcome"` // blocked, modified, flagged or approved
+}
+
+// Approval is a decision of the approval webhook on a violation.
+type Approval struct {
+	Rule     string `json:"rule"`
+	Approved bool   `json:"approved"`
+	Reason   string `json:"reason,omitempty"` // the approver's reason, or why the fallback applied
+	Source   string `json:"source"`           // webhook, fallback, not_required or disabled
+}
+
+// Identity is the gateway key or token a request was made with. The key or
+// token itself is never recorded.
+type Identity struct {
+	KeyID   string `json:"key_id"`
+	Subject string `json:"subject,omitempty"`
+	Tenant  string `json:"tenant,omitempty"`
+	Team    string `json:"team,omitempty"`
+	Profile string `json:"guardrail_profile,omitempty"`
+}
+
+// ClientCert is the verified TLS client certificate a request came with.
+type ClientCert struct {
+	Subject string `json:"subject"` // first of the URI, DNS and email SANs and the common name
+	SHA256  string `json:"sha256"`  // fingerprint of the DER certificate
+}
+
+// Shadow is what a policy in shadow mode would have done to the request or
+// response. Shadow decisions are never enforced.
+type Shadow struct {
+	Rule   string `json:"rule"`
+	Action string `json:"action"` // e.g. block, redact, strip, filter_tools, downgrade
+	Reason string `json:"reason"`
+}
+
+// Guardrail is a detection rule that triggered on the request and the
+// actions the gateway ran in response.
+type Guardrail struct {
+	Rule    string   `json:"rule"`
+	Message string   `json:"message"`
+	Actions []string `json:"actions"` // e.g. warn, throttle, strip_tools, block, save_replay
+}
+
+// Injection is one message the prompt-injection rule scored at or above a
+// threshold, and the action taken on it.
+type Injection struct {
+	Source  string   `json:"source"` // messages or input
+	Index   int      `json:"index"`
+	Role    string   `json:"role"`
+	Score   float64  `json:"score"`
+	Signals []string `json:"signals"`
+	Action  string   `json:"action"` // block, strip or annotate
+}
+
+// Redaction is one request field where prevention found PII. The record says
+// where and what kind, never the value itself.
+type Redaction struct {
+	Source string   `json:"source"` // messages, input, system, instructions
+	Index  int      `json:"index"`  // message or input item index
+	Field  string   `json:"field,omitempty"`
+	Types  []string `json:"types"`
+	Action string   `json:"action,omitempty"` // blocked, redacted or flagged
+}
+
+// Attempt is one upstream call made while serving a request. Retries and
+// fallbacks each add an attempt, so auditors can see what actually served it.
+type Attempt struct {
+	Number       int    `json:"number"`
+	Model        string `json:"model"`
+	Provider     string `json:"provider"`
+	StatusCode   int    `json:"status_code,omitempty"`
+	Outcome      string `json:"outcome"` // success, retry, fallback, circuit_open, no_credential, model_not_allowed, unsupported_endpoint, error
+	FailureClass string `json:"failure_class,omitempty"`
+	Error        string `json:"error,omitempty"`
+	DurationMS   int64  `json:"duration_ms"`
 }
 
 // Tokens holds token usage from the provider response.
+// Cached is the subset of Prompt served from the provider's prompt cache.
 type Tokens struct {
 	Prompt     int `json:"prompt"`
 	Completion int `json:"completion"`
 	Total      int `json:"total"`
+	Cached     int `json:"cached,omitempty"`
 }
 
 // Writer writes AIR records to a directory.
@@ -51,7 +174,7 @@ func NewWriter(dir string) (*Writer, error) {
 
 // Write persists an AIR record as <run_id>.air.json.
 func (w *Writer) Write(r Record) error {
-	r.Version = "1.0.0"
+	r.Version = Version
 
 	data, err := json.MarshalIndent(r, "", "  ")
 	if err != nil {
@@ -65,6 +188,11 @@ func (w *Writer) Write(r Record) error {
 	return nil
 }
 
+// Load reads the AIR record for a run written by this writer.
+func (w *Writer) Load(runID string) (Record, error) {
+	return Load(filepath.Join(w.dir, runID+".air.json"))
+}
+
 // Load reads an AIR record from a file path.
 func Load(path string) (Record, error) {
 	data, err := os.ReadFile(path)
@@ -44,8 +44,8 @@ func TestWriteAndLoad(t *testing.T) {
 		t.Fatalf("Load: %v", err)
 	}
 
-	if loaded.Version != "1.0.0" {
-		t.Errorf("version = %q, want 1.0.0", loaded.Version)
+	if loaded.Version != "1.1.0" {
+		t.Errorf("version = %q, want 1.1.0", loaded.Version)
 	}
 	if loaded.RunID != "test-run-001" {
 		t.Errorf("run_id = %q, want test-run-001", loaded.RunID)
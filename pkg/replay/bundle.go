@@ -0,0 +1,80 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/airblackbox/gateway/pkg/recorder"
+)
+
+// Bundle is a snapshot of a whole session, saved when a guardrail triggers so
+// the run can be investigated and replayed later. Each record's vault refs
+// point at the full request and response of that call.
+type Bundle struct {
+	SessionID string            `json:"session_id"`
+	CreatedAt time.Time         `json:"created_at"`
+	Rule      string            `json:"rule"`
+	Message   string            `json:"message"`
+	Actions   []string          `json:"actions"`
+	Records   []recorder.Record `json:"records"`
+	Missing   []string          `json:"missing,omitempty"` // run IDs whose AIR record could not be read
+
+	// Request is the body of the request that triggered the guardrail.
+	Request json.RawMessage `json:"request,omitempty"`
+}
+
+// SaveBundle writes b to dir as <session>-<timestamp>.bundle.json and returns
+// the file path.
+func SaveBundle(dir string, b Bundle) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("replay: create bundle dir: %w", err)
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("replay: marshal bundle: %w", err)
+	}
+	name := fmt.Sprintf("%s-%s.bundle.json", safeName(b.SessionID), b.CreatedAt.UTC().Format("20060102T150405.000Z"))
+	path := filepath.Join(dir, name)
+	// Write then rename so readers never see a partial bundle.
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return "", fmt.Errorf("replay: write %s: %w", path, err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return "", fmt.Errorf("replay: write %s: %w", path, err)
+	}
+	return path, nil
+}
+
+// LoadBundle reads a bundle written by SaveBundle.
+func LoadBundle(path string) (Bundle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Bundle{}, fmt.Errorf("replay: read %s: %w", path, err)
+	}
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return Bundle{}, fmt.Errorf("replay: parse %s: %w", path, err)
+	}
+	return b, nil
+}
+
+// safeName keeps a session ID usable as a file name; IDs come from a client
+// header and may contain anything.
+func safeName(id string) string {
+	out := []byte(id)
+	for i, c := range out {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			out[i] = '_'
+		}
+	}
+	if len(out) == 0 {
+		return "session"
+	}
+	if len(out) > 64 {
+		out = out[:64]
+	}
+	return string(out)
+}
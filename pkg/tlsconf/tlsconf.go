@@ -0,0 +1,197 @@
+// Package tlsconf builds the gateway's TLS configurations: the listener's
+// certificate, reloaded when its files change, optional client certificate
+// verification (mTLS), and client TLS for private upstreams.
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Client certificate policies for ServerOptions.ClientAuth.
+const (
+	ClientAuthRequire  = "require"  // every connection must present a trusted certificate
+	ClientAuthOptional = "optional" // a certificate is verified if presented
+)
+
+// reloadCheckInterval is how often a CertReloader looks at its files.
+const reloadCheckInterval = 10 * time.Second
+
+// CertReloader serves a certificate and key pair from files, reloading them
+// when either file changes, so a renewed certificate is picked up without a
+// restart. If the new files cannot be loaded the current pair stays in use.
+type CertReloader struct {
+	certFile, keyFile string
+	interval          time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+// NewCertReloader loads a certificate and key pair.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tlsconf: both a certificate and a key file are required")
+	}
+	c := &CertReloader{certFile: certFile, keyFile: keyFile, interval: reloadCheckInterval}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CertReloader) load() error {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return fmt.Errorf("tlsconf: %w", err)
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return fmt.Errorf("tlsconf: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("tlsconf: %s: %w", c.certFile, err)
+	}
+	c.cert, c.certMod, c.keyMod = &cert, certInfo.ModTime(), keyInfo.ModTime()
+	return nil
+}
+
+// Certificate returns the current pair, first reloading it if the files
+// changed since they were last checked.
+func (c *CertReloader) Certificate() *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < c.interval {
+		return c.cert
+	}
+	c.checked = time.Now()
+	certInfo, err1 := os.Stat(c.certFile)
+	keyInfo, err2 := os.Stat(c.keyFile)
+	if err1 != nil || err2 != nil || certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod) {
+		return c.cert
+	}
+	if err := c.load(); err != nil {
+		log.Printf("[tls] certificate reload failed, keeping current certificate: %v", err)
+	} else {
+		log.Printf("[tls] certificate reloaded from %s", c.certFile)
+	}
+	return c.cert
+}
+
+// GetCertificate serves the pair to TLS clients; see tls.Config.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
+
+// GetClientCertificate presents the pair to TLS servers; see tls.Config.
+func (c *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("tlsconf: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("tlsconf: %s: no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// ServerOptions configures the listener's TLS.
+type ServerOptions struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string // CA bundle client certificates are verified against; "" = no mTLS
+	ClientAuth   string // ClientAuthRequire (default) or ClientAuthOptional
+}
+
+// ServerConfig builds the listener's TLS config. Returns nil if no
+// certificate is configured.
+func ServerConfig(o ServerOptions) (*tls.Config, error) {
+	if o.CertFile == "" && o.KeyFile == "" {
+		if o.ClientCAFile != "" {
+			return nil, errors.New("tlsconf: a client CA needs a server certificate and key")
+		}
+		return nil, nil
+	}
+	certs, err := NewCertReloader(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	if o.ClientCAFile == "" {
+		return cfg, nil
+	}
+	cfg.ClientCAs, err = LoadCertPool(o.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	switch o.ClientAuth {
+	case "", ClientAuthRequire:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case ClientAuthOptional:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("tlsconf: unknown client auth %q (want require or optional)", o.ClientAuth)
+	}
+	return cfg, nil
+}
+
+// ClientOptions configures TLS to an upstream, e.g. a private model endpoint
+// behind an internal CA that wants a client certificate.
+type ClientOptions struct {
+	CAFile     string `yaml:"ca_file"`     // CA bundle trusted instead of the system roots
+	CertFile   string `yaml:"cert_file"`   // client certificate, reloaded on change
+	KeyFile    string `yaml:"key_file"`    // its key
+	ServerName string `yaml:"server_name"` // overrides the name verified in the server certificate
+}
+
+// ClientConfig builds the TLS config for an upstream. Returns nil if o is
+// empty, i.e. the default TLS settings apply.
+func ClientConfig(o ClientOptions) (*tls.Config, error) {
+	if o == (ClientOptions{}) {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: o.ServerName}
+	if o.CAFile != "" {
+		pool, err := LoadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		certs, err := NewCertReloader(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = certs.GetClientCertificate
+	}
+	return cfg, nil
+}
+
+// Transport returns an HTTP transport like http.DefaultTransport that uses
+// cfg for TLS.
+func Transport(cfg *tls.Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	return t
+}
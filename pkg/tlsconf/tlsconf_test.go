@@ -0,0 +1,192 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	writePEM(t, ca.path("ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) path(name string) string { return filepath.Join(ca.dir, name) }
+
+// issue writes a leaf certificate and key as <name>.pem and <name>-key.pem.
+func (ca *testCA) issue(t *testing.T, name string, serial int64, usage x509.ExtKeyUsage) (certFile, keyFile string) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile = ca.path(name+".pem"), ca.path(name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "gateway", 2, x509.ExtKeyUsageServerAuth)
+	c, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.interval = 0
+	first := c.Certificate()
+
+	// A renewed certificate is picked up once the files change.
+	renewedCert, renewedKey := ca.issue(t, "renewed", 3, x509.ExtKeyUsageServerAuth)
+	os.Rename(renewedCert, certFile)
+	os.Rename(renewedKey, keyFile)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	renewed := c.Certificate()
+	if renewed == first {
+		t.Fatal("certificate not reloaded")
+	}
+	if leaf, _ := x509.ParseCertificate(renewed.Certificate[0]); leaf.Subject.CommonName != "renewed" {
+		t.Errorf("reloaded %q", leaf.Subject.CommonName)
+	}
+
+	// A broken file keeps the current pair.
+	os.WriteFile(certFile, []byte("not a certificate"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if got := c.Certificate(); got != renewed {
+		t.Error("failed reload replaced the certificate")
+	}
+
+	if _, err := NewCertReloader(certFile, ""); err == nil {
+		t.Error("expected an error without a key file")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "gateway", 2, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, "agent", 3, x509.ExtKeyUsageClientAuth)
+
+	serverTLS, err := ServerConfig(ServerOptions{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca.path("ca.pem")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverTLS.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("ClientAuth = %v, want require", serverTLS.ClientAuth)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.TLS = serverTLS
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(o ClientOptions) (string, error) {
+		o.ServerName = "localhost" // with SNI the server skips httptest's own certificate
+		cfg, err := ClientConfig(o)
+		if err != nil {
+			return "", err
+		}
+		resp, err := (&http.Client{Transport: Transport(cfg)}).Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), nil
+	}
+
+	if got, err := get(ClientOptions{CAFile: ca.path("ca.pem"), CertFile: clientCert, KeyFile: clientKey}); err != nil || got != "agent" {
+		t.Errorf("with client certificate: %q, %v", got, err)
+	}
+	if _, err := get(ClientOptions{CAFile: ca.path("ca.pem")}); err == nil {
+		t.Error("server accepted a client without a certificate")
+	}
+	if _, err := get(ClientOptions{CertFile: clientCert, KeyFile: clientKey}); err == nil {
+		t.Error("client trusted the server without the CA bundle")
+	}
+}
+
+func TestConfigOptions(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "gateway", 2, x509.ExtKeyUsageServerAuth)
+
+	if cfg, err := ServerConfig(ServerOptions{}); cfg != nil || err != nil {
+		t.Errorf("ServerConfig({}) = %v, %v", cfg, err)
+	}
+	if cfg, err := ClientConfig(ClientOptions{}); cfg != nil || err != nil {
+		t.Errorf("ClientConfig({}) = %v, %v", cfg, err)
+	}
+	cfg, err := ServerConfig(ServerOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: ca.path("ca.pem"), ClientAuth: ClientAuthOptional})
+	if err != nil || cfg.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("optional client auth: %v, %v", cfg, err)
+	}
+
+	bad := map[string]ServerOptions{
+		"client CA without certificate": {ClientCAFile: ca.path("ca.pem")},
+		"unknown client auth":           {CertFile: certFile, KeyFile: keyFile, ClientCAFile: ca.path("ca.pem"), ClientAuth: "sometimes"},
+		"CA file without certificates":  {CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile},
+		"missing key":                   {CertFile: certFile, KeyFile: ca.path("missing.pem")},
+	}
+	for name, o := range bad {
+		if _, err := ServerConfig(o); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package upstream
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RetryConfig controls retries against a single upstream.
+type RetryConfig struct {
+	MaxAttempts          int      `yaml:"max_attempts"`            // per upstream, including the first try
+	BaseDelayMS          int      `yaml:"base_delay_ms"`           // first backoff step
+	MaxDelayMS           int      `yaml:"max_delay_ms"`            // backoff cap
+	MaxRetryAfterSeconds int      `yaml:"max_retry_after_seconds"` // longer Retry-After → move to the next fallback
+	RetryOn              []string `yaml:"retry_on"`                // failure classes (guardrails.Failure*)
+}
+
+// CircuitBreakerConfig controls the per-upstream circuit breaker.
+// A zero FailureThreshold disables the breaker.
+type CircuitBreakerConfig struct {
+	FailureThreshold int `yaml:"failure_threshold"` // consecutive failures before opening
+	CooldownSeconds  int `yaml:"cooldown_seconds"`  // open → half-open delay
+}
+
+// applyResilienceDefaults fills in unset retry and breaker values.
+func applyResilienceDefaults(c *Config) {
+	if c.Retry.MaxAttempts <= 0 {
+		c.Retry.MaxAttempts = 1
+	}
+	if c.Retry.BaseDelayMS <= 0 {
+		c.Retry.BaseDelayMS = 250
+	}
+	if c.Retry.MaxDelayMS <= 0 {
+		c.Retry.MaxDelayMS = 4000
+	}
+	if c.Retry.MaxRetryAfterSeconds <= 0 {
+		c.Retry.MaxRetryAfterSeconds = 20
+	}
+	if len(c.Retry.RetryOn) == 0 {
+		c.Retry.RetryOn = []string{"rate_limit", "server_error", "timeout"}
+	}
+	if c.CircuitBreaker.CooldownSeconds <= 0 {
+		c.CircuitBreaker.CooldownSeconds = 30
+	}
+}
+
+// Retryable reports whether a failure class should be retried.
+func (r RetryConfig) Retryable(failureClass string) bool {
+	for _, c := range r.RetryOn {
+		if c == failureClass {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff returns the delay before retry number attempt (1-based), using
+// exponential backoff with full jitter. A Retry-After header on resp, if any,
+// sets a floor. ok is false when the server asks for a longer wait than
+// MaxRetryAfterSeconds, meaning the caller should fall back instead of waiting.
+func (r RetryConfig) Backoff(attempt int, resp *http.Response) (delay time.Duration, ok bool) {
+	ceiling := time.Duration(r.BaseDelayMS) * time.Millisecond << uint(attempt-1)
+	if max := time.Duration(r.MaxDelayMS) * time.Millisecond; ceiling > max || ceiling <= 0 {
+		ceiling = max
+	}
+	delay = time.Duration(rand.Int63n(int64(ceiling) + 1))
+
+	if after, found := retryAfter(resp); found {
+		if after > time.Duration(r.MaxRetryAfterSeconds)*time.Second {
+			return 0, false
+		}
+		if after > delay {
+			delay = after
+		}
+	}
+	return delay, true
+}
+
+// retryAfter parses a Retry-After header in either delta-seconds or HTTP-date form.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// Chain returns the ordered list of models to try for a request: the model
+// itself followed by its configured fallbacks.
+func (c *Config) Chain(model string) []string {
+	chain := []string{model}
+	if c == nil {
+		return chain
+	}
+	for _, m := range c.Fallbacks[model] {
+		if m != model {
+			chain = append(chain, m)
+		}
+	}
+	return chain
+}
+
+// Circuit breaker states.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// Breaker is a consecutive-failure circuit breaker for one upstream.
+// After FailureThreshold consecutive failures it opens and rejects calls.
+// Once the cool-down elapses it half-opens and lets a single trial call through:
+// success closes it, failure re-opens it for another cool-down.
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     string
+	openedAt  time.Time
+	trialOut  bool // a half-open trial call is in flight
+}
+
+// NewBreaker creates a closed breaker.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown, state: BreakerClosed}
+}
+
+// Allow reports whether a call may proceed.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.trialOut = true
+		return true
+	case BreakerHalfOpen:
+		if b.trialOut {
+			return false
+		}
+		b.trialOut = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Success records a healthy response and closes the breaker.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.state = BreakerClosed
+	b.trialOut = false
+}
+
+// Failure records a failed call, opening the breaker at the threshold or
+// immediately if the half-open trial failed.
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+		b.trialOut = false
+	}
+}
+
+// Release ends a call that says nothing about the upstream's health, e.g.
+// one the caller cancelled, letting another half-open trial through.
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trialOut = false
+}
+
+// State returns the breaker's current state.
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// Breaker returns the circuit breaker for an upstream, creating it on first
+// use. Returns nil when the breaker is disabled.
+func (c *Config) Breaker(name string) *Breaker {
+	if c == nil || c.CircuitBreaker.FailureThreshold <= 0 {
+		return nil
+	}
+	c.breakerMu.Lock()
+	defer c.breakerMu.Unlock()
+	if c.breakers == nil {
+		c.breakers = make(map[string]*Breaker)
+	}
+	b, ok := c.breakers[name]
+	if !ok {
+		b = NewBreaker(c.CircuitBreaker.FailureThreshold,
+			time.Duration(c.CircuitBreaker.CooldownSeconds)*time.Second)
+		c.breakers[name] = b
+	}
+	return b
+}
@@ -0,0 +1,107 @@
+package upstream
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAndHalfOpens(t *testing.T) {
+	b := NewBreaker(2, 50*time.Millisecond)
+
+	b.Failure()
+	if !b.Allow() {
+		t.Fatal("breaker should stay closed below the threshold")
+	}
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("breaker should be open after 2 consecutive failures")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if got := b.State(); got != BreakerHalfOpen {
+		t.Fatalf("state after cool-down = %s, want half_open", got)
+	}
+	if !b.Allow() {
+		t.Fatal("half-open breaker should allow one trial call")
+	}
+	if b.Allow() {
+		t.Fatal("half-open breaker should allow only one trial call at a time")
+	}
+
+	// A failed trial re-opens immediately.
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("failed trial should re-open the breaker")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	b.Allow()
+	b.Success()
+	if got := b.State(); got != BreakerClosed {
+		t.Fatalf("state after successful trial = %s, want closed", got)
+	}
+}
+
+func TestBreakerSuccessResetsFailures(t *testing.T) {
+	b := NewBreaker(2, time.Minute)
+	b.Failure()
+	b.Success()
+	b.Failure()
+	if !b.Allow() {
+		t.Fatal("success should reset the consecutive failure count")
+	}
+}
+
+func TestBreakerReleaseFreesTrial(t *testing.T) {
+	b := NewBreaker(1, 0)
+	b.Failure()
+	if !b.Allow() {
+		t.Fatal("breaker without cool-down should allow a trial call")
+	}
+	b.Release()
+	if !b.Allow() || b.State() != BreakerHalfOpen {
+		t.Fatal("released trial should let another trial through and stay half-open")
+	}
+}
+
+func TestBackoffHonoursRetryAfter(t *testing.T) {
+	r := RetryConfig{BaseDelayMS: 10, MaxDelayMS: 100, MaxRetryAfterSeconds: 5}
+
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{"2"}}}
+	delay, ok := r.Backoff(1, resp)
+	if !ok || delay != 2*time.Second {
+		t.Fatalf("delay = %v ok=%v, want 2s", delay, ok)
+	}
+
+	resp.Header.Set("Retry-After", "60")
+	if _, ok := r.Backoff(1, resp); ok {
+		t.Fatal("Retry-After beyond the cap should signal a fallback")
+	}
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		delay, ok := r.Backoff(attempt, nil)
+		if !ok || delay < 0 || delay > 100*time.Millisecond {
+			t.Fatalf("attempt %d: delay = %v, want within [0, 100ms]", attempt, delay)
+		}
+	}
+}
+
+func TestChainAndBreakerRegistry(t *testing.T) {
+	cfg := &Config{
+		Fallbacks:      map[string][]string{"gpt-4o": {"gpt-4o-mini", "gpt-4o", "claude-3-5-sonnet-latest"}},
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 3, CooldownSeconds: 10},
+	}
+	chain := cfg.Chain("gpt-4o")
+	if len(chain) != 3 || chain[0] != "gpt-4o" || chain[1] != "gpt-4o-mini" || chain[2] != "claude-3-5-sonnet-latest" {
+		t.Fatalf("chain = %v", chain)
+	}
+	if cfg.Breaker("openai") != cfg.Breaker("openai") {
+		t.Fatal("breaker should be shared per upstream")
+	}
+
+	var nilCfg *Config
+	if nilCfg.Breaker("openai") != nil || len(nilCfg.Chain("gpt-4o")) != 1 {
+		t.Fatal("nil config should have no breakers and no fallbacks")
+	}
+}
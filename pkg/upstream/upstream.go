@@ -0,0 +1,239 @@
+// Package upstream maps models to LLM provider endpoints and credentials so a
+// single gateway can front several providers at once.
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/airblackbox/gateway/pkg/tlsconf"
+	"gopkg.in/yaml.v3"
+)
+
+// Auth schemes for attaching a server-side API key to upstream requests.
+const (
+	AuthPassthrough = "passthrough" // forward the client's own credentials (default)
+	AuthBearer      = "bearer"      // Authorization: Bearer <key>
+	AuthXAPIKey     = "x-api-key"   // x-api-key: <key> (Anthropic)
+	AuthHeader      = "header"      // <Header>: <key>
+	AuthNone        = "none"        // strip all client credentials
+)
+
+// Config holds the providers section of the gateway config.
+// If nil, the gateway forwards everything to a single PROVIDER_URL.
+type Config struct {
+	Providers      []Provider           `yaml:"providers"`
+	Retry          RetryConfig          `yaml:"retry"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Fallbacks      map[string][]string  `yaml:"fallbacks"` // model → ordered fallback models
+
+	breakerMu sync.Mutex
+	breakers  map[string]*Breaker // keyed by provider name
+}
+
+// Provider is one upstream LLM endpoint.
+type Provider struct {
+	Name    string                `yaml:"name"`     // e.g. "openai", "anthropic", "vllm"
+	BaseURL string                `yaml:"base_url"` // e.g. https://api.anthropic.com
+	Models  []string              `yaml:"models"`   // glob patterns, e.g. "claude-*"
+	Default bool                  `yaml:"default"`  // used when no other provider matches
+	Auth    AuthConfig            `yaml:"auth"`
+	Headers map[string]string     `yaml:"headers"` // static headers, e.g. anthropic-version
+	APIs    []string              `yaml:"apis"`    // request paths it serves; see Serves
+	TLS     tlsconf.ClientOptions `yaml:"tls"`     // CA bundle and client certificate for private endpoints
+
+	transport http.RoundTripper // built from TLS; nil uses the default
+}
+
+// AuthConfig controls which credentials the gateway sends upstream.
+type AuthConfig struct {
+	Scheme    string `yaml:"scheme"`      // one of the Auth* constants
+	Header    string `yaml:"header"`      // header name for scheme "header"
+	APIKey    string `yaml:"api_key"`     // inline key (prefer api_key_env)
+	APIKeyEnv string `yaml:"api_key_env"` // environment variable holding the key
+}
+
+// LoadConfig reads a providers YAML file. Returns nil if path is empty
+// (single-provider mode). Returns an error if the file exists but is invalid.
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.resolve(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// resolve validates providers, reads API keys from the environment and
+// applies retry and circuit breaker defaults.
+func (c *Config) resolve() error {
+	applyResilienceDefaults(c)
+
+	seen := make(map[string]bool, len(c.Providers))
+	for i := range c.Providers {
+		p := &c.Providers[i]
+		if p.Name == "" {
+			return fmt.Errorf("upstream: provider %d: name is required", i)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("upstream: provider %q defined twice", p.Name)
+		}
+		seen[p.Name] = true
+		if p.BaseURL == "" {
+			return fmt.Errorf("upstream: provider %q: base_url is required", p.Name)
+		}
+		p.BaseURL = strings.TrimRight(p.BaseURL, "/")
+
+		if p.Auth.APIKeyEnv != "" {
+			p.Auth.APIKey = os.Getenv(p.Auth.APIKeyEnv)
+			if p.Auth.APIKey == "" {
+				return fmt.Errorf("upstream: provider %q: %s is not set", p.Name, p.Auth.APIKeyEnv)
+			}
+		}
+		if p.Auth.Scheme == "" {
+			p.Auth.Scheme = AuthPassthrough
+			if p.Auth.APIKey != "" {
+				p.Auth.Scheme = AuthBearer
+			}
+		}
+		switch p.Auth.Scheme {
+		case AuthPassthrough, AuthNone:
+		case AuthBearer, AuthXAPIKey:
+			if p.Auth.APIKey == "" {
+				return fmt.Errorf("upstream: provider %q: auth scheme %q needs api_key or api_key_env", p.Name, p.Auth.Scheme)
+			}
+		case AuthHeader:
+			if p.Auth.Header == "" || p.Auth.APIKey == "" {
+				return fmt.Errorf("upstream: provider %q: auth scheme \"header\" needs header and api_key", p.Name)
+			}
+		default:
+			return fmt.Errorf("upstream: provider %q: unknown auth scheme %q", p.Name, p.Auth.Scheme)
+		}
+
+		tlsCfg, err := tlsconf.ClientConfig(p.TLS)
+		if err != nil {
+			return fmt.Errorf("upstream: provider %q: tls: %w", p.Name, err)
+		}
+		if tlsCfg != nil {
+			p.transport = tlsconf.Transport(tlsCfg)
+		}
+	}
+	return nil
+}
+
+// Resolve picks the provider for a model. Model patterns are checked first in
+// config order, then a provider whose name equals inferred (the provider family
+// guessed from the model name), then the default provider. Returns nil if
+// nothing matches, in which case the caller falls back to PROVIDER_URL.
+func (c *Config) Resolve(model, inferred string) *Provider {
+	if c == nil {
+		return nil
+	}
+	lower := strings.ToLower(model)
+	for i := range c.Providers {
+		for _, pattern := range c.Providers[i].Models {
+			if ok, _ := path.Match(strings.ToLower(pattern), lower); ok {
+				return &c.Providers[i]
+			}
+		}
+	}
+	for i := range c.Providers {
+		if c.Providers[i].Name == inferred {
+			return &c.Providers[i]
+		}
+	}
+	for i := range c.Providers {
+		if c.Providers[i].Default {
+			return &c.Providers[i]
+		}
+	}
+	return nil
+}
+
+// clientCredentialHeaders are the headers clients use to carry provider keys.
+var clientCredentialHeaders = []string{"Authorization", "X-Api-Key"}
+
+// Apply sets the provider's credentials and static headers on an upstream
+// request that already carries the client's forwarded headers. For every
+// scheme except passthrough, the client's credentials are removed first so a
+// client-supplied key can never reach a provider configured with its own.
+func (p *Provider) Apply(req *http.Request) {
+	for k, v := range p.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if p.Auth.Scheme == AuthPassthrough {
+		return
+	}
+	for _, h := range clientCredentialHeaders {
+		req.Header.Del(h)
+	}
+
+	switch p.Auth.Scheme {
+	case AuthBearer:
+		req.Header.Set("Authorization", "Bearer "+p.Auth.APIKey)
+	case AuthXAPIKey:
+		req.Header.Set("X-Api-Key", p.Auth.APIKey)
+	case AuthHeader:
+		req.Header.Set(p.Auth.Header, p.Auth.APIKey)
+	}
+}
+
+// Transport returns the transport for the provider's TLS settings, or nil
+// if it uses the default.
+func (p *Provider) Transport() http.RoundTripper {
+	return p.transport
+}
+
+// ForwardsClientCredentials reports whether the provider is sent the
+// client's own credentials rather than the gateway's.
+func (p *Provider) ForwardsClientCredentials() bool {
+	return p.Auth.Scheme == AuthPassthrough
+}
+
+// Serves reports whether the provider accepts requests on the API path.
+// Without apis, a provider named anthropic serves the Messages API and chat
+// completions, and any other provider every path but the Messages API.
+func (p *Provider) Serves(api string) bool {
+	if len(p.APIs) > 0 {
+		for _, a := range p.APIs {
+			if a == api {
+				return true
+			}
+		}
+		return false
+	}
+	if p.Name == "anthropic" {
+		return api == "/v1/messages" || api == "/v1/chat/completions"
+	}
+	return api != "/v1/messages"
+}
+
+// Secrets returns the server-side API keys of every provider.
+func (c *Config) Secrets() []string {
+	if c == nil {
+		return nil
+	}
+	var secrets []string
+	for _, p := range c.Providers {
+		if p.Auth.APIKey != "" {
+			secrets = append(secrets, p.Auth.APIKey)
+		}
+	}
+	return secrets
+}
@@ -0,0 +1,158 @@
+package upstream
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testConfig() *Config {
+	return &Config{Providers: []Provider{
+		{Name: "openai", BaseURL: "https://api.openai.com", Models: []string{"gpt-*"}, Default: true},
+		{Name: "anthropic", BaseURL: "https://api.anthropic.com", Models: []string{"claude-*"}},
+		{Name: "mistral", BaseURL: "https://api.mistral.ai"},
+		{Name: "vllm", BaseURL: "http://vllm:8000", Models: []string{"meta-llama/*"}},
+	}}
+}
+
+func TestResolveByPattern(t *testing.T) {
+	cfg := testConfig()
+	tests := []struct {
+		model, inferred, want string
+	}{
+		{"gpt-4o", "openai", "openai"},
+		{"claude-3-5-sonnet-20241022", "anthropic", "anthropic"},
+		{"CLAUDE-3-OPUS", "anthropic", "anthropic"},
+		{"meta-llama/Llama-3.1-8B-Instruct", "meta", "vllm"},
+		{"mistral-large-latest", "mistral", "mistral"}, // no pattern, matched by inferred name
+		{"some-custom-model", "unknown", "openai"},     // default provider
+	}
+	for _, tt := range tests {
+		p := cfg.Resolve(tt.model, tt.inferred)
+		if p == nil || p.Name != tt.want {
+			t.Errorf("Resolve(%q, %q) = %v, want %s", tt.model, tt.inferred, p, tt.want)
+		}
+	}
+}
+
+func TestResolveNilConfigAndNoDefault(t *testing.T) {
+	var nilCfg *Config
+	if p := nilCfg.Resolve("gpt-4o", "openai"); p != nil {
+		t.Fatalf("nil config should resolve to nil, got %v", p)
+	}
+
+	cfg := &Config{Providers: []Provider{{Name: "anthropic", BaseURL: "https://api.anthropic.com"}}}
+	if p := cfg.Resolve("gpt-4o", "openai"); p != nil {
+		t.Fatalf("expected no match without a default, got %v", p)
+	}
+}
+
+func TestApplyReplacesClientCredentials(t *testing.T) {
+	p := &Provider{
+		Name:    "anthropic",
+		Auth:    AuthConfig{Scheme: AuthXAPIKey, APIKey: "sk-ant-server"},
+		Headers: map[string]string{"anthropic-version": "2023-06-01"},
+	}
+	req, _ := http.NewRequest("POST", "https://api.anthropic.com/v1/messages", nil)
+	req.Header.Set("Authorization", "Bearer sk-client")
+	req.Header.Set("X-Api-Key", "sk-client")
+	p.Apply(req)
+
+	if got := req.Header.Get("X-Api-Key"); got != "sk-ant-server" {
+		t.Errorf("x-api-key = %q, want server key", got)
+	}
+	if got := req.Header.Get("Authorization"); got != "" {
+		t.Errorf("client Authorization should be stripped, got %q", got)
+	}
+	if got := req.Header.Get("Anthropic-Version"); got != "2023-06-01" {
+		t.Errorf("anthropic-version = %q", got)
+	}
+}
+
+func TestApplyPassthroughKeepsClientCredentials(t *testing.T) {
+	p := &Provider{Name: "openai", Auth: AuthConfig{Scheme: AuthPassthrough}}
+	req, _ := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", nil)
+	req.Header.Set("Authorization", "Bearer sk-client")
+	p.Apply(req)
+
+	if got := req.Header.Get("Authorization"); got != "Bearer sk-client" {
+		t.Errorf("Authorization = %q, want client key forwarded", got)
+	}
+}
+
+func TestProviderServes(t *testing.T) {
+	cases := []struct {
+		p    Provider
+		api  string
+		want bool
+	}{
+		{Provider{Name: "anthropic"}, "/v1/messages", true},
+		{Provider{Name: "anthropic"}, "/v1/chat/completions", true},
+		{Provider{Name: "anthropic"}, "/v1/responses", false},
+		{Provider{Name: "openai"}, "/v1/responses", true},
+		{Provider{Name: "openai"}, "/v1/messages", false},
+		{Provider{Name: "vllm", APIs: []string{"/v1/chat/completions"}}, "/v1/responses", false},
+		{Provider{Name: "proxy", APIs: []string{"/v1/messages"}}, "/v1/messages", true},
+	}
+	for _, c := range cases {
+		if got := c.p.Serves(c.api); got != c.want {
+			t.Errorf("%s.Serves(%s) = %v, want %v", c.p.Name, c.api, got, c.want)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("TEST_UPSTREAM_KEY", "sk-from-env")
+	path := filepath.Join(t.TempDir(), "providers.yaml")
+	os.WriteFile(path, []byte(`
+providers:
+  - name: openai
+    base_url: https://api.openai.com/
+    auth:
+      api_key_env: TEST_UPSTREAM_KEY
+  - name: local
+    base_url: http://localhost:8000
+`), 0644)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	openai := cfg.Providers[0]
+	if openai.BaseURL != "https://api.openai.com" {
+		t.Errorf("base_url = %q, trailing slash should be trimmed", openai.BaseURL)
+	}
+	if openai.Auth.Scheme != AuthBearer || openai.Auth.APIKey != "sk-from-env" {
+		t.Errorf("auth = %+v, want bearer with key from env", openai.Auth)
+	}
+	if cfg.Providers[1].Auth.Scheme != AuthPassthrough {
+		t.Errorf("keyless provider scheme = %q, want passthrough", cfg.Providers[1].Auth.Scheme)
+	}
+	if openai.Transport() != nil {
+		t.Error("provider without tls has a custom transport")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cases := map[string]string{
+		"missing base_url": "providers:\n  - name: openai\n",
+		"duplicate name":   "providers:\n  - {name: a, base_url: http://a}\n  - {name: a, base_url: http://b}\n",
+		"unknown scheme":   "providers:\n  - {name: a, base_url: http://a, auth: {scheme: magic}}\n",
+		"missing env key":  "providers:\n  - {name: a, base_url: http://a, auth: {api_key_env: AIR_TEST_UNSET_KEY}}\n",
+		"bearer no key":    "providers:\n  - {name: a, base_url: http://a, auth: {scheme: bearer}}\n",
+		"missing tls CA":   "providers:\n  - {name: a, base_url: https://a, tls: {ca_file: /nonexistent/ca.pem}}\n",
+		"tls cert no key":  "providers:\n  - {name: a, base_url: https://a, tls: {cert_file: /nonexistent/cert.pem}}\n",
+	}
+	for name, body := range cases {
+		path := filepath.Join(t.TempDir(), "providers.yaml")
+		os.WriteFile(path, []byte(body), 0644)
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	if cfg, err := LoadConfig(""); cfg != nil || err != nil {
+		t.Errorf("empty path should disable providers, got %v %v", cfg, err)
+	}
+}